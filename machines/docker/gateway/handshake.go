@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// The docker machines written in go share this file, their src folders link
+// to it.
+
+// handshake reads the challenge the node sends first on a gateway connection
+// and returns the packet answering it, which proves with the secret of the run
+// that the connection comes from the container the node started.
+func handshake(r *bufio.Reader) ([]byte, error) {
+	var ln uint32
+	if err := binary.Read(r, binary.LittleEndian, &ln); err != nil {
+		return nil, err
+	}
+	var callbackId uint64
+	if err := binary.Read(r, binary.LittleEndian, &callbackId); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, ln)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	challenge := struct {
+		Input struct {
+			Nonce string `json:"nonce"`
+		} `json:"input"`
+	}{}
+	if err := json.Unmarshal(buf, &challenge); err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(challenge.Input.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(os.Getenv("KASPER_RUN_SECRET")))
+	mac.Write(nonce)
+	return json.Marshal(map[string]any{"key": "handshake", "input": map[string]any{
+		"runId": os.Getenv("KASPER_RUN_ID"),
+		"proof": hex.EncodeToString(mac.Sum(nil)),
+	}})
+}
@@ -275,9 +275,14 @@ func main() {
 		log.Fatalf("dial error: %v", err)
 	}
 	defer conn.Close()
+	r := bufio.NewReader(conn)
+	packet, err := handshake(r)
+	if err != nil {
+		log.Fatalf("handshake error: %v", err)
+	}
+	writePacket(packet, nil)
 	log.Println("Container client connected")
 
-	r := bufio.NewReader(conn)
 	for {
 		var ln uint32
 		if err := binary.Read(r, binary.LittleEndian, &ln); err != nil {
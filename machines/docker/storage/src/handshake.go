@@ -0,0 +1 @@
+../../gateway/handshake.go
\ No newline at end of file
@@ -91,6 +91,28 @@ fn main() {
                 }
                 trx.commit().unwrap();
                 log("applied transactions effects successfully.".to_string());
+            } else if packet["type"] == "exportMachineState" {
+                let machine_id = packet["machineId"].as_str().unwrap().to_string();
+                thread::spawn(move || {
+                    let prefix = format!("{}::", machine_id);
+                    let mut state = serde_json::Map::new();
+                    {
+                        let global_db = GLOBAL_DB.lock().unwrap();
+                        for t in global_db.prefix_iterator(prefix.as_bytes()) {
+                            let item = t.unwrap();
+                            if !item.0.starts_with(prefix.as_bytes()) {
+                                break;
+                            }
+                            let key = String::from_utf8_lossy(&item.0).to_string();
+                            let val = String::from_utf8_lossy(&item.1).to_string();
+                            state.insert(key, JsonValue::from(val));
+                        }
+                    }
+                    wasm_send(json!({
+                        "key": "machineState",
+                        "input": { "machineId": machine_id, "state": state }
+                    }));
+                });
             } else if packet["type"] == "runOnChain" {
                 let input: JsonValue =
                     serde_json::from_str(packet["input"].as_str().unwrap()).unwrap();
@@ -467,6 +489,7 @@ pub struct WasmMac {
     pub onchain: bool,
     pub chain_token_id: String,
     pub token_owner_id: String,
+    pub callback_id: String,
     pub is_token_valid: bool,
     pub callback: Box<dyn (Fn(JsonValue) -> String) + Send + Sync>,
     pub machine_id: String,
@@ -505,6 +528,7 @@ impl WasmMac {
         WasmMac {
             onchain: false,
             token_owner_id: String::new(),
+            callback_id: String::new(),
             chain_token_id: String::new(),
             is_token_valid: false,
             callback: cb,
@@ -539,6 +563,7 @@ impl WasmMac {
         WasmMac {
             onchain: true,
             token_owner_id: String::new(),
+            callback_id: String::new(),
             chain_token_id: String::new(),
             is_token_valid: false,
             callback: cb,
@@ -730,6 +755,30 @@ impl WasmMac {
             )
             .unwrap()
         });
+        extern_mod.add_func("cancelTimer", unsafe {
+            Function::create_sync_func(
+                &wasmedge_sys::FuncType::new(vec![ValType::I32, ValType::I32], vec![ValType::I64]),
+                cancel_timer,
+                &mut (HostData {
+                    exec: &mut exec,
+                    runtime: self,
+                }),
+                1,
+            )
+            .unwrap()
+        });
+        extern_mod.add_func("listTimers", unsafe {
+            Function::create_sync_func(
+                &wasmedge_sys::FuncType::new(vec![], vec![ValType::I64]),
+                list_timers,
+                &mut (HostData {
+                    exec: &mut exec,
+                    runtime: self,
+                }),
+                1,
+            )
+            .unwrap()
+        });
         extern_mod.add_func("signalPoint", unsafe {
             Function::create_sync_func(
                 &wasmedge_sys::FuncType::new(
@@ -1120,6 +1169,30 @@ fn execute_on_chain(mac_item: Arc<Mutex<WasmMac>>, input: String, user_id: Strin
             )
             .unwrap()
         });
+        extern_mod.add_func("cancelTimer", unsafe {
+            Function::create_sync_func(
+                &wasmedge_sys::FuncType::new(vec![ValType::I32, ValType::I32], vec![ValType::I64]),
+                cancel_timer,
+                &mut (HostData {
+                    runtime: mac,
+                    exec: &mut exec,
+                }),
+                1,
+            )
+            .unwrap()
+        });
+        extern_mod.add_func("listTimers", unsafe {
+            Function::create_sync_func(
+                &wasmedge_sys::FuncType::new(vec![], vec![ValType::I64]),
+                list_timers,
+                &mut (HostData {
+                    runtime: mac,
+                    exec: &mut exec,
+                }),
+                1,
+            )
+            .unwrap()
+        });
         extern_mod.add_func("signalPoint", unsafe {
             Function::create_sync_func(
                 &wasmedge_sys::FuncType::new(
@@ -1528,7 +1601,8 @@ pub fn plant_trigger(
             "pointId": point_id,
             "input": text,
             "tag": tag,
-            "count": count
+            "count": count,
+            "callbackId": rt.callback_id
         }
     });
 
@@ -1537,6 +1611,76 @@ pub fn plant_trigger(
     Ok(vec![WasmValue::from_i64(0)])
 }
 
+fn pass_to_module(exec: &mut Executor, _inst: &mut Instance, val: String) -> Vec<WasmValue> {
+    let val_l = val.len();
+
+    let mut malloc_fn = _inst.get_func_mut("malloc").unwrap();
+    let mfn = malloc_fn.deref_mut();
+    let res = exec
+        .call_func(mfn, [WasmValue::from_i32(val_l as i32)])
+        .unwrap();
+    let val_offset = res[0].to_i32();
+
+    let arr = val.as_bytes().to_vec();
+
+    let mut mem2 = _inst.get_memory_mut("memory").unwrap();
+
+    mem2.set_data(arr, val_offset.cast_unsigned()).unwrap();
+    let c = ((val_offset as i64) << 32) | (val_l as i64);
+
+    vec![WasmValue::from_i64(c)]
+}
+
+pub fn cancel_timer(
+    host_data: &mut HostData,
+    _inst: &mut Instance,
+    _caller: &mut CallingFrame,
+    _input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    let mem = _caller.memory_mut(0).unwrap();
+    let rt: &mut WasmMac = unsafe { &mut *host_data.runtime };
+    let exec: &mut Executor = unsafe { &mut *host_data.exec };
+
+    let name_offset = _input[0].to_i32();
+    let name_l = _input[1].to_i32();
+    let name_bytes = mem.get_data(name_offset.cast_unsigned(), name_l.cast_unsigned());
+    let name_bytes_next = name_bytes.unwrap();
+    let name = str::from_utf8(&name_bytes_next).unwrap();
+
+    let j = json!({
+        "key": "cancelTimer",
+        "input": {
+            "machineId": rt.machine_id,
+            "name": name
+        }
+    });
+
+    let val = (rt.callback)(j);
+
+    Ok(pass_to_module(exec, _inst, val))
+}
+
+pub fn list_timers(
+    host_data: &mut HostData,
+    _inst: &mut Instance,
+    _caller: &mut CallingFrame,
+    _input: Vec<WasmValue>,
+) -> Result<Vec<WasmValue>, CoreError> {
+    let rt: &mut WasmMac = unsafe { &mut *host_data.runtime };
+    let exec: &mut Executor = unsafe { &mut *host_data.exec };
+
+    let j = json!({
+        "key": "listTimers",
+        "input": {
+            "machineId": rt.machine_id
+        }
+    });
+
+    let val = (rt.callback)(j);
+
+    Ok(pass_to_module(exec, _inst, val))
+}
+
 pub fn http_post(
     host_data: &mut HostData,
     _inst: &mut Instance,
@@ -1569,6 +1713,7 @@ pub fn http_post(
         "key": "httpPost",
         "input": {
             "machineId": rt.machine_id,
+            "callbackId": rt.callback_id,
             "url": url,
             "headers": headers,
             "body": body
@@ -2031,13 +2176,14 @@ impl ConcurrentRunner {
             let trx = self.trxs[i].clone();
             let ast_store_path = self.ast_store_path.clone();
             thread::spawn(move || {
-                let rt = WasmMac::new_onchain(
+                let mut rt = WasmMac::new_onchain(
                     trx.machine_id.clone(),
                     i.to_string(),
                     i as i32,
                     format!("{}/{}/module", ast_store_path, trx.machine_id),
                     Box::new(wasm_send),
                 );
+                rt.callback_id = trx.callback_id.clone();
                 let rt_arc = Arc::new(Mutex::new(rt));
                 {
                     unsafe {
@@ -150,7 +150,6 @@ require (
 	google.golang.org/genproto/googleapis/api v0.0.0-20250528174236-200df99c418a // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250519155744-55703ea1f237 // indirect
 	google.golang.org/grpc v1.72.0 // indirect
-	google.golang.org/protobuf v1.36.6 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gotest.tools/v3 v3.5.2 // indirect
 )
@@ -173,8 +172,10 @@ require (
 	github.com/pion/datachannel v1.5.10
 	github.com/pion/webrtc/v2 v2.2.26
 	github.com/spf13/viper v1.4.0
+	github.com/tetratelabs/wazero v1.9.0
 	github.com/ugorji/go/codec v1.2.11
 	github.com/x-cray/logrus-prefixed-formatter v0.5.2
 	golang.org/x/image v0.30.0
 	google.golang.org/api v0.231.0
+	google.golang.org/protobuf v1.36.6
 )
@@ -7,9 +7,17 @@ import (
 type IDocker interface {
 	Assign(machineId string)
 	SaRContainer(machineId string, imageName string, containerName string) error
-	RunContainer(machineId string, pointId string, imageName string, containerName string, inputFile map[string]string, standalone bool) (*models.File, error)
+	RunContainer(machineId string, pointId string, imageName string, containerName string, inputFile map[string]string, standalone bool) (*models.File, *ContainerUsage, error)
 	BuildImage(dockerfile string, machineId string, imageName string, outputChan chan string) error
 	ExecContainer(machineId string, imageName string, containerName string, command string) (string, error)
 	CopyToContainer(machineId string, imageName string, containerName string, fileName string, content string) error
 	RunGateway()
+	RunCost(machineId string) int64
+}
+
+type ContainerUsage struct {
+	CpuSeconds  float64 `json:"cpuSeconds"`
+	PeakMemory  uint64  `json:"peakMemory"`
+	WallSeconds float64 `json:"wallSeconds"`
+	TimedOut    bool    `json:"timedOut"`
 }
@@ -1,17 +1,24 @@
 package network
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"kasper/src/abstract/models/chain"
+	"kasper/src/abstract/models/trx"
+	"kasper/src/abstract/models/update"
+)
 
 type IChain interface {
 	Listen(port int, tlsConfig *tls.Config)
-	SubmitTrx(chainId string, machineId string, typ string, payload []byte)
-	RegisterPipeline(pipeline func([][]byte, func([]byte)) []string)
-	NotifyNewMachineCreated(chainId string, machineId string)
+	SubmitTrx(chainId string, machineId string, typ chain.TrxType, payload []byte)
+	RegisterPipeline(pipeline func(chain.Block, []chain.Envelope, func(chain.Envelope) []update.Update) ([]string, [][]update.Update))
+	NotifyNewMachineCreated(trx trx.ITrx, chainId string, machineId string)
 	CreateTempChain() string
 	CreateWorkChain() string
 	Peers() []string
 	UserOwnsOrigin(userId string, origin string) bool
 	GetNodeOwnerId(origin string) string
 	GetValidatorsOfMachineShard(machineId string) []string
+	MachineFrozen(shardId string, machineId string) bool
+	ListenToBlocks(listener func(workChainId string, shardChainId string, blockIndex int, timestamp int64))
 	Close()
 }
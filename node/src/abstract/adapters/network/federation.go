@@ -1,6 +1,13 @@
 package network
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// ErrFederationTimeout is handed to the callback of a federation request that
+// got no response from the destination org in time.
+var ErrFederationTimeout = errors.New("federation request timed out")
 
 type IFederation interface {
 	Listen(port int, tlsConfig *tls.Config)
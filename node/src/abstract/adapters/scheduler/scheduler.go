@@ -0,0 +1,27 @@
+package scheduler
+
+import "time"
+
+// Timer runs a machine with its input on a point once FireAt is reached. A
+// timer with a cron expression is scheduled again after each run instead of
+// being removed. OnChain timers are fired by the time of committed blocks and
+// count from CreatedAt, the time of the block of the request that planted
+// them, so every executor that holds one fires it on the same block.
+type Timer struct {
+	MachineId string `json:"machineId"`
+	Name      string `json:"name"`
+	PointId   string `json:"pointId"`
+	Input     string `json:"input"`
+	Cron      string `json:"cron"`
+	OnChain   bool   `json:"onChain"`
+	FireAt    int64  `json:"fireAt"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+type IScheduler interface {
+	Schedule(timer Timer, delay time.Duration) (Timer, error)
+	Cancel(machineId string, name string) bool
+	List(machineId string) []Timer
+	Start()
+	Close()
+}
@@ -1,11 +1,44 @@
 package security
 
+import (
+	"fmt"
+	"kasper/src/shell/utils/crypto"
+)
+
+// KeyRotation links a key of the node to the one it replaced. Proof is the
+// signature of KeyRotationMessage by the previous key, so a peer that kept an
+// older key can follow the rotations up to the current one and can not be
+// made to go back to a key that was already replaced.
+type KeyRotation struct {
+	Version   int64  `json:"version"`
+	PublicKey string `json:"publicKey"`
+	Proof     string `json:"proof"`
+}
+
+func KeyRotationMessage(version int64, publicKey string) []byte {
+	return []byte(fmt.Sprintf("keyRotation::%d::%s", version, publicKey))
+}
+
+// FollowRotations returns the key publicKey was rotated to through rotations.
+// Rotations not signed by the key reached so far are skipped.
+func FollowRotations(publicKey string, rotations []KeyRotation) string {
+	for _, rotation := range rotations {
+		if crypto.VerifySignature([]byte(publicKey), KeyRotationMessage(rotation.Version, rotation.PublicKey), rotation.Proof) == nil {
+			publicKey = rotation.PublicKey
+		}
+	}
+	return publicKey
+}
+
 type ISecurity interface {
 	LoadKeys()
 	GenerateSecureKeyPair(tag string)
 	FetchKeyPair(tag string) [][]byte
+	KeyRotations(tag string) []KeyRotation
 	Encrypt(tag string, plainText string) string
 	Decrypt(tag string, cipherText string) string
 	AuthWithSignature(userId string, packet []byte, signatureBase64 string) (bool, string, bool)
+	AuthWithEnvelope(userId string, path string, packetId string, packet []byte, signature string) (bool, string, bool)
+	VerifyEnvelope(userId string, path string, packet []byte, signature string) (bool, string, bool)
 	HasAccessToPoint(userId string, pointId string) bool
 }
@@ -16,6 +16,8 @@ type ISignaler interface {
 	JoinGroup(groupId string, userId string)
 	LeaveGroup(groupId string, userId string)
 	RetriveGroup(groupId string) (*Group, bool)
+	Resume(listener *Listener, afterSeq uint64) uint64
+	Ack(userId string, seq uint64)
 }
 
 type Group struct {
@@ -25,10 +27,19 @@ type Group struct {
 }
 
 type Listener struct {
-	Id      string
-	Paused  bool
-	DisTime int64
-	Signal  func(string, any)
+	Id        string
+	Paused    bool
+	DisTime   int64
+	Signal    func(string, any)
+	SignalSeq func(uint64, string, any)
+}
+
+type OutboxEntry struct {
+	Seq  uint64 `json:"seq"`
+	Key  string `json:"key"`
+	Data []byte `json:"data"`
+	Ref  string `json:"ref,omitempty"`
+	Time int64  `json:"time"`
 }
 
 type GlobalListener struct {
@@ -0,0 +1,15 @@
+package storage
+
+import "kasper/src/abstract/models/packet"
+
+type ILogStore interface {
+	LogTimeSieries(pointId string, userId string, data string, timeVal int64) packet.LogPacket
+	UpdateLog(pointId string, userId string, signalId string, data string, timeVal int64) packet.LogPacket
+	DeleteLog(pointId string, userId string, signalId string, timeVal int64) packet.LogPacket
+	ReadPointLogs(pointId string, beforeTime int64, count int) []packet.LogPacket
+	PickPointLogs(pointId string, ids []string) []packet.LogPacket
+	EachPointLog(fn func(packet.LogPacket))
+	LogBuild(buildId string, machineId string, data string) packet.BuildPacket
+	ReadBuildLogs(buildId string, machineId string) []packet.BuildPacket
+	Close() error
+}
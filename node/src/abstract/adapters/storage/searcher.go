@@ -0,0 +1,11 @@
+package storage
+
+import "kasper/src/abstract/models/packet"
+
+type ISearcher interface {
+	IndexLog(log packet.LogPacket)
+	RemoveLog(pointId string, id string)
+	SearchPointLogs(pointId string, query string, offset int, count int) []string
+	Backfill(logs ILogStore)
+	Close() error
+}
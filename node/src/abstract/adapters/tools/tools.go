@@ -6,6 +6,7 @@ import (
 	"kasper/src/abstract/adapters/file"
 	"kasper/src/abstract/adapters/firectl"
 	"kasper/src/abstract/adapters/network"
+	"kasper/src/abstract/adapters/scheduler"
 	"kasper/src/abstract/adapters/security"
 	"kasper/src/abstract/adapters/signaler"
 	"kasper/src/abstract/adapters/storage"
@@ -22,4 +23,5 @@ type ITools interface {
 	Elpis() elpis.IElpis
 	Docker() docker.IDocker
 	Firectl() firectl.IFirectl
+	Scheduler() scheduler.IScheduler
 }
@@ -7,6 +7,8 @@ type IWasm interface {
 	RunVm(machineId string, pointId string, data string)
 	ExecuteChainTrxsGroup(trxs []*worker.Trx)
 	ExecuteChainEffects(effects string)
+	ExportMachineState(machineId string) (map[string]string, error)
 	CloseKVDB()
 	WasmCallback(dataRaw string) (string, int64)
+	Runtime() string
 }
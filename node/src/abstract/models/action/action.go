@@ -20,7 +20,7 @@ type ISecureAction interface {
 	Key() string
 	HasGlobalParser() bool
 	ParseInput(protocol string, raw interface{}) (input.IInput, error)
-	SecurelyAct(userId string, packetId string, packetBinary []byte, packetSignature string, input input.IInput, dummy string, insider ...bool) (int, any, error)
+	SecurelyAct(userId string, packetId string, packetBinary []byte, packetSignature string, input input.IInput, remote string, insider ...bool) (int, any, error)
 	SecurlyActChain(userId string, packetId string, packetBinary []byte, packetSignature string, input input.IInput, origin string, tag string)
 	SecurelyActFed(userId string, packetBinary []byte, packetSignature string, input input.IInput) (int, any, error)
 }
@@ -1,6 +1,16 @@
 package chain
 
-import "kasper/src/abstract/models/update"
+import (
+	"fmt"
+	"kasper/src/abstract/models/update"
+)
+
+// FailedResult is what a machine gets back from a request it made on chain
+// that failed. It only carries the status code, as the error itself may be
+// local to the node, like a timeout, and would make its executors disagree.
+func FailedResult(resCode int) []byte {
+	return []byte(fmt.Sprintf(`{"resCode":%d}`, resCode))
+}
 
 type ChainMessage struct {
 	Key        string
@@ -33,6 +43,7 @@ type ChainResponse struct {
 	Err       string
 	Tag       string
 	ToUserId  string
+	Usage     int64
 }
 
 type ChainAppletRequest struct {
@@ -49,24 +60,58 @@ type ChainAppletRequest struct {
 }
 
 type ChainElectionPacket struct {
-	Type    string
-	Key     string
-	Meta    map[string]any
-	Payload []byte
+	Type      string
+	Key       string
+	Meta      map[string]any
+	Payload   []byte
+	Signature string
 }
 
 type Election struct {
-	MyNum        string
-	Participants map[string]bool
+	Epoch        uint64
+	Seed         string
+	Starter      string
+	Phase        string
+	MyReveal     []byte
+	Participants map[string]string
 	Commits      map[string][]byte
-	Reveals      map[string]string
+	Reveals      map[string][]byte
+}
+
+// ElectionResult is the outcome of an election epoch as written to state. It
+// keeps the signatures every output was derived from, so the chosen executors
+// can be recomputed from the previous seed by anyone holding the keys the
+// voters registered on chain.
+type ElectionResult struct {
+	Epoch     uint64            `json:"epoch"`
+	PrevSeed  string            `json:"prevSeed"`
+	Seed      string            `json:"seed"`
+	Executors []string          `json:"executors"`
+	Reveals   map[string]string `json:"reveals"`
+	Penalised []string          `json:"penalised"`
+	Excluded  []string          `json:"excluded"`
+}
+
+// Block is the block a pipeline applies, with its consensus timestamp in unix
+// seconds and the shard chain that committed it. State changes that need a
+// time or a height use it, so every node writes the same.
+type Block struct {
+	Index     int
+	Timestamp int64
+	ShardId   string
 }
 
 type ChainCallback struct {
-	Fn        func([]byte, int, error)
-	Executors map[string]bool
-	Responses map[string]string
-	Tag       string
+	Fn           func([]byte, int, error)
+	Executors    map[string]bool
+	Responses    map[string]string
+	Tag          string
+	MachineId    string
+	TokenOwnerId string
+	TokenId      string
+	BlockTime    int64
+	Deadline     int64
+	Settled      string
 }
 
 type MessageCallback struct {
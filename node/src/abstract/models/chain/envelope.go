@@ -0,0 +1,182 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Transactions are submitted to the chain inside an envelope naming their
+// type, the schema version of the envelope, the work and shard chain they
+// were submitted to and the node that submitted them. The envelope is encoded
+// in the protobuf wire format behind a magic prefix, and the payload keeps the
+// encoding of its type. Blocks written before the envelope hold transactions
+// as "<type>::<json>", which DecodeEnvelope still reads as version 0.
+type TrxType uint32
+
+const (
+	TrxUnknown TrxType = iota
+	TrxBaseRequest
+	TrxAppRequest
+	TrxResponse
+	TrxMessage
+	TrxElection
+	TrxNodeJoined
+	TrxShardTopology
+	TrxShardMap
+	TrxMachineBundle
+	TrxMachineMigrated
+	TrxMachineFreeze
+	TrxMachineThaw
+)
+
+var trxTypeNames = map[TrxType]string{
+	TrxBaseRequest:     "baseRequest",
+	TrxAppRequest:      "appRequest",
+	TrxResponse:        "response",
+	TrxMessage:         "message",
+	TrxElection:        "election",
+	TrxNodeJoined:      "nodeJoined",
+	TrxShardTopology:   "shardTopology",
+	TrxShardMap:        "shardMap",
+	TrxMachineBundle:   "machineBundle",
+	TrxMachineMigrated: "machineMigrated",
+	TrxMachineFreeze:   "machineFreeze",
+	TrxMachineThaw:     "machineThaw",
+}
+
+func (t TrxType) String() string {
+	if name, ok := trxTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(t))
+}
+
+// Insider tells if transactions of the type are handled by the chain driver
+// itself instead of the core.
+func (t TrxType) Insider() bool {
+	return t == TrxNodeJoined || t == TrxShardTopology || t == TrxShardMap || t == TrxMachineBundle || t == TrxMachineMigrated || t == TrxMachineFreeze || t == TrxMachineThaw
+}
+
+func ParseTrxType(name string) TrxType {
+	for t, n := range trxTypeNames {
+		if n == name {
+			return t
+		}
+	}
+	return TrxUnknown
+}
+
+const EnvelopeVersion uint32 = 1
+
+var (
+	envelopeMagic = []byte{0x00, 'K', 'T', 'X'}
+
+	ErrMalformedEnvelope   = errors.New("malformed transaction envelope")
+	ErrUnsupportedEnvelope = errors.New("unsupported transaction envelope version")
+)
+
+const (
+	envelopeFieldVersion protowire.Number = iota + 1
+	envelopeFieldType
+	envelopeFieldChainId
+	envelopeFieldShardId
+	envelopeFieldSigner
+	envelopeFieldPayload
+)
+
+type Envelope struct {
+	Version uint32
+	Type    TrxType
+	ChainId string
+	ShardId string
+	Signer  string
+	Payload []byte
+}
+
+func NewEnvelope(typ TrxType, chainId string, shardId string, signer string, payload []byte) Envelope {
+	return Envelope{Version: EnvelopeVersion, Type: typ, ChainId: chainId, ShardId: shardId, Signer: signer, Payload: payload}
+}
+
+func (e Envelope) Encode() []byte {
+	b := make([]byte, 0, len(envelopeMagic)+len(e.ChainId)+len(e.ShardId)+len(e.Signer)+len(e.Payload)+24)
+	b = append(b, envelopeMagic...)
+	b = protowire.AppendTag(b, envelopeFieldVersion, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(e.Version))
+	b = protowire.AppendTag(b, envelopeFieldType, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(e.Type))
+	b = protowire.AppendTag(b, envelopeFieldChainId, protowire.BytesType)
+	b = protowire.AppendString(b, e.ChainId)
+	b = protowire.AppendTag(b, envelopeFieldShardId, protowire.BytesType)
+	b = protowire.AppendString(b, e.ShardId)
+	b = protowire.AppendTag(b, envelopeFieldSigner, protowire.BytesType)
+	b = protowire.AppendString(b, e.Signer)
+	b = protowire.AppendTag(b, envelopeFieldPayload, protowire.BytesType)
+	b = protowire.AppendBytes(b, e.Payload)
+	return b
+}
+
+// DecodeEnvelope reads a transaction as committed in a block, either enveloped
+// or in the legacy "<type>::<json>" form. Unknown fields are skipped so that
+// older nodes can read envelopes carrying fields added later.
+func DecodeEnvelope(data []byte) (Envelope, error) {
+	rest, ok := bytes.CutPrefix(data, envelopeMagic)
+	if !ok {
+		return decodeLegacyEnvelope(data)
+	}
+	e := Envelope{}
+	for len(rest) > 0 {
+		num, typ, n := protowire.ConsumeTag(rest)
+		if n < 0 {
+			return e, ErrMalformedEnvelope
+		}
+		rest = rest[n:]
+		switch {
+		case num == envelopeFieldVersion && typ == protowire.VarintType:
+			v, m := protowire.ConsumeVarint(rest)
+			if m < 0 {
+				return e, ErrMalformedEnvelope
+			}
+			e.Version, n = uint32(v), m
+		case num == envelopeFieldType && typ == protowire.VarintType:
+			v, m := protowire.ConsumeVarint(rest)
+			if m < 0 {
+				return e, ErrMalformedEnvelope
+			}
+			e.Type, n = TrxType(v), m
+		case num == envelopeFieldChainId && typ == protowire.BytesType:
+			e.ChainId, n = protowire.ConsumeString(rest)
+		case num == envelopeFieldShardId && typ == protowire.BytesType:
+			e.ShardId, n = protowire.ConsumeString(rest)
+		case num == envelopeFieldSigner && typ == protowire.BytesType:
+			e.Signer, n = protowire.ConsumeString(rest)
+		case num == envelopeFieldPayload && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(rest)
+			e.Payload = bytes.Clone(v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, rest)
+		}
+		if n < 0 {
+			return e, ErrMalformedEnvelope
+		}
+		rest = rest[n:]
+	}
+	if e.Version == 0 {
+		return e, ErrMalformedEnvelope
+	}
+	if e.Version > EnvelopeVersion {
+		return e, fmt.Errorf("%w: %d", ErrUnsupportedEnvelope, e.Version)
+	}
+	return e, nil
+}
+
+func decodeLegacyEnvelope(data []byte) (Envelope, error) {
+	name, payload, ok := bytes.Cut(data, []byte("::"))
+	if !ok {
+		return Envelope{}, ErrMalformedEnvelope
+	}
+	return Envelope{Version: 0, Type: ParseTrxType(string(name)), Payload: payload}, nil
+}
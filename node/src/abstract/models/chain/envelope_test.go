@@ -0,0 +1,96 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	for typ := range trxTypeNames {
+		e := NewEnvelope(typ, "main", "shard-1", "node-a", []byte(`{"key":"/users/get"}`))
+		got, err := DecodeEnvelope(e.Encode())
+		if err != nil {
+			t.Fatalf("%v: %v", typ, err)
+		}
+		if got.Version != EnvelopeVersion || got.Type != typ || got.ChainId != "main" || got.ShardId != "shard-1" || got.Signer != "node-a" || !bytes.Equal(got.Payload, e.Payload) {
+			t.Fatalf("%v: decoded %+v, want %+v", typ, got, e)
+		}
+	}
+}
+
+func TestEnvelopeEmptyFields(t *testing.T) {
+	got, err := DecodeEnvelope(NewEnvelope(TrxMessage, "", "", "", nil).Encode())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got.Type != TrxMessage || got.ChainId != "" || len(got.Payload) != 0 {
+		t.Fatalf("decoded %+v", got)
+	}
+}
+
+func TestEnvelopeSkipsUnknownFields(t *testing.T) {
+	b := NewEnvelope(TrxResponse, "main", "shard-1", "node-a", []byte("payload")).Encode()
+	b = protowire.AppendTag(b, 42, protowire.BytesType)
+	b = protowire.AppendString(b, "added later")
+	b = protowire.AppendTag(b, 43, protowire.VarintType)
+	b = protowire.AppendVarint(b, 7)
+	got, err := DecodeEnvelope(b)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got.Type != TrxResponse || string(got.Payload) != "payload" {
+		t.Fatalf("decoded %+v", got)
+	}
+}
+
+func TestEnvelopeRejectsBadInput(t *testing.T) {
+	e := NewEnvelope(TrxAppRequest, "main", "shard-1", "node-a", []byte("payload"))
+	encoded := e.Encode()
+	if _, err := DecodeEnvelope(encoded[:len(encoded)-2]); !errors.Is(err, ErrMalformedEnvelope) {
+		t.Fatalf("truncated envelope: %v", err)
+	}
+	if _, err := DecodeEnvelope(envelopeMagic); !errors.Is(err, ErrMalformedEnvelope) {
+		t.Fatalf("envelope without a version: %v", err)
+	}
+	e.Version = EnvelopeVersion + 1
+	if _, err := DecodeEnvelope(e.Encode()); !errors.Is(err, ErrUnsupportedEnvelope) {
+		t.Fatalf("newer envelope: %v", err)
+	}
+	if _, err := DecodeEnvelope([]byte("no separator")); !errors.Is(err, ErrMalformedEnvelope) {
+		t.Fatalf("legacy trx without a type: %v", err)
+	}
+}
+
+func TestEnvelopeLegacy(t *testing.T) {
+	got, err := DecodeEnvelope([]byte(`appRequest::{"machineId":"m1","payload":"a::b"}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got.Version != 0 || got.Type != TrxAppRequest || string(got.Payload) != `{"machineId":"m1","payload":"a::b"}` {
+		t.Fatalf("decoded %+v", got)
+	}
+	got, err = DecodeEnvelope([]byte("somethingElse::{}"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got.Type != TrxUnknown {
+		t.Fatalf("unknown legacy type decoded as %v", got.Type)
+	}
+}
+
+func TestTrxTypeNames(t *testing.T) {
+	for typ, name := range trxTypeNames {
+		if typ.String() != name || ParseTrxType(name) != typ {
+			t.Fatalf("%d does not round trip through %q", typ, name)
+		}
+	}
+	if TrxType(999).String() != "unknown(999)" {
+		t.Fatalf("unknown type named %q", TrxType(999).String())
+	}
+	if TrxAppRequest.Insider() || !TrxShardMap.Insider() {
+		t.Fatalf("wrong insider types")
+	}
+}
@@ -32,10 +32,15 @@ type ICore interface {
 	ExecAppletResponseOnChain(callbackId string, packet []byte, signature string, resCode int, e string, updates []update.Update)
 	ExecBaseRequestOnChain(key string, payload []byte, signature string, userId string, tag string, callback func([]byte, int, error))
 	ExecBaseResponseOnChain(callbackId string, packet []byte, signature string, resCode int, e string, updates []update.Update, tag string, toUserId string)
-	OnChainPacket(typ string, trxPayload []byte) string
+	OnChainPacket(block chain.Block, typ chain.TrxType, trxPayload []byte) (string, []update.Update)
+	ChainTime() int64
 	AppPendingTrxs()
+	MachineSettled(machineId string) bool
+	RunningRequest(machineId string, callbackId string) (chain.ChainCallback, bool)
+	RunningRequests(machineId string) []string
 	IpAddr() string
 	ModifyState(bool, func(trx.ITrx) error)
+	ModifyStateChecked(func(trx.ITrx) error) error
 	ModifyStateSecurlyWithSource(readonly bool, info info.IInfo, src string, fn func(state.IState) error)
 	ModifyStateSecurly(readonly bool, info info.IInfo, fn func(state.IState) error)
 	SignPacket(data []byte) string
@@ -12,6 +12,7 @@ type LogPacket struct {
 	Data    string `json:"data"`
 	Time    int64  `json:"time"`
 	Edited  bool   `json:"edited"`
+	Deleted bool   `json:"deleted"`
 }
 
 type BuildPacket struct {
@@ -0,0 +1,6 @@
+package packet
+
+type QueueEnd struct {
+	Message string `json:"message"`
+	Seq     uint64 `json:"seq"`
+}
@@ -38,5 +38,6 @@ type ITrx interface {
 	GetPubKey(string) *rsa.PublicKey
 	Updates() []update.Update
 	Commit()
+	CommitChecked() error
 	Discard()
 }
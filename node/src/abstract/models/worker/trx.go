@@ -8,5 +8,6 @@ type Trx struct {
 	MachineId  string `json:"machineId"`
 	Runtime    string `json:"runtime"`
 	GasLimit   int64  `json:"gasLimit"`
+	TokenId    string `json:"tokenId"`
 	CallbackId string `json:"callbackId"`
 }
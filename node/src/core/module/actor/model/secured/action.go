@@ -3,6 +3,7 @@ package secured
 import (
 	"encoding/json"
 	"errors"
+	"kasper/src/abstract/adapters/network"
 	"kasper/src/abstract/models/action"
 	"kasper/src/abstract/models/core"
 	"kasper/src/abstract/models/input"
@@ -11,6 +12,16 @@ import (
 	"log"
 )
 
+// ResultRateLimited is the status code of a call turned down by the Limiter.
+const ResultRateLimited = -2
+
+// ResultTimeout is the status code of a call another org did not answer in time.
+const ResultTimeout = -3
+
+func rateLimitError(scope string) error {
+	return errors.New("rate limit exceeded for " + scope)
+}
+
 type Parse func(interface{}) (input.IInput, error)
 
 type SecureAction struct {
@@ -33,7 +44,7 @@ func (a *SecureAction) ParseInput(protocol string, raw interface{}) (input.IInpu
 }
 
 func (a *SecureAction) SecurlyActChain(userId string, packetId string, packetBinary []byte, packetSignature string, input input.IInput, origin string, tag string) {
-	success, info := a.Guard.CheckValidityForChain(a.core, packetBinary, packetSignature, userId, input.GetPointId())
+	success, info := a.Guard.CheckValidityForChain(a.core, a.Key(), packetBinary, packetSignature, userId, input.GetPointId())
 	if !success {
 		data := []byte("{}")
 		a.core.ExecBaseResponseOnChain(packetId, data, a.core.SignPacket(data), 403, "authorization failed", []update.Update{}, tag, userId)
@@ -52,12 +63,28 @@ func (a *SecureAction) SecurlyActChain(userId string, packetId string, packetBin
 	}
 }
 
-func (a *SecureAction) SecurelyAct(userId string, packetId string, packetBinary []byte, packetSignature string, input input.IInput, dummy string, insider ...bool) (int, any, error) {
+func (a *SecureAction) SecurelyAct(userId string, packetId string, packetBinary []byte, packetSignature string, input input.IInput, remote string, insider ...bool) (int, any, error) {
+	// until its signature is checked the user a call claims to be is not
+	// trusted, so it is limited by the address it came from first
+	if !Limiter.AllowConnection(a.Key(), remote) {
+		return ResultRateLimited, nil, rateLimitError("conn")
+	}
 	origin := input.Origin()
 	if origin == "" {
 		origin = a.core.Id()
 	}
 	if origin == "global" {
+		// freshness and the nonce are checked here only, the nodes applying
+		// the request from the chain check its signature and path
+		success, info := a.Guard.CheckValidity(a.core, a.Key(), packetId, packetBinary, packetSignature, userId, input.GetPointId(), insider...)
+		if !success {
+			return -1, nil, errors.New("authorization failed")
+		}
+		// chain requests are executed by every node, so they are limited once
+		// here on the node they enter through
+		if ok, scope := Limiter.Allow(a.core, a.Key(), info); !ok {
+			return ResultRateLimited, nil, rateLimitError(scope)
+		}
 		c := make(chan int, 1)
 		var res any
 		var sc int
@@ -74,9 +101,11 @@ func (a *SecureAction) SecurelyAct(userId string, packetId string, packetBinary
 		return sc, res, e
 	}
 	if a.core.Id() == origin {
-		success, info := a.Guard.CheckValidity(a.core, packetBinary, packetSignature, userId, input.GetPointId(), insider...)
+		success, info := a.Guard.CheckValidity(a.core, a.Key(), packetId, packetBinary, packetSignature, userId, input.GetPointId(), insider...)
 		if !success {
 			return -1, nil, errors.New("authorization failed")
+		} else if ok, scope := Limiter.Allow(a.core, a.Key(), info); !ok {
+			return ResultRateLimited, nil, rateLimitError(scope)
 		} else {
 			var sc int
 			var res any
@@ -89,7 +118,7 @@ func (a *SecureAction) SecurelyAct(userId string, packetId string, packetBinary
 			return sc, res, err
 		}
 	}
-	success := a.Guard.CheckIdentity(a.core, packetBinary, packetSignature, userId)
+	success := a.Guard.CheckIdentity(a.core, a.Key(), packetId, packetBinary, packetSignature, userId)
 	if !success {
 		return -1, nil, errors.New("authorization failed")
 	}
@@ -99,8 +128,13 @@ func (a *SecureAction) SecurelyAct(userId string, packetId string, packetBinary
 	var errFed error
 	a.core.Tools().Network().Federation().SendFedRequestByCallback(origin, packetId, userId, a.Key(), packetBinary, packetSignature, func(data []byte, resCode int, err error) {
 		result := map[string]any{}
-		e := json.Unmarshal(data, &result)
-		if e != nil {
+		if errors.Is(err, network.ErrFederationTimeout) {
+			scFed = ResultTimeout
+			errFed = err
+		} else if err != nil {
+			scFed = resCode
+			errFed = err
+		} else if e := json.Unmarshal(data, &result); e != nil {
 			log.Println(e)
 			scFed = 3
 			errFed = e
@@ -116,10 +150,13 @@ func (a *SecureAction) SecurelyAct(userId string, packetId string, packetBinary
 }
 
 func (a *SecureAction) SecurelyActFed(userId string, packetBinary []byte, packetSignature string, input input.IInput) (int, any, error) {
-	success, info := a.Guard.CheckValidity(a.core, packetBinary, packetSignature, userId, input.GetPointId())
+	success, info := a.Guard.CheckValidity(a.core, a.Key(), "", packetBinary, packetSignature, userId, input.GetPointId())
 	if !success {
 		return -1, nil, nil
 	}
+	if ok, scope := Limiter.Allow(a.core, a.Key(), info); !ok {
+		return ResultRateLimited, nil, rateLimitError(scope)
+	}
 	var sc int
 	var res any
 	var err error
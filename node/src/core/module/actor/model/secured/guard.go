@@ -12,7 +12,7 @@ type Guard struct {
 	IsInTopic bool `json:"isInTopic"`
 }
 
-func (g *Guard) CheckValidity(app core.ICore, packet []byte, signature string, userId string, pointId string, insider ...bool) (bool, *model.Info) {
+func (g *Guard) CheckValidity(app core.ICore, path string, packetId string, packet []byte, signature string, userId string, pointId string, insider ...bool) (bool, *model.Info) {
 	if !g.IsUser {
 		return true, model.NewInfo("", "")
 	}
@@ -33,7 +33,7 @@ func (g *Guard) CheckValidity(app core.ICore, packet []byte, signature string, u
 			return true, model.NewGodInfo(userId, pointId, false)
 		}
 	}
-	identified, _, isGod := app.Tools().Security().AuthWithSignature(userId, packet, signature)
+	identified, _, isGod := app.Tools().Security().AuthWithEnvelope(userId, path, packetId, packet, signature)
 	if !identified {
 		return false, &model.Info{}
 	}
@@ -47,7 +47,7 @@ func (g *Guard) CheckValidity(app core.ICore, packet []byte, signature string, u
 	return true, model.NewGodInfo(userId, pointId, isGod)
 }
 
-func (g *Guard) CheckValidityForChain(app core.ICore, packet []byte, signature string, userId string, pointId string) (bool, *model.Info) {
+func (g *Guard) CheckValidityForChain(app core.ICore, path string, packet []byte, signature string, userId string, pointId string) (bool, *model.Info) {
 	if !g.IsUser {
 		return true, model.NewInfo("", "")
 	}
@@ -68,7 +68,7 @@ func (g *Guard) CheckValidityForChain(app core.ICore, packet []byte, signature s
 			return true, model.NewGodInfo(userId, pointId, false)
 		}
 	}
-	identified, _, isGod := app.Tools().Security().AuthWithSignature(userId, packet, signature)
+	identified, _, isGod := app.Tools().Security().VerifyEnvelope(userId, path, packet, signature)
 	if !identified {
 		return false, &model.Info{}
 	}
@@ -82,10 +82,10 @@ func (g *Guard) CheckValidityForChain(app core.ICore, packet []byte, signature s
 	return true, model.NewGodInfo(userId, pointId, isGod)
 }
 
-func (g *Guard) CheckIdentity(app core.ICore, packet []byte, signature string, userId string) bool {
+func (g *Guard) CheckIdentity(app core.ICore, path string, packetId string, packet []byte, signature string, userId string) bool {
 	if !g.IsUser {
 		return true
 	}
-	identified, _, _ := app.Tools().Security().AuthWithSignature(userId, packet, signature)
+	identified, _, _ := app.Tools().Security().AuthWithEnvelope(userId, path, packetId, packet, signature)
 	return identified
 }
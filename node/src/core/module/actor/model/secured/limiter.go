@@ -0,0 +1,214 @@
+package secured
+
+import (
+	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/trx"
+	model "kasper/src/core/module/actor/model/base"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket refilled at Rate tokens per second holding at most
+// Burst tokens.
+type Limit struct {
+	Rate  float64
+	Burst float64
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter applies token buckets per action and user, per user and per point.
+// Limits are looked up by scope, "action:<key>", "user:<human|machine>" and
+// "point:<pointId>", falling back to the "*" entry of the scope when there is
+// one. A request is only admitted when every bucket it touches has a token.
+// Before its signature is checked, a request is only limited by the address it
+// came from, under the "conn:<address>" scope.
+type RateLimiter struct {
+	lock       sync.Mutex
+	sweeper    sync.Once
+	limits     map[string]Limit
+	buckets    map[string]*bucket
+	rejections map[string]int64
+	ExemptGods bool
+}
+
+const bucketIdleTimeout = 10 * time.Minute
+
+var DefaultRateLimits = "action:/machines/deploy=0.2:2,action:/pc/runPc=1:5,action:/points/signal=10:20,user:human=20:40,user:machine=200:400,point:*=100:200,conn:*=50:100"
+
+var Limiter = NewRateLimiter(os.Getenv("RATE_LIMITS"), os.Getenv("RATE_LIMIT_EXEMPT_GODS") != "false")
+
+// ParseLimits reads a comma separated list of "<scope>:<name>=<rate>:<burst>"
+// entries.
+func ParseLimits(spec string) map[string]Limit {
+	limits := map[string]Limit{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		eq := strings.LastIndex(entry, "=")
+		if eq < 0 {
+			log.Println("invalid rate limit entry:", entry)
+			continue
+		}
+		parts := strings.Split(entry[eq+1:], ":")
+		if len(parts) != 2 {
+			log.Println("invalid rate limit entry:", entry)
+			continue
+		}
+		rate, err1 := strconv.ParseFloat(parts[0], 64)
+		burst, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil || rate <= 0 || burst < 1 {
+			log.Println("invalid rate limit entry:", entry)
+			continue
+		}
+		limits[entry[:eq]] = Limit{Rate: rate, Burst: burst}
+	}
+	return limits
+}
+
+func NewRateLimiter(spec string, exemptGods bool) *RateLimiter {
+	limits := ParseLimits(DefaultRateLimits)
+	for k, v := range ParseLimits(spec) {
+		limits[k] = v
+	}
+	return &RateLimiter{limits: limits, buckets: map[string]*bucket{}, rejections: map[string]int64{}, ExemptGods: exemptGods}
+}
+
+// Start runs the sweep dropping idle buckets. It is called once the node
+// starts, further calls are no-ops.
+func (rl *RateLimiter) Start() {
+	rl.sweeper.Do(func() {
+		go func() {
+			for {
+				time.Sleep(time.Minute)
+				rl.sweep()
+			}
+		}()
+	})
+}
+
+func (rl *RateLimiter) limitOf(scope string, name string) (Limit, bool) {
+	if l, ok := rl.limits[scope+":"+name]; ok {
+		return l, true
+	}
+	l, ok := rl.limits[scope+":*"]
+	return l, ok
+}
+
+func (rl *RateLimiter) refill(key string, limit Limit, now time.Time) *bucket {
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.Burst, updated: now}
+		rl.buckets[key] = b
+		return b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * limit.Rate
+	if b.tokens > limit.Burst {
+		b.tokens = limit.Burst
+	}
+	b.updated = now
+	return b
+}
+
+// Allow takes a token for an action call from every bucket it is subject to,
+// or none at all when one of them is empty, in which case the scope that
+// rejected the call is returned.
+func (rl *RateLimiter) Allow(app core.ICore, actionKey string, info *model.Info) (bool, string) {
+	if info.UserId() == "" || (rl.ExemptGods && info.IsGod()) {
+		return true, ""
+	}
+	userType := ""
+	app.ModifyState(true, func(trx trx.ITrx) error {
+		userType = string(trx.GetColumn("User", info.UserId(), "type"))
+		return nil
+	})
+	if userType == "" {
+		userType = "human"
+	}
+	type check struct {
+		scope string
+		key   string
+		limit Limit
+	}
+	checks := []check{}
+	if l, ok := rl.limitOf("action", actionKey); ok {
+		checks = append(checks, check{"action", "action::" + actionKey + "::" + info.UserId(), l})
+	}
+	if l, ok := rl.limitOf("user", userType); ok {
+		checks = append(checks, check{"user", "user::" + info.UserId(), l})
+	}
+	if info.PointId() != "" {
+		if l, ok := rl.limitOf("point", info.PointId()); ok {
+			checks = append(checks, check{"point", "point::" + info.PointId(), l})
+		}
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	now := time.Now()
+	buckets := make([]*bucket, len(checks))
+	for i, c := range checks {
+		buckets[i] = rl.refill(c.key, c.limit, now)
+		if buckets[i].tokens < 1 {
+			rl.rejections[c.scope+":"+actionKey]++
+			return false, c.scope
+		}
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, ""
+}
+
+// AllowConnection takes a token for an action call from the bucket of the
+// address it came from. It is what limits a call before its signature is
+// checked, as the user it claims to be cannot be trusted yet.
+func (rl *RateLimiter) AllowConnection(actionKey string, remote string) bool {
+	if remote == "" {
+		return true
+	}
+	limit, ok := rl.limitOf("conn", remote)
+	if !ok {
+		return true
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	b := rl.refill("conn::"+remote, limit, time.Now())
+	if b.tokens < 1 {
+		rl.rejections["conn:"+actionKey]++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Rejections returns how many calls were turned down, keyed by
+// "<scope>:<action key>".
+func (rl *RateLimiter) Rejections() map[string]int64 {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	result := map[string]int64{}
+	for k, v := range rl.rejections {
+		result[k] = v
+	}
+	return result
+}
+
+func (rl *RateLimiter) sweep() {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	now := time.Now()
+	for k, b := range rl.buckets {
+		if now.Sub(b.updated) > bucketIdleTimeout {
+			delete(rl.buckets, k)
+		}
+	}
+}
@@ -68,6 +68,13 @@ func (tw *TrxWrapper) Commit() {
 	}
 }
 
+// CommitChecked commits the transaction as it is. It fails when a key the
+// transaction read was changed by another one committed since, instead of
+// writing the changes over it like Commit does.
+func (tw *TrxWrapper) CommitChecked() error {
+	return tw.dbTrx.Commit()
+}
+
 func (tw *TrxWrapper) DelKey(key string) {
 	tw.dbTrx.Delete([]byte(key))
 	tw.Changes = append(tw.Changes, update.Update{Typ: "del", Key: string([]byte(key))})
@@ -1,7 +1,6 @@
 package module_core
 
 import (
-	"bytes"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
@@ -16,6 +15,7 @@ import (
 	"kasper/src/abstract/adapters/file"
 	"kasper/src/abstract/adapters/firectl"
 	"kasper/src/abstract/adapters/network"
+	"kasper/src/abstract/adapters/scheduler"
 	"kasper/src/abstract/adapters/security"
 	"kasper/src/abstract/adapters/signaler"
 	"kasper/src/abstract/adapters/storage"
@@ -32,6 +32,7 @@ import (
 	"kasper/src/abstract/models/worker"
 	"kasper/src/abstract/state"
 	actor "kasper/src/core/module/actor"
+	"kasper/src/core/module/actor/model/secured"
 	mainstate "kasper/src/core/module/actor/model/state"
 	module_trx "kasper/src/core/module/actor/model/trx"
 	mach_model "kasper/src/shell/api/model"
@@ -45,6 +46,7 @@ import (
 	driver_file "kasper/src/drivers/file"
 	driver_firectl "kasper/src/drivers/firectl"
 	driver_network "kasper/src/drivers/network"
+	driver_scheduler "kasper/src/drivers/scheduler"
 	driver_security "kasper/src/drivers/security"
 	driver_signaler "kasper/src/drivers/signaler"
 	driver_storage "kasper/src/drivers/storage"
@@ -54,28 +56,28 @@ import (
 
 	"log"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"os"
 
-	mathrand "math/rand"
 
 	cryp "crypto"
 	"crypto/rand"
 )
 
 type Tools struct {
-	security security.ISecurity
-	signaler signaler.ISignaler
-	storage  storage.IStorage
-	network  network.INetwork
-	file     file.IFile
-	wasm     wasm.IWasm
-	elpis    elpis.IElpis
-	docker   docker.IDocker
-	firectl  firectl.IFirectl
+	security  security.ISecurity
+	signaler  signaler.ISignaler
+	storage   storage.IStorage
+	network   network.INetwork
+	file      file.IFile
+	wasm      wasm.IWasm
+	elpis     elpis.IElpis
+	docker    docker.IDocker
+	firectl   firectl.IFirectl
+	scheduler scheduler.IScheduler
 }
 
 func (t *Tools) Security() security.ISecurity {
@@ -114,6 +116,10 @@ func (t *Tools) Firectl() firectl.IFirectl {
 	return t.firectl
 }
 
+func (t *Tools) Scheduler() scheduler.IScheduler {
+	return t.scheduler
+}
+
 type Core struct {
 	lock             sync.Mutex
 	triggerLock      sync.Mutex
@@ -126,15 +132,15 @@ type Core struct {
 	chain            chan any
 	chainCallbacks   map[string]*chain.ChainCallback
 	Ip               string
-	elections        []chain.Election
-	elecReg          bool
-	elecStarter      string
+	election         *chain.Election
 	elecStartTime    int64
 	executors        map[string]bool
 	appPendingTrxs   []*worker.Trx
 	actionStore      iaction.IActor
 	privKey          *rsa.PrivateKey
 	messageCallbacks map[string]*chain.MessageCallback
+	blockChanges     []update.Update
+	chainTime        atomic.Int64
 }
 
 var MAX_VALIDATOR_COUNT = 5
@@ -152,8 +158,7 @@ func NewCore(origin string, ownerId string, ownerPrivateKey *rsa.PrivateKey) *Co
 		chainCallbacks:   map[string]*chain.ChainCallback{},
 		messageCallbacks: map[string]*chain.MessageCallback{},
 		Ip:               id,
-		elections:        nil,
-		elecReg:          false,
+		election:         nil,
 		executors:        execs,
 		actionStore:      actor.NewActor(),
 		started:          false,
@@ -213,6 +218,37 @@ func (c *Core) ModifyState(readonly bool, fn func(trx.ITrx) error) {
 	err = fn(trx)
 }
 
+// ModifyStateChecked is ModifyState for writes decided on what fn read. It
+// returns the error of fn, or the conflict when what fn read was changed
+// before its writes were committed.
+func (c *Core) ModifyStateChecked(fn func(trx.ITrx) error) error {
+	trx := module_trx.NewTrx(c, c.Tools().Storage(), false)
+	if err := fn(trx); err != nil {
+		trx.Discard()
+		return err
+	}
+	return trx.CommitChecked()
+}
+
+// modifyChainState is ModifyState for the writes a block makes while it is
+// applied. What fn commits is kept with the block, so that the state root of
+// the block covers it.
+func (c *Core) modifyChainState(fn func(trx.ITrx) error) {
+	c.ModifyState(false, func(trx trx.ITrx) error {
+		if err := fn(trx); err != nil {
+			return err
+		}
+		c.blockChanges = append(c.blockChanges, trx.Updates()...)
+		return nil
+	})
+}
+
+// ChainTime is the consensus timestamp, in unix milliseconds, of the block
+// applied last. Actions run from the chain use it instead of the local clock.
+func (c *Core) ChainTime() int64 {
+	return c.chainTime.Load()
+}
+
 func (c *Core) Tools() tools.ITools {
 	return c.tools
 }
@@ -252,6 +288,53 @@ func (c *Core) AppPendingTrxs() {
 	c.appPendingTrxs = []*worker.Trx{}
 }
 
+// MachineSettled tells whether a machine has no request left that could still
+// change its state: none waiting to run and none waiting for its responses.
+// A frozen machine that is settled keeps the state it has on every node.
+func (c *Core) MachineSettled(machineId string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, trx := range c.appPendingTrxs {
+		if trx.MachineId == machineId {
+			return false
+		}
+	}
+	for _, callback := range c.chainCallbacks {
+		if callback.MachineId == machineId && callback.Settled == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// RunningRequest returns a committed request a machine is running on this
+// node, with the token it was sent with and the time of the block that
+// committed it, so what the machine spends or plants while running it is tied
+// to the request whatever the machine itself claims.
+func (c *Core) RunningRequest(machineId string, callbackId string) (chain.ChainCallback, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	callback, ok := c.chainCallbacks[callbackId]
+	if !ok || callback.MachineId != machineId || !callback.Executors[c.Ip] {
+		return chain.ChainCallback{}, false
+	}
+	return *callback, true
+}
+
+// RunningRequests returns the ids of the committed requests a machine is
+// running on this node that have not settled yet.
+func (c *Core) RunningRequests(machineId string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ids := []string{}
+	for id, callback := range c.chainCallbacks {
+		if callback.MachineId == machineId && callback.Executors[c.Ip] && callback.Settled == "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
 func (c *Core) ClearAppPendingTrxs() {
 	c.appPendingTrxs = []*worker.Trx{}
 }
@@ -304,7 +387,7 @@ func (c *Core) ExecAppletRequestOnChain(pointId string, machineId string, key st
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	callbackId := crypto.SecureUniqueString()
-	c.chainCallbacks[callbackId] = &chain.ChainCallback{Tag: tag, Fn: callback, Executors: map[string]bool{}, Responses: map[string]string{}}
+	c.chainCallbacks[callbackId] = &chain.ChainCallback{Tag: tag, Fn: callback, Executors: map[string]bool{}, Responses: map[string]string{}, MachineId: machineId, Deadline: c.callbackDeadline()}
 	var runtimeType string
 	c.ModifyState(true, func(trx trx.ITrx) error {
 		vm := mach_model.Vm{MachineId: machineId}.Pull(trx)
@@ -317,8 +400,15 @@ func (c *Core) ExecAppletRequestOnChain(pointId string, machineId string, key st
 }
 
 func (c *Core) ExecAppletResponseOnChain(callbackId string, packet []byte, signature string, resCode int, e string, updates []update.Update) {
+	usage := int64(0)
+	c.ModifyState(false, func(trx trx.ITrx) error {
+		meter := mach_model.RunUsage{RequestId: callbackId}
+		usage = meter.Cost(trx)
+		meter.Clear(trx)
+		return nil
+	})
 	future.Async(func() {
-		c.chain <- chain.ChainResponse{Signature: signature, Executor: c.id, RequestId: callbackId, ResCode: resCode, Err: e, Payload: packet, Effects: chain.Effects{DbUpdates: updates}}
+		c.chain <- chain.ChainResponse{Signature: signature, Executor: c.id, RequestId: callbackId, ResCode: resCode, Err: e, Payload: packet, Effects: chain.Effects{DbUpdates: updates}, Usage: usage}
 	}, false)
 }
 
@@ -326,7 +416,7 @@ func (c *Core) ExecBaseRequestOnChain(key string, payload []byte, signature stri
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	callbackId := crypto.SecureUniqueString()
-	c.chainCallbacks[callbackId] = &chain.ChainCallback{Tag: tag, Fn: callback, Executors: map[string]bool{}, Responses: map[string]string{}}
+	c.chainCallbacks[callbackId] = &chain.ChainCallback{Tag: tag, Fn: callback, Executors: map[string]bool{}, Responses: map[string]string{}, Deadline: c.callbackDeadline()}
 	future.Async(func() {
 		c.chain <- chain.ChainBaseRequest{Tag: tag, Signatures: []string{c.SignPacket(payload), signature}, Submitter: c.id, RequestId: callbackId, Author: "user::" + userId, Key: key, Payload: payload}
 	}, false)
@@ -353,50 +443,59 @@ func (c *Core) ExecBaseResponseOnChain(callbackId string, packet []byte, signatu
 	}, false)
 }
 
-func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
+// OnChainPacket applies a transaction of a committed block and returns the
+// machine it was addressed to along with every state change it committed.
+func (c *Core) OnChainPacket(block chain.Block, typ chain.TrxType, trxPayload []byte) (string, []update.Update) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	c.chainTime.Store(block.Timestamp * 1000)
+	machineId, committed := c.onChainPacket(block, typ, trxPayload)
+	committed = append(committed, c.blockChanges...)
+	c.blockChanges = nil
+	return machineId, committed
+}
+
+func (c *Core) onChainPacket(block chain.Block, typ chain.TrxType, trxPayload []byte) (string, []update.Update) {
+	committed := []update.Update{}
 	switch typ {
-	case "message":
+	case chain.TrxMessage:
 		{
 			packet := chain.ChainMessage{}
 			err := json.Unmarshal(trxPayload, &packet)
 			if err != nil {
 				log.Println(err)
-				return ""
-			}
-			if !slices.Contains(packet.Recievers, c.id) {
-				return ""
+				return "", committed
 			}
+			isReciever := slices.Contains(packet.Recievers, c.id)
 			if packet.Key == "genGlobalId" {
 				input := map[string]any{}
 				err := json.Unmarshal(packet.Payload, &input)
 				if err != nil {
 					log.Println(err)
-					return ""
+					return "", committed
 				}
 				pointIdRaw, ok := input["pointId"]
 				if !ok {
 					log.Println("pointId not set in chain message")
-					return ""
+					return "", committed
 				}
 				pointId, ok := pointIdRaw.(string)
 				if !ok {
 					log.Println("pointId in chain message is not string")
-					return ""
+					return "", committed
 				}
 				namespaceRaw, ok := input["namespace"]
 				if !ok {
 					log.Println("namespace not set in chain message")
-					return ""
+					return "", committed
 				}
 				namespace, ok := namespaceRaw.(string)
 				if !ok {
 					log.Println("namespace in chain message is not string")
-					return ""
+					return "", committed
 				}
 				var newValue int64
-				c.ModifyState(false, func(trx trx.ITrx) error {
+				c.modifyChainState(func(trx trx.ITrx) error {
 					val := trx.GetBytes(pointId + "::" + namespace)
 					if len(val) == 0 {
 						newValue = 0
@@ -409,6 +508,11 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 					trx.PutBytes(pointId+"::"+namespace, newVal)
 					return nil
 				})
+				// every node counts, so the counter is part of the state root
+				// everywhere, and only the recievers answer
+				if !isReciever {
+					return "", committed
+				}
 				res, _ := json.Marshal(map[string]any{
 					"globalId":  newValue,
 					"pointId":   pointId,
@@ -416,199 +520,47 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 				})
 				signature := c.SignPacketAsOwner(res)
 				c.SendMessageOnChain("globalIdGened", res, signature, c.ownerId, []string{packet.Submitter}, packet.RequestId, nil)
-			} else if packet.Key == "globalIdGened" {
+			} else if packet.Key == "globalIdGened" && isReciever {
 				cb, ok := c.messageCallbacks[packet.ReplyTo]
 				if !ok {
-					return ""
+					return "", committed
 				}
 				cb.Fn(packet.Key, packet.Payload)
 			}
 			break
 		}
-	case "election":
+	case chain.TrxElection:
 		{
 			packet := chain.ChainElectionPacket{}
 			err := json.Unmarshal(trxPayload, &packet)
 			if err != nil {
 				log.Println(err)
-				return ""
+				return "", committed
 			}
 			if packet.Key == "choose-validator" {
-				phaseRaw, ok := packet.Meta["phase"]
+				phase, ok := packet.Meta["phase"].(string)
 				if !ok {
-					return ""
-				}
-				phase, ok2 := phaseRaw.(string)
-				if !ok2 {
-					return ""
+					return "", committed
 				}
-				voterRaw, ok := packet.Meta["voter"]
+				voter, ok := packet.Meta["voter"].(string)
 				if !ok {
-					return ""
+					return "", committed
 				}
-				voter, ok2 := voterRaw.(string)
-				if !ok2 {
-					return ""
-				}
-				if phase == "start-reg" {
-					c.elecReg = true
-					c.elecStarter = voter
-					c.elecStartTime = time.Now().UnixMilli()
-					c.elections = []chain.Election{}
-					for i := 0; i < MAX_VALIDATOR_COUNT; i++ {
-						c.elections = append(c.elections, chain.Election{Participants: map[string]bool{}, Commits: map[string][]byte{}, Reveals: map[string]string{}})
-					}
-					future.Async(func() {
-						c.chain <- chain.ChainElectionPacket{
-							Type:    "election",
-							Key:     "choose-validator",
-							Meta:    map[string]any{"phase": "register", "voter": c.Ip},
-							Payload: []byte("{}"),
-						}
-					}, false)
-					if voter == c.Ip {
-						future.Async(func() {
-							time.Sleep(time.Duration(10) * time.Second)
-							c.chain <- chain.ChainElectionPacket{
-								Type:    "election",
-								Key:     "choose-validator",
-								Meta:    map[string]any{"phase": "end-reg", "voter": c.Ip},
-								Payload: []byte("{}"),
-							}
-						}, false)
-					}
-				} else if phase == "end-reg" {
-					if c.elections == nil {
-						return ""
-					}
-					if c.elecStarter == voter && ((time.Now().UnixMilli() - c.elecStartTime) > 8000) {
-						c.elecReg = false
-						payload := [][]byte{}
-						nodeCount := len(c.tools.Network().Chain().Peers())
-						hasher := sha256.New()
-						for i := 0; i < MAX_VALIDATOR_COUNT; i++ {
-							r := fmt.Sprintf("%d", mathrand.Intn(nodeCount))
-							c.elections[i].MyNum = r
-							hasher.Write([]byte(r))
-							bs := hasher.Sum(nil)
-							payload = append(payload, bs)
-						}
-						data, _ := json.Marshal(payload)
-						future.Async(func() {
-							c.chain <- chain.ChainElectionPacket{
-								Type:    "election",
-								Key:     "choose-validator",
-								Meta:    map[string]any{"phase": "commit", "voter": c.Ip},
-								Payload: data,
-							}
-						}, false)
-					}
-				} else if phase == "register" {
-					if c.elections == nil {
-						return ""
-					}
-					if c.elecReg {
-						for i := 0; i < MAX_VALIDATOR_COUNT; i++ {
-							c.elections[i].Participants[voter] = true
-						}
-					}
-				} else if phase == "commit" {
-					if c.elections == nil {
-						return ""
-					}
-					votes := [][]byte{}
-					e := json.Unmarshal(packet.Payload, &votes)
-					if e != nil {
-						return ""
-					}
-					if len(votes) < MAX_VALIDATOR_COUNT {
-						return ""
-					}
-					if c.elections[0].Participants[voter] {
-						for i := 0; i < min(MAX_VALIDATOR_COUNT, len(c.tools.Network().Chain().Peers())); i++ {
-							c.elections[i].Commits[voter] = votes[i]
-						}
-						if len(c.elections[0].Commits) == len(c.elections[0].Participants) {
-							myReveals := []string{}
-							for i := 0; i < MAX_VALIDATOR_COUNT; i++ {
-								myReveals = append(myReveals, c.elections[i].MyNum)
-							}
-							data, _ := json.Marshal(myReveals)
-							future.Async(func() {
-								c.chain <- chain.ChainElectionPacket{
-									Type:    "election",
-									Key:     "choose-validator",
-									Meta:    map[string]any{"phase": "reveal", "voter": c.Ip},
-									Payload: data,
-								}
-							}, false)
-						}
-					}
-				} else if phase == "reveal" {
-					if c.elections == nil {
-						return ""
-					}
-					votes := []string{}
-					e := json.Unmarshal(packet.Payload, &votes)
-					if e != nil {
-						return ""
-					}
-					if len(votes) < MAX_VALIDATOR_COUNT {
-						return ""
-					}
-					if c.elections[0].Participants[voter] {
-						for i := 0; i < min(MAX_VALIDATOR_COUNT, len(c.tools.Network().Chain().Peers())); i++ {
-							c.elections[i].Reveals[voter] = votes[i]
-						}
-						if len(c.elections[0].Reveals) == len(c.elections[0].Participants) {
-							c.executors = map[string]bool{}
-							nodesArr := []string{}
-							for p := range c.elections[0].Participants {
-								nodesArr = append(nodesArr, p)
-							}
-							sort.Strings(nodesArr)
-							for _, elec := range c.elections[0:min(MAX_VALIDATOR_COUNT, len(nodesArr))] {
-								res := -1
-								first := true
-								for v := range elec.Participants {
-									hasher := sha256.New()
-									commit := elec.Commits[v]
-									reveal := elec.Reveals[v]
-									hasher.Write([]byte(reveal))
-									bs := hasher.Sum(nil)
-									if !bytes.Equal(bs, commit) {
-										continue
-									}
-									num, e := strconv.ParseInt(reveal, 10, 32)
-									if e != nil {
-										continue
-									}
-									if first {
-										first = false
-										res = int(num)
-									} else {
-										res ^= int(num)
-									}
-								}
-								result := res % len(nodesArr)
-								candidate := nodesArr[result]
-								c.executors[candidate] = true
-								nodesArr = append(nodesArr[:result], nodesArr[result+1:]...)
-								c.elections = nil
-							}
-						}
-					}
+				if err := c.verifyElectionPacket(phase, voter, packet.Payload, packet.Signature); err != nil {
+					log.Println("election packet of", voter, "rejected:", err)
+					return "", committed
 				}
+				c.onElectionPacket(phase, voter, packet.Payload)
 			}
 			break
 		}
-	case "baseRequest":
+	case chain.TrxBaseRequest:
 		{
 			packet := chain.ChainBaseRequest{}
 			err := json.Unmarshal(trxPayload, &packet)
 			if err != nil {
 				log.Println(err)
-				return ""
+				return "", committed
 			}
 			execs := map[string]bool{}
 			for k, v := range c.executors {
@@ -616,11 +568,12 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 			}
 			if packet.Submitter == c.id {
 				c.chainCallbacks[packet.RequestId].Executors = execs
+				c.chainCallbacks[packet.RequestId].Deadline = c.callbackDeadline()
 			} else {
-				c.chainCallbacks[packet.RequestId] = &chain.ChainCallback{Fn: nil, Executors: execs, Responses: map[string]string{}}
+				c.chainCallbacks[packet.RequestId] = &chain.ChainCallback{Fn: nil, Executors: execs, Responses: map[string]string{}, Deadline: c.callbackDeadline()}
 			}
 			if !c.executors[c.Ip] {
-				return ""
+				return "", committed
 			}
 			userId := ""
 			if strings.HasPrefix(packet.Author, "user::") {
@@ -628,7 +581,7 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 			}
 			action := c.actionStore.FetchAction(packet.Key)
 			if action == nil {
-				return ""
+				return "", committed
 			}
 			var input input.IInput
 			i, err2 := action.(iaction.ISecureAction).ParseInput("chain", packet.Payload)
@@ -637,69 +590,103 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 				errText := "input parsing error"
 				signature := c.SignPacket([]byte(errText))
 				c.ExecBaseResponseOnChain(packet.RequestId, []byte{}, signature, 400, errText, []update.Update{}, packet.Tag, userId)
-				return ""
+				return "", committed
 			}
 			input = i
 			action.(iaction.ISecureAction).SecurlyActChain(userId, packet.RequestId, packet.Payload, packet.Signatures[1], input, packet.Submitter, packet.Tag)
 			break
 		}
-	case "appRequest":
+	case chain.TrxAppRequest:
 		{
 			packet := chain.ChainAppletRequest{}
 			err := json.Unmarshal(trxPayload, &packet)
 			if err != nil {
 				log.Println(err)
-				return ""
+				return "", committed
 			}
 			execs := map[string]bool{}
 			for k, v := range c.executors {
 				execs[k] = v
 			}
-			if packet.Submitter == c.id {
-				c.chainCallbacks[packet.RequestId].Executors = execs
-			} else {
-				c.chainCallbacks[packet.RequestId] = &chain.ChainCallback{Fn: nil, Executors: execs, Responses: map[string]string{}}
+			// a machine frozen for a migration takes no more requests on this
+			// shard, its submitter sends them again to where it is moving
+			if c.tools.Network().Chain().MachineFrozen(block.ShardId, packet.MachineId) {
+				if packet.Submitter == c.id {
+					future.Async(func() {
+						c.tools.Network().Chain().SubmitTrx("main", packet.MachineId, chain.TrxAppRequest, trxPayload)
+					}, false)
+				}
+				return "", committed
 			}
-			if !c.executors[c.Ip] {
-				return ""
+			// a wasm machine is run by the executors of a single runtime, told
+			// by the machine on chain rather than by the request
+			c.ModifyState(true, func(trx trx.ITrx) error {
+				if (mach_model.Vm{MachineId: packet.MachineId}).Pull(trx).Runtime == "wasm" {
+					execs = runtimeExecutors(trx, execs)
+				}
+				return nil
+			})
+			if len(execs) < len(c.executors) {
+				c.openTally(packet.RequestId, execs)
 			}
 			userId := ""
 			if strings.HasPrefix(packet.Author, "user::") {
 				userId = packet.Author[len("user::"):]
 			}
-			c.appPendingTrxs = append(c.appPendingTrxs, &worker.Trx{CallbackId: packet.RequestId, Runtime: packet.Runtime, UserId: userId, MachineId: packet.MachineId, Key: packet.Key, Payload: string(packet.Payload)})
-			return packet.MachineId
+			if packet.Submitter == c.id {
+				c.chainCallbacks[packet.RequestId].Executors = execs
+				c.chainCallbacks[packet.RequestId].Deadline = c.callbackDeadline()
+			} else {
+				c.chainCallbacks[packet.RequestId] = &chain.ChainCallback{Fn: nil, Executors: execs, Responses: map[string]string{}, MachineId: packet.MachineId, Deadline: c.callbackDeadline()}
+			}
+			c.chainCallbacks[packet.RequestId].BlockTime = c.chainTime.Load()
+			if packet.TokenId != "" {
+				c.chainCallbacks[packet.RequestId].TokenOwnerId = userId
+				c.chainCallbacks[packet.RequestId].TokenId = packet.TokenId
+			}
+			// every node of the shard counts the request towards the load of
+			// the machine, executor or not
+			if !execs[c.Ip] {
+				return packet.MachineId, committed
+			}
+			c.appPendingTrxs = append(c.appPendingTrxs, &worker.Trx{CallbackId: packet.RequestId, Runtime: packet.Runtime, UserId: userId, MachineId: packet.MachineId, Key: packet.Key, Payload: string(packet.Payload), TokenId: packet.TokenId})
+			return packet.MachineId, committed
 		}
-	case "response":
+	case chain.TrxResponse:
 		{
 			packet := chain.ChainResponse{}
 			err := json.Unmarshal(trxPayload, &packet)
 			if err != nil {
 				log.Println(err)
-				return ""
+				return "", committed
 			}
+			usage := c.tallyResponse(packet)
 			callback, ok3 := c.chainCallbacks[packet.RequestId]
 			if ok3 {
 				if !callback.Executors[packet.Executor] {
-					return ""
+					return "", committed
+				}
+				if _, answered := callback.Responses[packet.Executor]; answered {
+					return "", committed
 				}
 				str, _ := json.Marshal(core.ResponseHolder{Payload: packet.Payload, Effects: packet.Effects})
 				callback.Responses[packet.Executor] = string(str)
-				if len(callback.Responses) < len(callback.Executors) {
-					return ""
+				if callback.Settled != "" {
+					if len(callback.Responses) == len(callback.Executors) {
+						delete(c.chainCallbacks, packet.RequestId)
+					}
+					return "", committed
 				}
-				temp := ""
+				agreed := 0
 				for _, res := range callback.Responses {
-					if temp == "" {
-						temp = res
-					} else if res != temp {
-						temp = ""
-						break
+					if res == string(str) {
+						agreed++
 					}
 				}
-				if temp == "" {
-					return ""
+				if agreed < responseQuorum(len(callback.Executors)) {
+					return "", committed
 				}
+				callback.Settled = string(str)
 
 				kvTokenKeyword := "consumeToken: "
 				kvstoreKeyword := "applet: "
@@ -711,7 +698,7 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 							log.Println(e)
 							break
 						}
-						c.ModifyState(false, func(trx trx.ITrx) error {
+						c.modifyChainState(func(trx trx.ITrx) error {
 							user := mach_model.User{Id: tokenData.TokenOwnerId}.Pull(trx)
 							if user.Balance < tokenData.Amount {
 								err := errors.New("your balance is not enough")
@@ -728,14 +715,17 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 									return err
 								}
 								if amount >= tokenData.Amount {
+									// the container runs the quorum reported are charged on
+									// top of what the machine asked for, up to the lock
+									charge := min(tokenData.Amount+usage, amount)
 									for _, orig := range validators {
 										nodeOwnerId := c.tools.Network().Chain().GetNodeOwnerId(orig)
 										toUser := mach_model.User{Id: nodeOwnerId}.Pull(trx)
-										toUser.Balance += int64(math.Floor(float64(tokenData.Amount) / float64(len(validators))))
+										toUser.Balance += int64(math.Floor(float64(charge) / float64(len(validators))))
 										toUser.Push(trx)
 										trx.DelJson("Json::User::"+tokenData.TokenOwnerId, "lockedTokens."+tokenData.TokenId)
 									}
-									user.Balance += (amount - tokenData.Amount)
+									user.Balance += (amount - charge)
 									user.Push(trx)
 									return nil
 								} else {
@@ -754,6 +744,12 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 					}
 				}
 
+				for _, ef := range packet.Effects.DbUpdates {
+					if ef.Key != "" {
+						committed = append(committed, ef)
+					}
+				}
+
 				if !callback.Executors[c.Ip] {
 					c.ModifyState(false, func(trx trx.ITrx) error {
 						for _, ef := range packet.Effects.DbUpdates {
@@ -768,10 +764,14 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 						return nil
 					})
 				}
-				delete(c.chainCallbacks, packet.RequestId)
-				if callback.Fn != nil {
+				if len(callback.Responses) == len(callback.Executors) {
+					delete(c.chainCallbacks, packet.RequestId)
+				}
+				fn := callback.Fn
+				callback.Fn = nil
+				if fn != nil {
 					if packet.Err == "" {
-						callback.Fn(packet.Payload, packet.ResCode, nil)
+						fn(packet.Payload, packet.ResCode, nil)
 						tempCount := int32(0)
 						targetCount := int32(-1)
 						keys := []string{}
@@ -827,7 +827,7 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 								b, e := json.Marshal(input)
 								if e != nil {
 									log.Println(e)
-									return ""
+									return "", committed
 								}
 								future.Async(func() {
 									c.tools.Wasm().RunVm(packet.ToUserId, pointIds[i], string(b))
@@ -835,20 +835,22 @@ func (c *Core) OnChainPacket(typ string, trxPayload []byte) string {
 							}
 						}
 					} else {
-						callback.Fn(packet.Payload, packet.ResCode, errors.New(packet.Err))
+						fn(packet.Payload, packet.ResCode, errors.New(packet.Err))
 					}
 				}
 			}
 			break
 		}
 	}
-	return ""
+	return "", committed
 }
 
 func (c *Core) Close() {
+	c.tools.Scheduler().Close()
 	c.tools.Network().Chain().Close()
 	c.tools.Storage().KvDb().Close()
-	c.tools.Storage().TsDb().Close()
+	c.tools.Storage().LogStore().Close()
+	c.tools.Storage().Searcher().Close()
 	c.tools.Wasm().CloseKVDB()
 }
 
@@ -867,7 +869,7 @@ func (c *Core) Load(gods []string, args map[string]interface{}) {
 
 	dnFederation := driver_network_fed.FirstStageBackFill(c)
 	dstorage := driver_storage.NewStorage(c, sroot, bdbPath, ldbPath, srchPath)
-	dsignaler := driver_signaler.NewSignaler(c, dnFederation)
+	dsignaler := driver_signaler.NewSignaler(c, dstorage, dnFederation)
 	dsecurity := driver_security.New(c, sroot, dstorage, dsignaler)
 	dNetwork := driver_network.NewNetwork(c, dstorage, dsecurity, dsignaler, dnFederation)
 	dFile := driver_file.NewFileTool(sroot)
@@ -876,6 +878,7 @@ func (c *Core) Load(gods []string, args map[string]interface{}) {
 	dElpis := driver_elpis.NewElpis(c, sroot, dstorage)
 	dnFederation.SecondStageForFill(dstorage, dFile, dsignaler)
 	dFirectl := driver_firectl.NewFireCtl()
+	dScheduler := driver_scheduler.NewScheduler(c, dstorage, dNetwork)
 
 	pemData := dsecurity.FetchKeyPair("server_key")[0]
 	block, _ := pem.Decode([]byte(pemData))
@@ -889,77 +892,82 @@ func (c *Core) Load(gods []string, args map[string]interface{}) {
 	c.privKey = privateKey.(*rsa.PrivateKey)
 
 	c.tools = &Tools{
-		signaler: dsignaler,
-		storage:  dstorage,
-		security: dsecurity,
-		network:  dNetwork,
-		file:     dFile,
-		docker:   dDocker,
-		firectl:  dFirectl,
-		wasm:     dWasm,
-		elpis:    dElpis,
+		signaler:  dsignaler,
+		storage:   dstorage,
+		security:  dsecurity,
+		network:   dNetwork,
+		file:      dFile,
+		docker:    dDocker,
+		firectl:   dFirectl,
+		wasm:      dWasm,
+		elpis:     dElpis,
+		scheduler: dScheduler,
 	}
+	c.loadElection()
+	secured.Limiter.Start()
 
-	c.tools.Network().Chain().RegisterPipeline(func(b [][]byte, insiderCb func([]byte)) []string {
+	c.tools.Network().Chain().RegisterPipeline(func(block chain.Block, b []chain.Envelope, insiderCb func(chain.Envelope) []update.Update) ([]string, [][]update.Update) {
 		machineIds := []string{}
-		for _, trx := range b {
-			firstIndex := strings.Index(string(trx), "::")
-			log.Println(string(trx))
-			typ := string(trx[:firstIndex])
-			if typ == "nodeJoined" {
-				insiderCb(trx)
-			} else if typ == ("sharderMap|" + c.id) {
-				insiderCb(trx)
+		effects := make([][]update.Update, len(b))
+		for i, trx := range b {
+			log.Println(trx.Type, trx.Signer, string(trx.Payload))
+			if trx.Type.Insider() {
+				effects[i] = insiderCb(trx)
 			} else {
-				r := c.OnChainPacket(typ, trx[firstIndex+2:])
+				r, committed := c.OnChainPacket(block, trx.Type, trx.Payload)
 				if r != "" {
 					machineIds = append(machineIds, r)
 				}
+				effects[i] = committed
 			}
 		}
 		c.AppPendingTrxs()
-		return machineIds
+		c.expireCallbacks()
+		if len(b) > 0 {
+			effects[len(b)-1] = append(effects[len(b)-1], c.expireTallies()...)
+		}
+		return machineIds, effects
 	})
 
 	c.chain = make(chan any, 1)
 	future.Async(func() {
 		for {
 			op := <-c.chain
-			typ := ""
+			typ := chain.TrxUnknown
 			machineId := ""
 			switch opData := op.(type) {
 			case chain.ChainBaseRequest:
 				{
-					typ = "baseRequest"
+					typ = chain.TrxBaseRequest
 					break
 				}
 			case chain.ChainResponse:
 				{
-					typ = "response"
+					typ = chain.TrxResponse
 					break
 				}
 			case chain.ChainAppletRequest:
 				{
-					typ = "appRequest"
+					typ = chain.TrxAppRequest
 					machineId = opData.MachineId
 					break
 				}
 			case chain.ChainElectionPacket:
 				{
-					typ = "election"
+					typ = chain.TrxElection
 					break
 				}
 			case chain.ChainMessage:
 				{
-					typ = "message"
+					typ = chain.TrxMessage
 					break
 				}
 			}
-			if typ != "" {
+			if typ != chain.TrxUnknown {
 				serialized, err := json.Marshal(op)
 				if err == nil {
 					log.Println(string(serialized))
-					c.tools.Network().Chain().SubmitTrx("main", machineId, typ, []byte(typ+"::"+string(serialized)))
+					c.tools.Network().Chain().SubmitTrx("main", machineId, typ, serialized)
 				} else {
 					log.Println(err)
 				}
@@ -988,15 +996,5 @@ func (c *Core) Load(gods []string, args map[string]interface{}) {
 }
 
 func (c *Core) DoElection() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.elecReg = true
-	future.Async(func() {
-		c.chain <- chain.ChainElectionPacket{
-			Type:    "election",
-			Key:     "choose-validator",
-			Meta:    map[string]any{"phase": "start-reg", "voter": c.Ip},
-			Payload: []byte("{}"),
-		}
-	}, false)
+	c.sendElectionPacket("start-reg", []byte("{}"))
 }
@@ -0,0 +1,24 @@
+package module_core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"kasper/src/abstract/models/chain"
+	"testing"
+)
+
+func TestGlobalIdCountedOnEveryNode(t *testing.T) {
+	c := newTestCore(t, "a")
+	c.id = "node-a"
+	input, _ := json.Marshal(map[string]any{"pointId": "p1", "namespace": "msg"})
+	packet, _ := json.Marshal(chain.ChainMessage{Key: "genGlobalId", Payload: input, Recievers: []string{"node-b"}})
+	for i := 0; i < 2; i++ {
+		_, committed := c.OnChainPacket(chain.Block{}, chain.TrxMessage, packet)
+		if len(committed) != 1 || committed[0].Key != "p1::msg" {
+			t.Fatalf("counter not committed with the block: %v", committed)
+		}
+		if got := binary.LittleEndian.Uint64(committed[0].Val); got != uint64(i) {
+			t.Fatalf("counter is %d, want %d", got, i)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package module_core
+
+import (
+	"bytes"
+	cryp "crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kasper/src/abstract/models/chain"
+	"kasper/src/abstract/models/trx"
+	mach_model "kasper/src/shell/api/model"
+	"kasper/src/shell/utils/crypto"
+	"kasper/src/shell/utils/future"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// electionPhaseTimeout is how long each phase of an election runs, in block
+// time.
+func electionPhaseTimeout() time.Duration {
+	if v, err := strconv.ParseInt(os.Getenv("ELECTION_PHASE_TIMEOUT"), 10, 64); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// electionPenaltyEpochs is how many epochs a participant that never revealed
+// is barred for.
+func electionPenaltyEpochs() uint64 {
+	if v, err := strconv.ParseUint(os.Getenv("ELECTION_PENALTY_EPOCHS"), 10, 64); err == nil {
+		return v
+	}
+	return 3
+}
+
+func electionMessage(epoch uint64, seed string) []byte {
+	return []byte(fmt.Sprintf("election::%d::%s", epoch, seed))
+}
+
+func electionSeed(prevSeed string, reveals map[string][]byte) string {
+	voters := make([]string, 0, len(reveals))
+	for voter := range reveals {
+		voters = append(voters, voter)
+	}
+	sort.Strings(voters)
+	hasher := sha256.New()
+	hasher.Write([]byte(prevSeed))
+	for _, voter := range voters {
+		output := sha256.Sum256(reveals[voter])
+		hasher.Write([]byte(voter))
+		hasher.Write(output[:])
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func pickExecutors(seed string, candidates []string) []string {
+	rest := slices.Clone(candidates)
+	sort.Strings(rest)
+	count := min(MAX_VALIDATOR_COUNT, len(rest))
+	picked := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		h := sha256.Sum256([]byte(fmt.Sprintf("%s::%d", seed, i)))
+		index := int(binary.BigEndian.Uint64(h[:8]) % uint64(len(rest)))
+		picked = append(picked, rest[index])
+		rest = append(rest[:index], rest[index+1:]...)
+	}
+	return picked
+}
+
+func electionPacketMessage(phase string, voter string, payload []byte) []byte {
+	return append([]byte(fmt.Sprintf("electionPacket::%s::%s::", phase, voter)), payload...)
+}
+
+// nodeKey returns the server key a node registered on chain, looked up by its
+// origin or its ip address.
+func nodeKey(trx trx.ITrx, voter string) string {
+	node, _ := mach_model.Node{Origin: voter}.Resolve(trx)
+	return node.PublicKey
+}
+
+// verifyElectionPacket checks that an election packet was signed by the node
+// it names as voter, with the key that node registered.
+func (c *Core) verifyElectionPacket(phase string, voter string, payload []byte, signature string) error {
+	key := ""
+	c.ModifyState(true, func(trx trx.ITrx) error {
+		key = nodeKey(trx, voter)
+		return nil
+	})
+	if key == "" {
+		return errors.New("voter is not a registered node")
+	}
+	return crypto.VerifySignature([]byte(key), electionPacketMessage(phase, voter, payload), signature)
+}
+
+func verifyElectionReveal(publicKey string, epoch uint64, seed string, signature []byte) error {
+	rsaKey, err := crypto.DecodePublicKey([]byte(publicKey))
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(electionMessage(epoch, seed))
+	return rsa.VerifyPKCS1v15(rsaKey, cryp.SHA256, hash[:], signature)
+}
+
+// AuditElection recomputes the seed and the executors of an election result
+// from its reveals, checking every reveal against the key its voter registered
+// on chain.
+func AuditElection(trx trx.ITrx, result chain.ElectionResult) error {
+	reveals := map[string][]byte{}
+	for voter, encoded := range result.Reveals {
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		if err := verifyElectionReveal(nodeKey(trx, voter), result.Epoch, result.PrevSeed, signature); err != nil {
+			return fmt.Errorf("reveal of %s: %w", voter, err)
+		}
+		reveals[voter] = signature
+	}
+	if electionSeed(result.PrevSeed, reveals) != result.Seed {
+		return errors.New("election seed does not match the reveals")
+	}
+	candidates := make([]string, 0, len(reveals))
+	for voter := range reveals {
+		if !slices.Contains(result.Excluded, voter) {
+			candidates = append(candidates, voter)
+		}
+	}
+	if !slices.Equal(pickExecutors(result.Seed, candidates), result.Executors) {
+		return errors.New("election executors do not match the seed")
+	}
+	return nil
+}
+
+func latestElection(trx trx.ITrx) (chain.ElectionResult, bool) {
+	result := chain.ElectionResult{}
+	data := trx.GetBytes("election::latest")
+	if len(data) == 0 {
+		return result, false
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		log.Println(err)
+		return result, false
+	}
+	return result, true
+}
+
+func penalisedUntil(trx trx.ITrx, voter string) (uint64, bool) {
+	data := trx.GetBytes("election::penalty::" + voter)
+	if len(data) < 8 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(data), true
+}
+
+// loadElection restores the executors of the latest epoch after a restart.
+func (c *Core) loadElection() {
+	c.ModifyState(true, func(trx trx.ITrx) error {
+		result, ok := latestElection(trx)
+		if !ok {
+			return nil
+		}
+		if err := AuditElection(trx, result); err != nil {
+			log.Println("stored election of epoch", result.Epoch, "failed audit:", err)
+			return nil
+		}
+		execs := map[string]bool{}
+		for _, e := range result.Executors {
+			execs[e] = true
+		}
+		c.executors = execs
+		return nil
+	})
+}
+
+func (c *Core) sendElectionPacket(phase string, payload []byte) {
+	future.Async(func() {
+		c.chain <- chain.ChainElectionPacket{
+			Type:      "election",
+			Key:       "choose-validator",
+			Meta:      map[string]any{"phase": phase, "voter": c.Ip},
+			Payload:   payload,
+			Signature: c.SignPacket(electionPacketMessage(phase, c.Ip, payload)),
+		}
+	}, false)
+}
+
+func (c *Core) sendElectionPacketLater(phase string, delay time.Duration) {
+	future.Async(func() {
+		time.Sleep(delay)
+		c.sendElectionPacket(phase, []byte("{}"))
+	}, false)
+}
+
+func (c *Core) onElectionPacket(phase string, voter string, payload []byte) {
+	if phase == "start-reg" {
+		if c.election != nil && c.ChainTime()-c.elecStartTime < 4*electionPhaseTimeout().Milliseconds() {
+			return
+		}
+		c.election = &chain.Election{Starter: voter, Phase: "reg", Participants: map[string]string{}, Commits: map[string][]byte{}, Reveals: map[string][]byte{}}
+		c.ModifyState(true, func(trx trx.ITrx) error {
+			if latest, ok := latestElection(trx); ok {
+				c.election.Epoch = latest.Epoch + 1
+				c.election.Seed = latest.Seed
+			}
+			return nil
+		})
+		c.elecStartTime = c.ChainTime()
+		c.sendElectionPacket("register", []byte("{}"))
+		if voter == c.Ip {
+			c.sendElectionPacketLater("end-reg", electionPhaseTimeout())
+		}
+		return
+	}
+	elec := c.election
+	if elec == nil {
+		return
+	}
+	switch phase {
+	case "register":
+		if elec.Phase != "reg" {
+			return
+		}
+		banned := false
+		c.ModifyState(true, func(trx trx.ITrx) error {
+			until, ok := penalisedUntil(trx, voter)
+			banned = ok && until >= elec.Epoch
+			return nil
+		})
+		if banned {
+			return
+		}
+		if _, registered := elec.Participants[voter]; registered {
+			return
+		}
+		key := ""
+		c.ModifyState(true, func(trx trx.ITrx) error {
+			key = nodeKey(trx, voter)
+			return nil
+		})
+		elec.Participants[voter] = key
+	case "end-reg":
+		if elec.Phase != "reg" || voter != elec.Starter {
+			return
+		}
+		elec.Phase = "commit"
+		if _, ok := elec.Participants[c.Ip]; ok {
+			hash := sha256.Sum256(electionMessage(elec.Epoch, elec.Seed))
+			signature, err := rsa.SignPKCS1v15(nil, c.privKey, cryp.SHA256, hash[:])
+			if err != nil {
+				log.Println(err)
+			} else {
+				elec.MyReveal = signature
+				commit := sha256.Sum256(signature)
+				c.sendElectionPacket("commit", commit[:])
+			}
+		}
+		if voter == c.Ip {
+			c.sendElectionPacketLater("end-commit", electionPhaseTimeout())
+			c.sendElectionPacketLater("end-reveal", 2*electionPhaseTimeout())
+		}
+	case "commit":
+		if elec.Phase != "commit" || len(payload) != sha256.Size {
+			return
+		}
+		if _, ok := elec.Participants[voter]; !ok {
+			return
+		}
+		elec.Commits[voter] = payload
+		if len(elec.Commits) == len(elec.Participants) {
+			c.startReveal()
+		}
+	case "end-commit":
+		if elec.Phase == "commit" && voter == elec.Starter {
+			c.startReveal()
+		}
+	case "reveal":
+		if elec.Phase != "reveal" {
+			return
+		}
+		commit, ok := elec.Commits[voter]
+		if !ok {
+			return
+		}
+		if _, done := elec.Reveals[voter]; done {
+			return
+		}
+		output := sha256.Sum256(payload)
+		if !bytes.Equal(output[:], commit) {
+			log.Println("election reveal of", voter, "does not match its commit")
+			return
+		}
+		if err := verifyElectionReveal(elec.Participants[voter], elec.Epoch, elec.Seed, payload); err != nil {
+			log.Println("election reveal of", voter, "rejected:", err)
+			return
+		}
+		elec.Reveals[voter] = payload
+		if len(elec.Reveals) == len(elec.Commits) {
+			c.finishElection()
+		}
+	case "end-reveal":
+		if elec.Phase == "reveal" && voter == elec.Starter {
+			c.finishElection()
+		}
+	}
+}
+
+func (c *Core) startReveal() {
+	elec := c.election
+	elec.Phase = "reveal"
+	if _, ok := elec.Commits[c.Ip]; ok {
+		c.sendElectionPacket("reveal", elec.MyReveal)
+	}
+}
+
+func (c *Core) finishElection() {
+	elec := c.election
+	c.election = nil
+	result := chain.ElectionResult{
+		Epoch:     elec.Epoch,
+		PrevSeed:  elec.Seed,
+		Reveals:   map[string]string{},
+		Penalised: []string{},
+		Excluded:  []string{},
+	}
+	candidates := []string{}
+	for voter, signature := range elec.Reveals {
+		result.Reveals[voter] = base64.StdEncoding.EncodeToString(signature)
+		candidates = append(candidates, voter)
+	}
+	sort.Strings(candidates)
+	c.ModifyState(true, func(trx trx.ITrx) error {
+		for _, voter := range candidates {
+			if divergentResponses(trx, elec.Epoch, voter) > maxDivergentResponses() {
+				result.Excluded = append(result.Excluded, voter)
+			}
+		}
+		return nil
+	})
+	if len(result.Excluded) == len(candidates) {
+		result.Excluded = []string{}
+	}
+	for voter := range elec.Participants {
+		if _, ok := elec.Reveals[voter]; !ok {
+			result.Penalised = append(result.Penalised, voter)
+		}
+	}
+	sort.Strings(result.Penalised)
+	c.modifyChainState(func(trx trx.ITrx) error {
+		until := make([]byte, 8)
+		binary.LittleEndian.PutUint64(until, elec.Epoch+electionPenaltyEpochs())
+		for _, voter := range result.Penalised {
+			trx.PutBytes("election::penalty::"+voter, until)
+		}
+		return nil
+	})
+	if len(candidates) == 0 {
+		log.Println("election of epoch", elec.Epoch, "ended without reveals")
+		return
+	}
+	result.Seed = electionSeed(elec.Seed, elec.Reveals)
+	drawn := []string{}
+	for _, voter := range candidates {
+		if !slices.Contains(result.Excluded, voter) {
+			drawn = append(drawn, voter)
+		}
+	}
+	result.Executors = pickExecutors(result.Seed, drawn)
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c.modifyChainState(func(trx trx.ITrx) error {
+		trx.PutBytes(fmt.Sprintf("election::result::%d", result.Epoch), data)
+		trx.PutBytes("election::latest", data)
+		return nil
+	})
+	execs := map[string]bool{}
+	for _, e := range result.Executors {
+		execs[e] = true
+	}
+	c.executors = execs
+}
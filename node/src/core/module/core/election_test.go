@@ -0,0 +1,266 @@
+package module_core
+
+import (
+	cryp "crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"kasper/src/abstract/adapters/storage"
+	"kasper/src/abstract/models/chain"
+	"kasper/src/abstract/models/trx"
+	mach_model "kasper/src/shell/api/model"
+	"kasper/src/shell/utils/crypto"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+type testStorage struct {
+	storage.IStorage
+	db *badger.DB
+}
+
+func (s testStorage) KvDb() *badger.DB {
+	return s.db
+}
+
+// newTestCore is a core running as node ip, over a fresh state holding the
+// given registered nodes.
+func newTestCore(t *testing.T, ip string, nodes ...mach_model.Node) *Core {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	c := &Core{
+		Ip:             ip,
+		tools:          &Tools{storage: testStorage{db: db}},
+		chain:          make(chan any, 100),
+		chainCallbacks: map[string]*chain.ChainCallback{},
+		executors:      map[string]bool{},
+	}
+	c.ModifyState(false, func(trx trx.ITrx) error {
+		for _, node := range nodes {
+			node.Push(trx)
+		}
+		return nil
+	})
+	return c
+}
+
+type testVoter struct {
+	node mach_model.Node
+	key  *rsa.PrivateKey
+}
+
+func newTestVoters(names ...string) []testVoter {
+	voters := []testVoter{}
+	for _, name := range names {
+		priv, pub := crypto.SecureKeyPairs("")
+		voters = append(voters, testVoter{
+			node: mach_model.Node{Origin: name, OwnerId: "owner", PublicKey: string(pub)},
+			key:  crypto.ParsePrivateKey(priv),
+		})
+	}
+	return voters
+}
+
+func (v testVoter) reveal(t *testing.T, epoch uint64, seed string) []byte {
+	hash := sha256.Sum256(electionMessage(epoch, seed))
+	signature, err := rsa.SignPKCS1v15(nil, v.key, cryp.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return signature
+}
+
+func latestOf(c *Core) (chain.ElectionResult, bool) {
+	var result chain.ElectionResult
+	found := false
+	c.ModifyState(true, func(trx trx.ITrx) error {
+		result, found = latestElection(trx)
+		return nil
+	})
+	return result, found
+}
+
+// runElection runs an election from the side of the core, with the voters
+// that reveal registering, committing and revealing, and the ones in
+// withholding registering and committing only.
+func runElection(t *testing.T, c *Core, revealing []testVoter, withholding []testVoter) {
+	starter := revealing[0].node.Origin
+	c.onElectionPacket("start-reg", starter, nil)
+	epoch, seed := c.election.Epoch, c.election.Seed
+	for _, v := range append(slices.Clone(revealing), withholding...) {
+		c.onElectionPacket("register", v.node.Origin, nil)
+	}
+	c.onElectionPacket("end-reg", starter, nil)
+	for _, v := range append(slices.Clone(revealing), withholding...) {
+		commit := sha256.Sum256(v.reveal(t, epoch, seed))
+		c.onElectionPacket("commit", v.node.Origin, commit[:])
+	}
+	c.onElectionPacket("end-commit", starter, nil)
+	for _, v := range revealing {
+		c.onElectionPacket("reveal", v.node.Origin, v.reveal(t, epoch, seed))
+	}
+	c.onElectionPacket("end-reveal", starter, nil)
+}
+
+func TestElectionResultIsAuditable(t *testing.T) {
+	voters := newTestVoters("n1", "n2", "n3")
+	c := newTestCore(t, "n1", voters[0].node, voters[1].node, voters[2].node)
+	c.privKey = voters[0].key
+	runElection(t, c, voters[:2], voters[2:])
+
+	result, ok := latestOf(c)
+	if !ok {
+		t.Fatalf("election result not written to state")
+	}
+	if result.Epoch != 0 || len(result.Reveals) != 2 || !slices.Equal(result.Penalised, []string{"n3"}) {
+		t.Fatalf("result %+v", result)
+	}
+	executors := slices.Clone(result.Executors)
+	sort.Strings(executors)
+	if !slices.Equal(executors, []string{"n1", "n2"}) || len(c.executors) != 2 || !c.executors["n1"] || !c.executors["n2"] {
+		t.Fatalf("executors %v, core runs with %v", result.Executors, c.executors)
+	}
+	c.ModifyState(true, func(trx trx.ITrx) error {
+		if err := AuditElection(trx, result); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		forged := result
+		forged.Seed = electionSeed("other", map[string][]byte{})
+		if AuditElection(trx, forged) == nil {
+			t.Fatalf("result with a forged seed passed the audit")
+		}
+		forged = result
+		forged.Reveals = map[string]string{"n1": result.Reveals["n1"], "n2": result.Reveals["n1"]}
+		if AuditElection(trx, forged) == nil {
+			t.Fatalf("reveal signed by another voter passed the audit")
+		}
+		forged = result
+		forged.Executors = slices.Clone(result.Executors)
+		slices.Reverse(forged.Executors)
+		if AuditElection(trx, forged) == nil {
+			t.Fatalf("result with other executors passed the audit")
+		}
+		return nil
+	})
+}
+
+func TestElectionRejectsRevealsNotMatchingCommits(t *testing.T) {
+	voters := newTestVoters("n1", "n2")
+	c := newTestCore(t, "n1", voters[0].node, voters[1].node)
+	c.privKey = voters[0].key
+	c.onElectionPacket("start-reg", "n1", nil)
+	for _, v := range voters {
+		c.onElectionPacket("register", v.node.Origin, nil)
+	}
+	c.onElectionPacket("end-reg", "n1", nil)
+	for _, v := range voters {
+		commit := sha256.Sum256(v.reveal(t, 0, ""))
+		c.onElectionPacket("commit", v.node.Origin, commit[:])
+	}
+	if c.election.Phase != "reveal" {
+		t.Fatalf("election in phase %s once every participant committed", c.election.Phase)
+	}
+	// n2 reveals the output of n1, which does not match its commit
+	c.onElectionPacket("reveal", "n2", voters[0].reveal(t, 0, ""))
+	if _, ok := c.election.Reveals["n2"]; ok {
+		t.Fatalf("reveal not matching its commit accepted")
+	}
+	// a phase packet of a voter other than the starter changes nothing
+	c.onElectionPacket("end-reveal", "n2", nil)
+	if c.election == nil {
+		t.Fatalf("election ended by a voter that did not start it")
+	}
+}
+
+func TestElectionBarsWithholdingVoters(t *testing.T) {
+	voters := newTestVoters("n1", "n2", "n3")
+	c := newTestCore(t, "n1", voters[0].node, voters[1].node, voters[2].node)
+	c.privKey = voters[0].key
+	runElection(t, c, voters[:2], voters[2:])
+
+	c.onElectionPacket("start-reg", "n1", nil)
+	if c.election.Epoch != 1 {
+		t.Fatalf("next election at epoch %d", c.election.Epoch)
+	}
+	first, _ := latestOf(c)
+	if c.election.Seed != first.Seed {
+		t.Fatalf("next election does not start from the last seed")
+	}
+	for _, v := range voters {
+		c.onElectionPacket("register", v.node.Origin, nil)
+	}
+	if _, ok := c.election.Participants["n3"]; ok {
+		t.Fatalf("voter that withheld its reveal registered again")
+	}
+	if len(c.election.Participants) != 2 {
+		t.Fatalf("participants %v", c.election.Participants)
+	}
+}
+
+func TestElectionExcludesDivergentExecutors(t *testing.T) {
+	voters := newTestVoters("n1", "n2", "n3")
+	c := newTestCore(t, "n1", voters[0].node, voters[1].node, voters[2].node)
+	c.privKey = voters[0].key
+	c.ModifyState(false, func(trx trx.ITrx) error {
+		count := make([]byte, 8)
+		binary.LittleEndian.PutUint64(count, maxDivergentResponses()+1)
+		trx.PutBytes(divergenceKey(0, "n2"), count)
+		return nil
+	})
+	runElection(t, c, voters, nil)
+
+	result, _ := latestOf(c)
+	if !slices.Equal(result.Excluded, []string{"n2"}) || slices.Contains(result.Executors, "n2") || len(result.Executors) != 2 {
+		t.Fatalf("result %+v", result)
+	}
+	if _, ok := result.Reveals["n2"]; !ok {
+		t.Fatalf("reveal of an excluded voter left out of the seed")
+	}
+	c.ModifyState(true, func(trx trx.ITrx) error {
+		if err := AuditElection(trx, result); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestPickExecutors(t *testing.T) {
+	candidates := []string{"a", "b", "c", "d", "e", "f", "g"}
+	picked := pickExecutors("seed", candidates)
+	if len(picked) != MAX_VALIDATOR_COUNT {
+		t.Fatalf("picked %v", picked)
+	}
+	reversed := slices.Clone(candidates)
+	slices.Reverse(reversed)
+	if !slices.Equal(picked, pickExecutors("seed", reversed)) {
+		t.Fatalf("pick depends on the order of the candidates")
+	}
+	sorted := slices.Clone(picked)
+	sort.Strings(sorted)
+	if len(slices.Compact(sorted)) != len(picked) {
+		t.Fatalf("executor picked twice: %v", picked)
+	}
+	if len(pickExecutors("seed", candidates[:2])) != 2 {
+		t.Fatalf("more executors picked than candidates")
+	}
+}
+
+func TestElectionSeedCoversReveals(t *testing.T) {
+	reveals := map[string][]byte{"a": []byte("1"), "b": []byte("2")}
+	seed := electionSeed("prev", reveals)
+	if seed == electionSeed("other", reveals) {
+		t.Fatalf("seed does not depend on the previous seed")
+	}
+	if seed == electionSeed("prev", map[string][]byte{"a": []byte("1"), "b": []byte("3")}) {
+		t.Fatalf("seed does not depend on the reveals")
+	}
+	if seed == electionSeed("prev", map[string][]byte{"a": []byte("2"), "b": []byte("1")}) {
+		t.Fatalf("seed does not bind reveals to their voters")
+	}
+}
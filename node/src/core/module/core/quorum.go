@@ -0,0 +1,336 @@
+package module_core
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kasper/src/abstract/models/chain"
+	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/trx"
+	"kasper/src/abstract/models/update"
+	mach_model "kasper/src/shell/api/model"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// callbackRetention is how many callback timeouts a timed out callback is kept
+// for, so that late responses still apply their effects.
+const callbackRetention = 10
+
+var ErrRequestTimeout = errors.New("request timed out waiting for executors")
+
+// responseQuorum is how many matching responses complete a request with the
+// given executors. CHAIN_RESPONSE_QUORUM is "bft" (n-f with f = (n-1)/3),
+// "majority", "all" or a fixed count.
+func responseQuorum(executors int) int {
+	if executors <= 0 {
+		return 1
+	}
+	quorum := os.Getenv("CHAIN_RESPONSE_QUORUM")
+	switch quorum {
+	case "all":
+		return executors
+	case "majority":
+		return executors/2 + 1
+	case "bft":
+		return executors - (executors-1)/3
+	}
+	count, err := strconv.Atoi(quorum)
+	if err != nil || count <= 0 {
+		return executors - (executors-1)/3
+	}
+	return min(count, executors)
+}
+
+// runtimeExecutors narrows the executors of a request to a wasm machine down to
+// the ones running the wasm runtime most of them registered, as runtimes
+// meter gas differently and their responses would never agree. Executors
+// registered without a runtime run the app engine, and a tie goes to the
+// runtime whose name sorts first.
+func runtimeExecutors(trx trx.ITrx, execs map[string]bool) map[string]bool {
+	runtimes := map[string]string{}
+	counts := map[string]int{}
+	for executor := range execs {
+		node, _ := mach_model.Node{Origin: executor}.Resolve(trx)
+		runtime := node.WasmRuntime
+		if runtime == "" {
+			runtime = "appengine"
+		}
+		runtimes[executor] = runtime
+		counts[runtime]++
+	}
+	chosen := ""
+	for runtime, count := range counts {
+		if count > counts[chosen] || (count == counts[chosen] && runtime < chosen) {
+			chosen = runtime
+		}
+	}
+	narrowed := map[string]bool{}
+	for executor, runtime := range runtimes {
+		if runtime == chosen {
+			narrowed[executor] = execs[executor]
+		}
+	}
+	return narrowed
+}
+
+// callbackDeadline is when a callback opened now times out, in the consensus
+// time of the blocks, so that every node expires a request at the same block.
+// Before the first block there is no deadline yet, the one of a request is
+// set again when the block carrying it commits.
+func (c *Core) callbackDeadline() int64 {
+	now := c.ChainTime()
+	if now == 0 {
+		return 0
+	}
+	return now + callbackTimeout().Milliseconds()
+}
+
+func callbackTimeout() time.Duration {
+	if v, err := strconv.ParseInt(os.Getenv("CHAIN_CALLBACK_TIMEOUT"), 10, 64); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return time.Minute
+}
+
+// maxDivergentResponses is how many responses an executor may send against the
+// quorum in an epoch before it is left out of the next election draw.
+func maxDivergentResponses() uint64 {
+	if v, err := strconv.ParseUint(os.Getenv("MAX_DIVERGENT_RESPONSES"), 10, 64); err == nil {
+		return v
+	}
+	return 3
+}
+
+func divergenceKey(epoch uint64, executor string) string {
+	return fmt.Sprintf("election::divergent::%d::%s", epoch, executor)
+}
+
+func divergentResponses(trx trx.ITrx, epoch uint64, executor string) uint64 {
+	data := trx.GetBytes(divergenceKey(epoch, executor))
+	if len(data) < 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(data)
+}
+
+// recordDivergence counts a response that disagreed with the quorum against
+// its executor, under the epoch the next election will be held for.
+func recordDivergence(trx trx.ITrx, executor string) {
+	log.Println("executor", executor, "diverged from the response quorum")
+	epoch := uint64(0)
+	if latest, ok := latestElection(trx); ok {
+		epoch = latest.Epoch + 1
+	}
+	count := make([]byte, 8)
+	binary.LittleEndian.PutUint64(count, divergentResponses(trx, epoch, executor)+1)
+	trx.PutBytes(divergenceKey(epoch, executor), count)
+}
+
+// responseTally is what the chain state keeps of the responses to a request
+// while they come in: the hash of each executor's response, the hash the
+// quorum agreed on, and the number of executors the quorum is taken from.
+// Members names them when only some of the executors run the request. Usage
+// is what each executor reported its container runs for the request used,
+// and SettledUsage the figure charged for them once the quorum settled. A
+// tally some executors never answer is dropped at Expires, in the consensus
+// time of the blocks.
+type responseTally struct {
+	Executors    int               `json:"executors"`
+	Responses    map[string]string `json:"responses"`
+	Settled      string            `json:"settled"`
+	Members      []string          `json:"members,omitempty"`
+	Usage        map[string]int64  `json:"usage,omitempty"`
+	SettledUsage int64             `json:"settledUsage,omitempty"`
+	Expires      int64             `json:"expires,omitempty"`
+}
+
+func responseTallyKey(requestId string) string {
+	return "election::responses::" + requestId
+}
+
+const responseExpiryPrefix = "election::expiry::"
+
+// responseExpiryKey orders the tallies by when they expire.
+func responseExpiryKey(expires int64, requestId string) string {
+	return fmt.Sprintf("%s%020d::%s", responseExpiryPrefix, expires, requestId)
+}
+
+// scheduleExpiry has a new tally expire once the callback of its request has
+// outlived its retention.
+func scheduleExpiry(trx trx.ITrx, tally *responseTally, requestId string, now int64) {
+	if tally.Expires != 0 {
+		return
+	}
+	tally.Expires = now + int64(1+callbackRetention)*callbackTimeout().Milliseconds()
+	trx.PutString(responseExpiryKey(tally.Expires, requestId), requestId)
+}
+
+// agreedUsage is the median of the usage reported by the executors that gave
+// the settled response, so that executors reporting more or less than their
+// runs used can not move it unless they make most of the quorum.
+func agreedUsage(tally responseTally) int64 {
+	usages := []int64{}
+	for executor, res := range tally.Responses {
+		if res == tally.Settled {
+			usages = append(usages, tally.Usage[executor])
+		}
+	}
+	slices.Sort(usages)
+	return usages[(len(usages)-1)/2]
+}
+
+// tallyResponse counts a committed response towards the quorum of its request
+// in the chain state, and counts it as divergent when it disagrees with what
+// the quorum settled on. Every node reads the same responses from the same
+// blocks, so they all count the same whether or not they hold a callback for
+// the request. It returns the usage agreed on once the quorum settled.
+func (c *Core) tallyResponse(packet chain.ChainResponse) int64 {
+	holder, _ := json.Marshal(core.ResponseHolder{Payload: packet.Payload, Effects: packet.Effects})
+	sum := sha256.Sum256(holder)
+	hash := hex.EncodeToString(sum[:])
+	usage := int64(0)
+	c.modifyChainState(func(trx trx.ITrx) error {
+		tally := responseTally{Executors: len(c.executors), Responses: map[string]string{}}
+		if data := trx.GetBytes(responseTallyKey(packet.RequestId)); len(data) > 0 {
+			if err := json.Unmarshal(data, &tally); err != nil {
+				return err
+			}
+		}
+		if len(tally.Members) > 0 {
+			if !slices.Contains(tally.Members, packet.Executor) {
+				return nil
+			}
+		} else if !c.executors[packet.Executor] {
+			return nil
+		}
+		if _, answered := tally.Responses[packet.Executor]; answered {
+			return nil
+		}
+		tally.Responses[packet.Executor] = hash
+		if tally.Usage == nil {
+			tally.Usage = map[string]int64{}
+		}
+		tally.Usage[packet.Executor] = max(packet.Usage, 0)
+		if tally.Settled != "" {
+			if hash != tally.Settled {
+				recordDivergence(trx, packet.Executor)
+			}
+		} else {
+			agreed := 0
+			for _, res := range tally.Responses {
+				if res == hash {
+					agreed++
+				}
+			}
+			if agreed >= responseQuorum(tally.Executors) {
+				tally.Settled = hash
+				tally.SettledUsage = agreedUsage(tally)
+				executors := make([]string, 0, len(tally.Responses))
+				for executor := range tally.Responses {
+					executors = append(executors, executor)
+				}
+				sort.Strings(executors)
+				for _, executor := range executors {
+					if tally.Responses[executor] != hash {
+						recordDivergence(trx, executor)
+					}
+				}
+			}
+		}
+		usage = tally.SettledUsage
+		if len(tally.Responses) >= tally.Executors {
+			trx.DelKey(responseTallyKey(packet.RequestId))
+			if tally.Expires != 0 {
+				trx.DelKey(responseExpiryKey(tally.Expires, packet.RequestId))
+			}
+			return nil
+		}
+		scheduleExpiry(trx, &tally, packet.RequestId, c.ChainTime())
+		data, err := json.Marshal(tally)
+		if err != nil {
+			return err
+		}
+		trx.PutBytes(responseTallyKey(packet.RequestId), data)
+		return nil
+	})
+	return usage
+}
+
+// openTally starts the tally of a request only some of the executors run.
+func (c *Core) openTally(requestId string, execs map[string]bool) {
+	members := make([]string, 0, len(execs))
+	for executor := range execs {
+		members = append(members, executor)
+	}
+	sort.Strings(members)
+	c.modifyChainState(func(trx trx.ITrx) error {
+		tally := responseTally{Executors: len(members), Responses: map[string]string{}, Members: members}
+		scheduleExpiry(trx, &tally, requestId, c.ChainTime())
+		data, err := json.Marshal(tally)
+		if err != nil {
+			return err
+		}
+		trx.PutBytes(responseTallyKey(requestId), data)
+		return nil
+	})
+}
+
+// expireCallbacks answers the clients of requests past their deadline and
+// drops callbacks that outlived their retention. It runs after every block,
+// against the consensus time of the blocks. The clients are answered once the
+// lock is released, as they may call back into the core.
+func (c *Core) expireCallbacks() {
+	expired := []func([]byte, int, error){}
+	c.lock.Lock()
+	now := c.ChainTime()
+	for id, callback := range c.chainCallbacks {
+		if callback.Deadline == 0 || now < callback.Deadline {
+			continue
+		}
+		if callback.Fn != nil {
+			expired = append(expired, callback.Fn)
+			callback.Fn = nil
+		}
+		if now >= callback.Deadline+int64(callbackRetention)*callbackTimeout().Milliseconds() {
+			delete(c.chainCallbacks, id)
+		}
+	}
+	c.lock.Unlock()
+	for _, fn := range expired {
+		fn(nil, 504, ErrRequestTimeout)
+	}
+}
+
+// expireTallies drops the tallies that expired by the consensus time of the
+// last block, as the executors that did not answer them never will, and
+// returns the writes for the block to keep.
+func (c *Core) expireTallies() []update.Update {
+	changes := []update.Update{}
+	now := c.ChainTime()
+	c.ModifyState(false, func(trx trx.ITrx) error {
+		for _, key := range trx.GetByPrefix(responseExpiryPrefix) {
+			expiry, requestId, _ := strings.Cut(key[len(responseExpiryPrefix):], "::")
+			expires, err := strconv.ParseInt(expiry, 10, 64)
+			if err != nil {
+				continue
+			}
+			if now < expires {
+				break
+			}
+			trx.DelKey(key)
+			trx.DelKey(responseTallyKey(requestId))
+		}
+		changes = trx.Updates()
+		return nil
+	})
+	return changes
+}
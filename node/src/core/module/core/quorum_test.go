@@ -0,0 +1,267 @@
+package module_core
+
+import (
+	"encoding/json"
+	"kasper/src/abstract/models/chain"
+	"kasper/src/abstract/models/trx"
+	"kasper/src/abstract/models/update"
+	mach_model "kasper/src/shell/api/model"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestResponseQuorum(t *testing.T) {
+	cases := map[string]map[int]int{
+		"bft":      {0: 1, 1: 1, 3: 3, 4: 3, 5: 4, 7: 5},
+		"majority": {1: 1, 4: 3, 5: 3},
+		"all":      {1: 1, 4: 4},
+		"2":        {1: 1, 4: 2},
+		"nonsense": {4: 3},
+	}
+	for quorum, counts := range cases {
+		t.Setenv("CHAIN_RESPONSE_QUORUM", quorum)
+		for executors, want := range counts {
+			if got := responseQuorum(executors); got != want {
+				t.Fatalf("%s quorum of %d executors is %d, want %d", quorum, executors, got, want)
+			}
+		}
+	}
+}
+
+func tallyOf(c *Core, requestId string) (responseTally, bool) {
+	tally := responseTally{}
+	found := false
+	c.ModifyState(true, func(trx trx.ITrx) error {
+		if data := trx.GetBytes(responseTallyKey(requestId)); len(data) > 0 {
+			found = json.Unmarshal(data, &tally) == nil
+		}
+		return nil
+	})
+	return tally, found
+}
+
+func divergenceOf(c *Core, executor string) uint64 {
+	count := uint64(0)
+	c.ModifyState(true, func(trx trx.ITrx) error {
+		count = divergentResponses(trx, 0, executor)
+		return nil
+	})
+	return count
+}
+
+func response(executor string, payload string) chain.ChainResponse {
+	return chain.ChainResponse{Executor: executor, RequestId: "r1", Payload: []byte(payload)}
+}
+
+func TestTallySettlesOnQuorum(t *testing.T) {
+	c := newTestCore(t, "a")
+	c.executors = map[string]bool{"a": true, "b": true, "c": true, "d": true}
+
+	c.tallyResponse(response("a", "ok"))
+	c.tallyResponse(response("c", "bad"))
+	c.tallyResponse(response("b", "ok"))
+	if tally, _ := tallyOf(c, "r1"); tally.Settled != "" {
+		t.Fatalf("settled on 2 of 4 responses")
+	}
+	c.tallyResponse(response("b", "ok"))
+	c.tallyResponse(response("x", "ok"))
+	if tally, _ := tallyOf(c, "r1"); tally.Settled != "" || len(tally.Responses) != 3 {
+		t.Fatalf("repeated or foreign responses counted: %+v", tally)
+	}
+	if divergenceOf(c, "c") != 0 {
+		t.Fatalf("divergence counted before the quorum settled")
+	}
+	c.tallyResponse(response("d", "ok"))
+	if divergenceOf(c, "c") != 1 || divergenceOf(c, "a") != 0 {
+		t.Fatalf("divergence of the minority not counted")
+	}
+	if _, found := tallyOf(c, "r1"); found {
+		t.Fatalf("tally kept once every executor answered")
+	}
+}
+
+func TestTallyCountsLateDivergence(t *testing.T) {
+	c := newTestCore(t, "a")
+	c.executors = map[string]bool{"a": true, "b": true, "c": true, "d": true}
+	for _, executor := range []string{"a", "b", "c"} {
+		c.tallyResponse(response(executor, "ok"))
+	}
+	tally, found := tallyOf(c, "r1")
+	if !found || tally.Settled == "" {
+		t.Fatalf("tally %+v", tally)
+	}
+	c.tallyResponse(response("d", "late and different"))
+	if divergenceOf(c, "d") != 1 {
+		t.Fatalf("late divergent response not counted")
+	}
+}
+
+func TestTallyAgreesOnMedianUsage(t *testing.T) {
+	c := newTestCore(t, "a")
+	c.executors = map[string]bool{"a": true, "b": true, "c": true, "d": true, "e": true}
+	usages := map[string]int64{"a": 10, "b": 1000, "c": 12, "d": 5, "e": -50}
+	payloads := map[string]string{"a": "ok", "b": "ok", "c": "ok", "d": "bad", "e": "ok"}
+	for _, executor := range []string{"d", "b", "a", "c"} {
+		res := response(executor, payloads[executor])
+		res.Usage = usages[executor]
+		if usage := c.tallyResponse(res); usage != 0 {
+			t.Fatalf("usage %d agreed before the quorum settled", usage)
+		}
+	}
+	res := response("e", payloads["e"])
+	res.Usage = usages["e"]
+	agreed := c.tallyResponse(res)
+	// the settled responses reported 0, 10, 12 and 1000, the divergent 5 is left out
+	if agreed != 10 {
+		t.Fatalf("agreed usage %d, want 10", agreed)
+	}
+}
+
+func TestTallyStoresBlockChanges(t *testing.T) {
+	c := newTestCore(t, "a")
+	c.executors = map[string]bool{"a": true, "b": true}
+	c.tallyResponse(response("a", "ok"))
+	if !slices.ContainsFunc(c.blockChanges, func(u update.Update) bool { return u.Key == responseTallyKey("r1") }) {
+		t.Fatalf("tally not kept with the block: %v", c.blockChanges)
+	}
+}
+
+func TestTallyExpiresByBlockTime(t *testing.T) {
+	c := newTestCore(t, "a")
+	c.executors = map[string]bool{"a": true, "b": true, "c": true}
+	retention := int64(1+callbackRetention) * callbackTimeout().Milliseconds()
+	c.chainTime.Store(1000)
+	c.tallyResponse(response("a", "ok"))
+	c.chainTime.Store(2000)
+	late := response("a", "ok")
+	late.RequestId = "r2"
+	c.tallyResponse(late)
+	tally, _ := tallyOf(c, "r1")
+	if tally.Expires != 1000+retention {
+		t.Fatalf("tally expires at %d, want %d", tally.Expires, 1000+retention)
+	}
+
+	c.chainTime.Store(1000 + retention - 1)
+	if changes := c.expireTallies(); len(changes) != 0 {
+		t.Fatalf("tally expired early: %v", changes)
+	}
+	c.chainTime.Store(1000 + retention)
+	changes := c.expireTallies()
+	if _, found := tallyOf(c, "r1"); found {
+		t.Fatalf("tally of an executor that never answered kept past its expiry")
+	}
+	if _, found := tallyOf(c, "r2"); !found {
+		t.Fatalf("tally expired before its time")
+	}
+	keys := []string{}
+	for _, u := range changes {
+		keys = append(keys, u.Key)
+	}
+	sort.Strings(keys)
+	if !slices.Equal(keys, []string{responseExpiryKey(1000+retention, "r1"), responseTallyKey("r1")}) {
+		t.Fatalf("expiry not kept with the block: %v", keys)
+	}
+
+	// a tally every executor answered leaves nothing to expire
+	done := response("b", "ok")
+	done.RequestId = "r2"
+	c.tallyResponse(done)
+	done.Executor = "c"
+	c.tallyResponse(done)
+	c.chainTime.Store(2000 + retention)
+	if changes := c.expireTallies(); len(changes) != 0 {
+		t.Fatalf("answered tally left an expiry behind: %v", changes)
+	}
+}
+
+func TestExpireCallbacksByBlockTime(t *testing.T) {
+	c := newTestCore(t, "a")
+	timeouts := 0
+	c.chainCallbacks["r1"] = &chain.ChainCallback{Deadline: 1000, Fn: func(_ []byte, resCode int, err error) {
+		if resCode != 504 || err != ErrRequestTimeout {
+			t.Fatalf("callback got %d %v", resCode, err)
+		}
+		timeouts++
+	}}
+
+	c.chainTime.Store(999)
+	c.expireCallbacks()
+	if timeouts != 0 {
+		t.Fatalf("callback expired before its deadline")
+	}
+	c.chainTime.Store(1000)
+	c.expireCallbacks()
+	c.expireCallbacks()
+	if timeouts != 1 {
+		t.Fatalf("client answered %d times", timeouts)
+	}
+	if _, ok := c.chainCallbacks["r1"]; !ok {
+		t.Fatalf("callback dropped before its retention")
+	}
+	c.chainTime.Store(1000 + int64(callbackRetention)*callbackTimeout().Milliseconds())
+	c.expireCallbacks()
+	if _, ok := c.chainCallbacks["r1"]; ok {
+		t.Fatalf("callback kept past its retention")
+	}
+}
+
+func nodeOn(origin string, runtime string) mach_model.Node {
+	return mach_model.Node{Origin: origin, OwnerId: "owner", WasmRuntime: runtime}
+}
+
+func TestRuntimeExecutors(t *testing.T) {
+	c := newTestCore(t, "a", nodeOn("a", "wazero"), nodeOn("b", "wazero"), nodeOn("c", ""), nodeOn("d", "appengine"), nodeOn("e", "wazero"))
+	cases := []struct {
+		execs []string
+		want  []string
+	}{
+		{[]string{"a", "b", "c"}, []string{"a", "b"}},
+		// nodes registered without a runtime run the app engine
+		{[]string{"a", "c", "d"}, []string{"c", "d"}},
+		// a tie goes to the runtime whose name sorts first
+		{[]string{"a", "c"}, []string{"c"}},
+		{[]string{"a", "b", "e"}, []string{"a", "b", "e"}},
+	}
+	for _, cs := range cases {
+		execs := map[string]bool{}
+		for _, e := range cs.execs {
+			execs[e] = true
+		}
+		got := []string{}
+		c.ModifyState(true, func(trx trx.ITrx) error {
+			for e := range runtimeExecutors(trx, execs) {
+				got = append(got, e)
+			}
+			return nil
+		})
+		sort.Strings(got)
+		if !slices.Equal(got, cs.want) {
+			t.Fatalf("executors of %v narrowed to %v, want %v", cs.execs, got, cs.want)
+		}
+	}
+}
+
+func TestOpenTallyCountsMembersOnly(t *testing.T) {
+	c := newTestCore(t, "a")
+	c.executors = map[string]bool{"a": true, "b": true, "c": true, "d": true, "e": true}
+	c.openTally("r1", map[string]bool{"a": true, "b": true, "c": true})
+
+	c.tallyResponse(response("d", "other"))
+	c.tallyResponse(response("a", "ok"))
+	c.tallyResponse(response("b", "ok"))
+	tally, _ := tallyOf(c, "r1")
+	if _, counted := tally.Responses["d"]; counted {
+		t.Fatalf("response of an executor outside the members counted")
+	}
+	if tally.Settled != "" {
+		t.Fatalf("settled on 2 of 3 members")
+	}
+	c.tallyResponse(response("c", "ok"))
+	if _, found := tallyOf(c, "r1"); found {
+		t.Fatalf("tally kept once every member answered")
+	}
+	if divergenceOf(c, "d") != 0 {
+		t.Fatalf("executor outside the members counted as divergent")
+	}
+}
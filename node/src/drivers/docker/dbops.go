@@ -0,0 +1,526 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kasper/src/abstract/models/trx"
+	models "kasper/src/shell/api/model"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Docker machines keep their objects under the "<machineId>->" namespace of
+// the state. A list of ops runs in one transaction, every write raises the
+// "_version" column of its object, and every key a machine stores counts
+// against its quota in "dbUsage::<machineId>".
+var (
+	ErrVersionConflict = errors.New("object version does not match")
+	ErrUniqueViolation = errors.New("value is already taken in unique index")
+	ErrDbQuotaExceeded = errors.New("machine storage quota exceeded")
+	ErrReservedColumn  = errors.New("column name is reserved")
+	ErrUnknownDbOp     = errors.New("unknown db op")
+	ErrDbConflict      = errors.New("storage changed while the ops were applied")
+)
+
+const versionColumn = "_version"
+
+type DbOpError struct {
+	Index int
+	Err   error
+}
+
+func (e *DbOpError) Error() string {
+	return fmt.Sprintf("op %d: %s", e.Index, e.Err.Error())
+}
+
+func (e *DbOpError) Unwrap() error {
+	return e.Err
+}
+
+// entrySize is what a key takes in the quota of a machine.
+func entrySize(key string, val []byte) int64 {
+	return int64(len(key) + len(val))
+}
+
+type machineDb struct {
+	trx       trx.ITrx
+	machineId string
+	quota     int64
+	used      int64
+}
+
+func (wm *Docker) dbLock(machineId string) *sync.Mutex {
+	wm.dbLocks.SetIfAbsent(machineId, &sync.Mutex{})
+	lock, _ := wm.dbLocks.Get(machineId)
+	return lock
+}
+
+func dbQuotaOf(trx trx.ITrx, machineId string) int64 {
+	maxMb := int64(64)
+	if v, err := strconv.ParseInt(os.Getenv("DOCKER_MAX_DB_MB"), 10, 64); err == nil && v > 0 {
+		maxMb = v
+	}
+	mb := models.VmResources{}.Pull(trx, machineId).DbMb
+	if mb <= 0 || mb > maxMb {
+		mb = maxMb
+	}
+	return mb * 1024 * 1024
+}
+
+// storedSize sums up the keys a machine already has in storage. It counts
+// the usage of machines that stored data before their usage was kept.
+func storedSize(trx trx.ITrx, machineId string) int64 {
+	size := int64(0)
+	for _, prefix := range []string{
+		"obj::" + machineId + "->",
+		"link::" + machineId + "->",
+		"index::" + machineId + "->",
+		"link::dbIndex::" + machineId + "::",
+		"link::dbSchema::" + machineId + "::",
+	} {
+		for _, key := range trx.GetByPrefix(prefix) {
+			size += entrySize(key, trx.GetBytes(key))
+		}
+	}
+	return size
+}
+
+// runDbOps applies the ops of a machine in a single transaction, one machine
+// at a time so that version checks hold until the write is committed. The
+// transaction fails with ErrDbConflict if what it read was changed meanwhile
+// by a write that does not go through here.
+func (wm *Docker) runDbOps(machineId string, ops []map[string]any) ([]any, error) {
+	lock := wm.dbLock(machineId)
+	lock.Lock()
+	defer lock.Unlock()
+	results := make([]any, 0, len(ops))
+	var opErr error
+	err := wm.app.ModifyStateChecked(func(trx trx.ITrx) error {
+		db := &machineDb{trx: trx, machineId: machineId, quota: dbQuotaOf(trx, machineId)}
+		usage := trx.GetLink("dbUsage::" + machineId)
+		if usage == "" {
+			db.used = storedSize(trx, machineId)
+		} else {
+			db.used, _ = strconv.ParseInt(usage, 10, 64)
+		}
+		start := db.used
+		for i, op := range ops {
+			res, err := db.run(op)
+			if err != nil {
+				opErr = &DbOpError{Index: i, Err: err}
+				return opErr
+			}
+			results = append(results, res)
+		}
+		if db.used > db.quota && db.used > start {
+			opErr = ErrDbQuotaExceeded
+			return opErr
+		}
+		if db.used != start || usage == "" {
+			trx.PutLink("dbUsage::"+machineId, strconv.FormatInt(max(db.used, 0), 10))
+		}
+		return nil
+	})
+	if opErr != nil {
+		return nil, opErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDbConflict, err.Error())
+	}
+	return results, nil
+}
+
+func (db *machineDb) run(op map[string]any) (any, error) {
+	name, err := checkField(op, "op", "")
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "getObj":
+		return db.getObj(op)
+	case "putObj":
+		return db.putObj(op)
+	case "delObj":
+		return db.delObj(op)
+	case "getLink":
+		k, err := checkField(op, "key", "")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"val": db.trx.GetLink(db.machineId + "->" + k)}, nil
+	case "putLink":
+		k, err := checkField(op, "key", "")
+		if err != nil {
+			return nil, err
+		}
+		v, err := checkField(op, "val", "")
+		if err != nil {
+			return nil, err
+		}
+		key := db.machineId + "->" + k
+		old := db.trx.GetLink(key)
+		if old != "" {
+			db.used -= entrySize("link::"+key, []byte(old))
+		}
+		db.used += entrySize("link::"+key, []byte(v))
+		db.trx.PutLink(key, v)
+		return map[string]any{}, nil
+	case "delLink":
+		k, err := checkField(op, "key", "")
+		if err != nil {
+			return nil, err
+		}
+		key := db.machineId + "->" + k
+		old := db.trx.GetLink(key)
+		if old == "" {
+			return map[string]any{"deleted": false}, nil
+		}
+		db.used -= entrySize("link::"+key, []byte(old))
+		db.trx.DelKey("link::" + key)
+		return map[string]any{"deleted": true}, nil
+	case "defineIndex":
+		return db.defineIndex(op)
+	case "query":
+		return db.query(op)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownDbOp, name)
+}
+
+func (db *machineDb) objType(typ string) string {
+	return db.machineId + "->" + typ
+}
+
+// objExists tells a stored object from a missing or deleted one, which has
+// no "|" marker.
+func objExists(obj map[string][]byte) bool {
+	_, ok := obj["|"]
+	return ok
+}
+
+func objVersion(obj map[string][]byte) int64 {
+	v, _ := strconv.ParseInt(string(obj[versionColumn]), 10, 64)
+	return v
+}
+
+func objSize(objKeyPrefix string, col string, val []byte) int64 {
+	return entrySize(objKeyPrefix+col, val)
+}
+
+func checkVersion(op map[string]any, current int64) error {
+	expected, err := checkField(op, "expectVersion", float64(0))
+	if err != nil {
+		return nil
+	}
+	if int64(expected) != current {
+		return fmt.Errorf("%w: expected %d, found %d", ErrVersionConflict, int64(expected), current)
+	}
+	return nil
+}
+
+// indexes lists the indexed columns of a type, telling which are unique.
+func (db *machineDb) indexes(typ string) map[string]bool {
+	prefix := db.machineId + "::" + typ + "::"
+	cols := map[string]bool{}
+	links, _ := db.trx.GetLinksList("dbSchema::"+prefix, -1, -1)
+	for _, link := range links {
+		col := link[len("dbSchema::"+prefix):]
+		cols[col] = db.trx.GetLink(link) == "unique"
+	}
+	return cols
+}
+
+func (db *machineDb) indexPrefix(typ string, col string, val []byte) string {
+	return "dbIndex::" + db.machineId + "::" + typ + "::" + col + "::" + hex.EncodeToString(val) + "::"
+}
+
+func (db *machineDb) uniqueKey(typ string, col string, val []byte) string {
+	return "index::" + db.objType(typ) + "::" + col + "::id::" + hex.EncodeToString(val)
+}
+
+func (db *machineDb) unindex(typ string, id string, col string, unique bool, val []byte) {
+	link := db.indexPrefix(typ, col, val) + id
+	db.trx.DelKey("link::" + link)
+	db.used -= entrySize("link::"+link, []byte(id))
+	if unique && db.trx.GetIndex(db.objType(typ), col, "id", hex.EncodeToString(val)) == id {
+		db.trx.DelIndex(db.objType(typ), col, "id", hex.EncodeToString(val))
+		db.used -= entrySize(db.uniqueKey(typ, col, val), []byte(id))
+	}
+}
+
+func (db *machineDb) index(typ string, id string, col string, unique bool, val []byte) error {
+	if unique {
+		owner := db.trx.GetIndex(db.objType(typ), col, "id", hex.EncodeToString(val))
+		if owner != "" && owner != id {
+			return fmt.Errorf("%w: %s", ErrUniqueViolation, col)
+		}
+		if owner == "" {
+			db.used += entrySize(db.uniqueKey(typ, col, val), []byte(id))
+		}
+		db.trx.PutIndex(db.objType(typ), col, "id", hex.EncodeToString(val), []byte(id))
+	}
+	link := db.indexPrefix(typ, col, val) + id
+	if db.trx.GetLink(link) == "" {
+		db.used += entrySize("link::"+link, []byte(id))
+	}
+	db.trx.PutLink(link, id)
+	return nil
+}
+
+func decodeColumns(raw map[string]any) (map[string][]byte, error) {
+	cols := map[string][]byte{}
+	for k, v := range raw {
+		if k == versionColumn || k == "|" {
+			return nil, fmt.Errorf("%w: %s", ErrReservedColumn, k)
+		}
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("column %s is not base64 encoded", k)
+		}
+		val, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, err
+		}
+		cols[k] = val
+	}
+	return cols, nil
+}
+
+func (db *machineDb) getObj(op map[string]any) (any, error) {
+	typ, err := checkField(op, "objType", "")
+	if err != nil {
+		return nil, err
+	}
+	id, err := checkField(op, "objId", "")
+	if err != nil {
+		return nil, err
+	}
+	obj := db.trx.GetObj(db.objType(typ), id)
+	if !objExists(obj) {
+		return map[string]any{"found": false, "version": objVersion(obj)}, nil
+	}
+	return map[string]any{"found": true, "obj": obj, "version": objVersion(obj)}, nil
+}
+
+func (db *machineDb) putObj(op map[string]any) (any, error) {
+	typ, err := checkField(op, "objType", "")
+	if err != nil {
+		return nil, err
+	}
+	id, err := checkField(op, "objId", "")
+	if err != nil {
+		return nil, err
+	}
+	if id == "" || strings.Contains(id, "::") {
+		return nil, errors.New("object id can not be empty or contain ::")
+	}
+	objRaw, err := checkField(op, "obj", map[string]any{})
+	if err != nil {
+		return nil, err
+	}
+	cols, err := decodeColumns(objRaw)
+	if err != nil {
+		return nil, err
+	}
+	old := db.trx.GetObj(db.objType(typ), id)
+	version := objVersion(old)
+	if err := checkVersion(op, version); err != nil {
+		return nil, err
+	}
+	for col, unique := range db.indexes(typ) {
+		val, changed := cols[col]
+		if !changed {
+			continue
+		}
+		if prev, ok := old[col]; ok {
+			db.unindex(typ, id, col, unique, prev)
+		}
+		if err := db.index(typ, id, col, unique, val); err != nil {
+			return nil, err
+		}
+	}
+	version++
+	cols[versionColumn] = []byte(strconv.FormatInt(version, 10))
+	prefix := "obj::" + db.objType(typ) + "::" + id + "::"
+	if !objExists(old) {
+		db.used += objSize(prefix, "|", []byte{0x01})
+	}
+	for col, val := range cols {
+		if prev, ok := old[col]; ok {
+			db.used -= objSize(prefix, col, prev)
+		}
+		db.used += objSize(prefix, col, val)
+	}
+	db.trx.PutObj(db.objType(typ), id, cols)
+	return map[string]any{"version": version}, nil
+}
+
+func (db *machineDb) delObj(op map[string]any) (any, error) {
+	typ, err := checkField(op, "objType", "")
+	if err != nil {
+		return nil, err
+	}
+	id, err := checkField(op, "objId", "")
+	if err != nil {
+		return nil, err
+	}
+	old := db.trx.GetObj(db.objType(typ), id)
+	version := objVersion(old)
+	if err := checkVersion(op, version); err != nil {
+		return nil, err
+	}
+	if !objExists(old) {
+		return map[string]any{"deleted": false, "version": version}, nil
+	}
+	for col, unique := range db.indexes(typ) {
+		if prev, ok := old[col]; ok {
+			db.unindex(typ, id, col, unique, prev)
+		}
+	}
+	prefix := "obj::" + db.objType(typ) + "::" + id + "::"
+	for col, val := range old {
+		db.used -= objSize(prefix, col, val)
+		if col != versionColumn {
+			db.trx.DelKey(prefix + col)
+		}
+	}
+	version++
+	tombstone := []byte(strconv.FormatInt(version, 10))
+	db.used += objSize(prefix, versionColumn, tombstone)
+	db.trx.PutBytes(prefix+versionColumn, tombstone)
+	return map[string]any{"deleted": true, "version": version}, nil
+}
+
+// defineIndex starts indexing a column of a type, indexing the objects the
+// type already has.
+func (db *machineDb) defineIndex(op map[string]any) (any, error) {
+	typ, err := checkField(op, "objType", "")
+	if err != nil {
+		return nil, err
+	}
+	col, err := checkField(op, "column", "")
+	if err != nil {
+		return nil, err
+	}
+	if col == "" || col == versionColumn || col == "|" || strings.Contains(col, "::") {
+		return nil, fmt.Errorf("%w: %s", ErrReservedColumn, col)
+	}
+	if strings.Contains(typ, "::") {
+		return nil, errors.New("indexed object type can not contain ::")
+	}
+	unique, _ := checkField(op, "unique", false)
+	schemaKey := "dbSchema::" + db.machineId + "::" + typ + "::" + col
+	kind := map[bool]string{true: "unique", false: "index"}[unique]
+	if prev := db.trx.GetLink(schemaKey); prev == kind {
+		return map[string]any{}, nil
+	} else if prev != "" {
+		return nil, fmt.Errorf("column %s is already indexed as %s", col, prev)
+	}
+	db.used += entrySize("link::"+schemaKey, []byte(kind))
+	db.trx.PutLink(schemaKey, kind)
+	objs, err := db.trx.GetObjList(db.objType(typ), []string{"*"}, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	for id, obj := range objs {
+		if val, ok := obj[col]; ok {
+			if err := db.index(typ, id, col, unique, val); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return map[string]any{}, nil
+}
+
+func decodeFilter(raw map[string]any) (map[string]string, error) {
+	filter := map[string]string{}
+	for k, v := range raw {
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("filter of %s is not base64 encoded", k)
+		}
+		val, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, err
+		}
+		filter[k] = string(val)
+	}
+	return filter, nil
+}
+
+// query finds the objects whose indexed column holds a value, optionally
+// narrowed down by exact column values in filter or sets of values in
+// inFilter.
+func (db *machineDb) query(op map[string]any) (any, error) {
+	typ, err := checkField(op, "objType", "")
+	if err != nil {
+		return nil, err
+	}
+	col, err := checkField(op, "column", "")
+	if err != nil {
+		return nil, err
+	}
+	if _, indexed := db.indexes(typ)[col]; !indexed {
+		return nil, fmt.Errorf("column %s of %s is not indexed", col, typ)
+	}
+	valRaw, err := checkField(op, "value", "")
+	if err != nil {
+		return nil, err
+	}
+	val, err := base64.StdEncoding.DecodeString(valRaw)
+	if err != nil {
+		return nil, err
+	}
+	filterRaw, _ := checkField(op, "filter", map[string]any{})
+	filter, err := decodeFilter(filterRaw)
+	if err != nil {
+		return nil, err
+	}
+	inFilterRaw, _ := checkField(op, "inFilter", map[string]any{})
+	inFilter := map[string][]string{}
+	for k, v := range inFilterRaw {
+		list, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("inFilter of %s is not a list", k)
+		}
+		for _, item := range list {
+			str, _ := item.(string)
+			b, err := base64.StdEncoding.DecodeString(str)
+			if err != nil {
+				return nil, err
+			}
+			inFilter[k] = append(inFilter[k], string(b))
+		}
+	}
+	offset, _ := checkField(op, "offset", float64(0))
+	count, _ := checkField(op, "count", float64(100))
+	ids, err := db.trx.SearchLinkKeysListByPrefix(db.indexPrefix(typ, col, val), db.objType(typ), filter, inFilter, int64(offset), int64(count))
+	if err != nil {
+		return nil, err
+	}
+	objs, err := db.trx.GetObjList(db.objType(typ), ids, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"ids": ids, "objs": objs}, nil
+}
+
+// dbOpResult is what a machine gets back from its db ops. A failed op gives
+// {"error": ..., "failedOp": <index of the op in its batch>}.
+func dbOpResult(res any, err error) string {
+	if err != nil {
+		out := map[string]any{"error": err.Error()}
+		var opErr *DbOpError
+		if errors.As(err, &opErr) {
+			out["failedOp"] = opErr.Index
+		}
+		str, _ := json.Marshal(out)
+		return string(str)
+	}
+	out, _ := json.Marshal(res)
+	return string(out)
+}
@@ -0,0 +1,272 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"kasper/src/abstract/adapters/storage"
+	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/trx"
+	module_trx "kasper/src/core/module/actor/model/trx"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	cmap "github.com/orcaman/concurrent-map/v2"
+)
+
+type testStorage struct {
+	storage.IStorage
+	db *badger.DB
+}
+
+func (s testStorage) KvDb() *badger.DB {
+	return s.db
+}
+
+// dbCore runs state changes on a badger db, calling beforeCommit, when set,
+// between the reads and the commit of a checked change.
+type dbCore struct {
+	core.ICore
+	storage      testStorage
+	beforeCommit func()
+}
+
+func (c *dbCore) ModifyState(readonly bool, fn func(trx.ITrx) error) {
+	tx := module_trx.NewTrx(c, c.storage, readonly)
+	if err := fn(tx); err != nil {
+		tx.Discard()
+		return
+	}
+	tx.Commit()
+}
+
+func (c *dbCore) ModifyStateChecked(fn func(trx.ITrx) error) error {
+	tx := module_trx.NewTrx(c, c.storage, false)
+	if err := fn(tx); err != nil {
+		tx.Discard()
+		return err
+	}
+	if c.beforeCommit != nil {
+		c.beforeCommit()
+	}
+	return tx.CommitChecked()
+}
+
+func newTestDocker(t *testing.T) (*Docker, *dbCore) {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	app := &dbCore{storage: testStorage{db: db}}
+	return &Docker{app: app, dbLocks: cmap.New[*sync.Mutex]()}, app
+}
+
+func b64(val string) string {
+	return base64.StdEncoding.EncodeToString([]byte(val))
+}
+
+func put(id string, cols map[string]any) map[string]any {
+	return map[string]any{"op": "putObj", "objType": "user", "objId": id, "obj": cols}
+}
+
+// runOps runs ops the way a machine sends them, as json.
+func runOps(t *testing.T, wm *Docker, ops ...map[string]any) ([]any, error) {
+	data, _ := json.Marshal(ops)
+	decoded := []map[string]any{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return wm.runDbOps("m1", decoded)
+}
+
+func mustRun(t *testing.T, wm *Docker, ops ...map[string]any) []map[string]any {
+	results, err := runOps(t, wm, ops...)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := []map[string]any{}
+	for _, res := range results {
+		out = append(out, res.(map[string]any))
+	}
+	return out
+}
+
+func TestDbOpsVersions(t *testing.T) {
+	wm, _ := newTestDocker(t)
+	res := mustRun(t, wm, put("u1", map[string]any{"name": b64("a")}))
+	if res[0]["version"] != int64(1) {
+		t.Fatalf("first version %v", res[0]["version"])
+	}
+	if _, err := runOps(t, wm, map[string]any{"op": "putObj", "objType": "user", "objId": "u1", "obj": map[string]any{}, "expectVersion": 0}); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("write over a stale version gave %v", err)
+	}
+	res = mustRun(t, wm,
+		map[string]any{"op": "putObj", "objType": "user", "objId": "u1", "obj": map[string]any{"name": b64("b")}, "expectVersion": 1},
+		map[string]any{"op": "getObj", "objType": "user", "objId": "u1"},
+	)
+	if res[0]["version"] != int64(2) || res[1]["version"] != int64(2) || string(res[1]["obj"].(map[string][]byte)["name"]) != "b" {
+		t.Fatalf("results %v", res)
+	}
+	if _, err := runOps(t, wm, put("u1", map[string]any{versionColumn: b64("9")})); !errors.Is(err, ErrReservedColumn) {
+		t.Fatalf("write to the version column gave %v", err)
+	}
+}
+
+func TestDbOpsBatchIsAtomic(t *testing.T) {
+	wm, _ := newTestDocker(t)
+	_, err := runOps(t, wm,
+		put("u1", map[string]any{"name": b64("a")}),
+		map[string]any{"op": "putLink", "key": "k", "val": "v"},
+		map[string]any{"op": "dropEverything"},
+	)
+	var opErr *DbOpError
+	if !errors.As(err, &opErr) || opErr.Index != 2 || !errors.Is(err, ErrUnknownDbOp) {
+		t.Fatalf("batch failed with %v", err)
+	}
+	out := map[string]any{}
+	json.Unmarshal([]byte(dbOpResult(nil, err)), &out)
+	if out["failedOp"] != float64(2) {
+		t.Fatalf("result of the failed batch %v", out)
+	}
+	res := mustRun(t, wm,
+		map[string]any{"op": "getObj", "objType": "user", "objId": "u1"},
+		map[string]any{"op": "getLink", "key": "k"},
+	)
+	if res[0]["found"] != false || res[1]["val"] != "" {
+		t.Fatalf("ops of the failed batch applied: %v", res)
+	}
+}
+
+func TestDbOpsDeleteKeepsVersion(t *testing.T) {
+	wm, _ := newTestDocker(t)
+	mustRun(t, wm, put("u1", map[string]any{"name": b64("a")}))
+	res := mustRun(t, wm,
+		map[string]any{"op": "delObj", "objType": "user", "objId": "u1", "expectVersion": 1},
+		map[string]any{"op": "getObj", "objType": "user", "objId": "u1"},
+		map[string]any{"op": "delObj", "objType": "user", "objId": "u1"},
+	)
+	if res[0]["deleted"] != true || res[0]["version"] != int64(2) {
+		t.Fatalf("delete gave %v", res[0])
+	}
+	if res[1]["found"] != false || res[1]["version"] != int64(2) {
+		t.Fatalf("deleted object read as %v", res[1])
+	}
+	if res[2]["deleted"] != false {
+		t.Fatalf("deleted object deleted again")
+	}
+	// a write made with what was read before the delete fails
+	for _, stale := range []int{0, 1} {
+		if _, err := runOps(t, wm, map[string]any{"op": "putObj", "objType": "user", "objId": "u1", "obj": map[string]any{}, "expectVersion": stale}); !errors.Is(err, ErrVersionConflict) {
+			t.Fatalf("write expecting version %d over a delete gave %v", stale, err)
+		}
+	}
+	res = mustRun(t, wm, map[string]any{"op": "putObj", "objType": "user", "objId": "u1", "obj": map[string]any{"name": b64("c")}, "expectVersion": 2})
+	if res[0]["version"] != int64(3) {
+		t.Fatalf("recreated object at version %v", res[0]["version"])
+	}
+}
+
+func TestDbOpsUniqueIndex(t *testing.T) {
+	wm, _ := newTestDocker(t)
+	mustRun(t, wm, put("u1", map[string]any{"email": b64("x@a")}))
+	mustRun(t, wm, map[string]any{"op": "defineIndex", "objType": "user", "column": "email", "unique": true})
+	if _, err := runOps(t, wm, put("u2", map[string]any{"email": b64("x@a")})); !errors.Is(err, ErrUniqueViolation) {
+		t.Fatalf("taken value written with %v", err)
+	}
+	if _, err := runOps(t, wm, map[string]any{"op": "defineIndex", "objType": "user", "column": "email", "unique": false}); err == nil {
+		t.Fatalf("unique column indexed again as non unique")
+	}
+	mustRun(t, wm, put("u1", map[string]any{"email": b64("y@a")}))
+	mustRun(t, wm, put("u2", map[string]any{"email": b64("x@a")}))
+	res := mustRun(t, wm, map[string]any{"op": "query", "objType": "user", "column": "email", "value": b64("x@a")})
+	if ids := res[0]["ids"].([]string); !slices.Equal(ids, []string{"u2"}) {
+		t.Fatalf("query found %v", ids)
+	}
+	mustRun(t, wm, map[string]any{"op": "delObj", "objType": "user", "objId": "u1"})
+	mustRun(t, wm, put("u3", map[string]any{"email": b64("y@a")}))
+	if _, err := runOps(t, wm, map[string]any{"op": "query", "objType": "user", "column": "name", "value": b64("a")}); err == nil {
+		t.Fatalf("query on a column without index")
+	}
+}
+
+func usageOf(app *dbCore, machineId string) (int64, int64) {
+	var usage, stored int64
+	app.ModifyState(true, func(trx trx.ITrx) error {
+		usage, _ = strconv.ParseInt(trx.GetLink("dbUsage::"+machineId), 10, 64)
+		stored = storedSize(trx, machineId)
+		return nil
+	})
+	return usage, stored
+}
+
+func TestDbOpsCountEveryStoredKey(t *testing.T) {
+	wm, app := newTestDocker(t)
+	steps := [][]map[string]any{
+		{put("u1", map[string]any{"email": b64("x@a"), "name": b64("a")})},
+		{map[string]any{"op": "defineIndex", "objType": "user", "column": "email", "unique": true}},
+		{map[string]any{"op": "defineIndex", "objType": "user", "column": "name"}},
+		{put("u2", map[string]any{"email": b64("z@a"), "name": b64("bb")})},
+		{put("u1", map[string]any{"email": b64("y@a")})},
+		{map[string]any{"op": "putLink", "key": "k", "val": "v1"}, map[string]any{"op": "putLink", "key": "k", "val": "v22"}},
+		{map[string]any{"op": "delObj", "objType": "user", "objId": "u2"}},
+		{map[string]any{"op": "delLink", "key": "k"}},
+	}
+	for i, ops := range steps {
+		mustRun(t, wm, ops...)
+		if usage, stored := usageOf(app, "m1"); usage != stored {
+			t.Fatalf("after step %d usage is %d, stored keys take %d", i, usage, stored)
+		}
+	}
+}
+
+func TestDbOpsQuota(t *testing.T) {
+	t.Setenv("DOCKER_MAX_DB_MB", "1")
+	wm, app := newTestDocker(t)
+	big := b64(strings.Repeat("x", 600*1024))
+	mustRun(t, wm, put("u1", map[string]any{"data": big}))
+	if _, err := runOps(t, wm, put("u2", map[string]any{"data": big})); !errors.Is(err, ErrDbQuotaExceeded) {
+		t.Fatalf("write over the quota gave %v", err)
+	}
+	mustRun(t, wm, map[string]any{"op": "delObj", "objType": "user", "objId": "u1"})
+	mustRun(t, wm, put("u2", map[string]any{"data": big}))
+	if usage, stored := usageOf(app, "m1"); usage != stored {
+		t.Fatalf("usage %d, stored keys take %d", usage, stored)
+	}
+}
+
+func TestDbOpsUsageOfMachinesWithoutIt(t *testing.T) {
+	wm, app := newTestDocker(t)
+	// data stored before usage was kept
+	app.ModifyState(false, func(trx trx.ITrx) error {
+		trx.PutObj("m1->user", "old", map[string][]byte{"name": []byte("a")})
+		trx.PutLink("m1->k", "v")
+		return nil
+	})
+	mustRun(t, wm, map[string]any{"op": "getLink", "key": "k"})
+	if usage, stored := usageOf(app, "m1"); usage == 0 || usage != stored {
+		t.Fatalf("usage %d, stored keys take %d", usage, stored)
+	}
+}
+
+func TestDbOpsFailOnConflict(t *testing.T) {
+	wm, app := newTestDocker(t)
+	mustRun(t, wm, put("u1", map[string]any{"name": b64("a")}))
+	app.beforeCommit = func() {
+		app.storage.db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte("obj::m1->user::u1::name"), []byte("outside"))
+		})
+	}
+	if _, err := runOps(t, wm, put("u1", map[string]any{"name": b64("b")})); !errors.Is(err, ErrDbConflict) {
+		t.Fatalf("conflicting write gave %v", err)
+	}
+	app.beforeCommit = nil
+	res := mustRun(t, wm, map[string]any{"op": "getObj", "objType": "user", "objId": "u1"})
+	if res[0]["version"] != int64(1) || string(res[0]["obj"].(map[string][]byte)["name"]) != "outside" {
+		t.Fatalf("conflicting write applied: %v", res[0])
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"kasper/src/abstract/adapters/signaler"
 	"kasper/src/abstract/adapters/storage"
 	iaction "kasper/src/abstract/models/action"
+	"kasper/src/abstract/models/chain"
 	"kasper/src/abstract/models/core"
 	"kasper/src/abstract/models/packet"
 	"kasper/src/abstract/models/trx"
@@ -23,12 +24,14 @@ import (
 	inputs_storage "kasper/src/shell/api/inputs/storage"
 	models "kasper/src/shell/api/model"
 	"kasper/src/shell/utils/crypto"
+	"kasper/src/shell/utils/egress"
 	"kasper/src/shell/utils/future"
 	"maps"
 	"net"
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"archive/tar"
 	"bytes"
@@ -42,7 +45,6 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	network "github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	cmap "github.com/orcaman/concurrent-map/v2"
@@ -54,6 +56,9 @@ type Docker struct {
 	storage     storage.IStorage
 	file        file.IFile
 	lockers     cmap.ConcurrentMap[string, *IOLocker]
+	sessions    cmap.ConcurrentMap[string, *gatewaySession]
+	dbLocks     cmap.ConcurrentMap[string, *sync.Mutex]
+	routesLock  sync.Mutex
 	client      *client.Client
 }
 
@@ -232,36 +237,7 @@ func (wm *Docker) dockerCallback(machineId string, dataRaw string) string {
 			log.Println(err)
 			return err.Error()
 		}
-		if op == "putObj" {
-			typ, err := checkField(input, "objType", "")
-			if err != nil {
-				log.Println(err)
-				return err.Error()
-			}
-			id, err := checkField(input, "objId", "")
-			if err != nil {
-				log.Println(err)
-				return err.Error()
-			}
-			objRaw, err := checkField(input, "obj", map[string]any{})
-			if err != nil {
-				log.Println(err)
-				return err.Error()
-			}
-			obj := map[string][]byte{}
-			for k, v := range objRaw {
-				obj[k], err = base64.StdEncoding.DecodeString(v.(string))
-				if err != nil {
-					log.Println(err)
-					return err.Error()
-				}
-			}
-			wm.app.ModifyState(false, func(trx trx.ITrx) error {
-				trx.PutObj(machineId+"->"+typ, id, obj)
-				return nil
-			})
-			return "{}"
-		} else if op == "getObj" {
+		if op == "getObj" {
 			typ, err := checkField(input, "objType", "")
 			if err != nil {
 				log.Println(err)
@@ -275,6 +251,9 @@ func (wm *Docker) dockerCallback(machineId string, dataRaw string) string {
 			obj := map[string][]byte{}
 			wm.app.ModifyState(true, func(trx trx.ITrx) error {
 				obj = trx.GetObj(machineId+"->"+typ, id)
+				if !objExists(obj) {
+					obj = map[string][]byte{}
+				}
 				return nil
 			})
 			otuput, err := json.Marshal(obj)
@@ -315,6 +294,11 @@ func (wm *Docker) dockerCallback(machineId string, dataRaw string) string {
 					links[i] = links[i][len(machineId+"->"+prefix):]
 				}
 				res, err := trx.GetObjList(machineId+"->"+typ, links, map[string]string{})
+				for id, obj := range res {
+					if !objExists(obj) {
+						delete(res, id)
+					}
+				}
 				result = res
 				return err
 			})
@@ -344,22 +328,33 @@ func (wm *Docker) dockerCallback(machineId string, dataRaw string) string {
 			})
 			str, _ := json.Marshal(result)
 			return string(str)
-		} else if op == "putLink" {
-			k, err := checkField(input, "key", "")
+		} else if op == "putObj" || op == "putLink" || op == "delObj" || op == "delLink" || op == "getLink" || op == "defineIndex" || op == "query" {
+			res, err := wm.runDbOps(machineId, []map[string]any{input})
 			if err != nil {
 				log.Println(err)
-				return err.Error()
+				return dbOpResult(nil, err)
 			}
-			v, err := checkField(input, "val", "")
+			return dbOpResult(res[0], nil)
+		} else if op == "batch" {
+			opsRaw, err := checkField(input, "ops", []any{})
 			if err != nil {
 				log.Println(err)
 				return err.Error()
 			}
-			wm.app.ModifyState(false, func(trx trx.ITrx) error {
-				trx.PutLink(machineId+"->"+k, v)
-				return nil
-			})
-			return "{}"
+			ops := make([]map[string]any, 0, len(opsRaw))
+			for _, o := range opsRaw {
+				opMap, ok := o.(map[string]any)
+				if !ok {
+					return dbOpResult(nil, errors.New("batch ops must be objects"))
+				}
+				ops = append(ops, opMap)
+			}
+			res, err := wm.runDbOps(machineId, ops)
+			if err != nil {
+				log.Println(err)
+				return dbOpResult(nil, err)
+			}
+			return dbOpResult(map[string]any{"results": res}, nil)
 		}
 	} else if key == "runDocker" {
 		pointId, err := checkField(input, "pointId", "")
@@ -410,8 +405,23 @@ func (wm *Docker) dockerCallback(machineId string, dataRaw string) string {
 			log.Println(err)
 			return err.Error()
 		}
+		// runs made for a committed request are metered against its token,
+		// runs made outside of one are not
+		callbackId, _ := checkField(input, "callbackId", "")
+		requestId, request, running, err := wm.runningRequest(machineId, callbackId)
+		if err != nil {
+			log.Println(err)
+			return err.Error()
+		}
+		if running && !wm.canRun(requestId, request) {
+			log.Println(ErrTokenExhausted)
+			return ErrTokenExhausted.Error()
+		}
 		wm.SaRContainer(machineId, imageName, containerName)
-		outputFile, err := wm.RunContainer(machineId, pointId, imageName, containerName, finalInputFiles, false)
+		outputFile, usage, err := wm.RunContainer(machineId, pointId, imageName, containerName, finalInputFiles, false)
+		if running && usage != nil {
+			wm.meter(requestId, usage)
+		}
 		if err != nil {
 			log.Println(err)
 			return err.Error()
@@ -498,34 +508,22 @@ func (wm *Docker) dockerCallback(machineId string, dataRaw string) string {
 			log.Println(err)
 			return err.Error()
 		}
-		req, err := http.NewRequest(method, url, bytes.NewBuffer([]byte(body)))
-		if err != nil {
-			log.Println("Error creating request:" + err.Error())
-			return err.Error()
-		}
+		// the call is metered against the token of the committed request
+		// the machine runs it for, never one the machine names itself
+		callbackId, _ := checkField(input, "callbackId", "")
 		heads := map[string]string{}
 		err = json.Unmarshal([]byte(headers), &heads)
 		if err != nil {
 			log.Println(err)
 			return err.Error()
 		}
-		for k, v := range heads {
-			req.Header.Set(k, v)
-		}
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		res, err := egress.Send(wm.app, callbackId, egress.Request{MachineId: machineId, Method: method, Url: url, Headers: heads, Body: []byte(body)})
 		if err != nil {
 			log.Println("Request failed:" + err.Error())
 			return err.Error()
 		}
-		defer resp.Body.Close()
-		log.Println("Response status:" + resp.Status)
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Println("Error reading response body:" + err.Error())
-			return err.Error()
-		}
-		return base64.StdEncoding.EncodeToString(bodyBytes)
+		log.Println("Response status:" + strconv.Itoa(res.Status))
+		return base64.StdEncoding.EncodeToString(res.Body)
 	} else if key == "checkTokenValidity" {
 		tokenOwnerId, err := checkField(input, "tokenOwnerId", "")
 		if err != nil {
@@ -538,16 +536,18 @@ func (wm *Docker) dockerCallback(machineId string, dataRaw string) string {
 			return err.Error()
 		}
 		gasLimit := int64(0)
+		metered := int64(0)
 		wm.app.ModifyState(true, func(trx trx.ITrx) error {
 			if trx.GetString("Temp::User::"+tokenOwnerId+"::consumedTokens::"+tokenId) == "true" {
 				return nil
 			}
 			if m, e := trx.GetJson("Json::User::"+tokenOwnerId, "lockedTokens."+tokenId); e == nil {
-				gasLimit = int64(m["amount"].(float64))
+				metered = models.TokenMeter{TokenOwnerId: tokenOwnerId, TokenId: tokenId}.Cost(trx)
+				gasLimit = max(int64(m["amount"].(float64))-metered, 0)
 			}
 			return nil
 		})
-		jsn, _ := json.Marshal(map[string]any{"gasLimit": gasLimit})
+		jsn, _ := json.Marshal(map[string]any{"gasLimit": gasLimit, "metered": metered})
 		return string(jsn)
 	} else if key == "submitOnchainResponse" {
 		callbackId, err := checkField(input, "callbackId", "")
@@ -590,12 +590,16 @@ func (wm *Docker) dockerCallback(machineId string, dataRaw string) string {
 			log.Println(err)
 			return err.Error()
 		}
-		trxInp := packet.ConsumeTokenInput{TokenId: tokenId, Amount: int64(cost), TokenOwnerId: tokenOwnerId}
-		i, _ := json.Marshal(trxInp)
+		amount := int64(cost)
 		wm.app.ModifyState(false, func(trx trx.ITrx) error {
+			meter := models.TokenMeter{TokenOwnerId: tokenOwnerId, TokenId: tokenId}
+			amount = max(amount, meter.Cost(trx))
 			trx.PutString("Temp::User::"+tokenOwnerId+"::consumedTokens::"+tokenId, "true")
+			meter.Clear(trx)
 			return nil
 		})
+		trxInp := packet.ConsumeTokenInput{TokenId: tokenId, Amount: amount, TokenOwnerId: tokenOwnerId}
+		i, _ := json.Marshal(trxInp)
 		wm.app.ExecAppletResponseOnChain(callbackId, []byte(pack), "#appletsign", int(resCode), e, []update.Update{{Val: []byte("consumeToken: " + string(i))}, {Val: []byte("applet: " + changes)}})
 	} else if key == "submitOnchainTrx" {
 		targetMachineId, err := checkField(input, "targetMachineId", "")
@@ -674,7 +678,7 @@ func (wm *Docker) dockerCallback(machineId string, dataRaw string) string {
 				wm.app.ExecBaseRequestOnChain(k, data, userSignature, userId, tag, func(b []byte, i int, err error) {
 					if err != nil {
 						log.Println(err)
-						return
+						b = chain.FailedResult(i)
 					}
 					result = b
 					if isRequesterOnchain {
@@ -705,7 +709,7 @@ func (wm *Docker) dockerCallback(machineId string, dataRaw string) string {
 				wm.app.ExecAppletRequestOnChain(dstPointId, targetMachineId, k, data, userSignature, userId, tag, tokenId, func(b []byte, i int, err error) {
 					if err != nil {
 						log.Println(err)
-						return
+						b = chain.FailedResult(i)
 					}
 					result = b
 					if isRequesterOnchain {
@@ -816,15 +820,21 @@ func (wm *Docker) Assign(machineId string) {
 	})
 }
 
-func (wm *Docker) RunContainer(machineId string, pointId string, imageName string, containerName string, inputFile map[string]string, standalone bool) (*models.File, error) {
+func (wm *Docker) RunContainer(machineId string, pointId string, imageName string, containerName string, inputFile map[string]string, standalone bool) (*models.File, *docker.ContainerUsage, error) {
 
 	cn := strings.Join(strings.Split(machineId, "@"), "_") + "_" + imageName + "_" + containerName
 
 	ctx := context.Background()
 
+	limits := wm.resourcesOf(machineId)
+	resources, storageOpt := hostResources(limits)
+
+	session := wm.openSession(machineId, imageName, containerName)
+	defer wm.closeSession(session)
+
 	config := &container.Config{
 		Image: strings.Join(strings.Split(machineId, "@"), "_") + "/" + imageName,
-		Env:   []string{},
+		Env:   session.env(),
 	}
 
 	_, err := wm.client.ContainerCreate(
@@ -837,6 +847,8 @@ func (wm *Docker) RunContainer(machineId string, pointId string, imageName strin
 			},
 			Runtime:     "runsc",
 			NetworkMode: "kasper",
+			Resources:   resources,
+			StorageOpt:  storageOpt,
 		},
 		nil,
 		nil,
@@ -845,21 +857,25 @@ func (wm *Docker) RunContainer(machineId string, pointId string, imageName strin
 
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		return nil, nil, err
 	}
 	defer wm.SaRContainer(machineId, imageName, containerName)
+	usage := &docker.ContainerUsage{}
+	timedOut := atomic.Bool{}
 	if !standalone {
-		future.Async(func() {
-			time.Sleep(60 * time.Minute)
+		timer := time.AfterFunc(time.Duration(limits.TimeoutSeconds)*time.Second, func() {
+			log.Println("Container ", cn, " timed out")
+			timedOut.Store(true)
 			wm.SaRContainer(machineId, imageName, containerName)
-		}, false)
+		})
+		defer timer.Stop()
 	}
 
 	tarId := WriteToTar(inputFile)
 	tarStream, err := os.Open(tarId)
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	err = wm.client.CopyToContainer(ctx, cn, "/app/input", tarStream, container.CopyToContainerOptions{
@@ -867,14 +883,21 @@ func (wm *Docker) RunContainer(machineId string, pointId string, imageName strin
 	})
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	err = wm.client.ContainerStart(ctx, cn, container.StartOptions{})
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		return nil, nil, err
 	}
+	wm.openRoute(session)
+	defer wm.closeRoute(session)
+	started := time.Now()
+	statsCtx, stopStats := context.WithCancel(ctx)
+	statsDone := make(chan struct{})
+	future.Async(func() { wm.watchUsage(statsCtx, cn, usage, statsDone) }, false)
+	defer stopStats()
 
 	log.Println("Container ", cn, " is created")
 
@@ -890,7 +913,7 @@ func (wm *Docker) RunContainer(machineId string, pointId string, imageName strin
 
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	statusCh, errCh := wm.client.ContainerWait(ctx, cn, container.WaitConditionNotRunning)
@@ -898,26 +921,34 @@ func (wm *Docker) RunContainer(machineId string, pointId string, imageName strin
 	case err := <-errCh:
 		if err != nil {
 			log.Println(err)
-			return nil, err
+			return nil, nil, err
 		}
 	case <-statusCh:
 	}
+	stopStats()
+	<-statsDone
+	usage.WallSeconds = time.Since(started).Seconds()
+	usage.TimedOut = timedOut.Load()
+	log.Println("Container ", cn, " used ", usage.CpuSeconds, " cpu seconds and ", usage.PeakMemory, " bytes of memory at peak")
+	if usage.TimedOut {
+		return nil, usage, ErrRunTimedOut
+	}
 	if !standalone {
 		reader, _, err := wm.client.CopyFromContainer(ctx, cn, "/app/output")
 		if err != nil {
 			log.Println(err)
-			return nil, nil
+			return nil, usage, err
 		}
 		defer reader.Close()
 		r := tar.NewReader(reader)
 		file, err := wm.readFromTar(r, machineId, pointId)
 		if err != nil {
 			log.Println(err)
-			return nil, err
+			return nil, usage, err
 		}
-		return file, nil
+		return file, usage, nil
 	} else {
-		return nil, nil
+		return nil, usage, nil
 	}
 }
 
@@ -1074,40 +1105,6 @@ func (wm *Docker) ExecContainer(machineId string, imageName string, containerNam
 	return string(stdout) + string(stderr), nil
 }
 
-func getContainerNameByIP(ip string, cli *client.Client) string {
-	ctx := context.Background()
-
-	// Get a list of all Docker networks.
-	networks, err := cli.NetworkList(ctx, network.ListOptions{})
-	if err != nil {
-		log.Println("Failed to list Docker networks:", err)
-		return ""
-	}
-
-	// Iterate through each network to inspect its connected containers.
-	for _, net := range networks {
-		log.Println(net.Name)
-		netInspect, err := cli.NetworkInspect(ctx, net.ID, network.InspectOptions{})
-		if err != nil {
-			log.Println("Failed to inspect network:", err)
-			continue
-		}
-		log.Println(net.Name)
-
-		// Look for a container on this network that has the matching IP.
-		for _, container := range netInspect.Containers {
-			log.Println(container.Name)
-			// Check if the container's IPv4 address matches the client's IP.
-			if strings.Split(container.IPv4Address, "/")[0] == ip {
-				log.Println(container.Name)
-				// The container name is prefixed with a slash; remove it.
-				return strings.TrimPrefix(container.Name, "/")
-			}
-		}
-	}
-	return ""
-}
-
 func genProxyConfig() string {
 	var proxyConfig = `
 	events {}
@@ -1209,7 +1206,7 @@ func (wm *Docker) RunGateway() {
 		userId := r.URL.Query().Get("userId")
 		inputBody := []byte(r.URL.Query().Get("input"))
 		signature := r.URL.Query().Get("signature")
-		if success, _, _ := wm.app.Tools().Security().AuthWithSignature(userId, inputBody, string(signature)); !success {
+		if success, _, _ := wm.app.Tools().Security().AuthWithEnvelope(userId, r.URL.Path, "", inputBody, string(signature)); !success {
 			log.Println("Error accessing point:", err.Error())
 			http.Error(w, "signature verification failed", http.StatusForbidden)
 			return
@@ -1307,124 +1304,10 @@ func NewDocker(core core.ICore, storageRoot string, storage storage.IStorage, fi
 		storage:     storage,
 		file:        file,
 		lockers:     cmap.New[*IOLocker](),
+		sessions:    cmap.New[*gatewaySession](),
+		dbLocks:     cmap.New[*sync.Mutex](),
 		client:      client,
 	}
-	future.Async(func() {
-		listener, err := net.Listen("tcp", ":8084")
-		if err != nil {
-			log.Fatalf("Failed to start TCP server: %v", err)
-		}
-		defer listener.Close()
-		log.Println("Docker tcp server listening on :8084")
-		for {
-			c, err := listener.Accept()
-			if err != nil {
-				log.Println("Error accepting connection:", err)
-				continue
-			}
-			remoteAddr := c.RemoteAddr().String()
-			clientIP := strings.Split(remoteAddr, ":")[0]
-			log.Printf("Connection from IP: %s", clientIP)
-			containerName := getContainerNameByIP(clientIP, client)
-			log.Println(containerName)
-			cnParts := strings.Split(containerName, "_")
-			machineId := cnParts[0] + "@" + cnParts[1]
-
-			if cnParts[2] == "main" && cnParts[3] == "main" {
-				locker, found := wm.lockers.Get(machineId)
-				if found {
-					locker.conn = c
-				}
-				activeMachines[machineId] = true
-			} else {
-				locker, found := wm.lockers.Get(machineId + "_" + cnParts[2] + "_" + cnParts[3])
-				if found {
-					locker.conn = c
-				}
-				sideMachines[machineId+"_"+cnParts[2]+"_"+cnParts[3]] = true
-			}
-
-			config := genProxyConfig()
-			file.SaveDataToGlobalStorage(storageRoot+"/docker_proxy", []byte(config), "nginx.conf", true)
-
-			func() {
-				ctx := context.Background()
-				config := container.ExecOptions{
-					AttachStderr: true,
-					AttachStdout: true,
-					Cmd:          strings.Split("nginx -s reload", " "),
-				}
-				res, err := wm.client.ContainerExecCreate(ctx, "kasper-proxy", config)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				execId := res.ID
-				resp, err := wm.client.ContainerExecAttach(ctx, execId, container.ExecAttachOptions{})
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				defer resp.Close()
-			}()
-
-			future.Async(func() {
-				defer func() {
-					c.Close()
-					log.Printf("docker container disconnected")
-				}()
-
-				log.Printf("docker container connected")
-				r := bufio.NewReader(c)
-				for {
-					var ln uint32
-					if err := binary.Read(r, binary.LittleEndian, &ln); err != nil {
-						if err != io.EOF {
-							log.Printf("read len err: %v", err)
-						}
-						return
-					}
-					var cbId uint64
-					if err := binary.Read(r, binary.LittleEndian, &cbId); err != nil {
-						if err != io.EOF {
-							log.Printf("read len err: %v", err)
-						}
-						return
-					}
-					buf := make([]byte, ln)
-					if _, err := io.ReadFull(r, buf); err != nil {
-						log.Printf("read body err: %v", err)
-						return
-					}
-					data := []byte(wm.dockerCallback(machineId, string(buf)))
-					var locker *IOLocker
-					if cnParts[2] == "main" && cnParts[3] == "main" {
-						l, found := wm.lockers.Get(machineId)
-						if found {
-							locker = l
-						}
-					} else {
-						l, found := wm.lockers.Get(machineId + "_" + cnParts[2] + "_" + cnParts[3])
-						if found {
-							locker = l
-						}
-					}
-					if locker != nil {
-						func() {
-							locker.Lock.Lock()
-							defer locker.Lock.Unlock()
-							lenBytes := make([]byte, 4)
-							binary.LittleEndian.PutUint32(lenBytes, uint32(len(data)))
-							locker.conn.Write(lenBytes)
-							callbackId := make([]byte, 8)
-							binary.LittleEndian.PutUint64(callbackId, cbId)
-							locker.conn.Write(callbackId)
-							locker.conn.Write(data)
-						}()
-					}
-				}
-			}, false)
-		}
-	}, false)
+	future.Async(wm.listenToContainers, false)
 	return wm
 }
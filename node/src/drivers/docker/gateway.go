@@ -0,0 +1,281 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kasper/src/shell/utils/future"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/google/uuid"
+)
+
+const maxHandshakeFrameSize = uint32(4096)
+
+var ErrHandshakeFailed = errors.New("container handshake failed")
+
+type gatewaySession struct {
+	MachineId     string
+	ImageName     string
+	ContainerName string
+	RunId         string
+	secret        string
+	locker        *IOLocker
+	conn          net.Conn
+}
+
+func (s *gatewaySession) isMain() bool {
+	return s.ImageName == "main" && s.ContainerName == "main"
+}
+
+func (s *gatewaySession) routeKey() string {
+	if s.isMain() {
+		return s.MachineId
+	}
+	return s.MachineId + "_" + s.ImageName + "_" + s.ContainerName
+}
+
+func (s *gatewaySession) env() []string {
+	return []string{"KASPER_RUN_ID=" + s.RunId, "KASPER_RUN_SECRET=" + s.secret}
+}
+
+func (s *gatewaySession) String() string {
+	return fmt.Sprintf("%s %s/%s run %s", s.MachineId, s.ImageName, s.ContainerName, s.RunId)
+}
+
+func handshakeProof(secret string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func readFrame(r *bufio.Reader, maxSize uint32) (uint64, []byte, error) {
+	var ln uint32
+	if err := binary.Read(r, binary.LittleEndian, &ln); err != nil {
+		return 0, nil, err
+	}
+	if maxSize > 0 && ln > maxSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", ln)
+	}
+	var cbId uint64
+	if err := binary.Read(r, binary.LittleEndian, &cbId); err != nil {
+		return 0, nil, err
+	}
+	buf := make([]byte, ln)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	return cbId, buf, nil
+}
+
+func writeFrame(w io.Writer, cbId uint64, data []byte) error {
+	frame := make([]byte, 12, 12+len(data))
+	binary.LittleEndian.PutUint32(frame[:4], uint32(len(data)))
+	binary.LittleEndian.PutUint64(frame[4:12], cbId)
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+// openSession issues the run id and secret of a container run. Runs of the
+// main container share the locker signals to the machine are written on.
+func (wm *Docker) openSession(machineId string, imageName string, containerName string) *gatewaySession {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	s := &gatewaySession{
+		MachineId:     machineId,
+		ImageName:     imageName,
+		ContainerName: containerName,
+		RunId:         uuid.NewString(),
+		secret:        hex.EncodeToString(secret),
+	}
+	if s.isMain() {
+		wm.lockers.SetIfAbsent(machineId, &IOLocker{})
+		s.locker, _ = wm.lockers.Get(machineId)
+	} else {
+		s.locker = &IOLocker{}
+	}
+	wm.sessions.Set(s.RunId, s)
+	return s
+}
+
+func (wm *Docker) closeSession(s *gatewaySession) {
+	wm.sessions.Remove(s.RunId)
+	s.locker.Lock.Lock()
+	defer s.locker.Lock.Unlock()
+	if s.conn != nil {
+		if s.locker.conn == s.conn {
+			s.locker.conn = nil
+		}
+		s.conn.Close()
+	}
+}
+
+// handshake challenges a container with a nonce it answers with its run id and
+// the HMAC-SHA256 of the nonce keyed by the secret of that run, and binds the
+// connection to the run.
+func (wm *Docker) handshake(c net.Conn, r *bufio.Reader) (*gatewaySession, error) {
+	timeout := 10 * time.Second
+	if v, err := strconv.ParseInt(os.Getenv("DOCKER_HANDSHAKE_TIMEOUT"), 10, 64); err == nil && v > 0 {
+		timeout = time.Duration(v) * time.Second
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	defer c.SetDeadline(time.Time{})
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	challenge, _ := json.Marshal(map[string]any{"key": "challenge", "input": map[string]any{"nonce": hex.EncodeToString(nonce)}})
+	if err := writeFrame(c, 0, challenge); err != nil {
+		return nil, err
+	}
+	_, data, err := readFrame(r, maxHandshakeFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	packet := struct {
+		Key   string `json:"key"`
+		Input struct {
+			RunId string `json:"runId"`
+			Proof string `json:"proof"`
+		} `json:"input"`
+	}{}
+	if err := json.Unmarshal(data, &packet); err != nil || packet.Key != "handshake" {
+		return nil, ErrHandshakeFailed
+	}
+	s, found := wm.sessions.Get(packet.Input.RunId)
+	if !found {
+		return nil, fmt.Errorf("%w: unknown run %s", ErrHandshakeFailed, packet.Input.RunId)
+	}
+	proof, err := hex.DecodeString(packet.Input.Proof)
+	if err != nil || !hmac.Equal(proof, handshakeProof(s.secret, nonce)) {
+		return nil, fmt.Errorf("%w: bad proof for run %s", ErrHandshakeFailed, s.RunId)
+	}
+	s.locker.Lock.Lock()
+	defer s.locker.Lock.Unlock()
+	if s.conn != nil {
+		return nil, fmt.Errorf("%w: run %s is already connected", ErrHandshakeFailed, s.RunId)
+	}
+	if _, open := wm.sessions.Get(s.RunId); !open {
+		return nil, fmt.Errorf("%w: run %s has ended", ErrHandshakeFailed, s.RunId)
+	}
+	s.conn = c
+	s.locker.conn = c
+	return s, nil
+}
+
+func (wm *Docker) serveContainer(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	s, err := wm.handshake(c, r)
+	if err != nil {
+		log.Println("rejected container connection from", c.RemoteAddr(), ":", err)
+		return
+	}
+	log.Println("docker container connected:", s)
+	defer func() {
+		s.locker.Lock.Lock()
+		defer s.locker.Lock.Unlock()
+		if s.conn == c {
+			s.conn = nil
+			if s.locker.conn == c {
+				s.locker.conn = nil
+			}
+		}
+		log.Println("docker container disconnected:", s)
+	}()
+	for {
+		cbId, buf, err := readFrame(r, 0)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("read frame err: %v", err)
+			}
+			return
+		}
+		data := []byte(wm.dockerCallback(s.MachineId, string(buf)))
+		func() {
+			s.locker.Lock.Lock()
+			defer s.locker.Lock.Unlock()
+			if s.conn == c {
+				writeFrame(c, cbId, data)
+			}
+		}()
+	}
+}
+
+func (wm *Docker) listenToContainers() {
+	listener, err := net.Listen("tcp", ":8084")
+	if err != nil {
+		log.Fatalf("Failed to start TCP server: %v", err)
+	}
+	defer listener.Close()
+	log.Println("Docker tcp server listening on :8084")
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			log.Println("Error accepting connection:", err)
+			continue
+		}
+		future.Async(func() { wm.serveContainer(c) }, false)
+	}
+}
+
+// openRoute and closeRoute expose the http server of a container through the
+// proxy for as long as the container runs.
+func (wm *Docker) openRoute(s *gatewaySession) {
+	wm.routesLock.Lock()
+	defer wm.routesLock.Unlock()
+	if s.isMain() {
+		activeMachines[s.routeKey()] = true
+	} else {
+		sideMachines[s.routeKey()] = true
+	}
+	wm.reloadProxy()
+}
+
+func (wm *Docker) closeRoute(s *gatewaySession) {
+	wm.routesLock.Lock()
+	defer wm.routesLock.Unlock()
+	if s.isMain() {
+		delete(activeMachines, s.routeKey())
+	} else {
+		delete(sideMachines, s.routeKey())
+	}
+	wm.reloadProxy()
+}
+
+func (wm *Docker) reloadProxy() {
+	config := genProxyConfig()
+	wm.file.SaveDataToGlobalStorage(wm.storageRoot+"/docker_proxy", []byte(config), "nginx.conf", true)
+	ctx := context.Background()
+	res, err := wm.client.ContainerExecCreate(ctx, "kasper-proxy", container.ExecOptions{
+		AttachStderr: true,
+		AttachStdout: true,
+		Cmd:          strings.Split("nginx -s reload", " "),
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resp, err := wm.client.ContainerExecAttach(ctx, res.ID, container.ExecAttachOptions{})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Close()
+}
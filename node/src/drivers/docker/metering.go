@@ -0,0 +1,192 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kasper/src/abstract/adapters/docker"
+	"kasper/src/abstract/models/chain"
+	"kasper/src/abstract/models/trx"
+	models "kasper/src/shell/api/model"
+	"log"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+var (
+	ErrRunTimedOut    = errors.New("container run timed out")
+	ErrTokenExhausted = errors.New("token is not locked or has nothing left for the run")
+	ErrRequestUnnamed = errors.New("the machine runs more than one request, name the one the run is for")
+)
+
+// Container runs are priced alike on every node, so the prices and the
+// resources assumed when a vm declares none are part of the protocol rather
+// than node settings.
+const (
+	CpuSecondPrice       = 1.0
+	MemoryMbPrice        = 0.01
+	pricedCpus           = 1.0
+	pricedMemoryMb       = 1024
+	pricedTimeoutSeconds = 3600
+)
+
+// resourcesOf is what a vm declared, capped by the node wide ceilings. A vm that
+// declares nothing, or more than allowed, gets the ceiling.
+func (wm *Docker) resourcesOf(machineId string) models.VmResources {
+	maxCpus := 1.0
+	if v, err := strconv.ParseFloat(os.Getenv("DOCKER_MAX_CPUS"), 64); err == nil && v > 0 {
+		maxCpus = v
+	}
+	maxMemoryMb := int64(1024)
+	if v, err := strconv.ParseInt(os.Getenv("DOCKER_MAX_MEMORY_MB"), 10, 64); err == nil && v > 0 {
+		maxMemoryMb = v
+	}
+	maxPids := int64(256)
+	if v, err := strconv.ParseInt(os.Getenv("DOCKER_MAX_PIDS"), 10, 64); err == nil && v > 0 {
+		maxPids = v
+	}
+	maxDiskMb := int64(0)
+	if v, err := strconv.ParseInt(os.Getenv("DOCKER_MAX_DISK_MB"), 10, 64); err == nil && v > 0 {
+		maxDiskMb = v
+	}
+	maxTimeout := int64(3600)
+	if v, err := strconv.ParseInt(os.Getenv("DOCKER_RUN_TIMEOUT"), 10, 64); err == nil && v > 0 {
+		maxTimeout = v
+	}
+	r := models.VmResources{}
+	wm.app.ModifyState(true, func(trx trx.ITrx) error {
+		r = models.VmResources{}.Pull(trx, machineId)
+		return nil
+	})
+	if r.Cpus <= 0 || r.Cpus > maxCpus {
+		r.Cpus = maxCpus
+	}
+	if r.MemoryMb <= 0 || r.MemoryMb > maxMemoryMb {
+		r.MemoryMb = maxMemoryMb
+	}
+	if r.PidsLimit <= 0 || r.PidsLimit > maxPids {
+		r.PidsLimit = maxPids
+	}
+	if maxDiskMb > 0 && (r.DiskMb <= 0 || r.DiskMb > maxDiskMb) {
+		r.DiskMb = maxDiskMb
+	}
+	if r.TimeoutSeconds <= 0 || r.TimeoutSeconds > maxTimeout {
+		r.TimeoutSeconds = maxTimeout
+	}
+	return r
+}
+
+func hostResources(r models.VmResources) (container.Resources, map[string]string) {
+	pids := r.PidsLimit
+	resources := container.Resources{
+		NanoCPUs:   int64(r.Cpus * 1e9),
+		Memory:     r.MemoryMb * 1024 * 1024,
+		MemorySwap: r.MemoryMb * 1024 * 1024,
+		PidsLimit:  &pids,
+	}
+	var storageOpt map[string]string
+	if r.DiskMb > 0 {
+		storageOpt = map[string]string{"size": strconv.FormatInt(r.DiskMb, 10) + "M"}
+	}
+	return resources, storageOpt
+}
+
+// watchUsage follows the stats stream of a container until ctx is done,
+// keeping its total cpu time and the highest memory usage seen.
+func (wm *Docker) watchUsage(ctx context.Context, cn string, usage *docker.ContainerUsage, done chan struct{}) {
+	defer close(done)
+	stats, err := wm.client.ContainerStats(ctx, cn, true)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer stats.Body.Close()
+	decoder := json.NewDecoder(stats.Body)
+	for {
+		s := container.StatsResponse{}
+		if err := decoder.Decode(&s); err != nil {
+			return
+		}
+		if cpu := float64(s.CPUStats.CPUUsage.TotalUsage) / 1e9; cpu > usage.CpuSeconds {
+			usage.CpuSeconds = cpu
+		}
+		peak := s.MemoryStats.MaxUsage
+		if s.MemoryStats.Usage > peak {
+			peak = s.MemoryStats.Usage
+		}
+		if peak > usage.PeakMemory {
+			usage.PeakMemory = peak
+		}
+	}
+}
+
+// RunCost prices a container run of a machine up front from the resources its
+// vm declared on chain: the cpus it may use for its whole timeout and the
+// memory it may hold.
+func (wm *Docker) RunCost(machineId string) int64 {
+	r := models.VmResources{}
+	wm.app.ModifyState(true, func(trx trx.ITrx) error {
+		r = models.VmResources{}.Pull(trx, machineId)
+		return nil
+	})
+	if r.Cpus <= 0 {
+		r.Cpus = pricedCpus
+	}
+	if r.MemoryMb <= 0 {
+		r.MemoryMb = pricedMemoryMb
+	}
+	if r.TimeoutSeconds <= 0 {
+		r.TimeoutSeconds = pricedTimeoutSeconds
+	}
+	cost := r.Cpus*float64(r.TimeoutSeconds)*CpuSecondPrice + float64(r.MemoryMb)*MemoryMbPrice
+	return int64(math.Ceil(cost))
+}
+
+// UsageCost prices what a container run used.
+func UsageCost(usage *docker.ContainerUsage) int64 {
+	cost := usage.CpuSeconds*CpuSecondPrice + float64(usage.PeakMemory)/(1024*1024)*MemoryMbPrice
+	return int64(math.Ceil(cost))
+}
+
+// runningRequest finds the committed request a run is made for. A run that
+// names none is made for the one request the machine runs on this node.
+func (wm *Docker) runningRequest(machineId string, callbackId string) (string, chain.ChainCallback, bool, error) {
+	if callbackId == "" {
+		ids := wm.app.RunningRequests(machineId)
+		if len(ids) > 1 {
+			return "", chain.ChainCallback{}, false, ErrRequestUnnamed
+		}
+		if len(ids) == 0 {
+			return "", chain.ChainCallback{}, false, nil
+		}
+		callbackId = ids[0]
+	}
+	request, running := wm.app.RunningRequest(machineId, callbackId)
+	return callbackId, request, running, nil
+}
+
+// canRun tells if the token of a request has something left once what it
+// spent on egress and on earlier runs is taken off.
+func (wm *Docker) canRun(requestId string, request chain.ChainCallback) bool {
+	can := false
+	wm.app.ModifyState(true, func(trx trx.ITrx) error {
+		remaining, locked := models.TokenMeter{TokenOwnerId: request.TokenOwnerId, TokenId: request.TokenId}.Remaining(trx)
+		can = locked && remaining-models.RunUsage{RequestId: requestId}.Cost(trx) > 0
+		return nil
+	})
+	return can
+}
+
+// meter adds what a run used to the usage this node reports with its response
+// to the request. The chain charges the token what the response quorum agreed
+// on, so the same figure is charged on every node.
+func (wm *Docker) meter(requestId string, usage *docker.ContainerUsage) {
+	cost := UsageCost(usage)
+	wm.app.ModifyState(false, func(trx trx.ITrx) error {
+		models.RunUsage{RequestId: requestId}.Add(trx, cost)
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+package docker
+
+import (
+	"errors"
+	"kasper/src/abstract/adapters/docker"
+	"kasper/src/abstract/models/chain"
+	"kasper/src/abstract/models/trx"
+	models "kasper/src/shell/api/model"
+	"slices"
+	"testing"
+)
+
+// runCore is a dbCore running the given committed requests.
+type runCore struct {
+	*dbCore
+	requests map[string]chain.ChainCallback
+}
+
+func (c runCore) RunningRequests(machineId string) []string {
+	ids := []string{}
+	for id, request := range c.requests {
+		if request.MachineId == machineId {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func (c runCore) RunningRequest(machineId string, callbackId string) (chain.ChainCallback, bool) {
+	request, ok := c.requests[callbackId]
+	if !ok || request.MachineId != machineId {
+		return chain.ChainCallback{}, false
+	}
+	return request, true
+}
+
+func newRunDocker(t *testing.T, requests map[string]chain.ChainCallback) (*Docker, *dbCore) {
+	wm, app := newTestDocker(t)
+	wm.app = runCore{dbCore: app, requests: requests}
+	return wm, app
+}
+
+func TestUsageCost(t *testing.T) {
+	cases := []struct {
+		usage docker.ContainerUsage
+		want  int64
+	}{
+		{docker.ContainerUsage{}, 0},
+		{docker.ContainerUsage{CpuSeconds: 2, PeakMemory: 512 * 1024 * 1024}, 8},
+		{docker.ContainerUsage{CpuSeconds: 0.1, WallSeconds: 3600}, 1},
+	}
+	for _, c := range cases {
+		if got := UsageCost(&c.usage); got != c.want {
+			t.Fatalf("cost of %+v is %d, want %d", c.usage, got, c.want)
+		}
+	}
+}
+
+func TestRunningRequestOfRun(t *testing.T) {
+	wm, _ := newRunDocker(t, map[string]chain.ChainCallback{
+		"r1": {MachineId: "m1", TokenOwnerId: "o", TokenId: "t1"},
+		"r2": {MachineId: "m1", TokenOwnerId: "o", TokenId: "t2"},
+		"r3": {MachineId: "m2", TokenOwnerId: "o", TokenId: "t3"},
+	})
+	if _, _, _, err := wm.runningRequest("m1", ""); !errors.Is(err, ErrRequestUnnamed) {
+		t.Fatalf("unnamed run of a machine running two requests gave %v", err)
+	}
+	if id, request, running, err := wm.runningRequest("m1", "r2"); err != nil || !running || id != "r2" || request.TokenId != "t2" {
+		t.Fatalf("named run gave %s %+v %v %v", id, request, running, err)
+	}
+	if id, _, running, err := wm.runningRequest("m2", ""); err != nil || !running || id != "r3" {
+		t.Fatalf("unnamed run of a machine running one request gave %s %v %v", id, running, err)
+	}
+	if _, _, running, err := wm.runningRequest("m2", "r1"); err != nil || running {
+		t.Fatalf("run named another machine's request")
+	}
+	if _, _, running, err := wm.runningRequest("m3", ""); err != nil || running {
+		t.Fatalf("run of an idle machine is metered")
+	}
+}
+
+func TestMeterRunAgainstToken(t *testing.T) {
+	request := chain.ChainCallback{MachineId: "m1", TokenOwnerId: "o", TokenId: "t1"}
+	wm, app := newRunDocker(t, map[string]chain.ChainCallback{"r1": request})
+	if wm.canRun("r1", request) {
+		t.Fatalf("run allowed on a token that is not locked")
+	}
+	app.ModifyState(false, func(trx trx.ITrx) error {
+		return trx.PutJson("Json::User::o", "lockedTokens.t1", map[string]any{"type": "exec", "amount": 10}, true)
+	})
+	if !wm.canRun("r1", request) {
+		t.Fatalf("run refused on a locked token")
+	}
+	wm.meter("r1", &docker.ContainerUsage{CpuSeconds: 4})
+	wm.meter("r1", &docker.ContainerUsage{CpuSeconds: 3})
+	usage := int64(0)
+	app.ModifyState(true, func(trx trx.ITrx) error {
+		usage = models.RunUsage{RequestId: "r1"}.Cost(trx)
+		return nil
+	})
+	if usage != 7 {
+		t.Fatalf("usage of the request %d, want 7", usage)
+	}
+	wm.meter("r1", &docker.ContainerUsage{CpuSeconds: 3})
+	if wm.canRun("r1", request) {
+		t.Fatalf("run allowed once the token is used up")
+	}
+}
@@ -0,0 +1,257 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kasper/src/drivers/network/chain/config"
+	"kasper/src/drivers/network/chain/peers"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+var bootstrapClient = &http.Client{Timeout: 10 * time.Second}
+
+// babbleKeyDir holds the validator key pair and the genesis peer set of the
+// node.
+func babbleKeyDir() string {
+	if dir := os.Getenv("BABBLE_KEY_DIR"); dir != "" {
+		return dir
+	}
+	return config.DefaultDataDir()
+}
+
+// provisionKeys copies the validator key pair of the node into the data
+// directory of a shard chain.
+func provisionKeys(dataDir string) error {
+	for _, name := range []string{config.DefaultKeyfile, "key.pub"} {
+		data, err := os.ReadFile(filepath.Join(babbleKeyDir(), name))
+		if err != nil {
+			if name == config.DefaultKeyfile {
+				return fmt.Errorf("reading validator key: %w", err)
+			}
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dataDir, name), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePeerSets(dataDir string, genesis []*peers.Peer, current []*peers.Peer) error {
+	if err := peers.NewJSONPeerSet(dataDir, false).Write(genesis); err != nil {
+		return err
+	}
+	return peers.NewJSONPeerSet(dataDir, true).Write(current)
+}
+
+// serviceAddr points at the service endpoint of a peer given its babble address.
+func serviceAddr(netAddr string) string {
+	host, _, err := net.SplitHostPort(netAddr)
+	if err != nil {
+		host = netAddr
+	}
+	_, port, _ := net.SplitHostPort(config.DefaultServiceAddr)
+	return net.JoinHostPort(host, port)
+}
+
+func fetchPeerSet(addr string, workChainId string, shardChainId string, path string) ([]*peers.Peer, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Work-Chain-Id", workChainId)
+	req.Header.Set("Shard-Chain-Id", shardChainId)
+	res, err := bootstrapClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s%s answered %s", addr, path, res.Status)
+	}
+	ps := []*peers.Peer{}
+	if err := json.NewDecoder(res.Body).Decode(&ps); err != nil {
+		return nil, err
+	}
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("%s%s returned no peers", addr, path)
+	}
+	return ps, nil
+}
+
+// verifyPeerSet checks that every peer of a fetched set is one of the trusted
+// peers, comparing public keys.
+func verifyPeerSet(ps []*peers.Peer, trusted []*peers.Peer) error {
+	keys := make([]string, 0, len(trusted))
+	for _, p := range trusted {
+		keys = append(keys, p.PubKeyString())
+	}
+	for _, p := range ps {
+		if !slices.Contains(keys, p.PubKeyString()) {
+			return fmt.Errorf("peer %s (%s) is not trusted", p.NetAddr, p.PubKeyHex)
+		}
+	}
+	return nil
+}
+
+// peerSetHash hashes the public keys of a peer set in sorted order, so it does
+// not depend on the order or the addresses of the peers.
+func peerSetHash(ps []*peers.Peer) string {
+	keys := make([]string, 0, len(ps))
+	for _, p := range ps {
+		keys = append(keys, p.PubKeyString())
+	}
+	sort.Strings(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// trustedPeers keeps the peers of a fetched current set that are in the
+// verified genesis set or registered on chain, and fails when none is.
+func trustedPeers(current []*peers.Peer, genesis []*peers.Peer, registered func(host string) bool) ([]*peers.Peer, error) {
+	trusted := []*peers.Peer{}
+	for _, p := range current {
+		host, _, err := net.SplitHostPort(p.NetAddr)
+		if err != nil {
+			host = p.NetAddr
+		}
+		if verifyPeerSet([]*peers.Peer{p}, genesis) == nil || registered(host) {
+			trusted = append(trusted, p)
+		} else {
+			log.Println("dropping untrusted peer", p.NetAddr, "from the current peer set")
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New("no peer of the current peer set is trusted")
+	}
+	return trusted, nil
+}
+
+// discoverPeerSets asks the candidates in turn for the genesis and current peer
+// sets of a shard chain, keeping the first answer that passes verify with the
+// current set verify returns.
+func discoverPeerSets(candidates []string, workChainId string, shardChainId string, verify func(genesis []*peers.Peer, current []*peers.Peer) ([]*peers.Peer, error)) ([]*peers.Peer, []*peers.Peer, error) {
+	for _, addr := range candidates {
+		genesis, err := fetchPeerSet(addr, workChainId, shardChainId, "/genesispeers")
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		current, err := fetchPeerSet(addr, workChainId, shardChainId, "/peers")
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		current, err = verify(genesis, current)
+		if err != nil {
+			log.Println("peer sets from", addr, "rejected:", err)
+			continue
+		}
+		return genesis, current, nil
+	}
+	return nil, nil, fmt.Errorf("no peer could provide valid peer sets for %s/%s", workChainId, shardChainId)
+}
+
+// bootstrapShardChain prepares the data directory of a shard chain. A created
+// shard runs on the listed nodes of the main chain, the head node starts the
+// main shard chains from its genesis, and any other node fetches the peer sets
+// from a known peer and checks them against the main chain, its own genesis or
+// GENESIS_PEERS_HASH.
+func (w *WorkChain) bootstrapShardChain(chainId string, dataDir string, created bool, peersArr []string) error {
+	if err := provisionKeys(dataDir); err != nil {
+		return err
+	}
+
+	if created {
+		mainChain, ok := w.blockchain.chains.Get("main")
+		if !ok || mainChain.mainLedger == nil {
+			return errors.New("main chain is not running")
+		}
+		peersList := []*peers.Peer{}
+		for _, peer := range mainChain.mainLedger.Peers.Peers {
+			if slices.Contains(peersArr, strings.Split(peer.NetAddr, ":")[0]) {
+				peersList = append(peersList, peer)
+			}
+		}
+		if len(peersList) == 0 {
+			return fmt.Errorf("none of the nodes of shard %s is a main chain peer", chainId)
+		}
+		return writePeerSets(dataDir, peersList, peersList)
+	}
+
+	localGenesis, err := peers.NewJSONPeerSet(babbleKeyDir(), false).PeerSet()
+	if err != nil {
+		localGenesis = nil
+	}
+
+	if os.Getenv("IS_HEAD") == "true" {
+		if localGenesis == nil {
+			return errors.New("head node has no genesis peer set")
+		}
+		return writePeerSets(dataDir, localGenesis.Peers, localGenesis.Peers)
+	}
+
+	candidates := []string{}
+	for _, addr := range strings.Split(os.Getenv("BOOTSTRAP_PEERS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			candidates = append(candidates, addr)
+		}
+	}
+	registered := func(host string) bool {
+		_, found := w.blockchain.nodeRecord(host)
+		return found
+	}
+	var verify func(genesis []*peers.Peer, current []*peers.Peer) ([]*peers.Peer, error)
+	if mainChain, ok := w.blockchain.chains.Get("main"); ok && mainChain.mainLedger != nil {
+		trusted := mainChain.mainLedger.Peers.Peers
+		for _, peer := range trusted {
+			candidates = append(candidates, serviceAddr(peer.NetAddr))
+		}
+		verify = func(genesis []*peers.Peer, current []*peers.Peer) ([]*peers.Peer, error) {
+			if err := verifyPeerSet(genesis, trusted); err != nil {
+				return nil, err
+			}
+			return current, verifyPeerSet(current, trusted)
+		}
+	} else if localGenesis == nil {
+		pinned := strings.ToLower(os.Getenv("GENESIS_PEERS_HASH"))
+		if pinned == "" {
+			return errors.New("no main chain and no genesis peer set to check peers against, set GENESIS_PEERS_HASH")
+		}
+		verify = func(genesis []*peers.Peer, current []*peers.Peer) ([]*peers.Peer, error) {
+			if hash := peerSetHash(genesis); hash != pinned {
+				return nil, fmt.Errorf("genesis peer set hash %s does not match the pinned one", hash)
+			}
+			return trustedPeers(current, genesis, registered)
+		}
+	} else {
+		verify = func(genesis []*peers.Peer, current []*peers.Peer) ([]*peers.Peer, error) {
+			if len(genesis) != len(localGenesis.Peers) {
+				return nil, errors.New("genesis peer set differs from the local one")
+			}
+			if err := verifyPeerSet(genesis, localGenesis.Peers); err != nil {
+				return nil, err
+			}
+			return trustedPeers(current, genesis, registered)
+		}
+	}
+	if len(candidates) == 0 {
+		return errors.New("no known peer to bootstrap from, set BOOTSTRAP_PEERS")
+	}
+	genesis, current, err := discoverPeerSets(candidates, w.Id, chainId, verify)
+	if err != nil {
+		return err
+	}
+	return writePeerSets(dataDir, genesis, current)
+}
@@ -0,0 +1,85 @@
+package chain
+
+import (
+	"encoding/json"
+	"kasper/src/abstract/models/trx"
+	"kasper/src/drivers/network/chain/config"
+	"kasper/src/drivers/network/chain/peers"
+	"kasper/src/shell/api/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	cmap "github.com/orcaman/concurrent-map/v2"
+)
+
+// servePeerSets serves the genesis and current peer sets of shard-1 of the
+// main work chain the way the service endpoint of a node does.
+func servePeerSets(t *testing.T, genesis []*peers.Peer, current []*peers.Peer) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Work-Chain-Id") != "main" || r.Header.Get("Shard-Chain-Id") != "shard-1" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/genesispeers":
+			json.NewEncoder(w).Encode(genesis)
+		case "/peers":
+			json.NewEncoder(w).Encode(current)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestBootstrapChecksCurrentPeers(t *testing.T) {
+	keyDir := t.TempDir()
+	t.Setenv("BABBLE_KEY_DIR", keyDir)
+	if err := os.WriteFile(filepath.Join(keyDir, config.DefaultKeyfile), []byte("key"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	genesis := []*peers.Peer{peers.NewPeer("0xAA", "10.0.0.1:1337", "a"), peers.NewPeer("0xBB", "10.0.0.2:1337", "b")}
+	joined := peers.NewPeer("0xCC", "10.0.0.3:1337", "c")
+	stranger := peers.NewPeer("0xDD", "10.0.0.4:1337", "d")
+	t.Setenv("GENESIS_PEERS_HASH", peerSetHash(genesis))
+
+	forged := servePeerSets(t, []*peers.Peer{stranger}, []*peers.Peer{stranger})
+	honest := servePeerSets(t, genesis, []*peers.Peer{genesis[0], genesis[1], joined, stranger})
+	t.Setenv("BOOTSTRAP_PEERS", forged+","+honest)
+
+	w := newTestWorkChain(t, newTestSharder("n1", testNodes, 1).ShardManager)
+	w.blockchain.chains = cmap.New[*WorkChain]()
+	w.blockchain.app.ModifyState(false, func(trx trx.ITrx) error {
+		model.Node{Origin: "10.0.0.3", OwnerId: "owner"}.Push(trx)
+		return nil
+	})
+
+	dataDir := t.TempDir()
+	if err := w.bootstrapShardChain("shard-1", dataDir, false, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	written, err := peers.NewJSONPeerSet(dataDir, true).PeerSet()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addrs := []string{}
+	for _, p := range written.Peers {
+		addrs = append(addrs, p.NetAddr)
+	}
+	sort.Strings(addrs)
+	if strings.Join(addrs, ",") != "10.0.0.1:1337,10.0.0.2:1337,10.0.0.3:1337" {
+		t.Fatalf("current peers written %v, want the genesis peers and the registered one", addrs)
+	}
+
+	// a current set holding no trusted peer is refused
+	t.Setenv("BOOTSTRAP_PEERS", servePeerSets(t, genesis, []*peers.Peer{stranger}))
+	if err := w.bootstrapShardChain("shard-1", t.TempDir(), false, nil); err == nil {
+		t.Fatalf("bootstrapped from an untrusted current peer set")
+	}
+}
@@ -1,8 +1,14 @@
 package chain
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/json"
+	"kasper/src/abstract/adapters/storage"
+	chainmodel "kasper/src/abstract/models/chain"
 	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/trx"
+	"kasper/src/abstract/models/update"
 	"kasper/src/drivers/network/chain/babble"
 	"kasper/src/drivers/network/chain/config"
 	"kasper/src/drivers/network/chain/crypto/keys"
@@ -10,17 +16,15 @@ import (
 	"kasper/src/drivers/network/chain/net"
 	"kasper/src/drivers/network/chain/net/signal/wamp"
 	"kasper/src/drivers/network/chain/node/state"
-	"kasper/src/drivers/network/chain/peers"
 	"kasper/src/drivers/network/chain/proxy"
 	"kasper/src/drivers/network/chain/proxy/inmem"
 	"kasper/src/drivers/network/chain/service"
 	"kasper/src/shell/utils/future"
 	"log"
 	"os"
-	"os/exec"
-	"slices"
 	"strings"
 
+	"github.com/dgraph-io/badger"
 	"github.com/google/uuid"
 	cmap "github.com/orcaman/concurrent-map/v2"
 )
@@ -32,6 +36,7 @@ type WorkChain struct {
 	mainProxy   *inmem.InmemProxy
 	sharder     *ShardManager
 	shardChains cmap.ConcurrentMap[string, *ShardChain]
+	migrations  *migrations
 }
 
 type ShardChain struct {
@@ -43,9 +48,12 @@ type ShardChain struct {
 type Blockchain struct {
 	app         core.ICore
 	chains      cmap.ConcurrentMap[string, *WorkChain]
-	pipeline    func([][]byte, func([]byte)) []string
+	pipeline    func(chainmodel.Block, []chainmodel.Envelope, func(chainmodel.Envelope) []update.Update) ([]string, [][]update.Update)
+	explorer    *Explorer
+	listeners   []func(workChainId string, shardChainId string, blockIndex int, timestamp int64)
 	trans       net.Transport
 	service     *service.Service
+	storage     storage.IStorage
 	storageRoot string
 }
 
@@ -120,74 +128,56 @@ func initTransport(config *config.Config) (net.Transport, error) {
 }
 
 func (b *Blockchain) createNewWorkChain(chainId string) *WorkChain {
-	wchain := &WorkChain{Id: chainId, mainLedger: nil, mainProxy: nil, sharder: nil, shardChains: cmap.New[*ShardChain](), blockchain: b}
+	wchain := &WorkChain{Id: chainId, mainLedger: nil, mainProxy: nil, sharder: nil, shardChains: cmap.New[*ShardChain](), blockchain: b, migrations: newMigrations()}
 	b.chains.Set(chainId, wchain)
 	shardCreatorCb := func(shardId string, nodes []string) {
 		wchain.createNewShardChain(shardId, true, nodes)
 	}
+	shardProposeCb := func(change ShardChange) {
+		change.Signature = b.app.SignPacket([]byte(change.key()))
+		payload, err := json.Marshal(change)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		future.Async(func() {
+			b.SubmitTrx(chainId, "", chainmodel.TrxShardTopology, payload)
+		}, false)
+	}
 	mainShardChain := wchain.createNewShardChain("shard-main", false, []string{})
 	wchain.mainLedger = mainShardChain.shardLedger
 	wchain.mainProxy = mainShardChain.shardProxy
-	if b.app.Id() == os.Getenv("ROOT_NODE") && chainId == "main" {
-		wchain.sharder = NewShardManager([]string{os.Getenv("ROOT_NODE")}, 1, 10, 5, 100000, 1, shardCreatorCb)
-	} else {
-		wchain.sharder = NewShardManager([]string{os.Getenv("ROOT_NODE"), b.app.Id()}, 1, 10, 5, 100000, 1, shardCreatorCb)
-	}
+	// every node starts from the same genesis map holding the root node only,
+	// the others are added to it through the main shard chain
+	wchain.sharder = NewShardManager(b.app.Id(), []string{os.Getenv("ROOT_NODE")}, 1, 10, 5, 100000, 1, shardCreatorCb, shardProposeCb)
 	return wchain
 }
 
 func (w *WorkChain) createNewShardChain(chainId string, created bool, peersArr []string) *ShardChain {
 	handler := &HgHandler{
-		Chain: w,
+		Chain:   w,
+		Tree:    NewStateTree(w.blockchain.storage.KvDb(), w.Id, chainId),
+		ShardId: chainId,
 	}
 	proxy := inmem.NewInmemProxy(handler, nil)
 
 	dataDir := w.blockchain.storageRoot + "/chains/" + w.Id + "/" + chainId
 	os.MkdirAll(dataDir, os.ModePerm)
 
-	peersListMode := "0"
-
-	if created {
-		mainChain, _ := w.blockchain.chains.Get("main")
-		peersList := []*peers.Peer{}
-		log.Println("shard peers", peersArr)
-		log.Println("inspecting all nodes...")
-		for _, peer := range mainChain.mainLedger.Peers.Peers {
-			if slices.Contains(peersArr, strings.Split(peer.NetAddr, ":")[0]) {
-				log.Println("node matched", peer)
-				peersList = append(peersList, peer)
-			}
-		}
-		log.Println("inspection finished.")
-		peerset := peers.PeerSet{Peers: peersList}
-		peersStr, _ := peerset.Marshal()
-		peersFile, _ := os.OpenFile(dataDir+"/peers.json", os.O_WRONLY|os.O_CREATE, 0600)
-		defer peersFile.Close()
-		peersFile.Write(peersStr)
-		peersListMode = "1"
-	} else if os.Getenv("IS_HEAD") == "true" {
-		peersListMode = "2"
-	} else {
-		peersListMode = "3"
-	}
-
-	cmd := exec.Command("bash", "/app/scripts/shardchain.sh", w.blockchain.storageRoot, w.Id, chainId, peersListMode)
-	err := cmd.Run()
-	if err != nil {
-		log.Println(err)
+	if err := w.bootstrapShardChain(chainId, dataDir, created, peersArr); err != nil {
+		panic(err)
 	}
 
 	config := config.NewDefaultConfig(os.Getenv("IPADDR") + ":" + os.Getenv("BLOCKCHAIN_API_PORT"))
 	config.DataDir = dataDir
 	config.Proxy = proxy
+	config.EnableFastSync = os.Getenv("CHAIN_FAST_SYNC") == "true"
 	engine := babble.NewBabble(config)
 	if err := engine.Init(w.blockchain.trans, w.Id, chainId, func(origin string) {
-		w.sharder.AddNode(string(origin))
-		w.sharder.mu.Lock()
-		defer w.sharder.mu.Unlock()
-		state, err := w.sharder.ExportState()
+		w.sharder.ProposeNode(origin)
+		sync, err := json.Marshal(shardMapSync{Target: origin, Map: w.sharder.Map()})
 		if err == nil {
-			w.blockchain.SubmitTrx(w.Id, "", "sharderMap|"+string(origin), []byte(state))
+			w.blockchain.SubmitTrx(w.Id, "", chainmodel.TrxShardMap, sync)
 		} else {
 			log.Println(err)
 		}
@@ -203,14 +193,16 @@ func (w *WorkChain) createNewShardChain(chainId string, created bool, peersArr [
 	return shardChain
 }
 
-func NewChain(core core.ICore, storageRoot string) *Blockchain {
+func NewChain(core core.ICore, storage storage.IStorage) *Blockchain {
 	blockchain := &Blockchain{
 		app:         core,
 		chains:      cmap.New[*WorkChain](),
-		storageRoot: storageRoot,
+		storage:     storage,
+		storageRoot: storage.StorageRoot(),
 		trans:       nil,
 		service:     nil,
 		pipeline:    nil,
+		explorer:    NewExplorer(storage.KvDb()),
 	}
 	config := config.NewDefaultConfig(os.Getenv("IPADDR") + ":" + os.Getenv("BLOCKCHAIN_API_PORT"))
 	trans, err := initTransport(config)
@@ -220,6 +212,9 @@ func NewChain(core core.ICore, storageRoot string) *Blockchain {
 	blockchain.trans = trans
 	service := initChainService(config)
 	blockchain.service = service
+	if service != nil {
+		service.SetExplorer(blockchain.explorer)
+	}
 	blockchain.createNewWorkChain("main")
 	return blockchain
 }
@@ -232,6 +227,9 @@ func (b *Blockchain) Listen(port int, tlsConfig *tls.Config) {
 			}, false)
 		}
 	}
+	future.Async(func() {
+		b.registerOrigin(tlsConfig)
+	}, false)
 }
 
 func (b *Blockchain) Close() {
@@ -242,7 +240,7 @@ func (b *Blockchain) Close() {
 	}
 }
 
-func (c *Blockchain) RegisterPipeline(pipeline func([][]byte, func([]byte)) []string) {
+func (c *Blockchain) RegisterPipeline(pipeline func(chainmodel.Block, []chainmodel.Envelope, func(chainmodel.Envelope) []update.Update) ([]string, [][]update.Update)) {
 	c.pipeline = pipeline
 }
 
@@ -256,44 +254,74 @@ func (c *Blockchain) Peers() []string {
 	return peers
 }
 
-func (c *Blockchain) SubmitTrx(chainId string, machineId string, typ string, payload []byte) {
+func (c *Blockchain) SubmitTrx(chainId string, machineId string, typ chainmodel.TrxType, payload []byte) {
 	mainWorkChain, _ := c.chains.Get(chainId)
-	if machineId == "" {
-		mainShardChain, _ := mainWorkChain.shardChains.Get("shard-main")
-		mainShardChain.shardProxy.SubmitTx(payload)
-	} else {
-		mainShardChain, _ := mainWorkChain.shardChains.Get(mainWorkChain.sharder.Hasher.GetShard(machineId))
-		mainShardChain.shardProxy.SubmitTx(payload)
+	shardId := "shard-main"
+	if machineId != "" {
+		if mainWorkChain.queue(machineId, typ, payload) {
+			return
+		}
+		shardId = mainWorkChain.sharder.ShardOf(machineId)
 	}
+	mainWorkChain.submitToShard(shardId, typ, payload)
+}
+
+// ListenToBlocks calls the listener after every block a shard chain commits,
+// with the consensus timestamp of the block in unix seconds.
+func (c *Blockchain) ListenToBlocks(listener func(workChainId string, shardChainId string, blockIndex int, timestamp int64)) {
+	c.listeners = append(c.listeners, listener)
 }
 
-func (c *Blockchain) NotifyNewMachineCreated(chainId string, machineId string) {
-	mainWorkChain, found := c.chains.Get(chainId)
-	if found {
-		mainWorkChain.sharder.DeployDapp(machineId)
+// MachineFrozen tells whether a shard chain takes no more requests for a
+// machine migrating out of its shard.
+func (c *Blockchain) MachineFrozen(shardId string, machineId string) bool {
+	mainWorkChain, found := c.chains.Get("main")
+	if !found {
+		return false
 	}
+	return mainWorkChain.frozenOn(shardId, machineId)
 }
 
-func (c *Blockchain) CreateTempChain() string {
-	return c.createNewWorkChain(uuid.NewString()).Id
+// dappDeployPrefix marks a machine created by a request. Only executors run
+// the request, so the machine is placed on its shard once the block carrying
+// the marker among its effects commits, on every node alike. Machines are
+// created by base requests, which go to the main shard chain, and only its
+// blocks place them, so the shard map it commits changes at the same block on
+// every node.
+const dappDeployPrefix = "ShardDapp::"
+
+func (c *Blockchain) NotifyNewMachineCreated(trx trx.ITrx, chainId string, machineId string) {
+	trx.PutBytes(dappDeployPrefix+chainId+"::"+machineId, []byte("true"))
 }
 
-func (c *Blockchain) CreateWorkChain() string {
-	return c.createNewWorkChain(uuid.NewString()).Id
+// deployDapps places the machines created by the committed effects of a block.
+func (c *Blockchain) deployDapps(effects []update.Update) {
+	for _, u := range effects {
+		if u.Typ != "put" || !strings.HasPrefix(u.Key, dappDeployPrefix) {
+			continue
+		}
+		chainId, machineId, ok := strings.Cut(u.Key[len(dappDeployPrefix):], "::")
+		if !ok {
+			continue
+		}
+		if workChain, found := c.chains.Get(chainId); found {
+			workChain.sharder.DeployDapp(machineId)
+		}
+	}
 }
 
-func (c *Blockchain) UserOwnsOrigin(userId string, origin string) bool {
-	return true
+func (c *Blockchain) CreateTempChain() string {
+	return c.createNewWorkChain(uuid.NewString()).Id
 }
 
-func (c *Blockchain) GetNodeOwnerId(origin string) string {
-	return ""
+func (c *Blockchain) CreateWorkChain() string {
+	return c.createNewWorkChain(uuid.NewString()).Id
 }
 
 func (c *Blockchain) GetValidatorsOfMachineShard(machineId string) []string {
 	validators := []string{}
 	mainChain, _ := c.chains.Get("main")
-	shardId := mainChain.sharder.Hasher.GetShard(machineId)
+	shardId := mainChain.sharder.ShardOf(machineId)
 	shardChain, _ := mainChain.shardChains.Get(shardId)
 	for _, peer := range shardChain.shardLedger.Peers.Peers {
 		validators = append(validators, strings.Split(peer.NetAddr, ":")[0])
@@ -302,27 +330,125 @@ func (c *Blockchain) GetValidatorsOfMachineShard(machineId string) []string {
 }
 
 type HgHandler struct {
-	State state.State
-	Chain *WorkChain
+	State     state.State
+	Chain     *WorkChain
+	Tree      *StateTree
+	ShardId   string
+	committed []byte // Shard map last written to the committed state
+}
+
+type shardMapSync struct {
+	Target string   `json:"target"`
+	Map    ShardMap `json:"map"`
 }
 
 func (p *HgHandler) CommitHandler(block hashgraph.Block) (proxy.CommitResponse, error) {
-	machineIds := p.Chain.blockchain.pipeline(block.Transactions(), func(insiderTrx []byte) {
-		sharderMapKey := "sharderMap|" + p.Chain.blockchain.app.Id() + "::"
-		if strings.HasPrefix(string(insiderTrx), sharderMapKey) {
-			payload := insiderTrx[len(sharderMapKey):]
-			p.Chain.sharder.ImportState(string(payload))
+	envelopes := []chainmodel.Envelope{}
+	for _, raw := range block.Transactions() {
+		envelope, err := chainmodel.DecodeEnvelope(raw)
+		if err != nil {
+			log.Println("dropping transaction of block", block.Index(), ":", err)
+			continue
 		}
+		envelopes = append(envelopes, envelope)
+	}
+	machineIds, applied := p.Chain.blockchain.pipeline(chainmodel.Block{Index: block.Index(), Timestamp: block.Timestamp(), ShardId: p.ShardId}, envelopes, func(insiderTrx chainmodel.Envelope) []update.Update {
+		if insiderTrx.Type == chainmodel.TrxMachineBundle {
+			signed := SignedBundle{}
+			if err := json.Unmarshal(insiderTrx.Payload, &signed); err != nil {
+				log.Println(err)
+				return nil
+			}
+			return p.Chain.onBundle(p.ShardId, signed)
+		}
+		if insiderTrx.Type == chainmodel.TrxMachineFreeze || insiderTrx.Type == chainmodel.TrxMachineThaw {
+			freeze := MachineFreeze{}
+			if err := json.Unmarshal(insiderTrx.Payload, &freeze); err != nil {
+				log.Println(err)
+				return nil
+			}
+			if insiderTrx.Type == chainmodel.TrxMachineFreeze {
+				return p.Chain.onFreeze(p.ShardId, freeze)
+			}
+			return p.Chain.onThaw(p.ShardId, freeze)
+		}
+		if p.ShardId != "shard-main" {
+			return nil
+		}
+		switch insiderTrx.Type {
+		case chainmodel.TrxShardTopology:
+			change := ShardChange{}
+			if err := json.Unmarshal(insiderTrx.Payload, &change); err != nil {
+				log.Println(err)
+				return nil
+			}
+			proposer, found := p.Chain.blockchain.nodeRecord(change.Proposer)
+			if !found || proposer.PublicKey == "" {
+				log.Println("shard change proposer", change.Proposer, "is not a registered node")
+				return nil
+			}
+			if err := verifyChange(proposer.PublicKey, change); err != nil {
+				log.Println("shard change rejected:", err)
+				return nil
+			}
+			if err := p.Chain.sharder.AcceptChange(change, block.Index()); err != nil {
+				log.Println("shard change rejected:", err)
+			}
+		case chainmodel.TrxShardMap:
+			sync := shardMapSync{}
+			if err := json.Unmarshal(insiderTrx.Payload, &sync); err != nil {
+				log.Println(err)
+				return nil
+			}
+			p.Chain.sharder.SyncMap(sync.Target, sync.Map)
+		case chainmodel.TrxMachineMigrated:
+			confirm := MigrationConfirm{}
+			if err := json.Unmarshal(insiderTrx.Payload, &confirm); err != nil {
+				log.Println(err)
+				return nil
+			}
+			return p.Chain.onMigrated(confirm)
+		}
+		return nil
 	})
 
-	p.Chain.sharder.ProcessDAppTransactionGroup(machineIds)
+	effects := []update.Update{}
+	for _, committed := range applied {
+		effects = append(effects, committed...)
+	}
+	if p.ShardId == "shard-main" {
+		p.Chain.blockchain.deployDapps(effects)
+	}
+
+	p.Chain.sharder.ProcessDAppTransactionGroup(p.ShardId, block.Timestamp(), machineIds)
+	if p.ShardId == "shard-main" {
+		started, aborted := p.Chain.sharder.Advance(block.Index())
+		p.Chain.abortMigrations(aborted)
+		p.Chain.startMigrations(started)
+	}
+	sharding, err := p.commitSharding(len(machineIds) > 0)
+	if err != nil {
+		return proxy.CommitResponse{}, err
+	}
+	effects = append(effects, sharding...)
+
+	p.Chain.blockchain.explorer.Index(p.Chain.Id, p.ShardId, block.Index(), envelopes, applied)
+
+	stateHash, err := p.Tree.Commit(block.Index(), effects)
+	if err != nil {
+		return proxy.CommitResponse{}, err
+	}
+
+	for _, listener := range p.Chain.blockchain.listeners {
+		listener(p.Chain.Id, p.ShardId, block.Index(), block.Timestamp())
+	}
 
 	receipts := []hashgraph.InternalTransactionReceipt{}
 	for _, it := range block.InternalTransactions() {
 		receipts = append(receipts, it.AsAccepted())
 	}
 	response := proxy.CommitResponse{
-		StateHash:                   []byte("statehash"),
+		StateHash:                   stateHash,
 		InternalTransactionReceipts: receipts,
 	}
 	return response, nil
@@ -334,9 +460,105 @@ func (p *HgHandler) StateChangeHandler(state state.State) error {
 }
 
 func (p *HgHandler) SnapshotHandler(blockIndex int) ([]byte, error) {
-	return []byte("statehash"), nil
+	return p.Tree.Snapshot(blockIndex)
 }
 
 func (p *HgHandler) RestoreHandler(snapshot []byte) ([]byte, error) {
-	return []byte("statehash"), nil
+	root, err := p.Tree.Restore(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	p.restoreSharding()
+	return root, nil
+}
+
+// The shard map and the shard loads are written to the committed state, so
+// they are covered by the state root and a node restoring a snapshot takes
+// them from there rather than from a single peer.
+func shardMapKey(workChainId string) string {
+	return "ShardMap::" + workChainId
+}
+
+func shardLoadsKey(workChainId string, shardId string) string {
+	return "ShardLoads::" + workChainId + "::" + shardId
+}
+
+type shardLoads struct {
+	Clock int64               `json:"clock"`
+	Dapps map[string]DAppLoad `json:"dapps"`
+}
+
+// commitSharding writes the shard map when the main shard chain changed it,
+// and the loads of a shard when its block had transactions for its DApps.
+func (p *HgHandler) commitSharding(loaded bool) ([]update.Update, error) {
+	effects := []update.Update{}
+	if p.ShardId == "shard-main" {
+		data, err := json.Marshal(p.Chain.sharder.Map())
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(data, p.committed) {
+			effects = append(effects, update.Update{Typ: "put", Key: shardMapKey(p.Chain.Id), Val: data})
+			p.committed = data
+		}
+	} else if loaded {
+		clock, dapps := p.Chain.sharder.Loads(p.ShardId)
+		data, err := json.Marshal(shardLoads{Clock: clock, Dapps: dapps})
+		if err != nil {
+			return nil, err
+		}
+		effects = append(effects, update.Update{Typ: "put", Key: shardLoadsKey(p.Chain.Id, p.ShardId), Val: data})
+	}
+	if len(effects) == 0 {
+		return effects, nil
+	}
+	err := p.Chain.blockchain.storage.KvDb().Update(func(txn *badger.Txn) error {
+		for _, u := range effects {
+			if err := txn.Set([]byte(u.Key), u.Val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return effects, err
+}
+
+// restoreSharding loads the shard map or the shard loads back from the state a
+// snapshot restored.
+func (p *HgHandler) restoreSharding() {
+	key := shardLoadsKey(p.Chain.Id, p.ShardId)
+	if p.ShardId == "shard-main" {
+		key = shardMapKey(p.Chain.Id)
+	}
+	var data []byte
+	err := p.Chain.blockchain.storage.KvDb().View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	if p.ShardId == "shard-main" {
+		m := ShardMap{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			log.Println(err)
+			return
+		}
+		if err := p.Chain.sharder.ImportMap(m); err != nil {
+			log.Println("shard map import failed:", err)
+			return
+		}
+		p.committed = data
+		return
+	}
+	loads := shardLoads{}
+	if err := json.Unmarshal(data, &loads); err != nil {
+		log.Println(err)
+		return
+	}
+	p.Chain.sharder.ImportLoads(p.ShardId, loads.Clock, loads.Dapps)
 }
@@ -0,0 +1,265 @@
+package chain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	chainmodel "kasper/src/abstract/models/chain"
+	"kasper/src/abstract/models/update"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Explorer indexes the Kasper transactions of committed blocks so that the
+// service API can tell what happened to a request, or which transactions an
+// author, a machine or a point was part of. Every indexed transaction is
+// stored once under its block position, and the indexes point at that key.
+// Index values are hex encoded in keys since user and point ids contain "::".
+// Committing the same block twice writes the same keys, so replays after a
+// restart leave the indexes unchanged.
+type Explorer struct {
+	db     *badger.DB
+	prefix string
+}
+
+const (
+	ExplorerIndexRequest = "request"
+	ExplorerIndexAuthor  = "author"
+	ExplorerIndexMachine = "machine"
+	ExplorerIndexPoint   = "point"
+)
+
+var ErrRequestNotIndexed = errors.New("request is not indexed")
+
+type ExplorerTrx struct {
+	WorkChainId  string          `json:"workChainId"`
+	ShardChainId string          `json:"shardChainId"`
+	BlockIndex   int             `json:"blockIndex"`
+	Position     int             `json:"position"`
+	Type         string          `json:"type"`
+	Version      uint32          `json:"version"`
+	Signer       string          `json:"signer"`
+	RequestId    string          `json:"requestId,omitempty"`
+	Author       string          `json:"author,omitempty"`
+	MachineId    string          `json:"machineId,omitempty"`
+	PointId      string          `json:"pointId,omitempty"`
+	Key          string          `json:"key,omitempty"`
+	Tag          string          `json:"tag,omitempty"`
+	Executor     string          `json:"executor,omitempty"`
+	ResCode      int             `json:"resCode,omitempty"`
+	Err          string          `json:"error,omitempty"`
+	Meta         map[string]any  `json:"meta,omitempty"`
+	Payload      string          `json:"payload"`
+	Effects      []update.Update `json:"effects,omitempty"`
+	Applied      []update.Update `json:"applied,omitempty"`
+}
+
+type RequestLifecycle struct {
+	RequestId string          `json:"requestId"`
+	Request   *ExplorerTrx    `json:"request"`
+	Responses []ExplorerTrx   `json:"responses"`
+	Applied   []update.Update `json:"applied"`
+}
+
+func NewExplorer(db *badger.DB) *Explorer {
+	return &Explorer{db: db, prefix: "explorer::"}
+}
+
+func (e *Explorer) trxKey(workChainId string, shardChainId string, blockIndex int, position int) []byte {
+	return []byte(fmt.Sprintf("%strx::%s::%s::%020d::%06d", e.prefix, workChainId, shardChainId, blockIndex, position))
+}
+
+func (e *Explorer) blockPrefix(workChainId string, shardChainId string, blockIndex int) []byte {
+	return []byte(fmt.Sprintf("%strx::%s::%s::%020d::", e.prefix, workChainId, shardChainId, blockIndex))
+}
+
+func (e *Explorer) indexPrefix(index string, value string) []byte {
+	return []byte(e.prefix + index + "::" + hex.EncodeToString([]byte(value)) + "::")
+}
+
+func payloadPointId(payload []byte) string {
+	input := struct {
+		PointId string `json:"pointId"`
+	}{}
+	if json.Unmarshal(payload, &input) != nil {
+		return ""
+	}
+	return input.PointId
+}
+
+// describe decodes the transactions the explorer indexes, reporting false for
+// the rest.
+func describe(envelope chainmodel.Envelope) (ExplorerTrx, bool) {
+	t := ExplorerTrx{Type: envelope.Type.String(), Version: envelope.Version, Signer: envelope.Signer}
+	switch envelope.Type {
+	case chainmodel.TrxBaseRequest:
+		packet := chainmodel.ChainBaseRequest{}
+		if json.Unmarshal(envelope.Payload, &packet) != nil {
+			return t, false
+		}
+		t.RequestId, t.Author, t.Key, t.Tag = packet.RequestId, packet.Author, packet.Key, packet.Tag
+		t.PointId, t.Payload = payloadPointId(packet.Payload), string(packet.Payload)
+	case chainmodel.TrxAppRequest:
+		packet := chainmodel.ChainAppletRequest{}
+		if json.Unmarshal(envelope.Payload, &packet) != nil {
+			return t, false
+		}
+		t.RequestId, t.Author, t.MachineId, t.Key, t.Tag = packet.RequestId, packet.Author, packet.MachineId, packet.Key, packet.Tag
+		t.PointId, t.Payload = payloadPointId(packet.Payload), string(packet.Payload)
+	case chainmodel.TrxResponse:
+		packet := chainmodel.ChainResponse{}
+		if json.Unmarshal(envelope.Payload, &packet) != nil {
+			return t, false
+		}
+		t.RequestId, t.Executor, t.Tag, t.ResCode, t.Err = packet.RequestId, packet.Executor, packet.Tag, packet.ResCode, packet.Err
+		t.Payload, t.Effects = string(packet.Payload), packet.Effects.DbUpdates
+	case chainmodel.TrxElection:
+		packet := chainmodel.ChainElectionPacket{}
+		if json.Unmarshal(envelope.Payload, &packet) != nil {
+			return t, false
+		}
+		t.Key, t.Meta = packet.Key, packet.Meta
+		if voter, ok := packet.Meta["voter"].(string); ok {
+			t.Author = voter
+		}
+		t.Payload = string(packet.Payload)
+	default:
+		return t, false
+	}
+	return t, true
+}
+
+// Index stores the transactions of a committed block along with the effects
+// each of them applied.
+func (e *Explorer) Index(workChainId string, shardChainId string, blockIndex int, envelopes []chainmodel.Envelope, applied [][]update.Update) {
+	err := e.db.Update(func(txn *badger.Txn) error {
+		for i, envelope := range envelopes {
+			t, ok := describe(envelope)
+			if !ok {
+				continue
+			}
+			t.WorkChainId, t.ShardChainId, t.BlockIndex, t.Position = workChainId, shardChainId, blockIndex, i
+			if i < len(applied) {
+				t.Applied = applied[i]
+			}
+			data, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			key := e.trxKey(workChainId, shardChainId, blockIndex, i)
+			if err := txn.Set(key, data); err != nil {
+				return err
+			}
+			for index, value := range map[string]string{
+				ExplorerIndexRequest: t.RequestId,
+				ExplorerIndexAuthor:  t.Author,
+				ExplorerIndexMachine: t.MachineId,
+				ExplorerIndexPoint:   t.PointId,
+			} {
+				if value == "" {
+					continue
+				}
+				if err := txn.Set(append(e.indexPrefix(index, value), key[len(e.prefix):]...), key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("indexing block", blockIndex, "of", workChainId, shardChainId, "failed:", err)
+	}
+}
+
+func scanTrxs(txn *badger.Txn, prefix []byte, from int, count int, resolve bool) ([]ExplorerTrx, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	trxs := []ExplorerTrx{}
+	skipped := 0
+	for it.Seek(prefix); it.ValidForPrefix(prefix) && (count < 0 || len(trxs) < count); it.Next() {
+		if skipped < from {
+			skipped++
+			continue
+		}
+		data, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		if resolve {
+			item, err := txn.Get(data)
+			if err != nil {
+				return nil, err
+			}
+			if data, err = item.ValueCopy(nil); err != nil {
+				return nil, err
+			}
+		}
+		t := ExplorerTrx{}
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, err
+		}
+		trxs = append(trxs, t)
+	}
+	return trxs, nil
+}
+
+// Transactions lists the indexed transactions of an author, a machine, a point
+// or a request, oldest first.
+func (e *Explorer) Transactions(index string, value string, from int, count int) (any, error) {
+	switch index {
+	case ExplorerIndexRequest, ExplorerIndexAuthor, ExplorerIndexMachine, ExplorerIndexPoint:
+	default:
+		return nil, fmt.Errorf("unknown explorer index %s", index)
+	}
+	var trxs []ExplorerTrx
+	err := e.db.View(func(txn *badger.Txn) error {
+		var err error
+		trxs, err = scanTrxs(txn, e.indexPrefix(index, value), from, count, true)
+		return err
+	})
+	return trxs, err
+}
+
+// BlockTransactions lists the indexed transactions of a block.
+func (e *Explorer) BlockTransactions(workChainId string, shardChainId string, blockIndex int) (any, error) {
+	var trxs []ExplorerTrx
+	err := e.db.View(func(txn *badger.Txn) error {
+		var err error
+		trxs, err = scanTrxs(txn, e.blockPrefix(workChainId, shardChainId, blockIndex), 0, -1, false)
+		return err
+	})
+	return trxs, err
+}
+
+// Lifecycle gathers a request, the response of every executor and the effects
+// the responses that completed it applied.
+func (e *Explorer) Lifecycle(requestId string) (any, error) {
+	var trxs []ExplorerTrx
+	err := e.db.View(func(txn *badger.Txn) error {
+		var err error
+		trxs, err = scanTrxs(txn, e.indexPrefix(ExplorerIndexRequest, requestId), 0, -1, true)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(trxs) == 0 {
+		return nil, ErrRequestNotIndexed
+	}
+	lifecycle := RequestLifecycle{RequestId: requestId, Responses: []ExplorerTrx{}, Applied: []update.Update{}}
+	for i := range trxs {
+		t := trxs[i]
+		if t.Type == chainmodel.TrxResponse.String() {
+			lifecycle.Responses = append(lifecycle.Responses, t)
+			lifecycle.Applied = append(lifecycle.Applied, t.Applied...)
+		} else if lifecycle.Request == nil {
+			lifecycle.Request = &t
+		}
+	}
+	return lifecycle, nil
+}
@@ -0,0 +1,454 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	chainmodel "kasper/src/abstract/models/chain"
+	"kasper/src/abstract/models/update"
+	"kasper/src/shell/utils/crypto"
+	"kasper/src/shell/utils/future"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// A machine leaving a shard is moved in three steps. When the shard change
+// moving it is applied, the nodes of the source shard submit a freeze of the
+// machine to the source shard chain, which takes no more requests for it from
+// the block committing the first freeze on. Once the requests it had already
+// taken are all answered, its state no longer changes, so every source node
+// exports the same applet keys into a MachineBundle, signs it and submits it to
+// the target shard chain. Nothing a node only holds locally, like requests it
+// has not run yet, goes into the bundle. The target shard imports the bundle
+// once a majority of the source nodes sent the same one and each target node
+// signs a confirm of it on the main shard chain, where the sharder switches the
+// machine over once a majority of the target nodes confirmed the same bundle.
+// Freezes and confirms are kept in the committed state of the shard chain
+// committing them, along with the state a bundle imports. Requests
+// submitted for the machine in between are held here and replayed to the
+// target shard after the switch. A migration that does not complete in time is
+// aborted on the main shard chain and the source shard chain thaws the machine.
+
+const bundleExportAttempts = 3
+
+type MachineBundle struct {
+	MachineId string            `json:"machineId"`
+	From      string            `json:"from"`
+	To        string            `json:"to"`
+	StartedAt int               `json:"startedAt"`
+	State     map[string]string `json:"state"`
+	Hash      string            `json:"hash"`
+}
+
+// MachineFreeze freezes a machine on the source shard chain of a migration, or
+// thaws it once the migration completed or was aborted.
+type MachineFreeze struct {
+	MachineId string    `json:"machineId"`
+	Migration Migration `json:"migration"`
+}
+
+// ComputeHash hashes everything in the bundle but the hash itself.
+func (b MachineBundle) ComputeHash() string {
+	b.Hash = ""
+	data, _ := json.Marshal(b)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type SignedBundle struct {
+	Bundle    MachineBundle `json:"bundle"`
+	Signer    string        `json:"signer"`
+	Signature string        `json:"signature"`
+}
+
+type MigrationConfirm struct {
+	MachineId string `json:"machineId"`
+	To        string `json:"to"`
+	StartedAt int    `json:"startedAt"`
+	Hash      string `json:"hash"` // Hash of the imported bundle
+	Signer    string `json:"signer"`
+	Signature string `json:"signature"`
+}
+
+func (c MigrationConfirm) key() string {
+	return fmt.Sprintf("%s|%s|%d|%s", c.MachineId, c.To, c.StartedAt, c.Hash)
+}
+
+// verifyConfirm checks a confirm against the server key its signer registered
+// on chain.
+func verifyConfirm(publicKey string, confirm MigrationConfirm) error {
+	return crypto.VerifySignature([]byte(publicKey), []byte(confirm.key()), confirm.Signature)
+}
+
+// migrationConfirms lists the target nodes that confirmed each bundle of a
+// migration.
+type migrationConfirms struct {
+	Migration string              `json:"migration"`
+	Signers   map[string][]string `json:"signers"`
+}
+
+func frozenKey(workChainId string, machineId string) string {
+	return "MachineFrozen::" + workChainId + "::" + machineId
+}
+
+func confirmsKey(workChainId string, machineId string) string {
+	return "MigrationConfirms::" + workChainId + "::" + machineId
+}
+
+type queuedTrx struct {
+	typ     chainmodel.TrxType
+	payload []byte
+}
+
+type migrations struct {
+	lock     sync.Mutex
+	queued   map[string][]queuedTrx
+	votes    map[string]map[string][]string
+	imported map[string]string
+}
+
+func newMigrations() *migrations {
+	return &migrations{
+		queued:   map[string][]queuedTrx{},
+		votes:    map[string]map[string][]string{},
+		imported: map[string]string{},
+	}
+}
+
+// readCommitted reads a key of the committed state.
+func (w *WorkChain) readCommitted(key string) []byte {
+	var data []byte
+	w.blockchain.storage.KvDb().View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	return data
+}
+
+// writeCommitted writes updates to the committed state right away, so the
+// transactions after them in the block read them, and returns them to be
+// folded into the state root of the block.
+func (w *WorkChain) writeCommitted(updates ...update.Update) []update.Update {
+	err := w.blockchain.storage.KvDb().Update(func(txn *badger.Txn) error {
+		for _, u := range updates {
+			if u.Typ == "del" {
+				if err := txn.Delete([]byte(u.Key)); err != nil {
+					return err
+				}
+			} else if err := txn.Set([]byte(u.Key), u.Val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return updates
+}
+
+// frozenFor returns the migration a machine is frozen for on its source shard
+// chain.
+func (w *WorkChain) frozenFor(machineId string) (Migration, bool) {
+	m := Migration{}
+	data := w.readCommitted(frozenKey(w.Id, machineId))
+	if data == nil || json.Unmarshal(data, &m) != nil {
+		return m, false
+	}
+	return m, true
+}
+
+// frozenOn tells whether a machine is frozen on a shard chain.
+func (w *WorkChain) frozenOn(shardId string, machineId string) bool {
+	m, ok := w.frozenFor(machineId)
+	return ok && m.From == shardId
+}
+
+// queue holds a transaction of a migrating machine, reporting false when the
+// machine is not migrating and the transaction should go out now.
+func (w *WorkChain) queue(machineId string, typ chainmodel.TrxType, payload []byte) bool {
+	if _, ok := w.sharder.Migrating(machineId); !ok {
+		return false
+	}
+	w.migrations.lock.Lock()
+	defer w.migrations.lock.Unlock()
+	w.migrations.queued[machineId] = append(w.migrations.queued[machineId], queuedTrx{typ: typ, payload: payload})
+	return true
+}
+
+func (w *WorkChain) replay(machineId string) {
+	w.migrations.lock.Lock()
+	queued := w.migrations.queued[machineId]
+	delete(w.migrations.queued, machineId)
+	delete(w.migrations.votes, machineId)
+	delete(w.migrations.imported, machineId)
+	w.migrations.lock.Unlock()
+	for _, trx := range queued {
+		w.blockchain.SubmitTrx(w.Id, machineId, trx.typ, trx.payload)
+	}
+}
+
+func (w *WorkChain) submitToShard(shardId string, typ chainmodel.TrxType, payload []byte) {
+	shardChain, ok := w.shardChains.Get(shardId)
+	if !ok {
+		log.Println("shard chain not found:", shardId)
+		return
+	}
+	shardChain.shardProxy.SubmitTx(chainmodel.NewEnvelope(typ, w.Id, shardId, w.blockchain.app.Id(), payload).Encode())
+}
+
+// startMigrations submits a freeze of every machine starting to migrate out of
+// a shard of this node to the chain of that shard.
+func (w *WorkChain) startMigrations(started map[string]Migration) {
+	for machineId, m := range started {
+		w.submitFreeze(chainmodel.TrxMachineFreeze, machineId, m)
+	}
+}
+
+// abortMigrations thaws the machines whose migration timed out and sends what
+// was queued for them back to their source shard.
+func (w *WorkChain) abortMigrations(aborted map[string]Migration) {
+	for machineId, m := range aborted {
+		log.Println("migration of machine", machineId, "from", m.From, "to", m.To, "aborted")
+		w.submitFreeze(chainmodel.TrxMachineThaw, machineId, m)
+		future.Async(func() {
+			w.replay(machineId)
+		}, false)
+	}
+}
+
+func (w *WorkChain) submitFreeze(typ chainmodel.TrxType, machineId string, m Migration) {
+	if !slices.Contains(w.sharder.ShardNodes(m.From), w.sharder.Self) {
+		return
+	}
+	payload, err := json.Marshal(MachineFreeze{MachineId: machineId, Migration: m})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	future.Async(func() {
+		w.submitToShard(m.From, typ, payload)
+	}, false)
+}
+
+// onFreeze freezes a machine when the source shard chain of its migration
+// commits the first freeze for it, and starts exporting its bundle. Freezes of
+// a migration the sharder is not running are dropped. Requests the shard chain
+// commits for the machine from there on are sent again by their submitters.
+func (w *WorkChain) onFreeze(shardId string, freeze MachineFreeze) []update.Update {
+	if freeze.Migration.From != shardId {
+		return nil
+	}
+	if m, ok := w.sharder.Migrating(freeze.MachineId); !ok || m != freeze.Migration {
+		log.Println("freeze of machine", freeze.MachineId, "does not match its migration")
+		return nil
+	}
+	if m, ok := w.frozenFor(freeze.MachineId); ok && m == freeze.Migration {
+		return nil
+	}
+	data, _ := json.Marshal(freeze.Migration)
+	effects := w.writeCommitted(update.Update{Typ: "put", Key: frozenKey(w.Id, freeze.MachineId), Val: data})
+	future.Async(func() {
+		w.exportBundle(freeze.MachineId, freeze.Migration)
+	}, false)
+	return effects
+}
+
+// onThaw lets the source shard chain take requests for a machine again once
+// its migration completed or was aborted.
+func (w *WorkChain) onThaw(shardId string, freeze MachineFreeze) []update.Update {
+	if freeze.Migration.From != shardId {
+		return nil
+	}
+	if m, ok := w.sharder.Migrating(freeze.MachineId); ok && m == freeze.Migration {
+		log.Println("thaw of machine", freeze.MachineId, "while it is still migrating")
+		return nil
+	}
+	if m, ok := w.frozenFor(freeze.MachineId); ok && m == freeze.Migration {
+		return w.writeCommitted(update.Update{Typ: "del", Key: frozenKey(w.Id, freeze.MachineId)})
+	}
+	return nil
+}
+
+// exportBundle waits for a frozen machine to answer the requests it took
+// before the freeze, then exports its state, which is final from there on.
+func (w *WorkChain) exportBundle(machineId string, m Migration) {
+	app := w.blockchain.app
+	for !app.MachineSettled(machineId) {
+		if current, ok := w.sharder.Migrating(machineId); !ok || current != m {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	var state map[string]string
+	var err error
+	for i := 0; i < bundleExportAttempts; i++ {
+		if state, err = app.Tools().Wasm().ExportMachineState(machineId); err == nil {
+			break
+		}
+		log.Println(err)
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		log.Println("giving up on exporting state of machine", machineId)
+		return
+	}
+	bundle := MachineBundle{MachineId: machineId, From: m.From, To: m.To, StartedAt: m.StartedAt, State: state}
+	bundle.Hash = bundle.ComputeHash()
+	signed := SignedBundle{
+		Bundle:    bundle,
+		Signer:    app.Id(),
+		Signature: app.SignPacket([]byte(bundle.Hash)),
+	}
+	payload, err := json.Marshal(signed)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.submitToShard(m.To, chainmodel.TrxMachineBundle, payload)
+}
+
+// verifyBundle checks a bundle against the server key its signer registered
+// on chain.
+func verifyBundle(publicKey string, signed SignedBundle) error {
+	if signed.Bundle.Hash != signed.Bundle.ComputeHash() {
+		return errors.New("bundle hash mismatch")
+	}
+	return crypto.VerifySignature([]byte(publicKey), []byte(signed.Bundle.Hash), signed.Signature)
+}
+
+// onBundle counts a bundle committed on the target shard chain and imports it
+// when a majority of the source shard nodes sent the same one, returning the
+// imported state as effects of the block.
+func (w *WorkChain) onBundle(shardId string, signed SignedBundle) []update.Update {
+	bundle := signed.Bundle
+	m, ok := w.sharder.Migrating(bundle.MachineId)
+	if !ok || m.From != bundle.From || m.To != bundle.To || m.StartedAt != bundle.StartedAt || bundle.To != shardId {
+		log.Println("unexpected bundle for machine", bundle.MachineId)
+		return nil
+	}
+	sourceNodes := w.sharder.ShardNodes(m.From)
+	if !slices.Contains(sourceNodes, signed.Signer) {
+		log.Println("bundle signer is not a node of shard", m.From)
+		return nil
+	}
+	signer, found := w.blockchain.nodeRecord(signed.Signer)
+	if !found || signer.PublicKey == "" {
+		log.Println("bundle signer", signed.Signer, "is not a registered node")
+		return nil
+	}
+	if err := verifyBundle(signer.PublicKey, signed); err != nil {
+		log.Println("bundle rejected:", err)
+		return nil
+	}
+
+	w.migrations.lock.Lock()
+	if _, done := w.migrations.imported[bundle.MachineId]; done {
+		w.migrations.lock.Unlock()
+		return nil
+	}
+	votes, ok := w.migrations.votes[bundle.MachineId]
+	if !ok {
+		votes = map[string][]string{}
+		w.migrations.votes[bundle.MachineId] = votes
+	}
+	if !slices.Contains(votes[bundle.Hash], signed.Signer) {
+		votes[bundle.Hash] = append(votes[bundle.Hash], signed.Signer)
+	}
+	if len(votes[bundle.Hash])*2 <= len(sourceNodes) {
+		w.migrations.lock.Unlock()
+		return nil
+	}
+	w.migrations.imported[bundle.MachineId] = bundle.Hash
+	w.migrations.lock.Unlock()
+
+	keys := make([]string, 0, len(bundle.State))
+	for k := range bundle.State {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	imported := make([]update.Update, 0, len(keys))
+	ops := make([]map[string]string, 0, len(keys))
+	for _, k := range keys {
+		imported = append(imported, update.Update{Typ: "put", Key: k, Val: []byte(bundle.State[k])})
+		ops = append(ops, map[string]string{"opType": "put", "key": k, "val": bundle.State[k]})
+	}
+	if len(ops) > 0 {
+		effects, _ := json.Marshal(ops)
+		w.blockchain.app.Tools().Wasm().ExecuteChainEffects(string(effects))
+	}
+
+	app := w.blockchain.app
+	confirm := MigrationConfirm{MachineId: bundle.MachineId, To: bundle.To, StartedAt: bundle.StartedAt, Hash: bundle.Hash, Signer: app.Id()}
+	confirm.Signature = app.SignPacket([]byte(confirm.key()))
+	payload, _ := json.Marshal(confirm)
+	future.Async(func() {
+		w.submitToShard("shard-main", chainmodel.TrxMachineMigrated, payload)
+	}, false)
+	return imported
+}
+
+// onMigrated counts a confirm committed on the main shard chain, and switches
+// the machine to its target shard once a majority of the target shard nodes
+// confirmed the same bundle, replaying what was queued for it meanwhile.
+func (w *WorkChain) onMigrated(confirm MigrationConfirm) []update.Update {
+	m, ok := w.sharder.Migrating(confirm.MachineId)
+	if !ok || m.To != confirm.To || m.StartedAt != confirm.StartedAt {
+		log.Println("unexpected migration confirm for machine", confirm.MachineId)
+		return nil
+	}
+	targetNodes := w.sharder.ShardNodes(m.To)
+	if !slices.Contains(targetNodes, confirm.Signer) {
+		log.Println("migration confirm signer is not a node of shard", m.To)
+		return nil
+	}
+	signer, found := w.blockchain.nodeRecord(confirm.Signer)
+	if !found || signer.PublicKey == "" {
+		log.Println("migration confirm signer", confirm.Signer, "is not a registered node")
+		return nil
+	}
+	if err := verifyConfirm(signer.PublicKey, confirm); err != nil {
+		log.Println("migration confirm rejected:", err)
+		return nil
+	}
+
+	key := confirmsKey(w.Id, confirm.MachineId)
+	confirms := migrationConfirms{}
+	if data := w.readCommitted(key); data != nil {
+		json.Unmarshal(data, &confirms)
+	}
+	if confirms.Migration != m.Key() {
+		confirms = migrationConfirms{Migration: m.Key(), Signers: map[string][]string{}}
+	}
+	if slices.Contains(confirms.Signers[confirm.Hash], confirm.Signer) {
+		return nil
+	}
+	confirms.Signers[confirm.Hash] = append(confirms.Signers[confirm.Hash], confirm.Signer)
+	if len(confirms.Signers[confirm.Hash])*2 <= len(targetNodes) {
+		data, _ := json.Marshal(confirms)
+		return w.writeCommitted(update.Update{Typ: "put", Key: key, Val: data})
+	}
+
+	if err := w.sharder.CompleteMigration(confirm.MachineId, confirm.To); err != nil {
+		log.Println(err)
+		return nil
+	}
+	effects := w.writeCommitted(update.Update{Typ: "del", Key: key})
+	w.submitFreeze(chainmodel.TrxMachineThaw, confirm.MachineId, m)
+	future.Async(func() {
+		w.replay(confirm.MachineId)
+	}, false)
+	return effects
+}
@@ -0,0 +1,301 @@
+package chain
+
+import (
+	"kasper/src/abstract/adapters/storage"
+	"kasper/src/abstract/adapters/tools"
+	"kasper/src/abstract/adapters/wasm"
+	chainmodel "kasper/src/abstract/models/chain"
+	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/trx"
+	module_trx "kasper/src/core/module/actor/model/trx"
+	"kasper/src/shell/api/model"
+	"kasper/src/shell/utils/crypto"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	cmap "github.com/orcaman/concurrent-map/v2"
+)
+
+type testStorage struct {
+	storage.IStorage
+	db *badger.DB
+}
+
+func (s testStorage) KvDb() *badger.DB {
+	return s.db
+}
+
+// unsettledCore is a core whose machines never settle, so a freeze waits for
+// them and export nothing. Its state is kept in a badger db.
+type unsettledCore struct {
+	core.ICore
+	storage testStorage
+	wasm    *recordingWasm
+}
+
+func (unsettledCore) MachineSettled(string) bool {
+	return false
+}
+
+func (unsettledCore) Id() string {
+	return "n9"
+}
+
+func (unsettledCore) SignPacket([]byte) string {
+	return ""
+}
+
+func (c unsettledCore) Tools() tools.ITools {
+	return testTools{wasm: c.wasm}
+}
+
+type testTools struct {
+	tools.ITools
+	wasm *recordingWasm
+}
+
+func (t testTools) Wasm() wasm.IWasm {
+	return t.wasm
+}
+
+// recordingWasm keeps the chain effects it is asked to apply.
+type recordingWasm struct {
+	wasm.IWasm
+	effects []string
+}
+
+func (r *recordingWasm) ExecuteChainEffects(effects string) {
+	r.effects = append(r.effects, effects)
+}
+
+func (c unsettledCore) ModifyState(readonly bool, fn func(trx.ITrx) error) {
+	tx := module_trx.NewTrx(c, c.storage, readonly)
+	if err := fn(tx); err != nil {
+		tx.Discard()
+		return
+	}
+	tx.Commit()
+}
+
+func newTestWorkChain(t *testing.T, sm *ShardManager) *WorkChain {
+	st := testStorage{db: openTestDb(t)}
+	return &WorkChain{
+		Id:          "main",
+		blockchain:  &Blockchain{app: unsettledCore{storage: st, wasm: &recordingWasm{}}, storage: st},
+		sharder:     sm,
+		shardChains: cmap.New[*ShardChain](),
+		migrations:  newMigrations(),
+	}
+}
+
+// migratingWorkChain is seen from n9, a node of no shard, while d1 migrates
+// from shard-1 to shard-2. The nodes of both shards are registered with the
+// returned private keys.
+func migratingWorkChain(t *testing.T) (*WorkChain, Migration, map[string][]byte) {
+	ts := newTestSharder("n9", testNodes, 1)
+	for _, id := range []string{"d1", "d2"} {
+		ts.DeployDapp(id)
+	}
+	acceptAll(t, ts.ShardManager, ShardChange{Op: "split", ShardId: "shard-1", NewShardId: "shard-2", Dapps: []string{"d1"}}, 10)
+	ts.Advance(10 + shardChangeDelay())
+	m, ok := ts.Migrating("d1")
+	if !ok {
+		t.Fatalf("d1 is not migrating")
+	}
+	w := newTestWorkChain(t, ts.ShardManager)
+	privKeys := map[string][]byte{}
+	w.blockchain.app.ModifyState(false, func(trx trx.ITrx) error {
+		for _, id := range testNodes {
+			privKey, pubKey := crypto.SecureKeyPairs("")
+			privKeys[id] = privKey
+			model.Node{Origin: id, OwnerId: "owner", PublicKey: string(pubKey)}.Push(trx)
+		}
+		return nil
+	})
+	return w, m, privKeys
+}
+
+func signedBundle(t *testing.T, privKey []byte) SignedBundle {
+	bundle := MachineBundle{MachineId: "d1", From: "shard-1", To: "shard-2", StartedAt: 20, State: map[string]string{"d1::k": "v"}}
+	bundle.Hash = bundle.ComputeHash()
+	signature, err := crypto.Sign(privKey, []byte(bundle.Hash))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return SignedBundle{Bundle: bundle, Signer: "n1", Signature: signature}
+}
+
+func TestVerifyBundle(t *testing.T) {
+	privKey, pubKey := crypto.SecureKeyPairs("")
+	signed := signedBundle(t, privKey)
+	if err := verifyBundle(string(pubKey), signed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tampered := signed
+	tampered.Bundle.State = map[string]string{"d1::k": "other"}
+	if err := verifyBundle(string(pubKey), tampered); err == nil {
+		t.Fatalf("bundle with changed state verified")
+	}
+	tampered.Bundle.Hash = tampered.Bundle.ComputeHash()
+	if err := verifyBundle(string(pubKey), tampered); err == nil {
+		t.Fatalf("rehashed bundle verified with the old signature")
+	}
+	_, otherPubKey := crypto.SecureKeyPairs("")
+	if err := verifyBundle(string(otherPubKey), signed); err == nil {
+		t.Fatalf("bundle verified with a key its signer did not register")
+	}
+}
+
+func TestBundleHashIgnoresHash(t *testing.T) {
+	bundle := MachineBundle{MachineId: "d1", From: "shard-1", To: "shard-2", State: map[string]string{"a": "1"}}
+	hash := bundle.ComputeHash()
+	bundle.Hash = "anything"
+	if bundle.ComputeHash() != hash {
+		t.Fatalf("hash depends on the hash field")
+	}
+	bundle.StartedAt = 1
+	if bundle.ComputeHash() == hash {
+		t.Fatalf("hash does not cover the migration")
+	}
+}
+
+func TestFreezeAndThaw(t *testing.T) {
+	w, m, _ := migratingWorkChain(t)
+
+	if effects := w.onFreeze("shard-2", MachineFreeze{MachineId: "d1", Migration: m}); w.frozenOn("shard-2", "d1") || w.frozenOn("shard-1", "d1") || len(effects) != 0 {
+		t.Fatalf("freeze committed on the target shard froze the machine")
+	}
+	other := Migration{From: "shard-1", To: "shard-3", StartedAt: m.StartedAt}
+	if w.onFreeze("shard-1", MachineFreeze{MachineId: "d1", Migration: other}); w.frozenOn("shard-1", "d1") {
+		t.Fatalf("freeze of a migration the sharder does not run froze the machine")
+	}
+	if w.onFreeze("shard-1", MachineFreeze{MachineId: "d2", Migration: Migration{From: "shard-1", To: "shard-2", StartedAt: m.StartedAt}}); w.frozenOn("shard-1", "d2") {
+		t.Fatalf("freeze of a machine that is not migrating froze it")
+	}
+	effects := w.onFreeze("shard-1", MachineFreeze{MachineId: "d1", Migration: m})
+	if !w.frozenOn("shard-1", "d1") || w.frozenOn("shard-2", "d1") {
+		t.Fatalf("machine not frozen on its source shard only")
+	}
+	if len(effects) != 1 || effects[0].Key != frozenKey("main", "d1") || effects[0].Typ != "put" {
+		t.Fatalf("freeze not kept in the committed state: %v", effects)
+	}
+	if effects := w.onFreeze("shard-1", MachineFreeze{MachineId: "d1", Migration: m}); len(effects) != 0 {
+		t.Fatalf("second freeze changed the state: %v", effects)
+	}
+
+	if w.onThaw("shard-1", MachineFreeze{MachineId: "d1", Migration: m}); !w.frozenOn("shard-1", "d1") {
+		t.Fatalf("thaw while still migrating thawed the machine")
+	}
+	w.sharder.Advance(m.StartedAt + shardMigrationTimeout())
+	if w.onThaw("shard-1", MachineFreeze{MachineId: "d1", Migration: Migration{From: "shard-1", To: "shard-2", StartedAt: 5}}); !w.frozenOn("shard-1", "d1") {
+		t.Fatalf("thaw of another migration thawed the machine")
+	}
+	effects = w.onThaw("shard-1", MachineFreeze{MachineId: "d1", Migration: m})
+	if w.frozenOn("shard-1", "d1") {
+		t.Fatalf("machine still frozen after its thaw")
+	}
+	if len(effects) != 1 || effects[0].Typ != "del" {
+		t.Fatalf("thaw not kept in the committed state: %v", effects)
+	}
+}
+
+func TestBundleImportIsBlockEffect(t *testing.T) {
+	w, m, privKeys := migratingWorkChain(t)
+	bundle := MachineBundle{MachineId: "d1", From: m.From, To: m.To, StartedAt: m.StartedAt, State: map[string]string{"d1::b": "2", "d1::a": "1"}}
+	bundle.Hash = bundle.ComputeHash()
+	sign := func(signer string) SignedBundle {
+		signature, err := crypto.Sign(privKeys[signer], []byte(bundle.Hash))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return SignedBundle{Bundle: bundle, Signer: signer, Signature: signature}
+	}
+	for _, signer := range []string{"n1", "n2"} {
+		if effects := w.onBundle("shard-2", sign(signer)); len(effects) != 0 {
+			t.Fatalf("bundle imported without a majority of the source nodes")
+		}
+	}
+	effects := w.onBundle("shard-2", sign("n3"))
+	if len(effects) != 2 || effects[0].Key != "d1::a" || string(effects[0].Val) != "1" || effects[1].Key != "d1::b" || effects[0].Typ != "put" {
+		t.Fatalf("imported state not returned as block effects: %v", effects)
+	}
+	if applied := w.blockchain.app.(unsettledCore).wasm.effects; len(applied) != 1 {
+		t.Fatalf("imported state applied %d times", len(applied))
+	}
+}
+
+func signedConfirm(t *testing.T, privKey []byte, signer string, m Migration, hash string) MigrationConfirm {
+	confirm := MigrationConfirm{MachineId: "d1", To: m.To, StartedAt: m.StartedAt, Hash: hash, Signer: signer}
+	signature, err := crypto.Sign(privKey, []byte(confirm.key()))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	confirm.Signature = signature
+	return confirm
+}
+
+func TestMigrationNeedsMajorityOfConfirms(t *testing.T) {
+	w, m, privKeys := migratingWorkChain(t)
+	migrating := func() bool {
+		_, ok := w.sharder.Migrating("d1")
+		return ok
+	}
+
+	forged := signedConfirm(t, privKeys["n2"], "n1", m, "h")
+	if effects := w.onMigrated(forged); len(effects) != 0 {
+		t.Fatalf("confirm signed by another node counted")
+	}
+	stale := signedConfirm(t, privKeys["n1"], "n1", Migration{To: m.To, StartedAt: 1}, "h")
+	if effects := w.onMigrated(stale); len(effects) != 0 {
+		t.Fatalf("confirm of another migration counted")
+	}
+	w.onMigrated(signedConfirm(t, privKeys["n1"], "n1", m, "h"))
+	w.onMigrated(signedConfirm(t, privKeys["n1"], "n1", m, "h"))
+	w.onMigrated(signedConfirm(t, privKeys["n2"], "n2", m, "h"))
+	w.onMigrated(signedConfirm(t, privKeys["n3"], "n3", m, "other"))
+	if !migrating() {
+		t.Fatalf("migration completed without a majority on one bundle")
+	}
+	effects := w.onMigrated(signedConfirm(t, privKeys["n4"], "n4", m, "h"))
+	if migrating() || w.sharder.ShardOf("d1") != "shard-2" {
+		t.Fatalf("migration not completed by a majority of the target nodes")
+	}
+	if len(effects) != 1 || effects[0].Typ != "del" || w.readCommitted(confirmsKey("main", "d1")) != nil {
+		t.Fatalf("confirms kept once the migration completed: %v", effects)
+	}
+}
+
+func TestVerifyConfirm(t *testing.T) {
+	privKey, pubKey := crypto.SecureKeyPairs("")
+	m := Migration{From: "shard-1", To: "shard-2", StartedAt: 20}
+	confirm := signedConfirm(t, privKey, "n1", m, "h")
+	if err := verifyConfirm(string(pubKey), confirm); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	confirm.Hash = "other"
+	if err := verifyConfirm(string(pubKey), confirm); err == nil {
+		t.Fatalf("confirm of another bundle verified")
+	}
+}
+
+func TestQueueHoldsMigratingMachines(t *testing.T) {
+	ts := newTestSharder("n1", testNodes, 1)
+	loadShard(ts)
+	w := newTestWorkChain(t, ts.ShardManager)
+	if w.queue("d1", chainmodel.TrxAppRequest, []byte("before")) {
+		t.Fatalf("request of a machine not migrating was held")
+	}
+	acceptAll(t, ts.ShardManager, ts.proposed[0], 10)
+	ts.Advance(10 + shardChangeDelay())
+	if !w.queue("d1", chainmodel.TrxAppRequest, []byte("during")) {
+		t.Fatalf("request of a migrating machine went out")
+	}
+	if w.queue("d2", chainmodel.TrxAppRequest, []byte("other")) {
+		t.Fatalf("request of a machine staying on its shard was held")
+	}
+	queued := w.migrations.queued["d1"]
+	if len(queued) != 1 || string(queued[0].payload) != "during" || queued[0].typ != chainmodel.TrxAppRequest {
+		t.Fatalf("queued %v", queued)
+	}
+}
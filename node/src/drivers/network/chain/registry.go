@@ -0,0 +1,89 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"kasper/src/abstract/models/trx"
+	inputs_chain "kasper/src/shell/api/inputs/chain"
+	"kasper/src/shell/api/model"
+	"log"
+	"time"
+)
+
+// Every node keeps its origin registered on chain with its owner, server key,
+// TLS certificate fingerprint and wasm runtime. The registration is sent by
+// the node itself on behalf of its owner once the chain is running, and sent
+// again whenever one of them changed.
+const (
+	registrationAttempts = 10
+	registrationInterval = 30 * time.Second
+)
+
+// CertFingerprint is the hex sha256 of the leaf certificate of a tls config.
+func CertFingerprint(tlsConfig *tls.Config) string {
+	if tlsConfig == nil || len(tlsConfig.Certificates) == 0 || len(tlsConfig.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(tlsConfig.Certificates[0].Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Blockchain) nodeRecord(origin string) (model.Node, bool) {
+	var node model.Node
+	found := false
+	c.app.ModifyState(true, func(trx trx.ITrx) error {
+		node, found = model.Node{Origin: origin}.Resolve(trx)
+		return nil
+	})
+	return node, found
+}
+
+func (c *Blockchain) UserOwnsOrigin(userId string, origin string) bool {
+	node, found := c.nodeRecord(origin)
+	return found && node.OwnerId == userId
+}
+
+func (c *Blockchain) GetNodeOwnerId(origin string) string {
+	node, _ := c.nodeRecord(origin)
+	return node.OwnerId
+}
+
+func (c *Blockchain) registerOrigin(tlsConfig *tls.Config) {
+	app := c.app
+	if app.OwnerId() == "" || app.Id() == "" {
+		return
+	}
+	node := model.Node{
+		Origin:          app.Id(),
+		OwnerId:         app.OwnerId(),
+		PublicKey:       string(app.Tools().Security().FetchKeyPair("server_key")[1]),
+		CertFingerprint: CertFingerprint(tlsConfig),
+		WasmRuntime:     app.Tools().Wasm().Runtime(),
+	}
+	input := inputs_chain.RegisterNodeInput{
+		Orig:            node.Origin,
+		PublicKey:       node.PublicKey,
+		CertFingerprint: node.CertFingerprint,
+		Proof:           app.SignPacket(node.ProofMessage()),
+		WasmRuntime:     node.WasmRuntime,
+		Rotations:       app.Tools().Security().KeyRotations("server_key"),
+	}
+	payload, err := json.Marshal(input)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for i := 0; i < registrationAttempts; i++ {
+		time.Sleep(registrationInterval)
+		if current, found := c.nodeRecord(node.Origin); found && current.OwnerId == node.OwnerId && current.PublicKey == node.PublicKey && current.CertFingerprint == node.CertFingerprint && current.WasmRuntime == node.WasmRuntime {
+			return
+		}
+		app.ExecBaseRequestOnChain("/chains/registerNode", payload, app.SignPacketAsOwner(payload), app.OwnerId(), "", func(_ []byte, _ int, err error) {
+			if err != nil {
+				log.Println("registering origin failed:", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// MAXTRANSACTIONS is the maximum number of transactions returned by the
+// /explorer/ index endpoints
+const MAXTRANSACTIONS = 100
+
+// Explorer answers queries over the application transactions of committed
+// blocks.
+type Explorer interface {
+	Lifecycle(requestId string) (any, error)
+	Transactions(index string, value string, from int, count int) (any, error)
+	BlockTransactions(workChainId string, shardChainId string, blockIndex int) (any, error)
+}
+
+// SetExplorer links the explorer that serves the /explorer/ endpoints.
+func (s *Service) SetExplorer(explorer Explorer) {
+	s.Lock()
+	defer s.Unlock()
+	s.explorer = explorer
+}
+
+func writeJSON(w http.ResponseWriter, res any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// GetRequestLifecycle returns a request, the response of each executor and
+// the effects that were applied.
+//
+//	GET /explorer/request/{requestId}
+//	returns: JSON RequestLifecycle
+func (s *Service) GetRequestLifecycle(w http.ResponseWriter, r *http.Request) {
+	if s.explorer == nil {
+		http.Error(w, "explorer is not enabled", http.StatusNotFound)
+		return
+	}
+	res, err := s.explorer.Lifecycle(r.URL.Path[len("/explorer/request/"):])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// makeIndexHandler serves the transactions of an author, a machine or a point,
+// oldest first.
+//
+//	GET /explorer/{index}/{value}?from={x}&count={y}
+//	returns: JSON []ExplorerTrx
+func (s *Service) makeIndexHandler(index string) func(http.ResponseWriter, *http.Request) {
+	prefix := "/explorer/" + index + "/"
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.explorer == nil {
+			http.Error(w, "explorer is not enabled", http.StatusNotFound)
+			return
+		}
+		from, count := 0, MAXTRANSACTIONS
+		if qf := r.URL.Query().Get("from"); qf != "" {
+			v, err := strconv.Atoi(qf)
+			if err != nil || v < 0 {
+				http.Error(w, "from is not valid", http.StatusBadRequest)
+				return
+			}
+			from = v
+		}
+		if qc := r.URL.Query().Get("count"); qc != "" {
+			v, err := strconv.Atoi(qc)
+			if err != nil || v <= 0 {
+				http.Error(w, "count is not valid", http.StatusBadRequest)
+				return
+			}
+			count = min(v, MAXTRANSACTIONS)
+		}
+		res, err := s.explorer.Transactions(index, r.URL.Path[len(prefix):], from, count)
+		if err != nil {
+			s.logger.WithError(err).Errorf("Querying %s transactions", index)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, res)
+	}
+}
+
+// GetBlockTransactions returns the application transactions of a block of the
+// chain named by the Work-Chain-Id and Shard-Chain-Id headers.
+//
+//	GET /explorer/block/{blockIndex}
+//	returns: JSON []ExplorerTrx
+func (s *Service) GetBlockTransactions(w http.ResponseWriter, r *http.Request) {
+	if s.explorer == nil {
+		http.Error(w, "explorer is not enabled", http.StatusNotFound)
+		return
+	}
+	param := r.URL.Path[len("/explorer/block/"):]
+	blockIndex, err := strconv.Atoi(param)
+	if err != nil {
+		s.logger.WithError(err).Errorf("Parsing block_index parameter %s", param)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := s.explorer.BlockTransactions(r.Header.Get("Work-Chain-Id"), r.Header.Get("Shard-Chain-Id"), blockIndex)
+	if err != nil {
+		s.logger.WithError(err).Errorf("Querying transactions of block %d", blockIndex)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, res)
+}
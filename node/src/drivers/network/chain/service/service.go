@@ -26,7 +26,8 @@ type Service struct {
 	bindAddress string
 	logger      *logrus.Entry
 
-	nodes cmap.ConcurrentMap[string, *node.Node]
+	nodes    cmap.ConcurrentMap[string, *node.Node]
+	explorer Explorer
 }
 
 // NewService instantiates a Service linked to a Babble node and a bind address.
@@ -62,6 +63,11 @@ func (s *Service) registerHandlers() {
 	http.HandleFunc("/genesispeers", s.makeHandler(s.GetGenesisPeers))
 	http.HandleFunc("/validators/", s.makeHandler(s.GetValidatorSet))
 	http.HandleFunc("/history", s.makeHandler(s.GetAllValidatorSets))
+	http.HandleFunc("/explorer/request/", s.makeHandler(s.GetRequestLifecycle))
+	http.HandleFunc("/explorer/author/", s.makeHandler(s.makeIndexHandler("author")))
+	http.HandleFunc("/explorer/machine/", s.makeHandler(s.makeIndexHandler("machine")))
+	http.HandleFunc("/explorer/point/", s.makeHandler(s.makeIndexHandler("point")))
+	http.HandleFunc("/explorer/block/", s.makeHandler(s.GetBlockTransactions))
 }
 
 func (s *Service) makeHandler(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
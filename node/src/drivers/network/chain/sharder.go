@@ -2,34 +2,98 @@ package chain
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash"
-	"math/rand"
+	"kasper/src/shell/utils/crypto"
+	"math"
+	"os"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
-	// "time"
+	"time"
 )
 
+// shardProposalTimeout is how long a proposal waits to be accepted before this
+// node makes it again.
+const shardProposalTimeout = time.Minute
+
+// shardLoadHalfLife is the half life of the load of a DApp, in block time.
+func shardLoadHalfLife() time.Duration {
+	if v, err := strconv.ParseInt(os.Getenv("SHARD_LOAD_HALF_LIFE"), 10, 64); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// shardChangeDelay is how many main shard chain blocks an accepted change waits
+// before it is applied.
+func shardChangeDelay() int {
+	if v, err := strconv.Atoi(os.Getenv("SHARD_CHANGE_DELAY")); err == nil && v >= 0 {
+		return v
+	}
+	return 10
+}
+
+// shardMigrationTimeout is how many main shard chain blocks a DApp migration
+// may take before it is aborted.
+func shardMigrationTimeout() int {
+	if v, err := strconv.Atoi(os.Getenv("SHARD_MIGRATION_TIMEOUT")); err == nil && v > 0 {
+		return v
+	}
+	return 600
+}
+
 // Node represents a physical or virtual machine in the network.
 type Node struct {
 	ID string
 }
 
 // DApp represents a decentralized application with a specific computational load.
-// Its load is now dynamic, measured by the number of transactions it processes.
+// Its load is the number of transactions its shard chain committed for it,
+// decaying with a half life of shardLoadHalfLife of block time so that old
+// bursts stop counting.
 type DApp struct {
-	ID                    string
-	mu                    sync.Mutex
-	ProcessedTransactions int // Simulates the computational load
+	ID      string
+	mu      sync.Mutex
+	load    float64
+	updated int64 // Timestamp of the block that last added to the load, in unix seconds
+}
+
+// ProcessTransaction records a transaction committed for the DApp in a block
+// with the given timestamp.
+func (d *DApp) ProcessTransaction(timestamp int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.load = d.decayed(timestamp) + 1
+	if timestamp > d.updated {
+		d.updated = timestamp
+	}
 }
 
-// ProcessTransaction simulates a new transaction being processed by the DApp.
-func (d *DApp) ProcessTransaction() {
+// Load returns the load of the DApp decayed up to the given block timestamp.
+func (d *DApp) Load(timestamp int64) float64 {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.ProcessedTransactions++
+	return d.decayed(timestamp)
+}
+
+func (d *DApp) decayed(timestamp int64) float64 {
+	if d.updated == 0 || timestamp <= d.updated {
+		return d.load
+	}
+	return d.load * math.Exp2(-float64(timestamp-d.updated)/shardLoadHalfLife().Seconds())
+}
+
+// DAppLoad is the load of a DApp as it is kept in the committed chain state.
+type DAppLoad struct {
+	Load    float64 `json:"load"`
+	Updated int64   `json:"updated"`
 }
 
 // Shard represents a logical partition of the distributed ledger.
@@ -39,6 +103,14 @@ type Shard struct {
 	mu      sync.RWMutex
 	Dapps   map[string]*DApp // Maps DApp ID to the DApp
 	nodeIDs []string         // The Nodes responsible for this shard
+	clock   int64            // Timestamp of the last block of the shard chain, in unix seconds
+}
+
+// Clock returns the timestamp of the last block the shard chain committed.
+func (s *Shard) Clock() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clock
 }
 
 // NewShard creates and initializes a new Shard.
@@ -74,7 +146,7 @@ func (s *Shard) GetDApp(id string) (*DApp, bool) {
 	return dapp, ok
 }
 
-// DappsDump returns a copy of the shard's DApp collection.
+// DappsDump returns a copy of the shard's DApp collection, ordered by ID.
 func (s *Shard) DappsDump() []*DApp {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -82,13 +154,13 @@ func (s *Shard) DappsDump() []*DApp {
 	for _, v := range s.Dapps {
 		dump = append(dump, v)
 	}
+	sort.Slice(dump, func(i, j int) bool { return dump[i].ID < dump[j].ID })
 	return dump
 }
 
 // ConsistentHasher is the core component for dynamic sharding.
 // It maps keys (DApp IDs) to Shards, minimizing rebalancing when Shards are added or removed.
 type ConsistentHasher struct {
-	hash     hash.Hash
 	replicas int
 	mutex    sync.RWMutex
 	Keys     []int          // Sorted hash ring
@@ -98,7 +170,6 @@ type ConsistentHasher struct {
 // NewConsistentHasher creates a new ConsistentHasher.
 func NewConsistentHasher(replicas int) *ConsistentHasher {
 	return &ConsistentHasher{
-		hash:     sha1.New(),
 		replicas: replicas,
 		Shards:   make(map[int]string),
 	}
@@ -137,11 +208,10 @@ func (ch *ConsistentHasher) RemoveShard(id string) {
 	fmt.Printf("ConsistentHasher: Removed shard %s. Total keys on ring: %d\n", id, len(ch.Keys))
 }
 
-// hashKey generates a SHA1 hash of a string and converts it to an integer.
+// hashKey places a string on the ring using the first four bytes of its SHA1 hash.
 func (ch *ConsistentHasher) hashKey(key string) int {
-	ch.hash.Reset()
-	ch.hash.Write([]byte(key))
-	return int(ch.hash.Sum(nil)[0])
+	sum := sha1.Sum([]byte(key))
+	return int(binary.BigEndian.Uint32(sum[:4]))
 }
 
 // GetShard determines which shard a key belongs to.
@@ -165,6 +235,79 @@ func (ch *ConsistentHasher) GetShard(key string) string {
 	return ch.Shards[ch.Keys[i]]
 }
 
+// ShardChange is a topology change proposed on the main shard chain.
+type ShardChange struct {
+	Op          string   `json:"op"` // "split", "merge" or "addNode"
+	ShardId     string   `json:"shardId"`
+	NewShardId  string   `json:"newShardId"`
+	Dapps       []string `json:"dapps"` // DApps moved to the new shard of a split
+	NodeId      string   `json:"nodeId"`
+	Proposer    string   `json:"proposer"`
+	BaseVersion uint64   `json:"baseVersion"`
+	ApplyAt     int      `json:"applyAt"`
+	Signature   string   `json:"signature"` // Proposer's signature of the change key
+}
+
+func (c ShardChange) key() string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%d", c.Op, c.ShardId, c.NewShardId, strings.Join(c.Dapps, ","), c.NodeId, c.BaseVersion)
+}
+
+// verifyChange checks a change against the server key its proposer registered
+// on chain.
+func verifyChange(publicKey string, change ShardChange) error {
+	return crypto.VerifySignature([]byte(publicKey), []byte(change.key()), change.Signature)
+}
+
+// changeQuorum is how many nodes of a shard have to propose a change to it:
+// n - (n-1)/3, so that the faulty nodes a shard tolerates can not make one.
+func changeQuorum(nodes int) int {
+	if nodes <= 0 {
+		return 1
+	}
+	return nodes - (nodes-1)/3
+}
+
+// Migration tracks a DApp moving between shards. The DApp stays routed to its
+// source shard until the target shard confirms it imported the DApp's state.
+type Migration struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	StartedAt int    `json:"startedAt"` // Main shard chain block the migration started at
+}
+
+// Key identifies a migration of a DApp among the ones it went through.
+func (m Migration) Key() string {
+	return fmt.Sprintf("%s|%s|%d", m.From, m.To, m.StartedAt)
+}
+
+// ShardMap is the state of a ShardManager that every node has to agree on.
+// Version counts the changes applied so far and Hash covers the topology, so
+// two nodes at the same version can tell whether they diverged. Pending is the
+// accepted change still waiting for its block and Endorsements lists the nodes
+// that proposed each change not accepted yet; neither is part of the hash.
+type ShardMap struct {
+	Version      uint64               `json:"version"`
+	Counter      int64                `json:"counter"`
+	Nodes        []string             `json:"nodes"`
+	Shards       map[string][]string  `json:"shards"`
+	Dapps        map[string]string    `json:"dapps"`
+	Migrations   map[string]Migration `json:"migrations,omitempty"`
+	Draining     []string             `json:"draining,omitempty"` // Merged shards waiting for their DApps to move out
+	Hash         string               `json:"hash"`
+	Pending      *ShardChange         `json:"pending,omitempty"`
+	Endorsements map[string][]string  `json:"endorsements,omitempty"`
+}
+
+// ComputeHash hashes the topology of the map.
+func (m ShardMap) ComputeHash() string {
+	m.Hash = ""
+	m.Pending = nil
+	m.Endorsements = nil
+	data, _ := json.Marshal(m)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 // ShardManager orchestrates the distributed ledger network.
 // It manages the collection of Nodes and Shards.
 type ShardManager struct {
@@ -179,17 +322,24 @@ type ShardManager struct {
 	MinShardLoad int
 	MaxNodes     int
 	MinNodes     int
-	ShardCounter int64 // Used to generate unique IDs for new Shards
-	NodeCounter  int   // Used to generate unique IDs for new Nodes
+	ShardCounter int64  // Used to generate unique IDs for new Shards
+	NodeCounter  int    // Used to generate unique IDs for new Nodes
+	Version      uint64 // Number of topology changes applied so far
+
+	Self         string // ID of the local node, the one proposing changes
+	pending      *ShardChange
+	endorsements map[string][]string // Proposers of each change not accepted yet, by change key
+	migrations   map[string]Migration
+	draining     map[string]bool
+	proposedFor  int64 // Version this node last proposed a change against
+	proposedAt   time.Time
 
 	createChainCb func(string, []string)
+	proposeCb     func(ShardChange)
 }
 
 // NewShardManager initializes a new network with an initial number of Nodes and Shards.
-func NewShardManager(initialNodes []string, initialShards int64, MaxShardLoad, MinShardLoad, MaxNodes, MinNodes int, createChainCallback func(string, []string)) *ShardManager {
-
-	// rand.Seed(time.Now().UnixNano())
-
+func NewShardManager(self string, initialNodes []string, initialShards int64, MaxShardLoad, MinShardLoad, MaxNodes, MinNodes int, createChainCallback func(string, []string), proposeCallback func(ShardChange)) *ShardManager {
 	manager := &ShardManager{
 		Nodes:         make(map[string]*Node),
 		Shards:        make(map[string]*Shard),
@@ -201,7 +351,13 @@ func NewShardManager(initialNodes []string, initialShards int64, MaxShardLoad, M
 		MinNodes:      MinNodes,
 		ShardCounter:  initialShards,
 		NodeCounter:   len(initialNodes),
+		Self:          self,
+		migrations:    make(map[string]Migration),
+		draining:      make(map[string]bool),
+		endorsements:  make(map[string][]string),
+		proposedFor:   -1,
 		createChainCb: createChainCallback,
+		proposeCb:     proposeCallback,
 	}
 
 	fmt.Println("Initializing distributed ledger network...")
@@ -218,50 +374,142 @@ func NewShardManager(initialNodes []string, initialShards int64, MaxShardLoad, M
 	return manager
 }
 
-// ExportState serializes the entire ShardManager state into a JSON string.
-func (sm *ShardManager) ExportState() (string, error) {
+// Map exports the shard map of the manager.
+func (sm *ShardManager) Map() ShardMap {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.shardMap()
+}
 
-	data, err := json.MarshalIndent(sm, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("failed to export state: %w", err)
+func (sm *ShardManager) shardMap() ShardMap {
+	m := ShardMap{
+		Version: sm.Version,
+		Counter: sm.ShardCounter,
+		Nodes:   make([]string, 0, len(sm.Nodes)),
+		Shards:  make(map[string][]string, len(sm.Shards)),
+		Dapps:   map[string]string{},
+	}
+	for id := range sm.Nodes {
+		m.Nodes = append(m.Nodes, id)
+	}
+	sort.Strings(m.Nodes)
+	for id, shard := range sm.Shards {
+		nodes := slices.Clone(shard.nodeIDs)
+		sort.Strings(nodes)
+		m.Shards[id] = nodes
+		for _, dapp := range shard.DappsDump() {
+			m.Dapps[dapp.ID] = id
+		}
 	}
-	return string(data), nil
+	if len(sm.migrations) > 0 {
+		m.Migrations = make(map[string]Migration, len(sm.migrations))
+		for id, migration := range sm.migrations {
+			m.Migrations[id] = migration
+		}
+	}
+	for id := range sm.draining {
+		m.Draining = append(m.Draining, id)
+	}
+	sort.Strings(m.Draining)
+	m.Hash = m.ComputeHash()
+	if sm.pending != nil {
+		change := *sm.pending
+		m.Pending = &change
+	}
+	if len(sm.endorsements) > 0 {
+		m.Endorsements = make(map[string][]string, len(sm.endorsements))
+		for key, proposers := range sm.endorsements {
+			m.Endorsements[key] = slices.Clone(proposers)
+		}
+	}
+	return m
 }
 
-// ImportState deserializes a JSON string to rebuild the ShardManager state.
-func (sm *ShardManager) ImportState(data string) error {
+// ImportMap replaces the state of the manager with a map read back from the
+// committed state of the main shard chain, as a node restoring a snapshot does.
+// Maps older than the local one are refused, as are maps whose hash does not
+// match their content. Measured DApp loads are kept.
+func (sm *ShardManager) ImportMap(m ShardMap) error {
+	if m.Hash != m.ComputeHash() {
+		return errors.New("shard map hash mismatch")
+	}
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	if m.Version < sm.Version {
+		return fmt.Errorf("shard map version %d is older than local version %d", m.Version, sm.Version)
+	}
 
-	var importedManager ShardManager
-	err := json.Unmarshal([]byte(data), &importedManager)
-	if err != nil {
-		return fmt.Errorf("failed to import state: %w", err)
-	}
-
-	// Manually re-initialize fields that weren't marshaled.
-	sm.Nodes = importedManager.Nodes
-	sm.Shards = importedManager.Shards
-	sm.Dapps = importedManager.Dapps
-	sm.Hasher = NewConsistentHasher(20) // Re-create the hasher
-	sm.Hasher.Keys = importedManager.Hasher.Keys
-	sm.Hasher.Shards = importedManager.Hasher.Shards
-	sm.MaxShardLoad = importedManager.MaxShardLoad
-	sm.MinShardLoad = importedManager.MinShardLoad
-	sm.MaxNodes = importedManager.MaxNodes
-	sm.MinNodes = importedManager.MinNodes
-	sm.ShardCounter = importedManager.ShardCounter
-	sm.NodeCounter = importedManager.NodeCounter
-
-	fmt.Println("\n--- Successfully imported network state! ---")
+	sm.Nodes = make(map[string]*Node, len(m.Nodes))
+	for _, id := range m.Nodes {
+		sm.Nodes[id] = &Node{ID: id}
+	}
+	shardIDs := make([]string, 0, len(m.Shards))
+	for id := range m.Shards {
+		shardIDs = append(shardIDs, id)
+	}
+	sort.Strings(shardIDs)
+	sm.Shards = make(map[string]*Shard, len(m.Shards))
+	sm.Hasher = NewConsistentHasher(20)
+	sm.draining = make(map[string]bool, len(m.Draining))
+	for _, id := range m.Draining {
+		sm.draining[id] = true
+	}
+	for _, id := range shardIDs {
+		sm.Shards[id] = NewShard(id, slices.Clone(m.Shards[id]))
+		if !sm.draining[id] {
+			sm.Hasher.AddShard(id)
+		}
+	}
+	sm.migrations = make(map[string]Migration, len(m.Migrations))
+	for id, migration := range m.Migrations {
+		sm.migrations[id] = migration
+	}
+	dapps := make(map[string]*DApp, len(m.Dapps))
+	for dappID, shardID := range m.Dapps {
+		dapp, ok := sm.Dapps[dappID]
+		if !ok {
+			dapp = &DApp{ID: dappID}
+		}
+		dapps[dappID] = dapp
+		if shard, ok := sm.Shards[shardID]; ok {
+			shard.Dapps[dappID] = dapp
+		}
+	}
+	sm.Dapps = dapps
+	sm.ShardCounter = m.Counter
+	sm.NodeCounter = len(m.Nodes)
+	sm.Version = m.Version
+	sm.pending = m.Pending
+	sm.endorsements = make(map[string][]string, len(m.Endorsements))
+	for key, proposers := range m.Endorsements {
+		sm.endorsements[key] = slices.Clone(proposers)
+	}
+
+	fmt.Printf("\n--- Imported shard map version %d (%s) ---\n", m.Version, m.Hash)
 	return nil
 }
 
-// AddNode adds a new node to the network and assigns it to a random shard.
+// SyncMap handles a shard map sent to the target node. A map sent by a single
+// node is never adopted, the target only takes a map from the committed state
+// of the main shard chain, so every node just compares it with its own.
+func (sm *ShardManager) SyncMap(target string, m ShardMap) {
+	local := sm.Map()
+	if m.Version == local.Version && m.Hash != local.Hash {
+		fmt.Printf("Shard map diverged at version %d: local %s, remote %s\n", m.Version, local.Hash, m.Hash)
+	} else if target == sm.Self && m.Version > local.Version {
+		fmt.Printf("Shard map is behind: local version %d, remote version %d\n", local.Version, m.Version)
+	}
+}
+
+// AddNode adds a new node to the network and assigns it to the shard with the
+// fewest nodes, picking the lowest shard ID on ties.
 func (sm *ShardManager) AddNode(id string) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	sm.addNode(id)
+}
 
+func (sm *ShardManager) addNode(id string) {
 	if _, exists := sm.Nodes[id]; exists {
 		fmt.Printf("Node %s already exists.\n", id)
 		return
@@ -269,14 +517,15 @@ func (sm *ShardManager) AddNode(id string) {
 
 	sm.Nodes[id] = &Node{ID: id}
 
-	if len(sm.Shards) > 0 {
-		var shardIDs []string
-		for sid := range sm.Shards {
-			shardIDs = append(shardIDs, sid)
+	var target *Shard
+	for _, shard := range sm.Shards {
+		if target == nil || len(shard.nodeIDs) < len(target.nodeIDs) || (len(shard.nodeIDs) == len(target.nodeIDs) && shard.ID < target.ID) {
+			target = shard
 		}
-		targetShardID := shardIDs[rand.Intn(len(shardIDs))]
-		sm.Shards[targetShardID].nodeIDs = append(sm.Shards[targetShardID].nodeIDs, id)
-		fmt.Printf("Added Node %s and assigned it to shard %s\n", id, targetShardID)
+	}
+	if target != nil {
+		target.nodeIDs = append(target.nodeIDs, id)
+		fmt.Printf("Added Node %s and assigned it to shard %s\n", id, target.ID)
 	} else {
 		fmt.Printf("Added Node %s, but no Shards exist to assign it to.\n", id)
 	}
@@ -307,202 +556,521 @@ func (sm *ShardManager) RemoveNode(id string) {
 	delete(sm.Nodes, id)
 }
 
-func (sm *ShardManager) manageShards() {
+// ProposeNode proposes adding a node that joined the network to the map.
+func (sm *ShardManager) ProposeNode(id string) {
 	sm.mu.RLock()
-	var shardIDs []string
-	for id := range sm.Shards {
-		shardIDs = append(shardIDs, id)
-	}
+	_, exists := sm.Nodes[id]
+	change := ShardChange{Op: "addNode", NodeId: id, Proposer: sm.Self, BaseVersion: sm.Version}
 	sm.mu.RUnlock()
+	if !exists {
+		sm.proposeCb(change)
+	}
+}
+
+// shardLoad sums the loads of the DApps of a shard, decayed up to the last
+// block of the shard chain.
+func shardLoad(shard *Shard) float64 {
+	clock := shard.Clock()
+	load := 0.0
+	for _, dapp := range shard.DappsDump() {
+		load += dapp.Load(clock)
+	}
+	return load
+}
+
+// manageShards proposes a split or a merge for the first shard of this node
+// that is out of its load bounds. A proposal that has not been accepted within
+// shardProposalTimeout is made again, otherwise there is one per map version.
+func (sm *ShardManager) manageShards() {
+	sm.mu.Lock()
+	if sm.pending != nil || len(sm.migrations) > 0 || (sm.proposedFor == int64(sm.Version) && time.Since(sm.proposedAt) < shardProposalTimeout) {
+		sm.mu.Unlock()
+		return
+	}
+	shardIDs := make([]string, 0, len(sm.Shards))
+	for id, shard := range sm.Shards {
+		if slices.Contains(shard.nodeIDs, sm.Self) {
+			shardIDs = append(shardIDs, id)
+		}
+	}
+	sort.Strings(shardIDs)
 
+	var change *ShardChange
 	for _, id := range shardIDs {
-		sm.mu.RLock()
-		shard, ok := sm.Shards[id]
-		sm.mu.RUnlock()
+		shard := sm.Shards[id]
+		totalLoad := shardLoad(shard)
+		if totalLoad > float64(sm.MaxShardLoad) && len(sm.Shards) < sm.MaxNodes {
+			dapps := sm.splitHalf(shard, totalLoad)
+			if len(dapps) == 0 {
+				continue
+			}
+			change = &ShardChange{Op: "split", ShardId: id, NewShardId: fmt.Sprintf("shard-%d", sm.ShardCounter+1), Dapps: dapps}
+		} else if totalLoad < float64(sm.MinShardLoad) && len(sm.Shards) > sm.MinNodes {
+			change = &ShardChange{Op: "merge", ShardId: id}
+		}
+		if change != nil {
+			change.Proposer = sm.Self
+			change.BaseVersion = sm.Version
+			sm.proposedFor = int64(sm.Version)
+			sm.proposedAt = time.Now()
+			break
+		}
+	}
+	sm.mu.Unlock()
+
+	if change != nil {
+		fmt.Printf("Proposing %s of shard %s at map version %d\n", change.Op, change.ShardId, change.BaseVersion)
+		sm.proposeCb(*change)
+	}
+}
+
+// splitHalf picks the heaviest DApps of a shard until they carry half of its
+// load, leaving at least one DApp behind.
+func (sm *ShardManager) splitHalf(shard *Shard, totalLoad float64) []string {
+	dapps := shard.DappsDump()
+	if len(dapps) < 2 {
+		return nil
+	}
+	clock := shard.Clock()
+	loads := make(map[string]float64, len(dapps))
+	for _, dapp := range dapps {
+		loads[dapp.ID] = dapp.Load(clock)
+	}
+	sort.SliceStable(dapps, func(i, j int) bool {
+		return loads[dapps[i].ID] > loads[dapps[j].ID]
+	})
+	moved := []string{}
+	migratedLoad := 0.0
+	for _, dapp := range dapps[:len(dapps)-1] {
+		if migratedLoad >= totalLoad/2 {
+			break
+		}
+		moved = append(moved, dapp.ID)
+		migratedLoad += loads[dapp.ID]
+	}
+	sort.Strings(moved)
+	return moved
+}
+
+// AcceptChange checks a proposed change against the current map when the main
+// shard chain commits it at blockIndex, once its signature was verified against
+// the key the proposer registered on chain, and schedules it for
+// blockIndex+shardChangeDelay. Every node reaches the same verdict since it
+// only looks at the map and at the change itself. The load a proposer claims
+// can not be checked by nodes outside the shard, so a split or a merge is only
+// accepted once changeQuorum of the shard nodes proposed it, each having
+// measured the load from the shard chain itself.
+func (sm *ShardManager) AcceptChange(change ShardChange, blockIndex int) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.pending != nil {
+		return errors.New("another shard change is pending")
+	}
+	if len(sm.migrations) > 0 {
+		return errors.New("dapps are still migrating")
+	}
+	if change.BaseVersion != sm.Version {
+		return fmt.Errorf("shard change is based on version %d, map is at %d", change.BaseVersion, sm.Version)
+	}
+	if _, ok := sm.Nodes[change.Proposer]; !ok {
+		return errors.New("shard change proposer is not a node of the network")
+	}
+	switch change.Op {
+	case "split":
+		shard, ok := sm.Shards[change.ShardId]
 		if !ok {
-			continue
+			return errors.New("shard to split not found")
+		}
+		if !slices.Contains(shard.nodeIDs, change.Proposer) {
+			return errors.New("shard change proposer does not maintain the shard")
+		}
+		if len(sm.Shards) >= sm.MaxNodes {
+			return errors.New("shard is not eligible for a split")
+		}
+		if change.NewShardId != fmt.Sprintf("shard-%d", sm.ShardCounter+1) {
+			return errors.New("unexpected id for the new shard")
+		}
+		if len(change.Dapps) == 0 || len(change.Dapps) >= len(shard.Dapps) {
+			return errors.New("a split has to move some but not all dapps")
+		}
+		for _, dappID := range change.Dapps {
+			if _, ok := shard.GetDApp(dappID); !ok {
+				return fmt.Errorf("dapp %s is not on shard %s", dappID, change.ShardId)
+			}
+		}
+	case "merge":
+		shard, ok := sm.Shards[change.ShardId]
+		if !ok {
+			return errors.New("shard to merge not found")
+		}
+		if !slices.Contains(shard.nodeIDs, change.Proposer) {
+			return errors.New("shard change proposer does not maintain the shard")
+		}
+		if len(sm.Shards) <= sm.MinNodes {
+			return errors.New("shard is not eligible for a merge")
 		}
+	case "addNode":
+		if change.NodeId == "" {
+			return errors.New("node id is empty")
+		}
+		if _, ok := sm.Nodes[change.NodeId]; ok {
+			return errors.New("node already exists")
+		}
+	default:
+		return fmt.Errorf("unknown shard change %q", change.Op)
+	}
 
-		shard.mu.RLock()
-		totalLoad := 0
-		for _, dapp := range shard.Dapps {
-			dapp.mu.Lock()
-			totalLoad += dapp.ProcessedTransactions
-			dapp.mu.Unlock()
+	if change.Op != "addNode" {
+		key := change.key()
+		if !slices.Contains(sm.endorsements[key], change.Proposer) {
+			sm.endorsements[key] = append(sm.endorsements[key], change.Proposer)
 		}
-		shard.mu.RUnlock()
+		nodes := len(sm.Shards[change.ShardId].nodeIDs)
+		if len(sm.endorsements[key]) < changeQuorum(nodes) {
+			fmt.Printf("%s of shard %s proposed by %d of %d nodes\n", change.Op, change.ShardId, len(sm.endorsements[key]), nodes)
+			return nil
+		}
+	}
+	sm.endorsements = make(map[string][]string)
+	change.ApplyAt = blockIndex + shardChangeDelay()
+	sm.pending = &change
+	fmt.Printf("Accepted %s of shard %s, applying at block %d\n", change.Op, change.ShardId, change.ApplyAt)
+	return nil
+}
+
+// Advance applies the pending change once the main shard chain has committed
+// its ApplyAt block, returning the DApp migrations the change started along
+// with the ones that timed out at blockIndex and were aborted.
+func (sm *ShardManager) Advance(blockIndex int) (map[string]Migration, map[string]Migration) {
+	sm.mu.Lock()
+	aborted := sm.abortMigrations(blockIndex)
+	change := sm.pending
+	if change == nil || blockIndex < change.ApplyAt {
+		sm.mu.Unlock()
+		return nil, aborted
+	}
+	started := map[string]Migration{}
+	sm.pending = nil
+	var created *Shard
+	switch change.Op {
+	case "split":
+		created = sm.applySplit(*change, started)
+	case "merge":
+		sm.applyMerge(*change, started)
+	case "addNode":
+		sm.addNode(change.NodeId)
+	}
+	sm.Version++
+	m := sm.shardMap()
+	sm.mu.Unlock()
+
+	fmt.Printf("Applied %s at block %d, shard map version %d (%s)\n", change.Op, blockIndex, m.Version, m.Hash)
+	if created != nil {
+		sm.createChainCb(created.ID, slices.Clone(created.nodeIDs))
+	}
+	return started, aborted
+}
 
-		if totalLoad > sm.MaxShardLoad && len(sm.Shards) < sm.MaxNodes {
-			sm.SplitShard(id)
-		} else if totalLoad < sm.MinShardLoad && len(sm.Shards) > sm.MinNodes {
-			sm.MergeShard(id)
+// abortMigrations drops the migrations that did not complete within
+// shardMigrationTimeout blocks, leaving their DApps on the source shard. A
+// merged shard that keeps DApps this way goes back on the ring once none of
+// its DApps is moving out anymore.
+func (sm *ShardManager) abortMigrations(blockIndex int) map[string]Migration {
+	aborted := map[string]Migration{}
+	for dappID, m := range sm.migrations {
+		if blockIndex >= m.StartedAt+shardMigrationTimeout() {
+			aborted[dappID] = m
+			delete(sm.migrations, dappID)
 		}
 	}
+	if len(aborted) == 0 {
+		return aborted
+	}
+	for _, m := range aborted {
+		if !sm.draining[m.From] {
+			continue
+		}
+		moving := false
+		for _, other := range sm.migrations {
+			if other.From == m.From {
+				moving = true
+				break
+			}
+		}
+		if !moving {
+			delete(sm.draining, m.From)
+			sm.Hasher.AddShard(m.From)
+			fmt.Printf("Merge of shard %s aborted\n", m.From)
+		}
+	}
+	sm.Version++
+	sm.endorsements = make(map[string][]string)
+	fmt.Printf("Aborted %d dapp migrations at block %d, shard map version %d\n", len(aborted), blockIndex, sm.Version)
+	return aborted
+}
+
+// ShardNodes returns the nodes maintaining a shard.
+func (sm *ShardManager) ShardNodes(id string) []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	if shard, ok := sm.Shards[id]; ok {
+		return slices.Clone(shard.nodeIDs)
+	}
+	return nil
+}
+
+// Migrating tells whether a DApp is on its way to another shard.
+func (sm *ShardManager) Migrating(dappID string) (Migration, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	m, ok := sm.migrations[dappID]
+	return m, ok
+}
+
+// CompleteMigration switches a DApp over to its target shard once the target
+// confirmed the import on the main shard chain. A merged shard is dropped
+// when its last DApp has moved out.
+func (sm *ShardManager) CompleteMigration(dappID string, to string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	m, ok := sm.migrations[dappID]
+	if !ok {
+		return fmt.Errorf("dapp %s is not migrating", dappID)
+	}
+	if m.To != to {
+		return fmt.Errorf("dapp %s is migrating to %s, not %s", dappID, m.To, to)
+	}
+	source, ok := sm.Shards[m.From]
+	if !ok {
+		return fmt.Errorf("source shard %s not found", m.From)
+	}
+	target, ok := sm.Shards[m.To]
+	if !ok {
+		return fmt.Errorf("target shard %s not found", m.To)
+	}
+	if dapp, ok := source.GetDApp(dappID); ok {
+		target.AddDApp(dapp)
+		source.RemoveDApp(dappID)
+	}
+	delete(sm.migrations, dappID)
+	if sm.draining[m.From] && len(source.DappsDump()) == 0 {
+		delete(sm.Shards, m.From)
+		delete(sm.draining, m.From)
+		fmt.Printf("Shard %s drained and removed\n", m.From)
+	}
+	sm.Version++
+	sm.endorsements = make(map[string][]string)
+	fmt.Printf("DApp %s migrated from %s to %s, shard map version %d\n", dappID, m.From, m.To, sm.Version)
+	return nil
 }
 
 // AddShard adds a new logical shard to the network.
 func (sm *ShardManager) AddShard(id string) {
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	shard := sm.addShard(id, nil)
+	sm.mu.Unlock()
 
+	if shard != nil {
+		sm.createChainCb(id, slices.Clone(shard.nodeIDs))
+	}
+}
+
+func (sm *ShardManager) addShard(id string, nodeIDs []string) *Shard {
 	if _, exists := sm.Shards[id]; exists {
 		fmt.Printf("Shard %s already exists.\n", id)
-		return
+		return nil
 	}
 
-	var activeNodeIDs []string
-	for nid := range sm.Nodes {
-		activeNodeIDs = append(activeNodeIDs, nid)
+	if nodeIDs == nil {
+		for nid := range sm.Nodes {
+			nodeIDs = append(nodeIDs, nid)
+		}
+		sort.Strings(nodeIDs)
 	}
 
-	newShard := NewShard(id, activeNodeIDs)
+	newShard := NewShard(id, nodeIDs)
 	sm.Shards[id] = newShard
 	sm.Hasher.AddShard(id)
 	fmt.Printf("Added logical shard %s and assigned it to Nodes: %v\n", id, newShard.nodeIDs)
-
-	sm.createChainCb(id, newShard.nodeIDs)
+	return newShard
 }
 
-// MergeShard simulates a shard being merged into others.
-func (sm *ShardManager) MergeShard(id string) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	shardToMerge, exists := sm.Shards[id]
+// applyMerge takes a shard off the ring and starts migrating its DApps to the
+// shards the ring now maps them to. The shard is kept, draining, until they
+// have all moved.
+func (sm *ShardManager) applyMerge(change ShardChange, started map[string]Migration) {
+	shardToMerge, exists := sm.Shards[change.ShardId]
 	if !exists {
-		fmt.Printf("Shard %s not found.\n", id)
+		fmt.Printf("Shard %s not found.\n", change.ShardId)
 		return
 	}
 
-	fmt.Printf("\n--- Merging Shard %s (underutilized) ---\n", id)
+	fmt.Printf("\n--- Merging Shard %s (underutilized) ---\n", change.ShardId)
 
 	DappsToMigrate := shardToMerge.DappsDump()
-	sm.Hasher.RemoveShard(id)
-	delete(sm.Shards, id)
+	sm.Hasher.RemoveShard(change.ShardId)
+	if len(DappsToMigrate) == 0 {
+		delete(sm.Shards, change.ShardId)
+		return
+	}
+	sm.draining[change.ShardId] = true
 
 	for _, dapp := range DappsToMigrate {
 		newShardID := sm.Hasher.GetShard(dapp.ID)
 		fmt.Printf("Migrating DApp '%s' to new shard '%s'\n", dapp.ID, newShardID)
-		if newShard, ok := sm.Shards[newShardID]; ok {
-			newShard.AddDApp(dapp)
+		if _, ok := sm.Shards[newShardID]; ok {
+			m := Migration{From: change.ShardId, To: newShardID, StartedAt: change.ApplyAt}
+			sm.migrations[dapp.ID] = m
+			started[dapp.ID] = m
 		}
 	}
 }
 
-// SplitShard simulates an overloaded shard splitting its data.
-func (sm *ShardManager) SplitShard(id string) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	shardToSplit, exists := sm.Shards[id]
+// applySplit creates the new shard of a split, maintained by the nodes of the
+// split shard, and starts migrating the listed DApps to it.
+func (sm *ShardManager) applySplit(change ShardChange, started map[string]Migration) *Shard {
+	shardToSplit, exists := sm.Shards[change.ShardId]
 	if !exists {
-		fmt.Printf("Shard %s not found.\n", id)
-		return
+		fmt.Printf("Shard %s not found.\n", change.ShardId)
+		return nil
 	}
 
-	sm.ShardCounter++
-	newShardID := fmt.Sprintf("shard-%d", sm.ShardCounter)
+	fmt.Printf("\n--- Splitting Shard %s to create new shard %s ---\n", change.ShardId, change.NewShardId)
 
-	fmt.Printf("\n--- Splitting Shard %s to create new shard %s ---\n", id, newShardID)
-
-	sm.AddShard(newShardID)
-
-	DappsToMigrate := shardToSplit.DappsDump()
-
-	// Sort DApps by their load to ensure a more even split
-	sort.Slice(DappsToMigrate, func(i, j int) bool {
-		return DappsToMigrate[i].ProcessedTransactions > DappsToMigrate[j].ProcessedTransactions
-	})
-
-	halfLoad := 0
-	for _, dapp := range DappsToMigrate {
-		halfLoad += dapp.ProcessedTransactions
+	sm.ShardCounter++
+	newShard := sm.addShard(change.NewShardId, slices.Clone(shardToSplit.nodeIDs))
+	if newShard == nil {
+		return nil
+	}
+	for _, dappID := range change.Dapps {
+		if _, ok := shardToSplit.GetDApp(dappID); ok {
+			m := Migration{From: change.ShardId, To: change.NewShardId, StartedAt: change.ApplyAt}
+			sm.migrations[dappID] = m
+			started[dappID] = m
+		}
 	}
-	halfLoad /= 2
+	return newShard
+}
 
-	var migratedLoad int
-	for _, dapp := range DappsToMigrate {
-		if migratedLoad < halfLoad {
-			sm.mu.RLock()
-			newShard, ok := sm.Shards[newShardID]
-			sm.mu.RUnlock()
-			if ok {
-				newShard.AddDApp(dapp)
-				migratedLoad += dapp.ProcessedTransactions
-				shardToSplit.RemoveDApp(dapp.ID)
-			}
+// ShardOf returns the shard a DApp lives on. DApps that are not deployed yet
+// are routed by the hash ring.
+func (sm *ShardManager) ShardOf(dappID string) string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.shardOf(dappID)
+}
+
+func (sm *ShardManager) shardOf(dappID string) string {
+	for id, shard := range sm.Shards {
+		if _, ok := shard.GetDApp(dappID); ok {
+			return id
 		}
 	}
+	return sm.Hasher.GetShard(dappID)
 }
 
-// DeployDapp routes a new DApp to the correct shard and deploys it.
+// DeployDapp places a new DApp on the shard the hash ring maps it to.
 func (sm *ShardManager) DeployDapp(dappID string) {
 	sm.mu.Lock()
-	dapp := &DApp{ID: dappID}
-	sm.Dapps[dappID] = dapp
-	sm.mu.Unlock()
-
+	if _, exists := sm.Dapps[dappID]; exists {
+		sm.mu.Unlock()
+		return
+	}
 	shardID := sm.Hasher.GetShard(dappID)
-	sm.mu.RLock()
 	shard, ok := sm.Shards[shardID]
-	sm.mu.RUnlock()
-
 	if !ok {
-		fmt.Printf("Error: Shard %s not found for DApp %s. Re-routing...\n", shardID, dappID)
-		sm.AddShard(shardID)
-		sm.mu.RLock()
-		shard = sm.Shards[shardID]
-		sm.mu.RUnlock()
+		sm.mu.Unlock()
+		fmt.Printf("Error: Shard %s not found for DApp %s.\n", shardID, dappID)
+		return
 	}
-
-	nodeID := shard.nodeIDs[rand.Intn(len(shard.nodeIDs))]
-	fmt.Printf("Routing DApp '%s' to node %s on shard %s\n", dappID, nodeID, shard.ID)
+	dapp := &DApp{ID: dappID}
+	sm.Dapps[dappID] = dapp
 	shard.AddDApp(dapp)
+	sm.mu.Unlock()
+
+	fmt.Printf("Routing DApp '%s' to shard %s\n", dappID, shard.ID)
 	sm.manageShards()
 }
 
-// ProcessDAppTransaction simulates a transaction for a given DApp.
-func (sm *ShardManager) ProcessDAppTransaction(dappID string) {
+// ProcessDAppTransactionGroup records the transactions a block of a shard
+// chain committed for each of the given DApps, and moves the clock of the
+// shard to the timestamp of the block.
+func (sm *ShardManager) ProcessDAppTransactionGroup(shardID string, timestamp int64, dappIDs []string) {
 	sm.mu.RLock()
-	dapp, ok := sm.Dapps[dappID]
+	shard, ok := sm.Shards[shardID]
 	sm.mu.RUnlock()
-	if !ok {
-		fmt.Printf("Error: DApp %s not found.\n", dappID)
-		return
+	if ok {
+		shard.mu.Lock()
+		if timestamp > shard.clock {
+			shard.clock = timestamp
+		}
+		shard.mu.Unlock()
 	}
-	dapp.ProcessTransaction()
-	sm.manageShards()
-}
-
-// ProcessDAppTransactionGroup simulates a transaction for a given DApp.
-func (sm *ShardManager) ProcessDAppTransactionGroup(dappIDs []string) {
 	for _, dappID := range dappIDs {
 		sm.mu.RLock()
 		dapp, ok := sm.Dapps[dappID]
 		sm.mu.RUnlock()
 		if !ok {
 			fmt.Printf("Error: DApp %s not found.\n", dappID)
-			return
+			continue
 		}
-		dapp.ProcessTransaction()
+		dapp.ProcessTransaction(timestamp)
 	}
 	sm.manageShards()
 }
 
-// RemoveDapp API method to remove a DApp from the network.
-func (sm *ShardManager) RemoveDapp(dappID string) {
+// Loads exports the clock of a shard and the loads of its DApps.
+func (sm *ShardManager) Loads(shardID string) (int64, map[string]DAppLoad) {
 	sm.mu.RLock()
-	shardID := sm.Hasher.GetShard(dappID)
 	shard, ok := sm.Shards[shardID]
 	sm.mu.RUnlock()
+	if !ok {
+		return 0, nil
+	}
+	loads := map[string]DAppLoad{}
+	for _, dapp := range shard.DappsDump() {
+		dapp.mu.Lock()
+		loads[dapp.ID] = DAppLoad{Load: dapp.load, Updated: dapp.updated}
+		dapp.mu.Unlock()
+	}
+	return shard.Clock(), loads
+}
+
+// ImportLoads restores the clock of a shard and the loads of its DApps from the
+// committed state of the shard chain.
+func (sm *ShardManager) ImportLoads(shardID string, clock int64, loads map[string]DAppLoad) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	shard, ok := sm.Shards[shardID]
+	if !ok {
+		return
+	}
+	shard.mu.Lock()
+	shard.clock = clock
+	shard.mu.Unlock()
+	for dappID, l := range loads {
+		if dapp, ok := sm.Dapps[dappID]; ok {
+			dapp.mu.Lock()
+			dapp.load = l.Load
+			dapp.updated = l.Updated
+			dapp.mu.Unlock()
+		}
+	}
+}
 
+// RemoveDapp API method to remove a DApp from the network.
+func (sm *ShardManager) RemoveDapp(dappID string) {
+	sm.mu.Lock()
+	shardID := sm.shardOf(dappID)
+	shard, ok := sm.Shards[shardID]
 	if !ok {
+		sm.mu.Unlock()
 		fmt.Printf("Error: Shard %s not found for DApp %s. Cannot remove.\n", shardID, dappID)
 		return
 	}
 	shard.RemoveDApp(dappID)
-
-	sm.mu.Lock()
 	delete(sm.Dapps, dappID)
 	sm.mu.Unlock()
 	sm.manageShards()
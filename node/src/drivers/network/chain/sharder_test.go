@@ -0,0 +1,323 @@
+package chain
+
+import (
+	"kasper/src/shell/utils/crypto"
+	"math"
+	"slices"
+	"testing"
+)
+
+type testSharder struct {
+	*ShardManager
+	created  []string
+	proposed []ShardChange
+}
+
+func newTestSharder(self string, nodes []string, shards int64) *testSharder {
+	ts := &testSharder{}
+	ts.ShardManager = NewShardManager(self, nodes, shards, 2, 0, 4, 1, func(id string, _ []string) {
+		ts.created = append(ts.created, id)
+	}, func(change ShardChange) {
+		ts.proposed = append(ts.proposed, change)
+	})
+	return ts
+}
+
+var testNodes = []string{"n1", "n2", "n3", "n4"}
+
+// loadShard deploys d1 to d3 on the only shard and commits a block that makes
+// d1 carry most of its load, over MaxShardLoad.
+func loadShard(ts *testSharder) {
+	for _, id := range []string{"d1", "d2", "d3"} {
+		ts.DeployDapp(id)
+	}
+	ts.ProcessDAppTransactionGroup("shard-1", 100, []string{"d1", "d1", "d1", "d2"})
+}
+
+func TestShardProposesSplitOfHeaviestDapps(t *testing.T) {
+	ts := newTestSharder("n1", testNodes, 1)
+	loadShard(ts)
+	if len(ts.proposed) != 1 {
+		t.Fatalf("proposed %v, want a single split", ts.proposed)
+	}
+	change := ts.proposed[0]
+	if change.Op != "split" || change.ShardId != "shard-1" || change.NewShardId != "shard-2" || !slices.Equal(change.Dapps, []string{"d1"}) || change.Proposer != "n1" || change.BaseVersion != 0 {
+		t.Fatalf("proposed %+v", change)
+	}
+	// the same load measured again does not propose the change twice
+	ts.ProcessDAppTransactionGroup("shard-1", 100, nil)
+	if len(ts.proposed) != 1 {
+		t.Fatalf("change proposed again at the same version")
+	}
+}
+
+func TestShardChangeNeedsQuorum(t *testing.T) {
+	ts := newTestSharder("n1", testNodes, 1)
+	loadShard(ts)
+	change := ts.proposed[0]
+	for i, proposer := range []string{"n1", "n2", "n2", "n3"} {
+		change.Proposer = proposer
+		if err := ts.AcceptChange(change, 10); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		// 4 nodes need 4 - 3/3 = 3 distinct proposers
+		if accepted := ts.Map().Pending != nil; accepted != (i == 3) {
+			t.Fatalf("change accepted %v after %d proposals", accepted, i+1)
+		}
+	}
+	if ts.Map().Pending.ApplyAt != 10+shardChangeDelay() {
+		t.Fatalf("change applies at %d", ts.Map().Pending.ApplyAt)
+	}
+	if err := ts.AcceptChange(change, 11); err == nil {
+		t.Fatalf("a second change was accepted while one is pending")
+	}
+}
+
+func TestShardChangeRejected(t *testing.T) {
+	ts := newTestSharder("n1", testNodes, 1)
+	loadShard(ts)
+	valid := ts.proposed[0]
+	cases := map[string]func(c *ShardChange){
+		"old base version":   func(c *ShardChange) { c.BaseVersion = 1 },
+		"unknown proposer":   func(c *ShardChange) { c.Proposer = "x" },
+		"unknown shard":      func(c *ShardChange) { c.ShardId = "shard-9" },
+		"unexpected shard":   func(c *ShardChange) { c.NewShardId = "shard-5" },
+		"every dapp moved":   func(c *ShardChange) { c.Dapps = []string{"d1", "d2", "d3"} },
+		"no dapp moved":      func(c *ShardChange) { c.Dapps = nil },
+		"dapp of no shard":   func(c *ShardChange) { c.Dapps = []string{"d9"} },
+		"unknown change":     func(c *ShardChange) { c.Op = "drop" },
+		"merge of last one":  func(c *ShardChange) { c.Op = "merge" },
+		"node already known": func(c *ShardChange) { c.Op, c.NodeId = "addNode", "n2" },
+	}
+	for name, mutate := range cases {
+		change := valid
+		change.Dapps = slices.Clone(valid.Dapps)
+		mutate(&change)
+		if err := ts.AcceptChange(change, 10); err == nil {
+			t.Fatalf("%s: change accepted", name)
+		}
+	}
+	if len(ts.Map().Endorsements) != 0 {
+		t.Fatalf("rejected changes were endorsed: %v", ts.Map().Endorsements)
+	}
+}
+
+func acceptAll(t *testing.T, sm *ShardManager, change ShardChange, blockIndex int) {
+	for _, proposer := range sm.ShardNodes(change.ShardId) {
+		change.Proposer = proposer
+		if err := sm.AcceptChange(change, blockIndex); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if sm.Map().Pending != nil {
+			return
+		}
+	}
+}
+
+func TestShardSplitMigratesAtApplyBlock(t *testing.T) {
+	ts := newTestSharder("n1", testNodes, 1)
+	loadShard(ts)
+	acceptAll(t, ts.ShardManager, ts.proposed[0], 10)
+	applyAt := 10 + shardChangeDelay()
+
+	if started, _ := ts.Advance(applyAt - 1); len(started) != 0 {
+		t.Fatalf("change applied before its block")
+	}
+	started, aborted := ts.Advance(applyAt)
+	want := Migration{From: "shard-1", To: "shard-2", StartedAt: applyAt}
+	if len(aborted) != 0 || len(started) != 1 || started["d1"] != want {
+		t.Fatalf("started %v, aborted %v", started, aborted)
+	}
+	if !slices.Equal(ts.created, []string{"shard-1", "shard-2"}) {
+		t.Fatalf("created chains %v", ts.created)
+	}
+	if !slices.Equal(ts.ShardNodes("shard-2"), testNodes) {
+		t.Fatalf("new shard maintained by %v", ts.ShardNodes("shard-2"))
+	}
+	// the dapp stays on its source shard until the target confirms the import
+	if ts.ShardOf("d1") != "shard-1" {
+		t.Fatalf("d1 routed to %s while migrating", ts.ShardOf("d1"))
+	}
+	if err := ts.CompleteMigration("d1", "shard-1"); err == nil {
+		t.Fatalf("migration completed to the wrong shard")
+	}
+	if err := ts.CompleteMigration("d1", "shard-2"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ts.ShardOf("d1") != "shard-2" {
+		t.Fatalf("d1 routed to %s after the migration", ts.ShardOf("d1"))
+	}
+	if m := ts.Map(); m.Version != 2 || m.Dapps["d1"] != "shard-2" || len(m.Migrations) != 0 {
+		t.Fatalf("map after the migration %+v", m)
+	}
+}
+
+func TestShardMigrationTimesOut(t *testing.T) {
+	ts := newTestSharder("n1", testNodes, 1)
+	loadShard(ts)
+	acceptAll(t, ts.ShardManager, ts.proposed[0], 10)
+	applyAt := 10 + shardChangeDelay()
+	ts.Advance(applyAt)
+
+	if _, aborted := ts.Advance(applyAt + shardMigrationTimeout() - 1); len(aborted) != 0 {
+		t.Fatalf("migration aborted early")
+	}
+	_, aborted := ts.Advance(applyAt + shardMigrationTimeout())
+	if len(aborted) != 1 || aborted["d1"].To != "shard-2" {
+		t.Fatalf("aborted %v", aborted)
+	}
+	if _, ok := ts.Migrating("d1"); ok || ts.ShardOf("d1") != "shard-1" {
+		t.Fatalf("aborted dapp did not stay on its source shard")
+	}
+	if err := ts.CompleteMigration("d1", "shard-2"); err == nil {
+		t.Fatalf("aborted migration completed")
+	}
+}
+
+func TestShardMergeDrainsShard(t *testing.T) {
+	ts := newTestSharder("n1", testNodes, 2)
+	for _, id := range []string{"d1", "d2", "d3", "d4"} {
+		ts.DeployDapp(id)
+	}
+	m := ts.Map()
+	moving := []string{}
+	for dapp, shard := range m.Dapps {
+		if shard == "shard-2" {
+			moving = append(moving, dapp)
+		}
+	}
+	acceptAll(t, ts.ShardManager, ShardChange{Op: "merge", ShardId: "shard-2"}, 5)
+	started, _ := ts.Advance(5 + shardChangeDelay())
+	if len(started) != len(moving) {
+		t.Fatalf("started %v, want migrations of %v", started, moving)
+	}
+	if !slices.Equal(ts.Map().Draining, []string{"shard-2"}) || ts.Hasher.GetShard("any") != "shard-1" {
+		t.Fatalf("merged shard still takes new dapps")
+	}
+	for _, dapp := range moving {
+		if err := ts.CompleteMigration(dapp, "shard-1"); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if m := ts.Map(); len(m.Shards) != 1 || len(m.Draining) != 0 {
+		t.Fatalf("drained shard kept: %+v", m)
+	}
+}
+
+func TestShardMapIsSameOnEveryNode(t *testing.T) {
+	a := newTestSharder("n1", testNodes, 1)
+	b := newTestSharder("n3", testNodes, 1)
+	loadShard(a)
+	loadShard(b)
+	for _, ts := range []*testSharder{a, b} {
+		acceptAll(t, ts.ShardManager, a.proposed[0], 10)
+		ts.Advance(10 + shardChangeDelay())
+	}
+	if a.Map().Hash != b.Map().Hash {
+		t.Fatalf("maps diverged")
+	}
+}
+
+func TestShardImportMap(t *testing.T) {
+	src := newTestSharder("n1", testNodes, 1)
+	loadShard(src)
+	acceptAll(t, src.ShardManager, src.proposed[0], 10)
+	src.Advance(10 + shardChangeDelay())
+	m := src.Map()
+
+	dst := newTestSharder("n2", testNodes, 1)
+	if err := dst.ImportMap(m); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if dst.Map().Hash != m.Hash {
+		t.Fatalf("imported map differs")
+	}
+	if mig, ok := dst.Migrating("d1"); !ok || mig.To != "shard-2" {
+		t.Fatalf("migration lost on import")
+	}
+
+	tampered := src.Map()
+	tampered.Dapps["d1"] = "shard-2"
+	if err := dst.ImportMap(tampered); err == nil {
+		t.Fatalf("map not matching its hash imported")
+	}
+	older := newTestSharder("n1", testNodes, 1).Map()
+	if err := dst.ImportMap(older); err == nil {
+		t.Fatalf("older map imported")
+	}
+}
+
+func TestShardLoadsDecayByBlockTime(t *testing.T) {
+	d := &DApp{ID: "d1"}
+	d.ProcessTransaction(1000)
+	d.ProcessTransaction(1000)
+	halfLife := int64(shardLoadHalfLife().Seconds())
+	if d.Load(1000) != 2 || math.Abs(d.Load(1000+halfLife)-1) > 1e-9 {
+		t.Fatalf("loads %v and %v", d.Load(1000), d.Load(1000+halfLife))
+	}
+
+	src := newTestSharder("n1", testNodes, 1)
+	loadShard(src)
+	clock, loads := src.Loads("shard-1")
+	dst := newTestSharder("n2", testNodes, 1)
+	for _, id := range []string{"d1", "d2", "d3"} {
+		dst.DeployDapp(id)
+	}
+	dst.ImportLoads("shard-1", clock, loads)
+	if dstClock, dstLoads := dst.Loads("shard-1"); dstClock != clock || dstLoads["d1"] != loads["d1"] {
+		t.Fatalf("imported loads %v at %d, want %v at %d", dstLoads, dstClock, loads, clock)
+	}
+}
+
+func TestChangeQuorum(t *testing.T) {
+	for nodes, want := range map[int]int{0: 1, 1: 1, 2: 2, 3: 3, 4: 3, 7: 5, 10: 7} {
+		if got := changeQuorum(nodes); got != want {
+			t.Fatalf("quorum of %d nodes is %d, want %d", nodes, got, want)
+		}
+	}
+}
+
+func TestVerifyChange(t *testing.T) {
+	privKey, pubKey := crypto.SecureKeyPairs("")
+	change := ShardChange{Op: "merge", ShardId: "shard-2", Proposer: "n1", BaseVersion: 3}
+	signature, err := crypto.Sign(privKey, []byte(change.key()))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	change.Signature = signature
+	if err := verifyChange(string(pubKey), change); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	replayed := change
+	replayed.BaseVersion = 4
+	if err := verifyChange(string(pubKey), replayed); err == nil {
+		t.Fatalf("change verified at another map version")
+	}
+	_, otherPubKey := crypto.SecureKeyPairs("")
+	if err := verifyChange(string(otherPubKey), change); err == nil {
+		t.Fatalf("change verified with a key its proposer did not register")
+	}
+	change.Signature = ""
+	if err := verifyChange(string(pubKey), change); err == nil {
+		t.Fatalf("unsigned change verified")
+	}
+}
+
+func TestGenesisMapIsSameOnEveryNode(t *testing.T) {
+	root := newTestSharder("n1", []string{"n1"}, 1)
+	other := newTestSharder("n2", []string{"n1"}, 1)
+	if root.Map().Hash != other.Map().Hash {
+		t.Fatalf("genesis maps differ")
+	}
+	change := ShardChange{Op: "addNode", NodeId: "n2", Proposer: "n1"}
+	for _, ts := range []*testSharder{root, other} {
+		if err := ts.AcceptChange(change, 5); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ts.Advance(5 + shardChangeDelay())
+		ts.DeployDapp("d1")
+	}
+	if root.Map().Hash != other.Map().Hash || root.Map().Version != 1 {
+		t.Fatalf("maps diverged once a node joined: %+v %+v", root.Map(), other.Map())
+	}
+}
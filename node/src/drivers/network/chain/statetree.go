@@ -0,0 +1,433 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kasper/src/abstract/models/update"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	stateBucketCount = 256
+	// StateSnapshotRetention is the number of past blocks for which a snapshot
+	// can still be exported.
+	StateSnapshotRetention = 1024
+)
+
+// StateEntry is a single key/value pair of the replicated application state.
+type StateEntry struct {
+	Key string `json:"key"`
+	Val []byte `json:"val"`
+}
+
+// StateSnapshot is the serialized application state of a shard chain at a
+// given block index. It is what babble ships to nodes joining with fast-sync.
+type StateSnapshot struct {
+	BlockIndex int          `json:"blockIndex"`
+	Root       []byte       `json:"root"`
+	Entries    []StateEntry `json:"entries"`
+}
+
+type stateJournalEntry struct {
+	Key     string `json:"key"`
+	Existed bool   `json:"existed"`
+	Val     []byte `json:"val"`
+}
+
+// StateTree maintains a deterministic root hash over the badger entries that
+// were committed through a shard chain. Keys are spread over 256 buckets by the
+// first byte of their sha256; a bucket hashes its leaves in key order and the
+// root is a binary merkle tree over the bucket hashes, so committing a block
+// only re-hashes the buckets it touched.
+//
+// The tree keeps its own copy of every committed value so that a snapshot
+// always matches the root it claims, and an undo journal per block so that a
+// snapshot can be exported at any of the last StateSnapshotRetention blocks.
+type StateTree struct {
+	db      *badger.DB
+	prefix  string
+	mu      sync.Mutex
+	buckets [stateBucketCount][]byte
+	head    int
+	loaded  bool
+}
+
+// NewStateTree creates a state tree stored under its own namespace in db.
+func NewStateTree(db *badger.DB, workChainId string, shardChainId string) *StateTree {
+	return &StateTree{
+		db:     db,
+		prefix: "statetree::" + workChainId + "::" + shardChainId + "::",
+		head:   -1,
+	}
+}
+
+func (st *StateTree) leafPrefix(bucket byte) string {
+	return st.prefix + "leaf::" + hex.EncodeToString([]byte{bucket}) + "::"
+}
+
+func (st *StateTree) bucketKey(bucket byte) []byte {
+	return []byte(st.prefix + "bucket::" + hex.EncodeToString([]byte{bucket}))
+}
+
+func (st *StateTree) rootKey(blockIndex int) []byte {
+	return []byte(fmt.Sprintf("%sroot::%020d", st.prefix, blockIndex))
+}
+
+func (st *StateTree) journalKey(blockIndex int) []byte {
+	return []byte(fmt.Sprintf("%sjournal::%020d", st.prefix, blockIndex))
+}
+
+func (st *StateTree) headKey() []byte {
+	return []byte(st.prefix + "head")
+}
+
+func stateBucketOf(key string) byte {
+	h := sha256.Sum256([]byte(key))
+	return h[0]
+}
+
+func stateLeafHash(key string, val []byte) []byte {
+	h := sha256.New()
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, uint32(len(key)))
+	h.Write(l)
+	h.Write([]byte(key))
+	h.Write(val)
+	return h.Sum(nil)
+}
+
+func stateRootOf(buckets [stateBucketCount][]byte) []byte {
+	level := make([][]byte, stateBucketCount)
+	for i, b := range buckets {
+		if len(b) == 0 {
+			level[i] = make([]byte, sha256.Size)
+		} else {
+			level[i] = b
+		}
+	}
+	for len(level) > 1 {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			h := sha256.New()
+			h.Write(level[2*i])
+			h.Write(level[2*i+1])
+			next[i] = h.Sum(nil)
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// stateRootOfEntries computes the root of a full set of entries from scratch.
+func stateRootOfEntries(entries []StateEntry) []byte {
+	sorted := make([]StateEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	hashers := [stateBucketCount][]byte{}
+	grouped := map[byte][][]byte{}
+	for _, e := range sorted {
+		b := stateBucketOf(e.Key)
+		grouped[b] = append(grouped[b], stateLeafHash(e.Key, e.Val))
+	}
+	for b, leaves := range grouped {
+		h := sha256.New()
+		for _, l := range leaves {
+			h.Write(l)
+		}
+		hashers[b] = h.Sum(nil)
+	}
+	return stateRootOf(hashers)
+}
+
+func (st *StateTree) load() {
+	if st.loaded {
+		return
+	}
+	st.db.View(func(txn *badger.Txn) error {
+		for i := 0; i < stateBucketCount; i++ {
+			if item, err := txn.Get(st.bucketKey(byte(i))); err == nil {
+				st.buckets[i], _ = item.ValueCopy(nil)
+			}
+		}
+		if item, err := txn.Get(st.headKey()); err == nil {
+			b, _ := item.ValueCopy(nil)
+			st.head = int(int64(binary.BigEndian.Uint64(b)))
+		}
+		return nil
+	})
+	st.loaded = true
+}
+
+func (st *StateTree) hashBucket(txn *badger.Txn, bucket byte) []byte {
+	prefix := []byte(st.leafPrefix(bucket))
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	h := sha256.New()
+	empty := true
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		it.Item().Value(func(val []byte) error {
+			h.Write(val[:sha256.Size])
+			return nil
+		})
+		empty = false
+	}
+	if empty {
+		return nil
+	}
+	return h.Sum(nil)
+}
+
+// Root returns the current state root.
+func (st *StateTree) Root() []byte {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.load()
+	return stateRootOf(st.buckets)
+}
+
+// Commit folds the updates that reached consensus in a block into the tree and
+// returns the resulting state root.
+func (st *StateTree) Commit(blockIndex int, updates []update.Update) ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.load()
+	dirty := map[byte]bool{}
+	buckets := st.buckets
+	var root []byte
+	err := st.db.Update(func(txn *badger.Txn) error {
+		journal := []stateJournalEntry{}
+		seen := map[string]bool{}
+		for _, u := range updates {
+			if u.Key == "" || (u.Typ != "put" && u.Typ != "del") {
+				continue
+			}
+			bucket := stateBucketOf(u.Key)
+			leafKey := []byte(st.leafPrefix(bucket) + u.Key)
+			if !seen[u.Key] {
+				seen[u.Key] = true
+				entry := stateJournalEntry{Key: u.Key}
+				if item, err := txn.Get(leafKey); err == nil {
+					leaf, _ := item.ValueCopy(nil)
+					entry.Existed = true
+					entry.Val = leaf[sha256.Size:]
+				}
+				journal = append(journal, entry)
+			}
+			if u.Typ == "put" {
+				if err := txn.Set(leafKey, append(stateLeafHash(u.Key, u.Val), u.Val...)); err != nil {
+					return err
+				}
+			} else if err := txn.Delete(leafKey); err != nil {
+				return err
+			}
+			dirty[bucket] = true
+		}
+		for bucket := range dirty {
+			buckets[bucket] = st.hashBucket(txn, bucket)
+			if buckets[bucket] == nil {
+				if err := txn.Delete(st.bucketKey(bucket)); err != nil {
+					return err
+				}
+			} else if err := txn.Set(st.bucketKey(bucket), buckets[bucket]); err != nil {
+				return err
+			}
+		}
+		root = stateRootOf(buckets)
+		if len(journal) > 0 {
+			b, err := json.Marshal(journal)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(st.journalKey(blockIndex), b); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set(st.rootKey(blockIndex), root); err != nil {
+			return err
+		}
+		head := make([]byte, 8)
+		binary.BigEndian.PutUint64(head, uint64(blockIndex))
+		if err := txn.Set(st.headKey(), head); err != nil {
+			return err
+		}
+		if expired := blockIndex - StateSnapshotRetention; expired >= 0 {
+			txn.Delete(st.journalKey(expired))
+			txn.Delete(st.rootKey(expired))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	st.buckets = buckets
+	st.head = blockIndex
+	return root, nil
+}
+
+// Snapshot exports the committed state as it was right after blockIndex.
+func (st *StateTree) Snapshot(blockIndex int) ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.load()
+	if blockIndex > st.head {
+		return nil, fmt.Errorf("snapshot %d not found, state head is %d", blockIndex, st.head)
+	}
+	if st.head-blockIndex >= StateSnapshotRetention {
+		return nil, fmt.Errorf("snapshot %d is no longer retained", blockIndex)
+	}
+	state := map[string][]byte{}
+	var root []byte
+	err := st.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(st.prefix + "leaf::")
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := string(it.Item().Key()[len(prefix)+len("00::"):])
+			leaf, _ := it.Item().ValueCopy(nil)
+			state[key] = leaf[sha256.Size:]
+		}
+		it.Close()
+		for i := st.head; i > blockIndex; i-- {
+			item, err := txn.Get(st.journalKey(i))
+			if err != nil {
+				continue
+			}
+			b, _ := item.ValueCopy(nil)
+			journal := []stateJournalEntry{}
+			if err := json.Unmarshal(b, &journal); err != nil {
+				return err
+			}
+			for _, entry := range journal {
+				if entry.Existed {
+					state[entry.Key] = entry.Val
+				} else {
+					delete(state, entry.Key)
+				}
+			}
+		}
+		item, err := txn.Get(st.rootKey(blockIndex))
+		if err != nil {
+			return fmt.Errorf("state root of block %d not found", blockIndex)
+		}
+		root, _ = item.ValueCopy(nil)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	snapshot := StateSnapshot{BlockIndex: blockIndex, Root: root, Entries: make([]StateEntry, 0, len(state))}
+	for k, v := range state {
+		snapshot.Entries = append(snapshot.Entries, StateEntry{Key: k, Val: v})
+	}
+	sort.Slice(snapshot.Entries, func(i, j int) bool { return snapshot.Entries[i].Key < snapshot.Entries[j].Key })
+	if !bytes.Equal(stateRootOfEntries(snapshot.Entries), root) {
+		return nil, fmt.Errorf("state of block %d does not match its root", blockIndex)
+	}
+	return json.Marshal(snapshot)
+}
+
+// Restore replaces the committed state with the content of a snapshot, writing
+// every entry back into badger, and returns the restored root.
+func (st *StateTree) Restore(data []byte) ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	snapshot := StateSnapshot{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	sort.Slice(snapshot.Entries, func(i, j int) bool { return snapshot.Entries[i].Key < snapshot.Entries[j].Key })
+	for i := 1; i < len(snapshot.Entries); i++ {
+		if snapshot.Entries[i].Key == snapshot.Entries[i-1].Key {
+			return nil, fmt.Errorf("snapshot holds key %s twice", snapshot.Entries[i].Key)
+		}
+	}
+	root := stateRootOfEntries(snapshot.Entries)
+	if !bytes.Equal(root, snapshot.Root) {
+		return nil, errors.New("snapshot content does not match its state root")
+	}
+
+	stale := [][]byte{}
+	err := st.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(st.prefix)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		leafPrefix := []byte(st.prefix + "leaf::")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			stale = append(stale, key)
+			if bytes.HasPrefix(key, leafPrefix) {
+				stale = append(stale, key[len(leafPrefix)+len("00::"):])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wb := st.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range stale {
+		if err := wb.Delete(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return nil, err
+	}
+
+	wb = st.db.NewWriteBatch()
+	defer wb.Cancel()
+	buckets := [stateBucketCount][]byte{}
+	grouped := map[byte][][]byte{}
+	for _, e := range snapshot.Entries {
+		bucket := stateBucketOf(e.Key)
+		leafHash := stateLeafHash(e.Key, e.Val)
+		grouped[bucket] = append(grouped[bucket], leafHash)
+		if err := wb.Set([]byte(e.Key), e.Val); err != nil {
+			return nil, err
+		}
+		if err := wb.Set([]byte(st.leafPrefix(bucket)+e.Key), append(leafHash, e.Val...)); err != nil {
+			return nil, err
+		}
+	}
+	for bucket, leaves := range grouped {
+		h := sha256.New()
+		for _, l := range leaves {
+			h.Write(l)
+		}
+		buckets[bucket] = h.Sum(nil)
+		if err := wb.Set(st.bucketKey(bucket), buckets[bucket]); err != nil {
+			return nil, err
+		}
+	}
+	if err := wb.Set(st.rootKey(snapshot.BlockIndex), root); err != nil {
+		return nil, err
+	}
+	head := make([]byte, 8)
+	binary.BigEndian.PutUint64(head, uint64(snapshot.BlockIndex))
+	if err := wb.Set(st.headKey(), head); err != nil {
+		return nil, err
+	}
+	if err := wb.Flush(); err != nil {
+		return nil, err
+	}
+	st.buckets = buckets
+	st.head = snapshot.BlockIndex
+	st.loaded = true
+	return root, nil
+}
@@ -0,0 +1,212 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kasper/src/abstract/models/update"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func openTestDb(t *testing.T) *badger.DB {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func put(key string, val string) update.Update {
+	return update.Update{Typ: "put", Key: key, Val: []byte(val)}
+}
+
+func del(key string) update.Update {
+	return update.Update{Typ: "del", Key: key}
+}
+
+func TestStateTreeRootIsDeterministic(t *testing.T) {
+	a := NewStateTree(openTestDb(t), "main", "shard-1")
+	b := NewStateTree(openTestDb(t), "main", "shard-1")
+	empty := a.Root()
+
+	updates := []update.Update{}
+	for i := 0; i < 50; i++ {
+		updates = append(updates, put(fmt.Sprintf("obj::%d", i), fmt.Sprintf("val%d", i)))
+	}
+	rootA, err := a.Commit(0, updates)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// the same entries committed in another order over several blocks
+	for i := 49; i >= 0; i -= 10 {
+		reversed := []update.Update{}
+		for j := i; j > i-10; j-- {
+			reversed = append(reversed, updates[j])
+		}
+		if _, err := b.Commit((49-i)/10, reversed); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if !bytes.Equal(rootA, b.Root()) {
+		t.Fatalf("roots of the same state differ")
+	}
+	if bytes.Equal(rootA, empty) {
+		t.Fatalf("root did not change")
+	}
+	entries := []StateEntry{}
+	for _, u := range updates {
+		entries = append(entries, StateEntry{Key: u.Key, Val: u.Val})
+	}
+	if !bytes.Equal(rootA, stateRootOfEntries(entries)) {
+		t.Fatalf("incremental root differs from the root computed from scratch")
+	}
+}
+
+func TestStateTreeRootCoversValuesAndDeletes(t *testing.T) {
+	st := NewStateTree(openTestDb(t), "main", "shard-1")
+	empty := st.Root()
+	first, _ := st.Commit(0, []update.Update{put("a", "1"), put("b", "2")})
+	changed, _ := st.Commit(1, []update.Update{put("a", "3")})
+	if bytes.Equal(first, changed) {
+		t.Fatalf("changing a value kept the root")
+	}
+	restored, _ := st.Commit(2, []update.Update{put("a", "1")})
+	if !bytes.Equal(first, restored) {
+		t.Fatalf("putting the value back did not restore the root")
+	}
+	cleared, _ := st.Commit(3, []update.Update{del("a"), del("b")})
+	if !bytes.Equal(empty, cleared) {
+		t.Fatalf("deleting every key did not give the empty root")
+	}
+	// updates without a key or of another type are not state
+	same, _ := st.Commit(4, []update.Update{{Typ: "put"}, {Typ: "other", Key: "c"}})
+	if !bytes.Equal(empty, same) {
+		t.Fatalf("ignored updates changed the root")
+	}
+}
+
+func TestStateTreeReloadsFromDb(t *testing.T) {
+	db := openTestDb(t)
+	root, _ := NewStateTree(db, "main", "shard-1").Commit(0, []update.Update{put("a", "1")})
+	if !bytes.Equal(root, NewStateTree(db, "main", "shard-1").Root()) {
+		t.Fatalf("reopened tree lost its root")
+	}
+	if bytes.Equal(root, NewStateTree(db, "main", "shard-2").Root()) {
+		t.Fatalf("trees of different shards share state")
+	}
+}
+
+func TestStateTreeSnapshotAtPastBlock(t *testing.T) {
+	st := NewStateTree(openTestDb(t), "main", "shard-1")
+	root0, _ := st.Commit(0, []update.Update{put("a", "1"), put("b", "2")})
+	st.Commit(1, []update.Update{put("a", "3"), del("b"), put("c", "4")})
+	st.Commit(2, []update.Update{del("c")})
+
+	data, err := st.Snapshot(0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	snapshot := StateSnapshot{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := []StateEntry{{Key: "a", Val: []byte("1")}, {Key: "b", Val: []byte("2")}}
+	if snapshot.BlockIndex != 0 || !bytes.Equal(snapshot.Root, root0) || len(snapshot.Entries) != len(want) {
+		t.Fatalf("snapshot %+v", snapshot)
+	}
+	for i, e := range want {
+		if snapshot.Entries[i].Key != e.Key || !bytes.Equal(snapshot.Entries[i].Val, e.Val) {
+			t.Fatalf("entry %d is %+v, want %+v", i, snapshot.Entries[i], e)
+		}
+	}
+	if _, err := st.Snapshot(3); err == nil {
+		t.Fatalf("snapshot past the head was exported")
+	}
+}
+
+func TestStateTreeRestore(t *testing.T) {
+	src := NewStateTree(openTestDb(t), "main", "shard-1")
+	src.Commit(0, []update.Update{put("a", "1")})
+	root, _ := src.Commit(1, []update.Update{put("b", "2")})
+	data, err := src.Snapshot(1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	db := openTestDb(t)
+	dst := NewStateTree(db, "main", "shard-1")
+	dst.Commit(0, []update.Update{put("stale", "x")})
+	db.Update(func(txn *badger.Txn) error { return txn.Set([]byte("stale"), []byte("x")) })
+	restored, err := dst.Restore(data)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(restored, root) || !bytes.Equal(dst.Root(), root) {
+		t.Fatalf("restored root differs from the snapshot root")
+	}
+	db.View(func(txn *badger.Txn) error {
+		if item, err := txn.Get([]byte("b")); err != nil {
+			t.Fatalf("restored entry missing: %v", err)
+		} else if val, _ := item.ValueCopy(nil); string(val) != "2" {
+			t.Fatalf("restored entry is %q", val)
+		}
+		if _, err := txn.Get([]byte("stale")); err != badger.ErrKeyNotFound {
+			t.Fatalf("entry missing from the snapshot was kept")
+		}
+		return nil
+	})
+
+	// the restored tree keeps committing from the snapshot block
+	next, _ := dst.Commit(2, []update.Update{put("c", "3")})
+	want, _ := src.Commit(2, []update.Update{put("c", "3")})
+	if !bytes.Equal(next, want) {
+		t.Fatalf("restored tree diverged")
+	}
+}
+
+func TestStateTreeRestoreRejectsTamperedSnapshot(t *testing.T) {
+	st := NewStateTree(openTestDb(t), "main", "shard-1")
+	st.Commit(0, []update.Update{put("a", "1")})
+	data, _ := st.Snapshot(0)
+	snapshot := StateSnapshot{}
+	json.Unmarshal(data, &snapshot)
+	snapshot.Entries[0].Val = []byte("2")
+	tampered, _ := json.Marshal(snapshot)
+	if _, err := NewStateTree(openTestDb(t), "main", "shard-1").Restore(tampered); err == nil {
+		t.Fatalf("tampered snapshot was restored")
+	}
+}
+
+func TestStateTreeRestoreIgnoresEntryOrder(t *testing.T) {
+	src := NewStateTree(openTestDb(t), "main", "shard-1")
+	updates := []update.Update{}
+	for i := 0; i < 2*stateBucketCount; i++ {
+		updates = append(updates, put(fmt.Sprintf("k%d", i), "v"))
+	}
+	src.Commit(0, updates)
+	data, _ := src.Snapshot(0)
+	snapshot := StateSnapshot{}
+	json.Unmarshal(data, &snapshot)
+	for i, j := 0, len(snapshot.Entries)-1; i < j; i, j = i+1, j-1 {
+		snapshot.Entries[i], snapshot.Entries[j] = snapshot.Entries[j], snapshot.Entries[i]
+	}
+	reversed, _ := json.Marshal(snapshot)
+	dst := NewStateTree(openTestDb(t), "main", "shard-1")
+	if _, err := dst.Restore(reversed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	next, _ := dst.Commit(1, []update.Update{put("k0", "w")})
+	want, _ := src.Commit(1, []update.Update{put("k0", "w")})
+	if !bytes.Equal(next, want) {
+		t.Fatalf("tree restored from reordered entries diverged")
+	}
+
+	snapshot.Entries = append(snapshot.Entries, snapshot.Entries[0])
+	duplicated, _ := json.Marshal(snapshot)
+	if _, err := NewStateTree(openTestDb(t), "main", "shard-1").Restore(duplicated); err == nil {
+		t.Fatalf("snapshot with a duplicate key was restored")
+	}
+}
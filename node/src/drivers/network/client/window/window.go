@@ -0,0 +1,142 @@
+package window
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+)
+
+// Clients that send a hello packet before anything else switch the connection
+// to protocol version 2: up to Size frames may be in flight, every frame carries
+// a sequence number and an encoding byte, and the client acknowledges
+// cumulatively with the highest sequence it has received. Clients that never
+// say hello stay on the stop-and-wait framing of version 1.
+const (
+	HelloMarker = 0x02
+	AckMarker   = 0x03
+
+	EncodingRaw  = 0x00
+	EncodingGzip = 0x01
+
+	CompressThreshold = 1024
+)
+
+type Hello struct {
+	Version     int    `json:"version"`
+	Window      int    `json:"window"`
+	Compression string `json:"compression"`
+}
+
+type Window struct {
+	Size     int
+	Compress bool
+	baseSeq  uint64
+	sent     int
+}
+
+// Negotiate answers the hello of a client with the settings the server agrees
+// to, returning a nil window when the connection stays on version 1.
+func Negotiate(payload []byte) (Hello, *Window) {
+	hello := Hello{}
+	if err := json.Unmarshal(payload, &hello); err != nil || hello.Version < 2 {
+		return Hello{Version: 1}, nil
+	}
+	maxSize := 64
+	if v, err := strconv.Atoi(os.Getenv("CLIENT_MAX_WINDOW")); err == nil && v > 0 {
+		maxSize = v
+	}
+	size := hello.Window
+	if size <= 0 || size > maxSize {
+		size = maxSize
+	}
+	w := &Window{Size: size, Compress: hello.Compression == "gzip", baseSeq: 1}
+	return w.Settings(), w
+}
+
+// Settings describes the window the way it is announced to the client.
+func (w *Window) Settings() Hello {
+	hello := Hello{Version: 2, Window: w.Size}
+	if w.Compress {
+		hello.Compression = "gzip"
+	}
+	return hello
+}
+
+// HelloReply builds the response frame answering a hello, which is written
+// straight to the connection and is not acknowledged by the client.
+func HelloReply(hello Hello) []byte {
+	requestId := []byte("hello")
+	body, _ := json.Marshal(hello)
+	packet := make([]byte, 1+4+len(requestId)+4+len(body))
+	packet[0] = 0x02
+	binary.BigEndian.PutUint32(packet[1:5], uint32(len(requestId)))
+	copy(packet[5:5+len(requestId)], requestId)
+	binary.BigEndian.PutUint32(packet[5+len(requestId):9+len(requestId)], 0)
+	copy(packet[9+len(requestId):], body)
+	return packet
+}
+
+// ParseAck reads the sequence out of a cumulative ack packet.
+func ParseAck(packet []byte) (uint64, bool) {
+	if len(packet) != 9 || packet[0] != AckMarker {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(packet[1:]), true
+}
+
+// Pending returns the frames of the buffer that fit in the window and have not
+// been written yet, encoded and ready to go on the wire.
+func (w *Window) Pending(buffer [][]byte) [][]byte {
+	frames := [][]byte{}
+	for w.sent < len(buffer) && w.sent < w.Size {
+		frames = append(frames, w.encode(w.baseSeq+uint64(w.sent), buffer[w.sent]))
+		w.sent++
+	}
+	return frames
+}
+
+// Ack drops every frame up to and including seq from the buffer.
+func (w *Window) Ack(seq uint64, buffer [][]byte) [][]byte {
+	if seq < w.baseSeq {
+		return buffer
+	}
+	n := int(seq - w.baseSeq + 1)
+	if n > w.sent {
+		n = w.sent
+	}
+	w.baseSeq += uint64(n)
+	w.sent -= n
+	return buffer[n:]
+}
+
+// Rewind marks the last n frames returned by Pending as unsent after a failed
+// write, so the next push writes them again under the same sequence numbers.
+func (w *Window) Rewind(n int) {
+	if n > w.sent {
+		n = w.sent
+	}
+	w.sent -= n
+}
+
+func (w *Window) encode(seq uint64, frame []byte) []byte {
+	encoding := byte(EncodingRaw)
+	if w.Compress && len(frame) >= CompressThreshold {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		if _, err := zw.Write(frame); err == nil && zw.Close() == nil {
+			frame = b.Bytes()
+			encoding = EncodingGzip
+		} else {
+			log.Println("frame compression failed, sending raw")
+		}
+	}
+	packet := make([]byte, 9+len(frame))
+	binary.BigEndian.PutUint64(packet[0:8], seq)
+	packet[8] = encoding
+	copy(packet[9:], frame)
+	return packet
+}
@@ -8,6 +8,8 @@ import (
 	"kasper/src/abstract/adapters/signaler"
 	"kasper/src/abstract/models/core"
 	"kasper/src/abstract/models/trx"
+	"kasper/src/core/module/actor/model/secured"
+	"kasper/src/drivers/network/client/window"
 	"kasper/src/shell/utils/crypto"
 	"kasper/src/shell/utils/future"
 	"log"
@@ -24,6 +26,16 @@ import (
 	cmap "github.com/orcaman/concurrent-map/v2"
 )
 
+type authOptions struct {
+	ResumeFrom *uint64 `json:"resumeFrom"`
+}
+
+// ackOptions confirms every outbox update up to Seq, which the node may then
+// drop from the user's outbox.
+type ackOptions struct {
+	Seq uint64 `json:"seq"`
+}
+
 type Socket struct {
 	Id           string
 	Lock         sync.Mutex
@@ -31,6 +43,7 @@ type Socket struct {
 	Buffer       [][]byte
 	Ack          bool
 	Disconnected bool
+	Window       *window.Window
 	app          core.ICore
 	server       *Ws
 	userId       string
@@ -67,6 +80,7 @@ func (c *Handler) OnOpen(conn *gws.Conn) {
 	socket.app = c.wsServer.app
 	socket.Ack = true
 	socket.Disconnected = false
+	socket.Window = nil
 	conn.Session().Store("session", socket)
 }
 
@@ -180,6 +194,38 @@ func (t *Socket) writeUpdate(key string, updatePack any, writeRaw bool) {
 	t.pushBuffer()
 }
 
+// writeSeqUpdate frames an update taken from the user's outbox, carrying its
+// sequence number right after the 0x03 marker so the client can resume from it.
+func (t *Socket) writeSeqUpdate(seq uint64, key string, data []byte) {
+
+	keyBytes := []byte(key)
+	keyBytesLen := make([]byte, 4)
+	binary.BigEndian.PutUint32(keyBytesLen, uint32(len(keyBytes)))
+
+	seqBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqBytes, seq)
+
+	packet := make([]byte, 1+len(seqBytes)+len(keyBytesLen)+len(keyBytes)+len(data))
+	pointer := 1
+
+	packet[0] = 0x03
+
+	copy(packet[pointer:pointer+len(seqBytes)], seqBytes[:])
+	pointer += len(seqBytes)
+	copy(packet[pointer:pointer+len(keyBytesLen)], keyBytesLen[:])
+	pointer += len(keyBytesLen)
+	copy(packet[pointer:pointer+len(keyBytes)], keyBytes[:])
+	pointer += len(keyBytes)
+
+	copy(packet[pointer:pointer+len(data)], data[:])
+
+	t.Lock.Lock()
+	defer t.Lock.Unlock()
+
+	t.Buffer = append(t.Buffer, packet)
+	t.pushBuffer()
+}
+
 func (t *Socket) writeResponse(requestId string, resCode int, response any, writeRaw bool) {
 
 	println("preparing response...")
@@ -230,6 +276,17 @@ func (t *Socket) writeResponse(requestId string, resCode int, response any, writ
 
 func (t *Socket) pushBuffer() {
 	println("pushing buffer to client...", t.Ack, len(t.Buffer))
+	if t.Window != nil {
+		frames := t.Window.Pending(t.Buffer)
+		for i, frame := range frames {
+			if err := t.writeFrame(frame); err != nil {
+				t.Window.Rewind(len(frames) - i)
+				println(err)
+				return
+			}
+		}
+		return
+	}
 	if t.Ack {
 		if len(t.Buffer) > 0 {
 			t.Ack = false
@@ -251,11 +308,52 @@ func (t *Socket) pushBuffer() {
 	}
 }
 
+func (t *Socket) writeFrame(packet []byte) error {
+	packetLen := make([]byte, 4)
+	binary.BigEndian.PutUint32(packetLen, uint32(len(packet)))
+	err := t.Conn.WriteMessage(gws.OpcodeBinary, packetLen)
+	if err != nil {
+		return err
+	}
+	err = t.Conn.WriteMessage(gws.OpcodeBinary, packet)
+	return err
+}
+
 func (t *Socket) processPacket(packet []byte) {
+	if len(packet) > 0 && packet[0] == window.HelloMarker {
+		t.Lock.Lock()
+		defer t.Lock.Unlock()
+		hello, w := window.Negotiate(packet[1:])
+		if t.Window != nil {
+			hello, w = t.Window.Settings(), nil
+		} else if w != nil && (!t.Ack || len(t.Buffer) > 0) {
+			hello, w = window.Hello{Version: 1}, nil
+		}
+		if err := t.writeFrame(window.HelloReply(hello)); err != nil {
+			println(err)
+			return
+		}
+		if w != nil {
+			t.Window = w
+		}
+		return
+	}
+	if seq, ok := window.ParseAck(packet); ok {
+		t.Lock.Lock()
+		defer t.Lock.Unlock()
+		if t.Window != nil {
+			t.Buffer = t.Window.Ack(seq, t.Buffer)
+			t.pushBuffer()
+		}
+		return
+	}
 	if len(packet) == 1 && packet[0] == 0x01 {
 		send := func() {
 			t.Lock.Lock()
 			defer t.Lock.Unlock()
+			if t.Window != nil {
+				return
+			}
 			t.Ack = true
 			if len(t.Buffer) > 0 {
 				t.Buffer = t.Buffer[1:]
@@ -306,20 +404,36 @@ func (t *Socket) processPacket(packet []byte) {
 	println(string(payload))
 
 	if path == "logout" {
-		success, _, _ := t.app.Tools().Security().AuthWithSignature(userId, payload, signature)
+		success, _, _ := t.app.Tools().Security().AuthWithEnvelope(userId, path, packetId, payload, signature)
 		if success {
 			t.app.Tools().Signaler().Listeners().Remove(userId)
 			t.writeResponse(packetId, 0, packetmodel.BuildErrorJson("loggedout"), false)
 		} else {
 			t.writeResponse(packetId, 0, packetmodel.BuildErrorJson("logout_failed"), false)
 		}
+	} else if path == "ackUpdates" {
+		success, _, _ := t.app.Tools().Security().AuthWithEnvelope(userId, path, packetId, payload, signature)
+		if success {
+			options := ackOptions{}
+			if err := json.Unmarshal(payload, &options); err != nil {
+				t.writeResponse(packetId, 2, packetmodel.BuildErrorJson(err.Error()), false)
+				return
+			}
+			t.app.Tools().Signaler().Ack(userId, options.Seq)
+			t.writeResponse(packetId, 0, packetmodel.BuildErrorJson("acked"), false)
+		} else {
+			t.writeResponse(packetId, 4, packetmodel.BuildErrorJson("authentication failed"), false)
+		}
+		return
 	} else if path == "authenticate" {
 		var lis *signaler.Listener
-		success, _, _ := t.app.Tools().Security().AuthWithSignature(userId, payload, signature)
+		success, _, _ := t.app.Tools().Security().AuthWithEnvelope(userId, path, packetId, payload, signature)
 		if success {
+			options := authOptions{}
+			json.Unmarshal(payload, &options)
 			func() {
 				soc, found := t.server.sockets.Get(userId)
-				if !found {
+				if !found || options.ResumeFrom != nil {
 					lis = &signaler.Listener{
 						Id:      userId,
 						Paused:  false,
@@ -366,9 +480,20 @@ func (t *Socket) processPacket(packet []byte) {
 				t.app.Tools().Signaler().JoinGroup(pointId[len(prefix):], userId)
 			}
 			t.writeResponse(packetId, 0, packetmodel.BuildErrorJson("authenticated"), false)
-			t.app.Tools().Signaler().ListenToSingle(lis)
-			b, _ := json.Marshal(packetmodel.ResponseSimpleMessage{Message: "old_queue_end"})
-			lis.Signal("old_queue_end", b)
+			if options.ResumeFrom != nil {
+				lis.SignalSeq = func(seq uint64, key string, b any) {
+					if b != nil {
+						t.writeSeqUpdate(seq, key, b.([]byte))
+					}
+				}
+				last := t.app.Tools().Signaler().Resume(lis, *options.ResumeFrom)
+				b, _ := json.Marshal(packetmodel.QueueEnd{Message: "old_queue_end", Seq: last})
+				lis.Signal("old_queue_end", b)
+			} else {
+				t.app.Tools().Signaler().ListenToSingle(lis)
+				b, _ := json.Marshal(packetmodel.ResponseSimpleMessage{Message: "old_queue_end"})
+				lis.Signal("old_queue_end", b)
+			}
 		} else {
 			t.writeResponse(packetId, 4, packetmodel.BuildErrorJson("authentication failed"), false)
 		}
@@ -392,8 +517,13 @@ func (t *Socket) processPacket(packet []byte) {
 		httpStatusCode := 3
 		if statusCode == -1 {
 			httpStatusCode = 4
+		} else if statusCode == secured.ResultRateLimited {
+			httpStatusCode = 5
+		} else if statusCode == secured.ResultTimeout {
+			httpStatusCode = 6
 		}
 		t.writeResponse(packetId, httpStatusCode, packetmodel.BuildErrorJson(err.Error()), false)
+		return
 	}
 	t.writeResponse(packetId, 0, result, false)
 }
@@ -0,0 +1,64 @@
+package net_federation
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("org is unreachable, circuit is open")
+
+func breakerThreshold() int {
+	if v, err := strconv.Atoi(os.Getenv("FED_BREAKER_THRESHOLD")); err == nil && v > 0 {
+		return v
+	}
+	return 5
+}
+
+func breakerCooldown() time.Duration {
+	if v, err := strconv.ParseInt(os.Getenv("FED_BREAKER_COOLDOWN"), 10, 64); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// breaker stops sending to an org after breakerThreshold consecutive
+// failures. Once breakerCooldown passed a single trial is let through, and
+// its outcome closes the circuit again or keeps it open for another cooldown.
+type breaker struct {
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *breaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < breakerThreshold() {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(breakerCooldown())
+	return true
+}
+
+func (b *breaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+func (b *breaker) Failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	if b.failures >= breakerThreshold() {
+		b.openUntil = time.Now().Add(breakerCooldown())
+	}
+}
@@ -21,18 +21,47 @@ import (
 	"kasper/src/shell/utils/future"
 	"log"
 	"net"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	cmap "github.com/orcaman/concurrent-map/v2"
 )
 
+// requestTimeout is how long a request to another org waits for a response.
+func requestTimeout() time.Duration {
+	if v, err := strconv.ParseInt(os.Getenv("FED_REQUEST_TIMEOUT"), 10, 64); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// requestRetries is how many times a request is resent with the same request
+// id. The receiving org answers a repeated request from its cache, so retries
+// are safe for any action.
+func requestRetries() int {
+	if v, err := strconv.Atoi(os.Getenv("FED_REQUEST_RETRIES")); err == nil && v >= 0 {
+		return v
+	}
+	return 2
+}
+
 type FedPacketCallback struct {
 	UserId        string
 	Key           string
 	Request       []byte
 	Callback      func([]byte, int, error)
 	UserRequestId string
+	done          chan struct{}
+}
+
+type servedRequest struct {
+	lock    sync.Mutex
+	done    bool
+	resCode int
+	res     any
+	at      time.Time
 }
 
 type FedFileCallback struct {
@@ -47,12 +76,20 @@ type FedNet struct {
 	signaler        signaler.ISignaler
 	Gateway         *Tcp
 	packetCallbacks *cmap.ConcurrentMap[string, *FedPacketCallback]
+	breakers        *cmap.ConcurrentMap[string, *breaker]
+	served          *cmap.ConcurrentMap[string, *servedRequest]
+	orgKeys         *cmap.ConcurrentMap[string, *orgKey]
+	orgKeyFetches   *cmap.ConcurrentMap[string, time.Time]
 	Port            int
 }
 
 func FirstStageBackFill(core core.ICore) *FedNet {
 	m := cmap.New[*FedPacketCallback]()
-	return &FedNet{app: core, packetCallbacks: &m}
+	b := cmap.New[*breaker]()
+	r := cmap.New[*servedRequest]()
+	k := cmap.New[*orgKey]()
+	f := cmap.New[time.Time]()
+	return &FedNet{app: core, packetCallbacks: &m, breakers: &b, served: &r, orgKeys: &k, orgKeyFetches: &f}
 }
 
 func (fed *FedNet) Listen(port int, tlsConfig *tls.Config) {
@@ -85,6 +122,12 @@ func (fed *FedNet) SecondStageForFill(storage storage.IStorage, file file.IFile,
 			log.Println("hostname not known")
 		}
 	})
+	future.Async(func() {
+		for {
+			time.Sleep(requestTimeout())
+			fed.forgetServedRequests()
+		}
+	}, false)
 	return fed
 }
 
@@ -99,8 +142,10 @@ func ParseInput[T input.IInput](i string) (input.IInput, error) {
 
 func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet.OriginPacket) {
 	if payload.Type == "response" {
-		cb, ok := fed.packetCallbacks.Get(payload.RequestId)
+		cb, ok := fed.packetCallbacks.Pop(payload.RequestId)
 		if ok {
+			close(cb.done)
+			fed.breaker(channelId).Success()
 			if payload.ResCode == 0 {
 				if cb.Key == "/invites/accept" || cb.Key == "/points/join" {
 					userId := ""
@@ -110,6 +155,7 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 						err2 := json.Unmarshal(cb.Request, &memberRes)
 						if err2 != nil {
 							log.Println(err2)
+							cb.Callback([]byte(""), 1, err2)
 							return
 						}
 						userId = cb.UserId
@@ -119,6 +165,7 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 						err2 := json.Unmarshal(cb.Request, &memberRes)
 						if err2 != nil {
 							log.Println(err2)
+							cb.Callback([]byte(""), 1, err2)
 							return
 						}
 						userId = cb.UserId
@@ -137,6 +184,7 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 					err3 := json.Unmarshal(payload.Binary, &spaceOut)
 					if err3 != nil {
 						log.Println(err3)
+						cb.Callback([]byte(""), 1, err3)
 						return
 					}
 					fed.app.ModifyState(false, func(trx trx.ITrx) error {
@@ -148,7 +196,6 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 					fed.signaler.JoinGroup(spaceOut.Point.Id, cb.UserId)
 				}
 			}
-			fed.packetCallbacks.Remove(payload.RequestId)
 			if payload.ResCode != 0 {
 				errPack := payload.Binary
 				errObj := packet.Error{}
@@ -161,6 +208,17 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 		}
 	} else if payload.Type == "update" {
 		log.Println("received update")
+		if err := fed.verifyUpdate(channelId, payload); err != nil {
+			log.Println("update from", channelId, "rejected:", err)
+			return
+		}
+		homeOf := func(pointId string) bool {
+			if pointOrigin(pointId) != channelId {
+				log.Println("update of point", pointId, "from", channelId, "rejected: not its home org")
+				return false
+			}
+			return true
+		}
 		reactToUpdate := func(key string, data string) {
 			if key == "points/update" {
 				tc := updates_points.Update{}
@@ -169,6 +227,9 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 					log.Println(err)
 					return
 				}
+				if !homeOf(tc.Point.Id) {
+					return
+				}
 				fed.app.ModifyState(false, func(trx trx.ITrx) error {
 					tc.Point.Push(trx)
 					return nil
@@ -180,6 +241,9 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 					log.Println(err)
 					return
 				}
+				if !homeOf(tc.Point.Id) {
+					return
+				}
 				fed.app.ModifyState(false, func(trx trx.ITrx) error {
 					trx.DelKey("obj::Point::" + tc.Point.Id)
 					return nil
@@ -191,6 +255,9 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 					log.Println(err)
 					return
 				}
+				if !homeOf(tc.PointId) {
+					return
+				}
 				fed.app.ModifyState(false, func(trx trx.ITrx) error {
 					trx.PutLink("member::"+tc.PointId+"::"+tc.User.Id, "true")
 					trx.PutLink("memberof::"+tc.User.Id+"::"+tc.PointId, "true")
@@ -203,6 +270,9 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 					log.Println(err)
 					return
 				}
+				if !homeOf(tc.PointId) {
+					return
+				}
 				fed.app.ModifyState(false, func(trx trx.ITrx) error {
 					trx.DelKey("link::member::" + tc.PointId + "::" + tc.User.Id)
 					trx.DelKey("link::memberof::" + tc.User.Id + "::" + tc.PointId)
@@ -215,6 +285,9 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 					log.Println(err)
 					return
 				}
+				if !homeOf(tc.PointId) {
+					return
+				}
 				fed.app.ModifyState(false, func(trx trx.ITrx) error {
 					trx.PutJson("member_"+tc.PointId+"_"+tc.User.Id, "meta", tc.Metadata, false)
 					return nil
@@ -226,6 +299,9 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 					log.Println(err)
 					return
 				}
+				if !homeOf(tc.PointId) {
+					return
+				}
 				fed.app.ModifyState(false, func(trx trx.ITrx) error {
 					trx.PutLink("member::"+tc.PointId+"::"+tc.User.Id, "true")
 					trx.PutLink("memberof::"+tc.User.Id+"::"+tc.PointId, "true")
@@ -242,55 +318,66 @@ func (fed *FedNet) HandlePacket(socket *Socket, channelId string, payload packet
 			fed.signaler.SignalGroup(payload.Key, payload.PointId, payload.Binary, false, payload.Exceptions)
 		}
 	} else if payload.Type == "request" {
-		action := fed.app.Actor().FetchAction(payload.Key)
-		if action == nil {
-			fed.SendFedResponse(channelId, payload.RequestId, 1, packet.BuildErrorJson("action not found"))
-		}
-		input, err := action.(iaction.ISecureAction).ParseInput("fed", payload.Binary)
-		if err != nil {
-			fed.SendFedResponse(channelId, payload.RequestId, 1, packet.BuildErrorJson("input could not be parsed"))
-		}
-		_, res, err := action.(iaction.ISecureAction).SecurelyActFed(payload.UserId, payload.Binary, payload.Signature, input)
-		if err != nil {
-			log.Println(err)
-			fed.SendFedResponse(channelId, payload.RequestId, 1, packet.BuildErrorJson(err.Error()))
+		served := &servedRequest{at: time.Now()}
+		served.lock.Lock()
+		if !fed.served.SetIfAbsent(channelId+"::"+payload.RequestId, served) {
+			served.lock.Unlock()
+			cached, ok := fed.served.Get(channelId + "::" + payload.RequestId)
+			if !ok {
+				return
+			}
+			cached.lock.Lock()
+			defer cached.lock.Unlock()
+			if cached.done {
+				fed.SendFedResponse(channelId, payload.RequestId, cached.resCode, cached.res)
+			}
 			return
 		}
-		fed.SendFedResponse(channelId, payload.RequestId, 0, res)
+		defer served.lock.Unlock()
+		served.resCode, served.res = fed.serveRequest(payload)
+		served.done = true
+		fed.SendFedResponse(channelId, payload.RequestId, served.resCode, served.res)
 	}
 }
 
-func (fed *FedNet) SendFedRequest(destOrg string, requestId string, userId string, path string, payload []byte, signature string) {
-	ipAddr := ""
-	ips, _ := net.LookupIP(destOrg)
-	for _, ip := range ips {
-		if ipv4 := ip.To4(); ipv4 != nil {
-			ipAddr = ipv4.String()
-			break
-		}
+func (fed *FedNet) serveRequest(payload packet.OriginPacket) (int, any) {
+	action := fed.app.Actor().FetchAction(payload.Key)
+	if action == nil {
+		return 1, packet.BuildErrorJson("action not found")
 	}
-	ok := false
-	for _, peer := range fed.app.Tools().Network().Chain().Peers() {
-		if peer == ipAddr {
-			ok = true
-			break
-		}
+	input, err := action.(iaction.ISecureAction).ParseInput("fed", payload.Binary)
+	if err != nil {
+		return 1, packet.BuildErrorJson("input could not be parsed")
 	}
-	if ok {
-		address := destOrg + ":" + strconv.Itoa(fed.Port)
-		s := fed.Gateway.NewSocket(address)
-		if s == nil {
-			return
-		}
-		defer s.Conn.Close()
-		s.writeRequest(requestId, userId, path, payload, signature)
-		log.Println("packet sent successfully")
-	} else {
-		log.Println("state org not found")
+	_, res, err := action.(iaction.ISecureAction).SecurelyActFed(payload.UserId, payload.Binary, payload.Signature, input)
+	if err != nil {
+		log.Println(err)
+		return 1, packet.BuildErrorJson(err.Error())
 	}
+	return 0, res
 }
 
-func (fed *FedNet) SendFedResponse(destOrg string, requestId string, resCode int, res any) {
+func (fed *FedNet) forgetServedRequests() {
+	expired := time.Now().Add(-2 * requestTimeout())
+	for _, key := range fed.served.Keys() {
+		fed.served.RemoveCb(key, func(_ string, served *servedRequest, exists bool) bool {
+			return exists && served.at.Before(expired)
+		})
+	}
+}
+
+func (fed *FedNet) breaker(destOrg string) *breaker {
+	return fed.breakers.Upsert(destOrg, nil, func(exists bool, current *breaker, _ *breaker) *breaker {
+		if exists {
+			return current
+		}
+		return &breaker{}
+	})
+}
+
+// orgAddress resolves the federation address of an org, which has to be one
+// of the chain peers.
+func (fed *FedNet) orgAddress(destOrg string) (string, error) {
 	ipAddr := ""
 	ips, _ := net.LookupIP(destOrg)
 	for _, ip := range ips {
@@ -299,94 +386,98 @@ func (fed *FedNet) SendFedResponse(destOrg string, requestId string, resCode int
 			break
 		}
 	}
-	ok := false
 	for _, peer := range fed.app.Tools().Network().Chain().Peers() {
 		if peer == ipAddr {
-			ok = true
-			break
+			return destOrg + ":" + strconv.Itoa(fed.Port), nil
 		}
 	}
-	if ok {
-		address := destOrg + ":" + strconv.Itoa(fed.Port)
-		s := fed.Gateway.NewSocket(address)
-		if s == nil {
-			return
-		}
-		defer s.Conn.Close()
-		s.writeResponse(requestId, resCode, res, false)
-		log.Println("packet sent successfully")
-	} else {
-		log.Println("state org not found")
+	return "", errors.New("state org not found")
+}
+
+func (fed *FedNet) send(destOrg string, write func(*Socket) error) error {
+	address, err := fed.orgAddress(destOrg)
+	if err != nil {
+		return err
+	}
+	b := fed.breaker(destOrg)
+	if !b.Allow() {
+		return ErrCircuitOpen
 	}
+	s, err := fed.Gateway.Socket(address)
+	if err == nil {
+		err = write(s)
+	}
+	if err != nil {
+		b.Failure()
+		return err
+	}
+	return nil
 }
 
-func (fed *FedNet) SendFedUpdate(destOrg string, key string, updatePack any, targetType string, targetIdVal string, exceptions []string) {
-	ipAddr := ""
-	ips, _ := net.LookupIP(destOrg)
-	for _, ip := range ips {
-		if ipv4 := ip.To4(); ipv4 != nil {
-			ipAddr = ipv4.String()
-			break
-		}
+func (fed *FedNet) SendFedRequest(destOrg string, requestId string, userId string, path string, payload []byte, signature string) {
+	err := fed.send(destOrg, func(s *Socket) error {
+		return s.writeRequest(requestId, userId, path, payload, signature)
+	})
+	if err != nil {
+		log.Println(err)
+		return
 	}
-	ok := false
-	for _, peer := range fed.app.Tools().Network().Chain().Peers() {
-		if peer == ipAddr {
-			ok = true
-			break
-		}
+	log.Println("packet sent successfully")
+}
+
+func (fed *FedNet) SendFedResponse(destOrg string, requestId string, resCode int, res any) {
+	err := fed.send(destOrg, func(s *Socket) error {
+		return s.writeResponse(requestId, resCode, res, false)
+	})
+	if err != nil {
+		log.Println(err)
+		return
 	}
-	if ok {
-		address := destOrg + ":" + strconv.Itoa(fed.Port)
-		s := fed.Gateway.NewSocket(address)
-		if s == nil {
-			return
-		}
-		defer s.Conn.Close()
-		s.writeUpdate(key, updatePack, targetType, targetIdVal, exceptions, false)
-		log.Println("packet sent successfully")
-	} else {
-		log.Println("state org not found")
+	log.Println("packet sent successfully")
+}
+
+func (fed *FedNet) SendFedUpdate(destOrg string, key string, updatePack any, targetType string, targetIdVal string, exceptions []string) {
+	err := fed.send(destOrg, func(s *Socket) error {
+		return s.writeUpdate(key, updatePack, targetType, targetIdVal, exceptions, false)
+	})
+	if err != nil {
+		log.Println(err)
+		return
 	}
+	log.Println("packet sent successfully")
 }
 
 func (fed *FedNet) SendFedRequestByCallback(destOrg string, requestId string, userId string, path string, payload []byte, signature string, callback func([]byte, int, error)) {
-	ipAddr := ""
-	ips, _ := net.LookupIP(destOrg)
-	for _, ip := range ips {
-		if ipv4 := ip.To4(); ipv4 != nil {
-			ipAddr = ipv4.String()
-			break
-		}
+	if _, err := fed.orgAddress(destOrg); err != nil {
+		callback([]byte(""), 1, err)
+		return
 	}
-	ok := false
-	for _, peer := range fed.app.Tools().Network().Chain().Peers() {
-		if peer == ipAddr {
-			ok = true
-			break
-		}
+	if !fed.breaker(destOrg).Allow() {
+		callback([]byte(""), 1, ErrCircuitOpen)
+		return
 	}
-	if ok {
-		callbackId := crypto.SecureUniqueString()
-		cb := &FedPacketCallback{Callback: callback, Key: path, UserRequestId: requestId, Request: payload, UserId: userId}
-		fed.packetCallbacks.Set(callbackId, cb)
-		future.Async(func() {
-			time.Sleep(time.Duration(120) * time.Second)
-			cb, ok := fed.packetCallbacks.Get(callbackId)
-			if ok {
-				fed.packetCallbacks.Remove(callbackId)
-				cb.Callback([]byte(""), 0, errors.New("federation callback timeout"))
+	callbackId := crypto.SecureUniqueString()
+	cb := &FedPacketCallback{Callback: callback, Key: path, UserRequestId: requestId, Request: payload, UserId: userId, done: make(chan struct{})}
+	fed.packetCallbacks.Set(callbackId, cb)
+	future.Async(func() {
+		attempts := requestRetries() + 1
+		wait := requestTimeout() / time.Duration(attempts)
+		for i := 0; i < attempts; i++ {
+			err := fed.send(destOrg, func(s *Socket) error {
+				return s.writeRequest(callbackId, userId, path, payload, signature)
+			})
+			if err != nil {
+				log.Println(err)
+			}
+			select {
+			case <-cb.done:
+				return
+			case <-time.After(wait):
 			}
-		}, false)
-		address := destOrg + ":" + strconv.Itoa(fed.Port)
-		s := fed.Gateway.NewSocket(address)
-		if s == nil {
-			return
 		}
-		defer s.Conn.Close()
-		s.writeRequest(callbackId, userId, path, payload, signature)
-		log.Println("packet sent successfully")
-	} else {
-		log.Println("state org not found")
-	}
+		if cb, ok := fed.packetCallbacks.Pop(callbackId); ok {
+			fed.breaker(destOrg).Failure()
+			cb.Callback([]byte(""), 1, network.ErrFederationTimeout)
+		}
+	}, false)
 }
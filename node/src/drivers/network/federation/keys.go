@@ -0,0 +1,164 @@
+package net_federation
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kasper/src/abstract/adapters/security"
+	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/packet"
+	"kasper/src/abstract/models/trx"
+	"kasper/src/shell/api/model"
+	"kasper/src/shell/utils/crypto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Updates from other orgs are signed with the server key of the sending org.
+// Orgs registered on chain are pinned to the key and certificate they
+// registered, the keys of others are asked from the org itself and kept.
+
+func pointOrigin(pointId string) string {
+	parts := strings.Split(pointId, "@")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-1]
+}
+
+func registeredNode(app core.ICore, origin string) (model.Node, bool) {
+	var node model.Node
+	found := false
+	app.ModifyState(true, func(trx trx.ITrx) error {
+		node, found = model.Node{Origin: origin}.Resolve(trx)
+		return nil
+	})
+	return node, found
+}
+
+// verifyPinnedCert checks the leaf certificate presented by an org against the
+// fingerprint it registered, if any.
+func verifyPinnedCert(app core.ICore, origin string, cs tls.ConnectionState) error {
+	node, found := registeredNode(app, origin)
+	if !found || node.CertFingerprint == "" {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("org presented no certificate")
+	}
+	sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	if hex.EncodeToString(sum[:]) != node.CertFingerprint {
+		return fmt.Errorf("certificate of %s does not match its registered fingerprint", origin)
+	}
+	return nil
+}
+
+// orgKey is the server key kept for an org, with the rotation version it was
+// served with.
+type orgKey struct {
+	PublicKey string
+	Version   int64
+}
+
+func orgKeyRefetch() time.Duration {
+	if v, err := strconv.ParseInt(os.Getenv("FED_ORG_KEY_REFETCH"), 10, 64); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return 60 * time.Second
+}
+
+// fetchOrgKey asks an org for its server key, at most once every
+// orgKeyRefetch, so updates with bad signatures can not make the node ask
+// the org again and again. A key that replaces the kept one is only taken if
+// it comes with a rotation to a later version signed by the kept key.
+func (fed *FedNet) fetchOrgKey(org string) (*orgKey, error) {
+	allowed := false
+	fed.orgKeyFetches.Upsert(org, time.Now(), func(exist bool, last time.Time, now time.Time) time.Time {
+		if exist && now.Sub(last) < orgKeyRefetch() {
+			return last
+		}
+		allowed = true
+		return now
+	})
+	if !allowed {
+		return nil, fmt.Errorf("key of %s was fetched less than %s ago", org, orgKeyRefetch())
+	}
+	done := make(chan struct{})
+	var data []byte
+	var err error
+	fed.SendFedRequestByCallback(org, "", "", "/auths/getServerPublicKey", []byte("{}"), "", func(res []byte, _ int, e error) {
+		data, err = res, e
+		close(done)
+	})
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	out := struct {
+		PublicKey string                 `json:"publicKey"`
+		Version   int64                  `json:"version"`
+		Rotations []security.KeyRotation `json:"rotations"`
+	}{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	key := &orgKey{PublicKey: out.PublicKey, Version: out.Version}
+	if held, ok := fed.orgKeys.Get(org); ok {
+		if err := followRotations(held, key, out.Rotations); err != nil {
+			return nil, fmt.Errorf("key of %s is not accepted: %w", org, err)
+		}
+	}
+	fed.orgKeys.Set(org, key)
+	return key, nil
+}
+
+// followRotations checks that key replaces held through rotations each signed
+// by the key before it.
+func followRotations(held *orgKey, key *orgKey, rotations []security.KeyRotation) error {
+	if key.Version < held.Version {
+		return errors.New("key is older than the kept one")
+	}
+	current := *held
+	for _, rotation := range rotations {
+		if rotation.Version <= current.Version {
+			continue
+		}
+		if rotation.Version != current.Version+1 {
+			return fmt.Errorf("rotation %d is missing", current.Version+1)
+		}
+		if err := crypto.VerifySignature([]byte(current.PublicKey), security.KeyRotationMessage(rotation.Version, rotation.PublicKey), rotation.Proof); err != nil {
+			return fmt.Errorf("rotation %d is not signed by the key before it: %w", rotation.Version, err)
+		}
+		current = orgKey{PublicKey: rotation.PublicKey, Version: rotation.Version}
+	}
+	if current.Version != key.Version || current.PublicKey != key.PublicKey {
+		return errors.New("key does not follow from the kept one")
+	}
+	return nil
+}
+
+// verifyUpdate checks that an update was signed by the server key of the org
+// it came from.
+func (fed *FedNet) verifyUpdate(org string, payload packet.OriginPacket) error {
+	if payload.Signature == "" {
+		return errors.New("update is not signed")
+	}
+	if node, found := registeredNode(fed.app, org); found && node.PublicKey != "" {
+		return crypto.VerifySignature([]byte(node.PublicKey), payload.Binary, payload.Signature)
+	}
+	if key, ok := fed.orgKeys.Get(org); ok {
+		if crypto.VerifySignature([]byte(key.PublicKey), payload.Binary, payload.Signature) == nil {
+			return nil
+		}
+	}
+	key, err := fed.fetchOrgKey(org)
+	if err != nil {
+		return err
+	}
+	return crypto.VerifySignature([]byte(key.PublicKey), payload.Binary, payload.Signature)
+}
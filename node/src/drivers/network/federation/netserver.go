@@ -1,10 +1,13 @@
 package net_federation
 
 import (
+	"bufio"
 	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"kasper/src/abstract/models/core"
 	"kasper/src/shell/utils/crypto"
 	"kasper/src/shell/utils/future"
@@ -12,20 +15,30 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	packetmodel "kasper/src/abstract/models/packet"
 
 	cmap "github.com/orcaman/concurrent-map/v2"
 )
 
+// Connections to other orgs are kept open and shared by every request to the
+// same destination. Packets are framed with a big endian length prefix and
+// matched to their callbacks by request id, so any number of requests can be
+// in flight on one connection.
+var (
+	FedDialTimeout   = 10 * time.Second
+	FedWriteTimeout  = 10 * time.Second
+	MaxFedPacketSize = 64 << 20
+)
+
 type Socket struct {
 	Id     string
 	Lock   sync.Mutex
 	Conn   net.Conn
-	Buffer [][]byte
-	Ack    bool
 	app    core.ICore
 	server *Tcp
+	closed bool
 }
 
 type FedApi func(socket *Socket, srcIp string, packet packetmodel.OriginPacket)
@@ -34,6 +47,8 @@ type Tcp struct {
 	app     core.ICore
 	bridge  FedApi
 	sockets *cmap.ConcurrentMap[string, *Socket]
+	pool    *cmap.ConcurrentMap[string, *Socket]
+	dialing sync.Mutex
 }
 
 func (t *Tcp) InjectBridge(bridge FedApi) {
@@ -62,141 +77,94 @@ func (t *Tcp) Listen(port int, tlsConfig *tls.Config) {
 }
 
 func (t *Tcp) listenForPackets(socket *Socket) {
-	defer func() {
-		t.sockets.Remove(socket.Id)
-		socket.Conn.Close()
-	}()
+	defer socket.Close()
 	origin := strings.Split(socket.Conn.RemoteAddr().String(), ":")[0]
+	reader := bufio.NewReader(socket.Conn)
 	lenBuf := make([]byte, 4)
-	buf := make([]byte, 1024)
-	nextBuf := make([]byte, 2048)
-	readCount := 0
-	oldReadCount := 0
-	enough := false
-	beginning := true
-	length := 0
-	readLength := 0
-	remainedReadLength := 0
-	var readData []byte
 	for {
-		if !enough {
-			var err error
-			readLength, err = socket.Conn.Read(buf)
-			if err != nil {
-				log.Println(origin, err)
-				log.Println(origin, "socket had error and closed")
-				return
-			}
-			func() {
-				socket.Lock.Lock()
-				defer socket.Lock.Unlock()
-				log.Println(origin, "stat 0: reading data...")
-
-				log.Println(origin, buf[0:readLength])
-
-				readCount += readLength
-				copy(nextBuf[remainedReadLength:remainedReadLength+readLength], buf[0:readLength])
-				remainedReadLength += readLength
-
-				log.Println(origin, nextBuf[0:readLength])
-
-				log.Println(origin, "stat 1:", readLength, oldReadCount, readCount, remainedReadLength)
-			}()
+		if _, err := io.ReadFull(reader, lenBuf); err != nil {
+			log.Println(origin, "socket closed:", err)
+			return
 		}
-
-		if beginning {
-			if readCount >= 4 {
-				func() {
-					socket.Lock.Lock()
-					defer socket.Lock.Unlock()
-					log.Println(origin, "stating stat 2...")
-					copy(lenBuf, nextBuf[0:4])
-					log.Println(origin, "nextBuf", nextBuf[0:4])
-					log.Println(origin, "lenBuf", lenBuf[0:4])
-					remainedReadLength -= 4
-					copy(nextBuf[0:remainedReadLength], nextBuf[4:remainedReadLength+4])
-					length = int(binary.LittleEndian.Uint32(lenBuf))
-					readData = make([]byte, length)
-					readCount -= 4
-					beginning = false
-					enough = true
-
-					log.Println(origin, "stat 2:", remainedReadLength, length, readCount)
-				}()
-
-			} else {
-				enough = false
-			}
-		} else {
-			if remainedReadLength == 0 {
-				enough = false
-			} else if readCount >= length {
-				func() {
-					socket.Lock.Lock()
-					defer socket.Lock.Unlock()
-					log.Println(origin, "stating stat 3...")
-					log.Println(origin, "stat 3 step 1", oldReadCount, length)
-					copy(readData[oldReadCount:length], nextBuf[0:length-oldReadCount])
-					log.Println(origin, "stat 3 step 2", readLength, readCount, length)
-					readCount -= length
-					copy(nextBuf[0:readCount], nextBuf[length-oldReadCount:(length-oldReadCount)+readCount])
-					log.Println(origin, "nextBuf", nextBuf[0:readCount])
-					log.Println(origin, "stat 3 step 3", readCount, length)
-					remainedReadLength = readCount
-					log.Println(origin, "packet received")
-					packet := make([]byte, length)
-					copy(packet, readData)
-					log.Println(origin, "stat 3 step 4")
-					oldReadCount = 0
-					enough = true
-					beginning = true
-
-					log.Println(origin, "stat 3:", remainedReadLength, oldReadCount, readCount)
-
-					future.Async(func() {
-						socket.processPacket(packet)
-					}, false)
-				}()
-			} else {
-				func() {
-					socket.Lock.Lock()
-					defer socket.Lock.Unlock()
-					log.Println(origin, "stating stat 4...")
-
-					copy(readData[oldReadCount:oldReadCount+(readCount-oldReadCount)], nextBuf[0:readCount-oldReadCount])
-					remainedReadLength = 0
-					oldReadCount = readCount
-					enough = true
-
-					log.Println(origin, "stat 4:", remainedReadLength)
-				}()
-			}
+		length := int(binary.BigEndian.Uint32(lenBuf))
+		if length > MaxFedPacketSize {
+			log.Println(origin, "packet of", length, "bytes is too large")
+			return
 		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			log.Println(origin, "socket closed:", err)
+			return
+		}
+		future.Async(func() {
+			socket.processPacket(packet)
+		}, false)
 	}
 }
 
 func (t *Tcp) handleConnection(conn net.Conn) *Socket {
-	socket := &Socket{Id: crypto.SecureUniqueString(), server: t, Buffer: [][]byte{}, Conn: conn, app: t.app, Ack: true}
-	t.sockets.Set(strings.Split(conn.RemoteAddr().String(), ":")[0], socket)
+	socket := &Socket{Id: crypto.SecureUniqueString(), server: t, Conn: conn, app: t.app}
+	t.sockets.Set(socket.Id, socket)
 	future.Async(func() {
 		t.listenForPackets(socket)
 	}, false)
 	return socket
 }
 
-func (t *Tcp) NewSocket(destAddress string) *Socket {
+func (t *Tcp) NewSocket(destAddress string) (*Socket, error) {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: false,
 		ServerName:         strings.Split(destAddress, ":")[0],
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyPinnedCert(t.app, strings.Split(destAddress, ":")[0], cs)
+		},
 	}
-	conn, err := tls.Dial("tcp", destAddress, tlsConfig)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: FedDialTimeout}, "tcp", destAddress, tlsConfig)
 	if err != nil {
-		log.Println("failed to connect:", err.Error())
+		return nil, err
 	}
-	return t.handleConnection(conn)
+	return t.handleConnection(conn), nil
 }
 
-func (t *Socket) writeRequest(requestId string, userId string, path string, payload []byte, signature string) {
+// Socket returns the pooled connection to destAddress, dialing a new one when
+// there is none or the last one was closed.
+func (t *Tcp) Socket(destAddress string) (*Socket, error) {
+	if s, ok := t.pool.Get(destAddress); ok && !s.isClosed() {
+		return s, nil
+	}
+	t.dialing.Lock()
+	defer t.dialing.Unlock()
+	if s, ok := t.pool.Get(destAddress); ok && !s.isClosed() {
+		return s, nil
+	}
+	s, err := t.NewSocket(destAddress)
+	if err != nil {
+		return nil, err
+	}
+	t.pool.Set(destAddress, s)
+	return s, nil
+}
+
+func (t *Socket) isClosed() bool {
+	t.Lock.Lock()
+	defer t.Lock.Unlock()
+	return t.closed
+}
+
+func (t *Socket) Close() {
+	t.Lock.Lock()
+	t.closed = true
+	t.Lock.Unlock()
+	t.Conn.Close()
+	t.server.sockets.Remove(t.Id)
+	for _, key := range t.server.pool.Keys() {
+		t.server.pool.RemoveCb(key, func(_ string, s *Socket, exists bool) bool {
+			return exists && s == t
+		})
+	}
+}
+
+func (t *Socket) writeRequest(requestId string, userId string, path string, payload []byte, signature string) error {
 
 	signBytes := []byte(signature)
 	signLenBytes := make([]byte, 4)
@@ -242,14 +210,10 @@ func (t *Socket) writeRequest(requestId string, userId string, path string, payl
 	copy(packet[pointer:pointer+len(payload)], payload[:])
 	pointer += len(payload)
 
-	t.Lock.Lock()
-	defer t.Lock.Unlock()
-
-	t.Buffer = append(t.Buffer, packet)
-	t.pushBuffer()
+	return t.write(packet)
 }
 
-func (t *Socket) writeUpdate(key string, updatePack any, targetType string, targetIdVal string, exceptions []string, writeRaw bool) {
+func (t *Socket) writeUpdate(key string, updatePack any, targetType string, targetIdVal string, exceptions []string, writeRaw bool) error {
 
 	targetId := targetType + "::" + targetIdVal
 
@@ -265,8 +229,7 @@ func (t *Socket) writeUpdate(key string, updatePack any, targetType string, targ
 		var err error
 		b3, err = json.Marshal(updatePack)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
 		signBytes = []byte(t.app.SignPacket(b3))
 	}
@@ -280,8 +243,7 @@ func (t *Socket) writeUpdate(key string, updatePack any, targetType string, targ
 
 	excepBytes, err := json.Marshal(exceptions)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	excepLenBytes := make([]byte, 4)
 	binary.BigEndian.PutUint32(excepLenBytes[:], uint32(len(excepBytes)))
@@ -314,14 +276,10 @@ func (t *Socket) writeUpdate(key string, updatePack any, targetType string, targ
 	copy(packet[pointer:pointer+len(b3)], b3[:])
 	pointer += len(b3)
 
-	t.Lock.Lock()
-	defer t.Lock.Unlock()
-
-	t.Buffer = append(t.Buffer, packet)
-	t.pushBuffer()
+	return t.write(packet)
 }
 
-func (t *Socket) writeResponse(requestId string, resCode int, response any, writeRaw bool) {
+func (t *Socket) writeResponse(requestId string, resCode int, response any, writeRaw bool) error {
 
 	log.Println("preparing response...")
 
@@ -340,8 +298,7 @@ func (t *Socket) writeResponse(requestId string, resCode int, response any, writ
 		var err error
 		b3, err = json.Marshal(response)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
 		b4 = []byte(t.app.SignPacket(b3))
 	}
@@ -369,55 +326,31 @@ func (t *Socket) writeResponse(requestId string, resCode int, response any, writ
 	copy(packet[pointer:pointer+len(b3)], b3[:])
 	pointer += len(b3)
 
-	log.Println("appending to buffer...")
+	log.Println("sending response...")
 
-	t.Lock.Lock()
-	defer t.Lock.Unlock()
-
-	t.Buffer = append(t.Buffer, packet)
-	t.pushBuffer()
+	return t.write(packet)
 }
 
-func (t *Socket) pushBuffer() {
-	log.Println("pushing buffer to client...", t.Ack, len(t.Buffer))
-	if t.Ack {
-		if len(t.Buffer) > 0 {
-			t.Ack = false
-			packetLen := make([]byte, 4)
-			binary.BigEndian.PutUint32(packetLen, uint32(len(t.Buffer[0])))
-			_, err := t.Conn.Write(packetLen)
-			if err != nil {
-				t.Ack = true
-				log.Println(err)
-			}
-			_, err = t.Conn.Write(t.Buffer[0])
-			if err != nil {
-				t.Ack = true
-				log.Println(err)
-			}
-		}
+func (t *Socket) write(packet []byte) error {
+	t.Lock.Lock()
+	defer t.Lock.Unlock()
+	if t.closed {
+		return errors.New("socket is closed")
 	}
+	frame := make([]byte, 4+len(packet))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(packet)))
+	copy(frame[4:], packet)
+	t.Conn.SetWriteDeadline(time.Now().Add(FedWriteTimeout))
+	if _, err := t.Conn.Write(frame); err != nil {
+		t.closed = true
+		t.Conn.Close()
+		return err
+	}
+	return nil
 }
 
 func (t *Socket) processPacket(packet []byte) {
-	if len(packet) == len([]byte("packet_received")) && string(packet) == "packet_received" {
-		send := func() {
-			t.Lock.Lock()
-			defer t.Lock.Unlock()
-			t.Ack = true
-			if len(t.Buffer) > 0 {
-				t.Buffer = t.Buffer[1:]
-				if len(t.Buffer) > 0 {
-					t.Ack = false
-					_, err := t.Conn.Write(t.Buffer[0])
-					if err != nil {
-						t.Ack = true
-						log.Println(err)
-					}
-				}
-			}
-		}
-		send()
+	if len(packet) == 0 || string(packet) == "packet_received" {
 		return
 	}
 	typ := ""
@@ -535,5 +468,6 @@ func (t *Socket) processPacket(packet []byte) {
 
 func NewTcp(app core.ICore) *Tcp {
 	m := cmap.New[*Socket]()
-	return &Tcp{app: app, sockets: &m}
+	p := cmap.New[*Socket]()
+	return &Tcp{app: app, sockets: &m, pool: &p}
 }
@@ -61,7 +61,7 @@ func NewNetwork(
 		tcp:       tcp.NewTcp(core),
 		ws:        ws.NewWs(core),
 		fed:       fed,
-		chain:     chain.NewChain(core, storage.StorageRoot()),
+		chain:     chain.NewChain(core, storage),
 		tlsConfig: config,
 	}
 	return net
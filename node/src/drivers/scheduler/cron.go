@@ -0,0 +1,122 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a five field cron expression, minute hour day-of-month month
+// day-of-week, evaluated in UTC. Fields take "*", numbers, ranges "a-b", steps
+// "*/n" or "a-b/n", and comma separated lists of those. As in classic cron a
+// day matches if either day field matches when both are restricted.
+type cronSpec struct {
+	minutes  []bool
+	hours    []bool
+	days     []bool
+	months   []bool
+	weekdays []bool
+	anyDay   bool
+	anyWeek  bool
+}
+
+// cronHorizon bounds the search for the next run of an expression that can
+// never match, like the 31st of February.
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+func parseCronField(field string, lo int, hi int) ([]bool, bool, error) {
+	set := make([]bool, hi+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if rng, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return nil, false, fmt.Errorf("invalid cron step %q", part)
+			}
+			part, step = rng, n
+		}
+		from, to := lo, hi
+		if part != "*" {
+			a, b, isRange := strings.Cut(part, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil {
+				return nil, false, fmt.Errorf("invalid cron value %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil {
+					return nil, false, fmt.Errorf("invalid cron value %q", part)
+				}
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, false, fmt.Errorf("cron value %q out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, field == "*", nil
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression needs 5 fields")
+	}
+	c := &cronSpec{}
+	var err error
+	if c.minutes, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hours, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.days, c.anyDay, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.months, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.weekdays, c.anyWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	c.weekdays[0] = c.weekdays[0] || c.weekdays[7]
+	return c, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	day, week := c.days[t.Day()], c.weekdays[int(t.Weekday())]
+	if c.anyDay || c.anyWeek {
+		return day && week
+	}
+	return day || week
+}
+
+// next returns the first minute strictly after t the expression matches.
+func (c *cronSpec) next(t time.Time) (time.Time, error) {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	end := t.Add(cronHorizon)
+	for t.Before(end) {
+		if !c.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.hours[t.Hour()] {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !c.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, nil
+	}
+	return time.Time{}, errors.New("cron expression never matches")
+}
@@ -0,0 +1,90 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func mustTime(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return parsed
+}
+
+func TestCronNext(t *testing.T) {
+	cases := []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"* * * * *", "2026-03-01T10:00:30Z", "2026-03-01T10:01:00Z"},
+		{"*/15 * * * *", "2026-03-01T10:00:00Z", "2026-03-01T10:15:00Z"},
+		{"0 9 * * 1-5", "2026-03-06T09:00:00Z", "2026-03-09T09:00:00Z"},
+		{"30 2 1 * *", "2026-12-15T00:00:00Z", "2027-01-01T02:30:00Z"},
+		{"0 0 29 2 *", "2026-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"0 12 * * 0", "2026-03-02T00:00:00Z", "2026-03-08T12:00:00Z"},
+		{"0 12 * * 7", "2026-03-02T00:00:00Z", "2026-03-08T12:00:00Z"},
+		{"5,10 1-2/1 * 6 *", "2026-03-01T00:00:00Z", "2026-06-01T01:05:00Z"},
+		// with both day fields restricted either one matches
+		{"0 0 13 * 5", "2026-03-01T00:00:00Z", "2026-03-06T00:00:00Z"},
+	}
+	for _, c := range cases {
+		spec, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		next, err := spec.next(mustTime(t, c.from))
+		if err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		if !next.Equal(mustTime(t, c.want)) {
+			t.Fatalf("%s after %s is %s, want %s", c.expr, c.from, next.Format(time.RFC3339), c.want)
+		}
+	}
+}
+
+func TestCronNextIsInUTC(t *testing.T) {
+	spec, _ := parseCron("0 9 * * *")
+	from := time.Date(2026, 3, 1, 8, 0, 0, 0, time.FixedZone("UTC+5", 5*3600))
+	next, err := spec.next(from)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !next.Equal(mustTime(t, "2026-03-01T09:00:00Z")) {
+		t.Fatalf("next run at %s", next)
+	}
+}
+
+func TestCronNeverMatches(t *testing.T) {
+	spec, err := parseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := spec.next(mustTime(t, "2026-01-01T00:00:00Z")); err == nil {
+		t.Fatalf("31st of february matched")
+	}
+}
+
+func TestCronRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"*/x * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Fatalf("%q parsed", expr)
+		}
+	}
+}
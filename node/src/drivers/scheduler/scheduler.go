@@ -0,0 +1,371 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kasper/src/abstract/adapters/network"
+	"kasper/src/abstract/adapters/scheduler"
+	"kasper/src/abstract/adapters/storage"
+	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/trx"
+	"kasper/src/shell/api/model"
+	"kasper/src/shell/utils/future"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Timers are kept under "scheduler::<machineId>::<name>" and loaded back on
+// boot. OnChain timers run on the block time of the main shard so that every
+// executor fires them alike.
+const MaxTimerNameLength = 64
+
+var (
+	ErrTooManyTimers         = errors.New("machine has too many timers")
+	ErrRuntimeNotSchedulable = errors.New("runtime of the machine can not run timers")
+
+	schedulable = map[string]bool{"wasm": true}
+)
+
+type Scheduler struct {
+	app       core.ICore
+	db        *badger.DB
+	lock      sync.Mutex
+	timers    map[string]*scheduler.Timer
+	crons     map[string]*cronSpec
+	wake      chan struct{}
+	done      chan struct{}
+	started   bool
+	blockTime atomic.Int64
+}
+
+func timerKey(machineId string, name string) string {
+	return "scheduler::" + machineId + "::" + name
+}
+
+func NewScheduler(app core.ICore, storage storage.IStorage, network network.INetwork) *Scheduler {
+	log.Println("creating scheduler...")
+	s := &Scheduler{
+		app:    app,
+		db:     storage.KvDb(),
+		timers: map[string]*scheduler.Timer{},
+		crons:  map[string]*cronSpec{},
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	s.load()
+	network.Chain().ListenToBlocks(func(workChainId string, shardChainId string, blockIndex int, timestamp int64) {
+		if workChainId == "main" && shardChainId == "shard-main" {
+			s.onBlock(timestamp * 1000)
+		}
+	})
+	return s
+}
+
+func (s *Scheduler) load() {
+	prefix := []byte("scheduler::")
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			timer := &scheduler.Timer{}
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, timer)
+			})
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			key := timerKey(timer.MachineId, timer.Name)
+			if timer.Cron != "" {
+				spec, err := parseCron(timer.Cron)
+				if err != nil {
+					log.Println("dropping timer", key, ":", err)
+					continue
+				}
+				s.crons[key] = spec
+			}
+			s.timers[key] = timer
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	log.Println("scheduler loaded", len(s.timers), "timers")
+}
+
+func (s *Scheduler) persist(timer *scheduler.Timer) {
+	data, err := json.Marshal(timer)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(timerKey(timer.MachineId, timer.Name)), data)
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Scheduler) remove(machineId string, name string) {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(timerKey(machineId, name)))
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) runtimeOf(machineId string) string {
+	runtime := ""
+	s.app.ModifyState(true, func(trx trx.ITrx) error {
+		runtime = model.Vm{MachineId: machineId}.Pull(trx).Runtime
+		return nil
+	})
+	return runtime
+}
+
+// Schedule adds a timer, replacing the one of the machine with the same name.
+// Unless FireAt is given the timer fires after delay, or at the next match of
+// its cron expression, counted from now or for OnChain timers from CreatedAt.
+func (s *Scheduler) Schedule(timer scheduler.Timer, delay time.Duration) (scheduler.Timer, error) {
+	if timer.MachineId == "" {
+		return timer, errors.New("timer has no machine")
+	}
+	if timer.Name == "" || len(timer.Name) > MaxTimerNameLength {
+		return timer, fmt.Errorf("timer name must have 1 to %d characters", MaxTimerNameLength)
+	}
+	if !schedulable[s.runtimeOf(timer.MachineId)] {
+		return timer, ErrRuntimeNotSchedulable
+	}
+	var spec *cronSpec
+	if timer.Cron != "" {
+		var err error
+		if spec, err = parseCron(timer.Cron); err != nil {
+			return timer, err
+		}
+	}
+	now := time.Now().UnixMilli()
+	if timer.OnChain {
+		if timer.CreatedAt <= 0 {
+			return timer, errors.New("on chain timer has no block time to count from")
+		}
+		now = timer.CreatedAt
+	}
+	timer.CreatedAt = now
+	if timer.FireAt <= 0 {
+		if spec != nil {
+			next, err := spec.next(time.UnixMilli(now))
+			if err != nil {
+				return timer, err
+			}
+			timer.FireAt = next.UnixMilli()
+		} else {
+			timer.FireAt = now + delay.Milliseconds()
+		}
+	}
+	maxTimers := 100
+	if v, err := strconv.Atoi(os.Getenv("SCHEDULER_MAX_TIMERS")); err == nil && v > 0 {
+		maxTimers = v
+	}
+	key := timerKey(timer.MachineId, timer.Name)
+	s.lock.Lock()
+	if _, exists := s.timers[key]; !exists && s.countOf(timer.MachineId) >= maxTimers {
+		s.lock.Unlock()
+		return timer, ErrTooManyTimers
+	}
+	t := timer
+	s.timers[key] = &t
+	if spec != nil {
+		s.crons[key] = spec
+	} else {
+		delete(s.crons, key)
+	}
+	s.persist(&t)
+	s.lock.Unlock()
+	s.signal()
+	return timer, nil
+}
+
+func (s *Scheduler) countOf(machineId string) int {
+	count := 0
+	for _, t := range s.timers {
+		if t.MachineId == machineId {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Scheduler) Cancel(machineId string, name string) bool {
+	key := timerKey(machineId, name)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.timers[key]; !ok {
+		return false
+	}
+	delete(s.timers, key)
+	delete(s.crons, key)
+	s.remove(machineId, name)
+	s.signal()
+	return true
+}
+
+// List returns the timers of a machine, soonest first.
+func (s *Scheduler) List(machineId string) []scheduler.Timer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	timers := []scheduler.Timer{}
+	for _, t := range s.timers {
+		if t.MachineId == machineId {
+			timers = append(timers, *t)
+		}
+	}
+	sort.Slice(timers, func(i, j int) bool {
+		if timers[i].FireAt == timers[j].FireAt {
+			return timers[i].Name < timers[j].Name
+		}
+		return timers[i].FireAt < timers[j].FireAt
+	})
+	return timers
+}
+
+// due takes the timers of a clock that reached now, rescheduling the cron
+// ones and dropping the others.
+func (s *Scheduler) due(onChain bool, now int64) []scheduler.Timer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fired := []scheduler.Timer{}
+	for key, t := range s.timers {
+		if t.OnChain != onChain || t.FireAt > now {
+			continue
+		}
+		fired = append(fired, *t)
+		if spec, ok := s.crons[key]; ok {
+			next, err := spec.next(time.UnixMilli(now))
+			if err == nil {
+				t.FireAt = next.UnixMilli()
+				s.persist(t)
+				continue
+			}
+			log.Println("timer", key, "has no next run:", err)
+		}
+		delete(s.timers, key)
+		delete(s.crons, key)
+		s.remove(t.MachineId, t.Name)
+	}
+	sort.Slice(fired, func(i, j int) bool {
+		if fired[i].FireAt == fired[j].FireAt {
+			return timerKey(fired[i].MachineId, fired[i].Name) < timerKey(fired[j].MachineId, fired[j].Name)
+		}
+		return fired[i].FireAt < fired[j].FireAt
+	})
+	return fired
+}
+
+func (s *Scheduler) nextLocal() (time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	next := int64(0)
+	for _, t := range s.timers {
+		if !t.OnChain && (next == 0 || t.FireAt < next) {
+			next = t.FireAt
+		}
+	}
+	if next == 0 {
+		return 0, false
+	}
+	return max(time.Duration(next-time.Now().UnixMilli())*time.Millisecond, 0), true
+}
+
+func (s *Scheduler) onBlock(blockTime int64) {
+	if blockTime <= s.blockTime.Load() {
+		return
+	}
+	s.blockTime.Store(blockTime)
+	s.lock.Lock()
+	started := s.started
+	s.lock.Unlock()
+	if !started {
+		return
+	}
+	for _, t := range s.due(true, blockTime) {
+		s.fire(t)
+	}
+}
+
+func (s *Scheduler) fire(t scheduler.Timer) {
+	future.Async(func() {
+		runtime := s.runtimeOf(t.MachineId)
+		// the machine may have been deployed again on another runtime since
+		if !schedulable[runtime] {
+			log.Println("cancelling timer", t.Name, "of", t.MachineId, ":", ErrRuntimeNotSchedulable, runtime)
+			s.Cancel(t.MachineId, t.Name)
+			return
+		}
+		if !s.app.Tools().Security().HasAccessToPoint(t.MachineId, t.PointId) {
+			log.Println("timer", t.Name, "of", t.MachineId, "has no access to point", t.PointId)
+			return
+		}
+		s.app.Tools().Wasm().RunVm(t.MachineId, t.PointId, t.Input)
+	}, false)
+}
+
+// Start begins firing timers, once the machines they run are assigned.
+func (s *Scheduler) Start() {
+	s.lock.Lock()
+	if s.started {
+		s.lock.Unlock()
+		return
+	}
+	s.started = true
+	s.lock.Unlock()
+	future.Async(func() {
+		for {
+			for _, t := range s.due(false, time.Now().UnixMilli()) {
+				s.fire(t)
+			}
+			wait, ok := s.nextLocal()
+			if !ok {
+				wait = time.Hour
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-s.done:
+				timer.Stop()
+				return
+			case <-s.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+	}, false)
+}
+
+func (s *Scheduler) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
@@ -0,0 +1,187 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"kasper/src/abstract/adapters/scheduler"
+	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/trx"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// runtimeTrx reads the runtime of every machine from a map.
+type runtimeTrx struct {
+	trx.ITrx
+	runtimes map[string]string
+}
+
+func (t runtimeTrx) GetObj(typ string, key string) map[string][]byte {
+	if runtime, ok := t.runtimes[key]; ok {
+		return map[string][]byte{"machineId": []byte(key), "runtime": []byte(runtime)}
+	}
+	return map[string][]byte{}
+}
+
+type runtimeCore struct {
+	core.ICore
+	runtimes map[string]string
+}
+
+func (c runtimeCore) ModifyState(_ bool, fn func(trx.ITrx) error) {
+	fn(runtimeTrx{runtimes: c.runtimes})
+}
+
+func openTestDb(t *testing.T) *badger.DB {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestScheduler is a scheduler over db that is not started, where m1 and
+// m2 run on wasm and d1 on docker.
+func newTestScheduler(db *badger.DB) *Scheduler {
+	s := &Scheduler{
+		app:    runtimeCore{runtimes: map[string]string{"m1": "wasm", "m2": "wasm", "d1": "docker"}},
+		db:     db,
+		timers: map[string]*scheduler.Timer{},
+		crons:  map[string]*cronSpec{},
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	s.load()
+	return s
+}
+
+func TestScheduleRejectsInvalidTimers(t *testing.T) {
+	s := newTestScheduler(openTestDb(t))
+	cases := map[string]scheduler.Timer{
+		"no machine":        {Name: "t"},
+		"no name":           {MachineId: "m1"},
+		"long name":         {MachineId: "m1", Name: strings.Repeat("t", MaxTimerNameLength+1)},
+		"docker machine":    {MachineId: "d1", Name: "t"},
+		"unknown machine":   {MachineId: "x", Name: "t"},
+		"bad cron":          {MachineId: "m1", Name: "t", Cron: "* * *"},
+		"no block to start": {MachineId: "m1", Name: "t", OnChain: true},
+	}
+	for name, timer := range cases {
+		if _, err := s.Schedule(timer, time.Minute); err == nil {
+			t.Fatalf("%s: timer scheduled", name)
+		}
+	}
+	if _, err := s.Schedule(scheduler.Timer{MachineId: "d1", Name: "t"}, time.Minute); !errors.Is(err, ErrRuntimeNotSchedulable) {
+		t.Fatalf("docker machine scheduled with %v", err)
+	}
+	if len(s.List("m1")) != 0 {
+		t.Fatalf("rejected timers were kept")
+	}
+}
+
+func TestScheduleOnChainCountsFromItsBlock(t *testing.T) {
+	s := newTestScheduler(openTestDb(t))
+	timer, err := s.Schedule(scheduler.Timer{MachineId: "m1", Name: "t", OnChain: true, CreatedAt: 1_000_000}, time.Minute)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if timer.FireAt != 1_000_000+time.Minute.Milliseconds() {
+		t.Fatalf("fires at %d", timer.FireAt)
+	}
+	cron, err := s.Schedule(scheduler.Timer{MachineId: "m1", Name: "c", OnChain: true, CreatedAt: mustTime(t, "2026-03-01T10:07:00Z").UnixMilli(), Cron: "*/15 * * * *"}, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if cron.FireAt != mustTime(t, "2026-03-01T10:15:00Z").UnixMilli() {
+		t.Fatalf("cron fires at %d", cron.FireAt)
+	}
+}
+
+func TestScheduleLimitsTimersPerMachine(t *testing.T) {
+	t.Setenv("SCHEDULER_MAX_TIMERS", "2")
+	s := newTestScheduler(openTestDb(t))
+	for i := 0; i < 2; i++ {
+		if _, err := s.Schedule(scheduler.Timer{MachineId: "m1", Name: fmt.Sprintf("t%d", i)}, time.Hour); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if _, err := s.Schedule(scheduler.Timer{MachineId: "m1", Name: "t2"}, time.Hour); !errors.Is(err, ErrTooManyTimers) {
+		t.Fatalf("third timer scheduled with %v", err)
+	}
+	if _, err := s.Schedule(scheduler.Timer{MachineId: "m1", Name: "t1", Input: "again"}, time.Hour); err != nil {
+		t.Fatalf("replacing a timer failed: %v", err)
+	}
+	if _, err := s.Schedule(scheduler.Timer{MachineId: "m2", Name: "t0"}, time.Hour); err != nil {
+		t.Fatalf("timer of another machine failed: %v", err)
+	}
+	if timers := s.List("m1"); len(timers) != 2 {
+		t.Fatalf("timers %v", timers)
+	}
+}
+
+func TestTimersSurviveRestart(t *testing.T) {
+	db := openTestDb(t)
+	s := newTestScheduler(db)
+	s.Schedule(scheduler.Timer{MachineId: "m1", Name: "late", Input: "x"}, 2*time.Hour)
+	s.Schedule(scheduler.Timer{MachineId: "m1", Name: "soon"}, time.Hour)
+	s.Schedule(scheduler.Timer{MachineId: "m1", Name: "cron", Cron: "0 0 1 1 *"}, 0)
+	s.Schedule(scheduler.Timer{MachineId: "m1", Name: "gone"}, time.Hour)
+	if !s.Cancel("m1", "gone") || s.Cancel("m1", "gone") {
+		t.Fatalf("cancel did not remove the timer once")
+	}
+
+	restarted := newTestScheduler(db)
+	timers := restarted.List("m1")
+	if len(timers) != 3 || timers[0].Name != "soon" || timers[1].Name != "late" || timers[1].Input != "x" {
+		t.Fatalf("timers after restart %+v", timers)
+	}
+	if _, ok := restarted.crons[timerKey("m1", "cron")]; !ok {
+		t.Fatalf("cron of a loaded timer not parsed")
+	}
+}
+
+func TestDueFiresByItsOwnClock(t *testing.T) {
+	db := openTestDb(t)
+	s := newTestScheduler(db)
+	at := mustTime(t, "2026-03-01T10:07:00Z").UnixMilli()
+	s.Schedule(scheduler.Timer{MachineId: "m1", Name: "once", OnChain: true, CreatedAt: at}, time.Minute)
+	s.Schedule(scheduler.Timer{MachineId: "m2", Name: "cron", OnChain: true, CreatedAt: at, Cron: "*/15 * * * *"}, 0)
+	s.Schedule(scheduler.Timer{MachineId: "m1", Name: "local"}, 0)
+
+	if fired := s.due(true, at+time.Minute.Milliseconds()-1); len(fired) != 0 {
+		t.Fatalf("fired early %v", fired)
+	}
+	fired := s.due(true, mustTime(t, "2026-03-01T10:15:00Z").UnixMilli())
+	if len(fired) != 2 || fired[0].Name != "once" || fired[1].Name != "cron" {
+		t.Fatalf("fired %+v", fired)
+	}
+	if timers := s.List("m1"); len(timers) != 1 || timers[0].Name != "local" {
+		t.Fatalf("fired on chain timer kept or local timer fired by a block: %+v", timers)
+	}
+	if timers := s.List("m2"); len(timers) != 1 || timers[0].FireAt != mustTime(t, "2026-03-01T10:30:00Z").UnixMilli() {
+		t.Fatalf("cron not rescheduled: %+v", timers)
+	}
+	if timers := newTestScheduler(db).List("m1"); len(timers) != 1 {
+		t.Fatalf("fired timer still stored: %+v", timers)
+	}
+}
+
+func TestBlocksBeforeStartFireNothing(t *testing.T) {
+	s := newTestScheduler(openTestDb(t))
+	s.Schedule(scheduler.Timer{MachineId: "m1", Name: "t", OnChain: true, CreatedAt: 1000}, time.Second)
+	s.onBlock(10_000)
+	if len(s.List("m1")) != 1 {
+		t.Fatalf("timer fired before the scheduler started")
+	}
+	if s.blockTime.Load() != 10_000 {
+		t.Fatalf("block time not tracked")
+	}
+	s.onBlock(5_000)
+	if s.blockTime.Load() != 10_000 {
+		t.Fatalf("block time went back")
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"kasper/src/abstract/adapters/security"
 	"kasper/src/abstract/adapters/signaler"
@@ -18,16 +20,45 @@ import (
 	"kasper/src/shell/utils/vaidate"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
 )
 
 type Security struct {
-	app         core.ICore
-	storage     storage.IStorage
-	signaler    signaler.ISignaler
-	storageRoot string
-	keys        map[string][][]byte
+	app              core.ICore
+	storage          storage.IStorage
+	signaler         signaler.ISignaler
+	storageRoot      string
+	keys             map[string][][]byte
+	rotations        map[string][]security.KeyRotation
+	serverKeyVersion int64
+	freshnessWindow  time.Duration
+}
+
+// SignedEnvelope is the header a client signs together with the payload, so a
+// captured packet can not be replayed on another path, after its freshness
+// window or a second time with the same nonce.
+//
+// On the wire the signature field carries "v2.<base64 header json>.<base64 sig>"
+// and the signed message is "<base64 header json>." followed by the payload.
+type SignedEnvelope struct {
+	Path     string `json:"path"`
+	PacketId string `json:"packetId"`
+	IssuedAt int64  `json:"issuedAt"`
+	Nonce    string `json:"nonce"`
 }
 
+const envelopePrefix = "v2."
+
+// LegacySignaturesUntil is the time, in unix milliseconds, from which packets
+// signed without an envelope are rejected. Requests applied from the chain
+// compare it with the time of their block, so it is a rule of the chain and
+// not a setting of a node.
+var LegacySignaturesUntil = time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
 type AuthHolder struct {
 	Token string `json:"token"`
 }
@@ -46,6 +77,11 @@ type Location struct {
 
 const keysFolderName = "keys"
 
+// Raising SERVER_KEY_VERSION rotates the server key on start up until it has
+// that version. The rotations are kept next to the key and served with it, so
+// orgs holding an older key can follow them to the current one.
+const rotationsFileName = "rotations.json"
+
 func (sm *Security) LoadKeys() {
 	files, err := os.ReadDir(sm.storageRoot + "/keys")
 	if err != nil {
@@ -64,11 +100,70 @@ func (sm *Security) LoadKeys() {
 				continue
 			}
 			sm.keys[file.Name()] = [][]byte{priKey, pubKey}
+			if data, err := os.ReadFile(sm.keyFolder(file.Name()) + "/" + rotationsFileName); err == nil {
+				rotations := []security.KeyRotation{}
+				if err := json.Unmarshal(data, &rotations); err != nil {
+					log.Println(err)
+					continue
+				}
+				sm.rotations[file.Name()] = rotations
+			}
 		}
 	}
 	if sm.FetchKeyPair("server_key") == nil {
 		sm.GenerateSecureKeyPair("server_key")
 	}
+	for sm.keyVersion("server_key") < sm.serverKeyVersion {
+		if err := sm.rotateKeyPair("server_key"); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (sm *Security) keyFolder(tag string) string {
+	return sm.storageRoot + "/" + keysFolderName + "/" + tag
+}
+
+func (sm *Security) keyVersion(tag string) int64 {
+	rotations := sm.rotations[tag]
+	if len(rotations) == 0 {
+		return 0
+	}
+	return rotations[len(rotations)-1].Version
+}
+
+// rotateKeyPair replaces a key pair with a new one and records the rotation
+// signed by the key it replaces.
+func (sm *Security) rotateKeyPair(tag string) error {
+	old := sm.keys[tag]
+	priKey, pubKey := cryp.SecureKeyPairs("")
+	version := sm.keyVersion(tag) + 1
+	proof, err := cryp.Sign(old[0], security.KeyRotationMessage(version, string(pubKey)))
+	if err != nil {
+		return err
+	}
+	rotations := append(sm.rotations[tag], security.KeyRotation{Version: version, PublicKey: string(pubKey), Proof: proof})
+	data, err := json.Marshal(rotations)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(sm.keyFolder(tag)+"/"+rotationsFileName, data, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(sm.keyFolder(tag)+"/public.pem", pubKey, 0644); err != nil {
+		return err
+	}
+	// the key generated first was written readable by everyone, and WriteFile
+	// keeps the mode of a file it overwrites
+	if err := os.Chmod(sm.keyFolder(tag)+"/private.pem", 0600); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.WriteFile(sm.keyFolder(tag)+"/private.pem", priKey, 0600); err != nil {
+		return err
+	}
+	sm.keys[tag] = [][]byte{priKey, pubKey}
+	sm.rotations[tag] = rotations
+	return nil
 }
 
 func (sm *Security) GenerateSecureKeyPair(tag string) {
@@ -80,6 +175,10 @@ func (sm *Security) FetchKeyPair(tag string) [][]byte {
 	return sm.keys[tag]
 }
 
+func (sm *Security) KeyRotations(tag string) []security.KeyRotation {
+	return sm.rotations[tag]
+}
+
 func (sm *Security) Encrypt(tag string, plainText string) string {
 	publicKeyPEM := sm.keys[tag][1]
 	publicKeyBlock, _ := pem.Decode(publicKeyPEM)
@@ -146,6 +245,91 @@ func (sm *Security) AuthWithSignature(userId string, packet []byte, signatureBas
 	return true, userType, isGod
 }
 
+// verifyEnvelope checks the signature of a packet and the path and packet id
+// it is bound to, and returns the envelope it was signed with. A packet
+// without an envelope passes only when at is before LegacySignaturesUntil.
+func (sm *Security) verifyEnvelope(userId string, path string, packetId string, packet []byte, signature string, at int64) (*SignedEnvelope, bool, string, bool) {
+	if !strings.HasPrefix(signature, envelopePrefix) {
+		if at >= LegacySignaturesUntil {
+			log.Println("legacy signature rejected for user", userId)
+			return nil, false, "", false
+		}
+		success, userType, isGod := sm.AuthWithSignature(userId, packet, signature)
+		return nil, success, userType, isGod
+	}
+	parts := strings.Split(signature[len(envelopePrefix):], ".")
+	if len(parts) != 2 {
+		return nil, false, "", false
+	}
+	headerRaw, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		log.Println(err)
+		return nil, false, "", false
+	}
+	envelope := SignedEnvelope{}
+	if err := json.Unmarshal(headerRaw, &envelope); err != nil {
+		log.Println(err)
+		return nil, false, "", false
+	}
+	if path != "" && envelope.Path != path {
+		log.Println("signed envelope path mismatch:", envelope.Path, path)
+		return nil, false, "", false
+	}
+	if packetId != "" && envelope.PacketId != packetId {
+		log.Println("signed envelope packet id mismatch:", envelope.PacketId, packetId)
+		return nil, false, "", false
+	}
+	message := append([]byte(parts[0]+"."), packet...)
+	success, userType, isGod := sm.AuthWithSignature(userId, message, parts[1])
+	if !success {
+		return nil, false, "", false
+	}
+	return &envelope, true, userType, isGod
+}
+
+func (sm *Security) AuthWithEnvelope(userId string, path string, packetId string, packet []byte, signature string) (bool, string, bool) {
+	envelope, success, userType, isGod := sm.verifyEnvelope(userId, path, packetId, packet, signature, time.Now().UnixMilli())
+	if !success || envelope == nil {
+		return success, userType, isGod
+	}
+	if envelope.Nonce == "" {
+		return false, "", false
+	}
+	age := time.Since(time.UnixMilli(envelope.IssuedAt))
+	if age > sm.freshnessWindow || age < -sm.freshnessWindow {
+		log.Println("signed envelope expired for user", userId)
+		return false, "", false
+	}
+	if err := sm.consumeNonce(userId, envelope.Nonce); err != nil {
+		log.Println(err)
+		return false, "", false
+	}
+	return true, userType, isGod
+}
+
+// VerifyEnvelope checks only the signature and the path binding of a packet.
+// It is used for requests applied from the chain: their freshness and nonce
+// were checked once by the node they entered through, and checking them again
+// would make every node decide on its own clock and nonce store.
+func (sm *Security) VerifyEnvelope(userId string, path string, packet []byte, signature string) (bool, string, bool) {
+	_, success, userType, isGod := sm.verifyEnvelope(userId, path, "", packet, signature, sm.app.ChainTime())
+	return success, userType, isGod
+}
+
+// consumeNonce records the nonce of a user in badger for twice the freshness
+// window, failing when it has already been seen.
+func (sm *Security) consumeNonce(userId string, nonce string) error {
+	key := []byte("nonce::" + userId + "::" + nonce)
+	return sm.storage.KvDb().Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(key); err == nil {
+			return errors.New("replayed nonce for user " + userId)
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		return txn.SetEntry(badger.NewEntry(key, []byte{0x01}).WithTTL(2 * sm.freshnessWindow))
+	})
+}
+
 func (sm *Security) HasAccessToPoint(userId string, pointId string) bool {
 	if pointId == "" {
 		return false
@@ -162,12 +346,23 @@ func (sm *Security) HasAccessToPoint(userId string, pointId string) bool {
 
 func New(core core.ICore, storageRoot string, storage storage.IStorage, signaler signaler.ISignaler) security.ISecurity {
 	vaidate.LoadValidationSystem()
+	window := int64(300)
+	if w, err := strconv.ParseInt(os.Getenv("SIGNATURE_FRESHNESS_WINDOW"), 10, 64); err == nil && w > 0 {
+		window = w
+	}
+	keyVersion := int64(0)
+	if v, err := strconv.ParseInt(os.Getenv("SERVER_KEY_VERSION"), 10, 64); err == nil && v > 0 {
+		keyVersion = v
+	}
 	s := &Security{
-		app:         core,
-		storage:     storage,
-		signaler:    signaler,
-		storageRoot: storageRoot,
-		keys:        make(map[string][][]byte),
+		app:              core,
+		storage:          storage,
+		signaler:         signaler,
+		storageRoot:      storageRoot,
+		keys:             make(map[string][][]byte),
+		rotations:        make(map[string][]security.KeyRotation),
+		serverKeyVersion: keyVersion,
+		freshnessWindow:  time.Duration(window) * time.Second,
 	}
 	s.LoadKeys()
 	return s
@@ -0,0 +1,170 @@
+package security
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"kasper/src/abstract/adapters/security"
+	"kasper/src/abstract/adapters/storage"
+	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/trx"
+	module_trx "kasper/src/core/module/actor/model/trx"
+	cryp "kasper/src/shell/utils/crypto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+type testStorage struct {
+	storage.IStorage
+	db *badger.DB
+}
+
+func (s testStorage) KvDb() *badger.DB {
+	return s.db
+}
+
+type testCore struct {
+	core.ICore
+	storage   testStorage
+	chainTime int64
+}
+
+func (c *testCore) ModifyState(readonly bool, fn func(trx.ITrx) error) {
+	tx := module_trx.NewTrx(c, c.storage, readonly)
+	if err := fn(tx); err != nil {
+		tx.Discard()
+		return
+	}
+	tx.Commit()
+}
+
+func (c *testCore) ChainTime() int64 {
+	return c.chainTime
+}
+
+// newTestSecurity is a security driver knowing user u1, whose private key it
+// returns.
+func newTestSecurity(t *testing.T) (*Security, *testCore, []byte) {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	app := &testCore{storage: testStorage{db: db}}
+	priv, pub := cryp.SecureKeyPairs("")
+	app.ModifyState(false, func(trx trx.ITrx) error {
+		trx.PutString("obj::User::u1::publicKey", string(pub))
+		return nil
+	})
+	return &Security{app: app, storage: app.storage, freshnessWindow: time.Minute}, app, priv
+}
+
+func sign(t *testing.T, priv []byte, envelope SignedEnvelope, payload string) string {
+	header, _ := json.Marshal(envelope)
+	encoded := base64.StdEncoding.EncodeToString(header)
+	signature, err := cryp.Sign(priv, append([]byte(encoded+"."), payload...))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return envelopePrefix + encoded + "." + signature
+}
+
+func TestEnvelopeFreshness(t *testing.T) {
+	sm, _, priv := newTestSecurity(t)
+	now := time.Now()
+	cases := map[string]struct {
+		issuedAt time.Time
+		want     bool
+	}{
+		"fresh":       {now, true},
+		"recent":      {now.Add(-50 * time.Second), true},
+		"expired":     {now.Add(-2 * time.Minute), false},
+		"from future": {now.Add(2 * time.Minute), false},
+	}
+	for name, c := range cases {
+		signature := sign(t, priv, SignedEnvelope{Path: "/p", Nonce: name, IssuedAt: c.issuedAt.UnixMilli()}, "{}")
+		if ok, _, _ := sm.AuthWithEnvelope("u1", "/p", "", []byte("{}"), signature); ok != c.want {
+			t.Fatalf("%s packet accepted: %v", name, ok)
+		}
+	}
+}
+
+func TestEnvelopeBinding(t *testing.T) {
+	sm, _, priv := newTestSecurity(t)
+	signature := sign(t, priv, SignedEnvelope{Path: "/p", PacketId: "1", Nonce: "n", IssuedAt: time.Now().UnixMilli()}, "{}")
+	if ok, _, _ := sm.AuthWithEnvelope("u1", "/other", "1", []byte("{}"), signature); ok {
+		t.Fatalf("packet replayed on another path")
+	}
+	if ok, _, _ := sm.AuthWithEnvelope("u1", "/p", "2", []byte("{}"), signature); ok {
+		t.Fatalf("packet replayed with another packet id")
+	}
+	if ok, _, _ := sm.AuthWithEnvelope("u1", "/p", "1", []byte(`{"a":1}`), signature); ok {
+		t.Fatalf("signature accepted for another payload")
+	}
+	if ok, _, _ := sm.AuthWithEnvelope("u1", "/p", "1", []byte("{}"), sign(t, priv, SignedEnvelope{Path: "/p", PacketId: "1", IssuedAt: time.Now().UnixMilli()}, "{}")); ok {
+		t.Fatalf("packet without a nonce accepted")
+	}
+}
+
+func TestEnvelopeNonceReuse(t *testing.T) {
+	sm, _, priv := newTestSecurity(t)
+	signature := sign(t, priv, SignedEnvelope{Path: "/p", Nonce: "n1", IssuedAt: time.Now().UnixMilli()}, "{}")
+	if ok, _, _ := sm.AuthWithEnvelope("u1", "/p", "", []byte("{}"), signature); !ok {
+		t.Fatalf("first use of a nonce rejected")
+	}
+	if ok, _, _ := sm.AuthWithEnvelope("u1", "/p", "", []byte("{}"), signature); ok {
+		t.Fatalf("packet replayed with the same nonce")
+	}
+	// a packet applied from the chain was checked by its entry node
+	if ok, _, _ := sm.VerifyEnvelope("u1", "/p", []byte("{}"), signature); !ok {
+		t.Fatalf("packet from the chain checked against the nonce store")
+	}
+	other := sign(t, priv, SignedEnvelope{Path: "/p", Nonce: "n2", IssuedAt: time.Now().UnixMilli()}, "{}")
+	if ok, _, _ := sm.AuthWithEnvelope("u1", "/p", "", []byte("{}"), other); !ok {
+		t.Fatalf("packet with a new nonce rejected")
+	}
+}
+
+func TestLegacySignaturesUntilCutover(t *testing.T) {
+	defer func(until int64) { LegacySignaturesUntil = until }(LegacySignaturesUntil)
+	sm, app, priv := newTestSecurity(t)
+	signature, _ := cryp.Sign(priv, []byte("{}"))
+
+	LegacySignaturesUntil = time.Now().Add(time.Hour).UnixMilli()
+	if ok, _, _ := sm.AuthWithEnvelope("u1", "/p", "", []byte("{}"), signature); !ok {
+		t.Fatalf("legacy signature rejected before the cutover")
+	}
+	app.chainTime = LegacySignaturesUntil - 1
+	if ok, _, _ := sm.VerifyEnvelope("u1", "/p", []byte("{}"), signature); !ok {
+		t.Fatalf("legacy signature rejected in a block before the cutover")
+	}
+	app.chainTime = LegacySignaturesUntil
+	if ok, _, _ := sm.VerifyEnvelope("u1", "/p", []byte("{}"), signature); ok {
+		t.Fatalf("legacy signature accepted in a block at the cutover")
+	}
+
+	LegacySignaturesUntil = time.Now().Add(-time.Hour).UnixMilli()
+	if ok, _, _ := sm.AuthWithEnvelope("u1", "/p", "", []byte("{}"), signature); ok {
+		t.Fatalf("legacy signature accepted after the cutover")
+	}
+}
+
+func TestRotatedPrivateKeyIsPrivate(t *testing.T) {
+	sm, _, _ := newTestSecurity(t)
+	sm.storageRoot = t.TempDir()
+	sm.keys = map[string][][]byte{}
+	sm.rotations = map[string][]security.KeyRotation{}
+	sm.GenerateSecureKeyPair("server_key")
+	if err := sm.rotateKeyPair("server_key"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	info, err := os.Stat(sm.keyFolder("server_key") + "/private.pem")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("rotated private key written with mode %v", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,284 @@
+package signaler
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"kasper/src/abstract/adapters/signaler"
+	"kasper/src/shell/utils/crypto"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+func outboxPrefix(userId string) string {
+	return "outbox::" + userId + "::"
+}
+
+func outboxKey(userId string, seq uint64) string {
+	return fmt.Sprintf("%s%020d", outboxPrefix(userId), seq)
+}
+
+func outboxSeqKey(userId string) string {
+	return "outboxseq::" + userId
+}
+
+func outboxDataKey(ref string) string {
+	return "outboxdata::" + ref
+}
+
+// userLock is the lock of a user, counting the callers holding or waiting for
+// it so that it is dropped once none is left.
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (p *Signaler) lockUser(userId string) *userLock {
+	lock := p.userLocks.Upsert(userId, nil, func(exist bool, old *userLock, _ *userLock) *userLock {
+		if !exist {
+			old = &userLock{}
+		}
+		old.refs++
+		return old
+	})
+	lock.Lock()
+	return lock
+}
+
+// unlockUser releases the lock of a user. The last caller to release it drops
+// the lock along with the sequence cached for the user.
+func (p *Signaler) unlockUser(userId string, lock *userLock) {
+	lock.Unlock()
+	p.userLocks.RemoveCb(userId, func(_ string, held *userLock, exists bool) bool {
+		if !exists || held != lock {
+			return false
+		}
+		held.refs--
+		if held.refs > 0 {
+			return false
+		}
+		p.seqs.Remove(userId)
+		return true
+	})
+}
+
+func (p *Signaler) lastSeq(txn *badger.Txn, userId string) (uint64, error) {
+	item, err := txn.Get([]byte(outboxSeqKey(userId)))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var seq uint64
+	err = item.Value(func(val []byte) error {
+		seq = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	return seq, err
+}
+
+// nextSeq hands out the next sequence of a user. The last sequence is read
+// from badger and kept in memory while the user's lock is held, so the caller
+// must hold it.
+func (p *Signaler) nextSeq(userId string) (uint64, error) {
+	seq, found := p.seqs.Get(userId)
+	if !found {
+		err := p.storage.KvDb().View(func(txn *badger.Txn) error {
+			var err error
+			seq, err = p.lastSeq(txn, userId)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	seq++
+	p.seqs.Set(userId, seq)
+	return seq, nil
+}
+
+// appendOutbox records an update in the outboxes of the given users in a
+// single write batch and returns the sequence each of them got. It is kept
+// until acknowledged or for OUTBOX_RETENTION, and an update for several users
+// is stored once and referenced from each outbox. The caller holds the locks
+// of all the users.
+func (p *Signaler) appendOutbox(userIds []string, key string, data []byte) (map[string]uint64, error) {
+	retention := 7 * 24 * time.Hour
+	if secs, err := strconv.ParseInt(os.Getenv("OUTBOX_RETENTION"), 10, 64); err == nil && secs > 0 {
+		retention = time.Duration(secs) * time.Second
+	}
+	batch := p.storage.KvDb().NewWriteBatch()
+	fail := func(err error) (map[string]uint64, error) {
+		batch.Cancel()
+		return nil, err
+	}
+	ref := ""
+	if len(userIds) > 1 {
+		ref = crypto.SecureUniqueString()
+		if err := batch.SetEntry(badger.NewEntry([]byte(outboxDataKey(ref)), data).WithTTL(retention)); err != nil {
+			return fail(err)
+		}
+	}
+	now := time.Now().UnixMilli()
+	seqs := map[string]uint64{}
+	for _, userId := range userIds {
+		seq, err := p.nextSeq(userId)
+		if err != nil {
+			return fail(err)
+		}
+		entry := signaler.OutboxEntry{Seq: seq, Key: key, Time: now}
+		if ref != "" {
+			entry.Ref = ref
+		} else {
+			entry.Data = data
+		}
+		b, _ := json.Marshal(entry)
+		if err := batch.SetEntry(badger.NewEntry([]byte(outboxKey(userId, seq)), b).WithTTL(retention)); err != nil {
+			return fail(err)
+		}
+		seqBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(seqBytes, seq)
+		if err := batch.Set([]byte(outboxSeqKey(userId)), seqBytes); err != nil {
+			return fail(err)
+		}
+		seqs[userId] = seq
+	}
+	if err := batch.Flush(); err != nil {
+		return nil, err
+	}
+	return seqs, nil
+}
+
+func (p *Signaler) readOutbox(userId string, afterSeq uint64) ([]signaler.OutboxEntry, uint64) {
+	entries := []signaler.OutboxEntry{}
+	var last uint64
+	p.storage.KvDb().View(func(txn *badger.Txn) error {
+		var err error
+		last, err = p.lastSeq(txn, userId)
+		if err != nil {
+			return err
+		}
+		prefix := []byte(outboxPrefix(userId))
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek([]byte(outboxKey(userId, afterSeq+1))); it.ValidForPrefix(prefix); it.Next() {
+			entry := signaler.OutboxEntry{}
+			if err := it.Item().Value(func(val []byte) error { return json.Unmarshal(val, &entry) }); err != nil {
+				log.Println(err)
+				continue
+			}
+			if entry.Ref != "" {
+				item, err := txn.Get([]byte(outboxDataKey(entry.Ref)))
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				if entry.Data, err = item.ValueCopy(nil); err != nil {
+					log.Println(err)
+					continue
+				}
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, last
+}
+
+// Ack drops the updates of a user up to seq, once its client confirmed it got
+// them. Payloads shared with other members of a group are left to expire.
+func (p *Signaler) Ack(userId string, seq uint64) {
+	lock := p.lockUser(userId)
+	defer p.unlockUser(userId, lock)
+	keys := [][]byte{}
+	p.storage.KvDb().View(func(txn *badger.Txn) error {
+		prefix := []byte(outboxPrefix(userId))
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		end := []byte(outboxKey(userId, seq))
+		for it.Rewind(); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if string(key) > string(end) {
+				break
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if len(keys) == 0 {
+		return
+	}
+	batch := p.storage.KvDb().NewWriteBatch()
+	for _, key := range keys {
+		if err := batch.Delete(key); err != nil {
+			log.Println(err)
+			batch.Cancel()
+			return
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		log.Println(err)
+	}
+}
+
+// deliver records a packed update in the outboxes of local users and hands it
+// to the listeners attached for them. Both happen under the users' locks, taken
+// in a fixed order, so that a concurrent Resume never misses or reorders an
+// update.
+func (p *Signaler) deliver(userIds []string, key string, packet any) {
+	userIds = slices.Clone(userIds)
+	sort.Strings(userIds)
+	userIds = slices.Compact(userIds)
+	for _, userId := range userIds {
+		lock := p.lockUser(userId)
+		defer p.unlockUser(userId, lock)
+	}
+	data, durable := packet.([]byte)
+	seqs := map[string]uint64{}
+	if durable {
+		var err error
+		if seqs, err = p.appendOutbox(userIds, key, data); err != nil {
+			log.Println(err)
+			durable = false
+		}
+	}
+	for _, userId := range userIds {
+		listener, found := p.listeners.Get(userId)
+		if !found || listener == nil {
+			continue
+		}
+		if durable && listener.SignalSeq != nil {
+			listener.SignalSeq(seqs[userId], key, packet)
+		} else {
+			listener.Signal(key, packet)
+		}
+	}
+}
+
+// Resume attaches a listener and replays every retained update after afterSeq
+// to it, returning the sequence of the last update that existed at that point.
+func (p *Signaler) Resume(listener *signaler.Listener, afterSeq uint64) uint64 {
+	lock := p.lockUser(listener.Id)
+	defer p.unlockUser(listener.Id, lock)
+	entries, last := p.readOutbox(listener.Id, afterSeq)
+	if seq, found := p.seqs.Get(listener.Id); found && seq > last {
+		last = seq
+	}
+	p.ListenToSingle(listener)
+	for _, entry := range entries {
+		listener.SignalSeq(entry.Seq, entry.Key, entry.Data)
+	}
+	return last
+}
@@ -0,0 +1,71 @@
+package signaler
+
+import (
+	"kasper/src/abstract/adapters/signaler"
+	"kasper/src/abstract/adapters/storage"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+type testStorage struct {
+	storage.IStorage
+	db *badger.DB
+}
+
+func (s testStorage) KvDb() *badger.DB {
+	return s.db
+}
+
+func newTestSignaler(t *testing.T) *Signaler {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewSignaler(nil, testStorage{db: db}, nil).(*Signaler)
+}
+
+func TestOutboxDropsLocksOfIdleUsers(t *testing.T) {
+	p := newTestSignaler(t)
+	p.deliver([]string{"u1", "u2"}, "k", []byte("a"))
+	if p.userLocks.Count() != 0 || p.seqs.Count() != 0 {
+		t.Fatalf("%d locks and %d sequences kept after delivery", p.userLocks.Count(), p.seqs.Count())
+	}
+	p.deliver([]string{"u1"}, "k", []byte("b"))
+	p.Ack("u2", 1)
+	if p.userLocks.Count() != 0 || p.seqs.Count() != 0 {
+		t.Fatalf("%d locks and %d sequences kept after ack", p.userLocks.Count(), p.seqs.Count())
+	}
+	entries, last := p.readOutbox("u1", 0)
+	if last != 2 || len(entries) != 2 || entries[1].Seq != 2 || string(entries[1].Data) != "b" {
+		t.Fatalf("outbox of u1 %+v up to %d", entries, last)
+	}
+}
+
+func TestOutboxSequencesUnderConcurrency(t *testing.T) {
+	p := newTestSignaler(t)
+	seqs := make(chan uint64, 100)
+	p.ListenToSingle(&signaler.Listener{Id: "u1", Signal: func(string, any) {}, SignalSeq: func(seq uint64, _ string, _ any) { seqs <- seq }})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.deliver([]string{"u1", "u2"}, "k", []byte("x"))
+		}()
+	}
+	wg.Wait()
+	close(seqs)
+	seen := map[uint64]bool{}
+	for seq := range seqs {
+		if seen[seq] || seq < 1 || seq > 100 {
+			t.Fatalf("sequence %d handed out twice or out of range", seq)
+		}
+		seen[seq] = true
+	}
+	if len(seen) != 100 || p.userLocks.Count() != 0 {
+		t.Fatalf("%d sequences delivered, %d locks kept", len(seen), p.userLocks.Count())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"kasper/src/abstract/adapters/network"
 	"kasper/src/abstract/adapters/signaler"
+	"kasper/src/abstract/adapters/storage"
 	"kasper/src/abstract/models/core"
 	"kasper/src/abstract/models/trx"
 	"log"
@@ -16,6 +17,9 @@ import (
 type Signaler struct {
 	lock           sync.Mutex
 	app            core.ICore
+	storage        storage.IStorage
+	userLocks      *cmap.ConcurrentMap[string, *userLock]
+	seqs           *cmap.ConcurrentMap[string, uint64]
 	listeners      *cmap.ConcurrentMap[string, *signaler.Listener]
 	groups         *cmap.ConcurrentMap[string, *signaler.Group]
 	GlobalBridge   *signaler.GlobalListener
@@ -79,25 +83,22 @@ func (p *Signaler) SignalUser(key string, listenerId string, data any, pack bool
 	}
 	origin := uParts[1]
 	if origin == p.app.Id() {
-		listener, found := p.listeners.Get(listenerId)
-		if found && (listener != nil) {
-			if pack {
-				var message string
-				switch d := data.(type) {
-				case string:
-					message = d
-				default:
-					msg, err := json.Marshal(d)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-					message = string(msg)
+		if pack {
+			var message string
+			switch d := data.(type) {
+			case string:
+				message = d
+			default:
+				msg, err := json.Marshal(d)
+				if err != nil {
+					log.Println(err)
+					return
 				}
-				listener.Signal(key, []byte(message))
-			} else {
-				listener.Signal(key, data)
+				message = string(msg)
 			}
+			p.deliver([]string{listenerId}, key, []byte(message))
+		} else {
+			p.deliver([]string{listenerId}, key, data)
 		}
 	} else {
 		p.Federation.SendFedUpdate(origin, key, data, "user", listenerId, []string{})
@@ -138,6 +139,7 @@ func (p *Signaler) SignalGroup(key string, groupId string, data any, pack bool,
 			return
 		}
 		var foreignersMap = map[string][]string{}
+		locals := []string{}
 		for t := range group.Points.IterBuffered() {
 			userId := t.Val
 			username := ""
@@ -157,21 +159,21 @@ func (p *Signaler) SignalGroup(key string, groupId string, data any, pack bool,
 			if (userOrigin == p.app.Id()) || (userOrigin == "global") {
 				if !p.LGroupDisabled || !group.Override {
 					if !excepDict[t.Key] {
-						listener, found := p.listeners.Get(userId)
-						if found && (listener != nil) {
-							listener.Signal(key, packet)
-						}
+						locals = append(locals, userId)
 					}
 				}
 			} else {
 				if foreignersMap[userOrigin] == nil {
 					foreignersMap[userOrigin] = []string{}
 				}
-				if excepDict[t.Key] {
+				if !excepDict[t.Key] {
 					foreignersMap[userOrigin] = append(foreignersMap[userOrigin], t.Val)
 				}
 			}
 		}
+		if len(locals) > 0 {
+			p.deliver(locals, key, packet)
+		}
 		for k, v := range foreignersMap {
 			p.Federation.SendFedUpdate(k, key, data, "point", groupId, v)
 		}
@@ -208,12 +210,17 @@ func (p *Signaler) RetriveGroup(groupId string) (*signaler.Group, bool) {
 	return p.groups.Get(groupId)
 }
 
-func NewSignaler(app core.ICore, federation network.IFederation) signaler.ISignaler {
+func NewSignaler(app core.ICore, storage storage.IStorage, federation network.IFederation) signaler.ISignaler {
 	log.Println("creating signaler...")
 	newMap := cmap.New[*signaler.Group]()
 	lisMap := cmap.New[*signaler.Listener]()
+	lockMap := cmap.New[*userLock]()
+	seqMap := cmap.New[uint64]()
 	return &Signaler{
 		app:            app,
+		storage:        storage,
+		userLocks:      &lockMap,
+		seqs:           &seqMap,
 		listeners:      &lisMap,
 		groups:         &newMap,
 		LGroupDisabled: false,
@@ -0,0 +1,232 @@
+package tool_storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"kasper/src/abstract/models/packet"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/google/uuid"
+)
+
+// BadgerLogStore keeps point and build logs in an embedded badger database so a
+// node can run without an external time-series server. Point logs are keyed by
+// (pointId, time, id) which lets history pages be read with a reverse scan.
+type BadgerLogStore struct {
+	db *badger.DB
+}
+
+func pointLogPrefix(pointId string) string {
+	return "log::" + pointId + "::"
+}
+
+func pointLogKey(pointId string, timeVal int64, id string) string {
+	return fmt.Sprintf("%s%020d::%s", pointLogPrefix(pointId), timeVal, id)
+}
+
+func pointLogIdKey(pointId string, id string) string {
+	return "logid::" + pointId + "::" + id
+}
+
+func buildLogPrefix(machineId string, buildId string) string {
+	return "buildlog::" + machineId + "::" + buildId + "::"
+}
+
+func (ls *BadgerLogStore) Close() error {
+	return ls.db.Close()
+}
+
+func (ls *BadgerLogStore) LogBuild(buildId string, machineId string, data string) packet.BuildPacket {
+	id := uuid.NewString()
+	packet := packet.BuildPacket{Id: id, BuildId: buildId, MachineId: machineId, Data: data}
+	b, _ := json.Marshal(packet)
+	key := fmt.Sprintf("%s%020d::%s", buildLogPrefix(machineId, buildId), time.Now().UnixNano(), id)
+	err := ls.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), b)
+	})
+	if err != nil {
+		log.Println("Insert error: " + err.Error())
+	}
+	return packet
+}
+
+func (ls *BadgerLogStore) ReadBuildLogs(buildId string, machineId string) []packet.BuildPacket {
+	logs := []packet.BuildPacket{}
+	ls.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(buildLogPrefix(machineId, buildId))
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			l := packet.BuildPacket{}
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &l)
+			})
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			logs = append(logs, l)
+		}
+		return nil
+	})
+	return logs
+}
+
+func (ls *BadgerLogStore) LogTimeSieries(pointId string, userId string, data string, timeVal int64) packet.LogPacket {
+	id := uuid.NewString()
+	packet := packet.LogPacket{Id: id, UserId: userId, Data: data, PointId: pointId, Time: timeVal, Edited: false}
+	b, _ := json.Marshal(packet)
+	key := pointLogKey(pointId, timeVal, id)
+	err := ls.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte(key), b); err != nil {
+			return err
+		}
+		return txn.Set([]byte(pointLogIdKey(pointId, id)), []byte(key))
+	})
+	if err != nil {
+		log.Println("Insert error: " + err.Error())
+	}
+	return packet
+}
+
+func (ls *BadgerLogStore) modifyLog(packet packet.LogPacket, fn func(*packet.LogPacket)) (packet.LogPacket, error) {
+	err := ls.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(pointLogIdKey(packet.PointId, packet.Id)))
+		if err != nil {
+			return err
+		}
+		key, _ := item.ValueCopy(nil)
+		item, err = txn.Get(key)
+		if err != nil {
+			return err
+		}
+		err = item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &packet)
+		})
+		if err != nil {
+			return err
+		}
+		fn(&packet)
+		b, _ := json.Marshal(packet)
+		return txn.Set(key, b)
+	})
+	return packet, err
+}
+
+func (ls *BadgerLogStore) UpdateLog(pointId string, userId string, signalId string, data string, timeVal int64) packet.LogPacket {
+	packet, err := ls.modifyLog(packet.LogPacket{Id: signalId, UserId: userId, PointId: pointId, Time: timeVal}, func(l *packet.LogPacket) {
+		l.Data = data
+		l.Edited = true
+	})
+	if err != nil {
+		log.Println("Update error: " + err.Error())
+	}
+	return packet
+}
+
+func (ls *BadgerLogStore) DeleteLog(pointId string, userId string, signalId string, timeVal int64) packet.LogPacket {
+	packet, err := ls.modifyLog(packet.LogPacket{Id: signalId, UserId: userId, PointId: pointId, Time: timeVal}, func(l *packet.LogPacket) {
+		l.Data = ""
+		l.Deleted = true
+	})
+	if err != nil {
+		log.Println("Delete error: " + err.Error())
+	}
+	return packet
+}
+
+func (ls *BadgerLogStore) ReadPointLogs(pointId string, beforeTime int64, count int) []packet.LogPacket {
+	logs := []packet.LogPacket{}
+	ls.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(pointLogPrefix(pointId))
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		var seek []byte
+		if beforeTime == 0 {
+			seek = append(append([]byte{}, prefix...), 0xFF)
+		} else {
+			seek = []byte(fmt.Sprintf("%s%020d", prefix, beforeTime))
+		}
+		for it.Seek(seek); it.ValidForPrefix(prefix) && len(logs) < count; it.Next() {
+			l := packet.LogPacket{}
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &l)
+			})
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			logs = append(logs, l)
+		}
+		return nil
+	})
+	return logs
+}
+
+func (ls *BadgerLogStore) PickPointLogs(pointId string, ids []string) []packet.LogPacket {
+	logs := []packet.LogPacket{}
+	ls.db.View(func(txn *badger.Txn) error {
+		for _, id := range ids {
+			item, err := txn.Get([]byte(pointLogIdKey(pointId, id)))
+			if err != nil {
+				continue
+			}
+			key, _ := item.ValueCopy(nil)
+			item, err = txn.Get(key)
+			if err != nil {
+				continue
+			}
+			l := packet.LogPacket{}
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &l)
+			})
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			logs = append(logs, l)
+		}
+		return nil
+	})
+	return logs
+}
+
+// EachPointLog calls fn with every point log of every point.
+func (ls *BadgerLogStore) EachPointLog(fn func(packet.LogPacket)) {
+	ls.db.View(func(txn *badger.Txn) error {
+		prefix := []byte("log::")
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			l := packet.LogPacket{}
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &l)
+			})
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fn(l)
+		}
+		return nil
+	})
+}
+
+func NewBadgerLogStore(path string) *BadgerLogStore {
+	os.MkdirAll(path, os.ModePerm)
+	db, err := badger.Open(badger.DefaultOptions(path).WithSyncWrites(true))
+	if err != nil {
+		panic(err)
+	}
+	return &BadgerLogStore{db: db}
+}
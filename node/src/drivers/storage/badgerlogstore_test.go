@@ -0,0 +1,21 @@
+package tool_storage
+
+import "testing"
+
+func TestBadgerLogStoreDeleteKeepsAuthorAndTime(t *testing.T) {
+	ls := NewBadgerLogStore(t.TempDir())
+	t.Cleanup(func() { ls.Close() })
+	logged := ls.LogTimeSieries("p1", "u1", "hello", 1000)
+	deleted := ls.DeleteLog("p1", "u1", logged.Id, 1000)
+	if !deleted.Deleted || deleted.Data != "" || deleted.UserId != "u1" || deleted.Time != 1000 {
+		t.Fatalf("deleted packet %+v", deleted)
+	}
+	picked := ls.PickPointLogs("p1", []string{logged.Id})
+	if len(picked) != 1 || picked[0] != deleted {
+		t.Fatalf("stored packet %+v", picked)
+	}
+	missing := ls.DeleteLog("p1", "u2", "unknown", 2000)
+	if missing.UserId != "u2" || missing.Time != 2000 {
+		t.Fatalf("packet of a missing log %+v", missing)
+	}
+}
@@ -0,0 +1,189 @@
+package tool_storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"kasper/src/abstract/adapters/storage"
+	"kasper/src/abstract/models/packet"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Searcher is an embedded inverted index over point message history. Every
+// term of a log points back to it through "term::<pointId>::<term>::<time>::<id>"
+// keys, so a point's matches come out newest first, and "doc::<pointId>::<id>"
+// remembers the terms of a log to drop its postings on edit or delete.
+type Searcher struct {
+	db *badger.DB
+}
+
+type searchDoc struct {
+	Time  int64    `json:"time"`
+	Terms []string `json:"terms"`
+}
+
+func searchTerms(text string) []string {
+	seen := map[string]bool{}
+	terms := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len([]rune(word)) < 2 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+func searchTermPrefix(pointId string, term string) string {
+	return "term::" + pointId + "::" + term + "::"
+}
+
+func searchTermKey(pointId string, term string, timeVal int64, id string) string {
+	return fmt.Sprintf("%s%020d::%s", searchTermPrefix(pointId, term), timeVal, id)
+}
+
+func searchDocKey(pointId string, id string) string {
+	return "doc::" + pointId + "::" + id
+}
+
+func (s *Searcher) Close() error {
+	return s.db.Close()
+}
+
+func (s *Searcher) dropDoc(txn *badger.Txn, pointId string, id string) error {
+	item, err := txn.Get([]byte(searchDocKey(pointId, id)))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	doc := searchDoc{}
+	if err := item.Value(func(val []byte) error { return json.Unmarshal(val, &doc) }); err != nil {
+		return err
+	}
+	for _, term := range doc.Terms {
+		if err := txn.Delete([]byte(searchTermKey(pointId, term, doc.Time, id))); err != nil {
+			return err
+		}
+	}
+	return txn.Delete([]byte(searchDocKey(pointId, id)))
+}
+
+func (s *Searcher) IndexLog(l packet.LogPacket) {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		if err := s.dropDoc(txn, l.PointId, l.Id); err != nil {
+			return err
+		}
+		doc := searchDoc{Time: l.Time, Terms: searchTerms(l.Data)}
+		for _, term := range doc.Terms {
+			if err := txn.Set([]byte(searchTermKey(l.PointId, term, l.Time, l.Id)), []byte{}); err != nil {
+				return err
+			}
+		}
+		b, _ := json.Marshal(doc)
+		return txn.Set([]byte(searchDocKey(l.PointId, l.Id)), b)
+	})
+	if err != nil {
+		log.Println("Index error: " + err.Error())
+	}
+}
+
+func (s *Searcher) RemoveLog(pointId string, id string) {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return s.dropDoc(txn, pointId, id)
+	})
+	if err != nil {
+		log.Println("Index error: " + err.Error())
+	}
+}
+
+// SearchPointLogs returns the ids of the logs of a point containing every term
+// of the query, newest first.
+func (s *Searcher) SearchPointLogs(pointId string, query string, offset int, count int) []string {
+	ids := []string{}
+	terms := searchTerms(query)
+	if len(terms) == 0 || count <= 0 {
+		return ids
+	}
+	s.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(searchTermPrefix(pointId, terms[0]))
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		skipped := 0
+		for it.Seek(append(append([]byte{}, prefix...), 0xFF)); it.ValidForPrefix(prefix) && len(ids) < count; it.Next() {
+			rest := strings.SplitN(string(it.Item().Key()[len(prefix):]), "::", 2)
+			if len(rest) < 2 {
+				continue
+			}
+			matched := true
+			for _, term := range terms[1:] {
+				if _, err := txn.Get([]byte(searchTermPrefix(pointId, term) + rest[0] + "::" + rest[1])); err != nil {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			ids = append(ids, rest[1])
+		}
+		return nil
+	})
+	return ids
+}
+
+const searchBackfilledKey = "backfilled"
+
+// Backfill indexes the logs stored before the index existed. It runs once, on
+// the first start with an index, before any new log is written.
+func (s *Searcher) Backfill(logs storage.ILogStore) {
+	backfilled := false
+	s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(searchBackfilledKey))
+		backfilled = err == nil
+		return nil
+	})
+	if backfilled {
+		return
+	}
+	log.Println("indexing point logs for search...")
+	count := 0
+	logs.EachPointLog(func(l packet.LogPacket) {
+		if l.Deleted {
+			return
+		}
+		s.IndexLog(l)
+		count++
+	})
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(searchBackfilledKey), []byte{0x01})
+	})
+	if err != nil {
+		log.Println("Index error: " + err.Error())
+	}
+	log.Println(count, "point logs indexed")
+}
+
+func NewSearcher(path string) *Searcher {
+	os.MkdirAll(path, os.ModePerm)
+	db, err := badger.Open(badger.DefaultOptions(path).WithSyncWrites(true))
+	if err != nil {
+		panic(err)
+	}
+	return &Searcher{db: db}
+}
@@ -0,0 +1,32 @@
+package tool_storage
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSearcherBackfillsStoredLogs(t *testing.T) {
+	ls := NewBadgerLogStore(t.TempDir())
+	t.Cleanup(func() { ls.Close() })
+	older := ls.LogTimeSieries("p1", "u1", "hello world", 1000)
+	newer := ls.LogTimeSieries("p1", "u2", "hello again", 2000)
+	deleted := ls.LogTimeSieries("p1", "u1", "hello there", 3000)
+	ls.DeleteLog("p1", "u1", deleted.Id, 3000)
+
+	path := t.TempDir()
+	s := NewSearcher(path)
+	s.Backfill(ls)
+	if ids := s.SearchPointLogs("p1", "hello", 0, 10); !slices.Equal(ids, []string{newer.Id, older.Id}) {
+		t.Fatalf("search after backfill found %v", ids)
+	}
+
+	// a later start does not index the store again
+	s.RemoveLog("p1", older.Id)
+	s.Close()
+	s = NewSearcher(path)
+	t.Cleanup(func() { s.Close() })
+	s.Backfill(ls)
+	if ids := s.SearchPointLogs("p1", "hello", 0, 10); !slices.Equal(ids, []string{newer.Id}) {
+		t.Fatalf("search after restart found %v", ids)
+	}
+}
@@ -0,0 +1,856 @@
+package wasm
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kasper/src/abstract/models/worker"
+	"kasper/src/shell/utils/future"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// The embedded runtime runs machines inside the node with wazero, offering the
+// same env imports as the app engine. Gas is the number of instructions a
+// machine runs plus a price per host call and per byte crossing into the host.
+var (
+	GasPerHostCall = uint64(1000)
+	GasPerByte     = uint64(1)
+	OffChainTries  = 3
+
+	ErrOutOfGas = errors.New("machine ran out of gas")
+)
+
+// migratedKey marks an applet db holding the state of the app engine.
+const migratedKey = "#appEngineStateMigrated"
+
+type embedded struct {
+	wm           *Wasm
+	db           *badger.DB
+	cache        wazero.CompilationCache
+	chainGroups  chan []*worker.Trx
+	runtimesLock sync.Mutex
+	runtimes     map[string]*machineRuntime
+	signalsLock  sync.Mutex
+	signals      map[string]chan string
+}
+
+func newEmbedded(wm *Wasm, kvDbPath string) *embedded {
+	path := kvDbPath + "/embedded"
+	os.MkdirAll(path, os.ModePerm)
+	db, err := badger.Open(badger.DefaultOptions(path).WithSyncWrites(true))
+	if err != nil {
+		log.Fatalf("failed to open applet db: %v", err)
+	}
+	e := &embedded{
+		wm:          wm,
+		db:          db,
+		cache:       wazero.NewCompilationCache(),
+		chainGroups: make(chan []*worker.Trx, 1000),
+		runtimes:    map[string]*machineRuntime{},
+		signals:     map[string]chan string{},
+	}
+	future.Async(func() {
+		for trxs := range e.chainGroups {
+			e.runOnChain(wm.storageRoot+"/machines", trxs)
+		}
+	}, false)
+	return e
+}
+
+func (e *embedded) close() {
+	e.runtimesLock.Lock()
+	for _, mr := range e.runtimes {
+		mr.runtime.Close(context.Background())
+	}
+	e.runtimesLock.Unlock()
+	e.cache.Close(context.Background())
+	e.db.Close()
+}
+
+func (e *embedded) callback(key string, input map[string]any) string {
+	data, _ := json.Marshal(map[string]any{"key": key, "input": input, "requestId": 0})
+	res, _ := e.wm.WasmCallback(string(data))
+	return res
+}
+
+// migrate copies the applet state of every machine the node stores out of the
+// app engine, once, so that switching a node to the embedded runtime keeps the
+// state of its machines. A node without machines has nothing to copy.
+func (e *embedded) migrate(export func(machineId string) (map[string]string, error)) error {
+	done := false
+	e.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(migratedKey))
+		done = err == nil
+		return nil
+	})
+	if done {
+		return nil
+	}
+	entries, err := os.ReadDir(e.wm.storageRoot + "/machines")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(e.wm.storageRoot + "/machines/" + entry.Name() + "/module"); err != nil {
+			continue
+		}
+		state, err := export(entry.Name())
+		if err != nil {
+			return fmt.Errorf("copying the state of machine %s from the app engine: %w", entry.Name(), err)
+		}
+		ops := make([]ChainDbOp, 0, len(state))
+		for key, val := range state {
+			ops = append(ops, ChainDbOp{OpType: "put", Key: key, Val: val})
+		}
+		if err := applyDbOps(e.db, ops); err != nil {
+			return err
+		}
+		log.Println("copied", len(state), "applet keys of machine", entry.Name(), "from the app engine")
+	}
+	return e.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(migratedKey), []byte("true"))
+	})
+}
+
+// appletTrx is the badger transaction a run reads and writes the applet state
+// in, seeing its own writes. Off-chain runs commit it, which fails if what the
+// run read was changed meanwhile, and on-chain runs hand its ops out as
+// effects.
+type appletTrx struct {
+	txn *badger.Txn
+	ops []ChainDbOp
+}
+
+func newAppletTrx(db *badger.DB) *appletTrx {
+	return &appletTrx{txn: db.NewTransaction(true), ops: []ChainDbOp{}}
+}
+
+func (t *appletTrx) put(key string, val string) {
+	if err := t.txn.Set([]byte(key), []byte(val)); err != nil {
+		panic(err)
+	}
+	t.ops = append(t.ops, ChainDbOp{OpType: "put", Key: key, Val: val})
+}
+
+func (t *appletTrx) del(key string) {
+	if err := t.txn.Delete([]byte(key)); err != nil {
+		panic(err)
+	}
+	t.ops = append(t.ops, ChainDbOp{OpType: "del", Key: key})
+}
+
+func (t *appletTrx) get(key string) string {
+	item, err := t.txn.Get([]byte(key))
+	if err != nil {
+		return ""
+	}
+	val, _ := item.ValueCopy(nil)
+	return string(val)
+}
+
+// getByPrefix returns the values under a prefix in the order of their keys.
+func (t *appletTrx) getByPrefix(prefix string) []string {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefix)
+	it := t.txn.NewIterator(opts)
+	defer it.Close()
+	result := []string{}
+	for it.Seek(opts.Prefix); it.ValidForPrefix(opts.Prefix); it.Next() {
+		val, _ := it.Item().ValueCopy(nil)
+		result = append(result, string(val))
+	}
+	return result
+}
+
+func applyDbOps(db *badger.DB, ops []ChainDbOp) error {
+	return db.Update(func(txn *badger.Txn) error {
+		for _, op := range ops {
+			var err error
+			switch op.OpType {
+			case "put":
+				err = txn.Set([]byte(op.Key), []byte(op.Val))
+			case "del":
+				err = txn.Delete([]byte(op.Key))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// gasMeter keeps the gas of a run in the gas global of its module. Without a
+// limit, the global keeps counting down from gasStart.
+type gasMeter struct {
+	limit  uint64
+	global api.MutableGlobal
+}
+
+// start sets the limit of the run on a module just instantiated, less the gas
+// instantiating it took.
+func (g *gasMeter) start(mod api.Module) error {
+	global, ok := mod.ExportedGlobal(gasGlobal).(api.MutableGlobal)
+	if !ok {
+		return fmt.Errorf("%w: module is not metered", ErrBadModule)
+	}
+	g.global = global
+	if g.limit > 0 {
+		used := gasStart - g.remaining()
+		global.Set(uint64(int64(g.limit) - used))
+	}
+	return nil
+}
+
+func (g *gasMeter) remaining() int64 {
+	return int64(g.global.Get())
+}
+
+// charge panics once the gas is used up, which wazero turns into a trap of
+// the running call.
+func (g *gasMeter) charge(amount uint64) {
+	if g.global == nil {
+		return
+	}
+	left := g.remaining() - int64(amount)
+	g.global.Set(uint64(left))
+	if left < 0 {
+		panic(ErrOutOfGas)
+	}
+}
+
+func (g *gasMeter) exhausted() bool {
+	return g.global != nil && g.remaining() < 0
+}
+
+func (g *gasMeter) cost() uint64 {
+	switch {
+	case g.global == nil:
+		return 0
+	case g.limit == 0:
+		return uint64(gasStart - g.remaining())
+	case g.exhausted():
+		return g.limit
+	}
+	return g.limit - uint64(g.remaining())
+}
+
+type syncTask struct {
+	Name string   `json:"name"`
+	Deps []string `json:"deps"`
+}
+
+type machineVm struct {
+	machineId    string
+	pointId      string
+	onChain      bool
+	tokenOwnerId string
+	tokenId      string
+	callbackId   string
+	trx          *appletTrx
+	gas          *gasMeter
+	output       string
+	tasks        []syncTask
+	exited       bool
+	exitCode     uint32
+	err          error
+	lock         sync.Mutex
+	ctx          context.Context
+	cancel       context.CancelFunc
+	machine      *machineRuntime
+	mod          api.Module
+}
+
+type vmKey struct{}
+
+func vmOf(ctx context.Context) *machineVm {
+	vm, _ := ctx.Value(vmKey{}).(*machineVm)
+	return vm
+}
+
+func (e *embedded) newVm(machineId string, pointId string, onChain bool) *machineVm {
+	vm := &machineVm{
+		machineId: machineId,
+		pointId:   pointId,
+		onChain:   onChain,
+		trx:       newAppletTrx(e.db),
+		gas:       &gasMeter{},
+	}
+	ctx := context.WithValue(context.Background(), vmKey{}, vm)
+	if onChain {
+		vm.ctx, vm.cancel = context.WithCancel(ctx)
+	} else {
+		maxRunTime := 5 * time.Minute
+		if v, err := strconv.ParseInt(os.Getenv("WASM_MAX_RUN_TIME"), 10, 64); err == nil && v > 0 {
+			maxRunTime = time.Duration(v) * time.Second
+		}
+		vm.ctx, vm.cancel = context.WithTimeout(ctx, maxRunTime)
+	}
+	return vm
+}
+
+// machineRuntime is the runtime a machine runs in, with its metered module
+// compiled and the host modules it imports. Runs of the machine share it and
+// instantiate the module each on their own. A runtime left behind by a new
+// version of the module is closed once its last run ends.
+type machineRuntime struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	sum      [32]byte
+	users    int
+	stale    bool
+}
+
+func (e *embedded) acquireRuntime(modPath string) (*machineRuntime, error) {
+	code, err := os.ReadFile(modPath)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(code)
+	e.runtimesLock.Lock()
+	defer e.runtimesLock.Unlock()
+	if mr, ok := e.runtimes[modPath]; ok {
+		if mr.sum == sum {
+			mr.users++
+			return mr, nil
+		}
+		mr.stale = true
+		delete(e.runtimes, modPath)
+		if mr.users == 0 {
+			mr.runtime.Close(context.Background())
+		}
+	}
+	mr, err := e.newMachineRuntime(code)
+	if err != nil {
+		return nil, err
+	}
+	mr.sum = sum
+	mr.users = 1
+	e.runtimes[modPath] = mr
+	return mr, nil
+}
+
+func (e *embedded) releaseRuntime(mr *machineRuntime) {
+	e.runtimesLock.Lock()
+	defer e.runtimesLock.Unlock()
+	mr.users--
+	if mr.stale && mr.users == 0 {
+		mr.runtime.Close(context.Background())
+	}
+}
+
+// newMachineRuntime compiles a module once metered, with env imports built
+// to the signatures the module declares.
+func (e *embedded) newMachineRuntime(code []byte) (*machineRuntime, error) {
+	metered, err := meterModule(code)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	mr := &machineRuntime{runtime: wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCompilationCache(e.cache).WithCloseOnContextDone(true))}
+	if err := e.buildRuntime(ctx, mr, metered); err != nil {
+		mr.runtime.Close(ctx)
+		return nil, err
+	}
+	return mr, nil
+}
+
+func (e *embedded) buildRuntime(ctx context.Context, mr *machineRuntime, code []byte) error {
+	compiled, err := mr.runtime.CompileModule(ctx, code)
+	if err != nil {
+		return err
+	}
+	mr.compiled = compiled
+	wasi := mr.runtime.NewHostModuleBuilder(wasi_snapshot_preview1.ModuleName)
+	wasi_snapshot_preview1.NewFunctionExporter().ExportFunctions(wasi)
+	// exiting unwinds the call instead of closing the module, as machines
+	// built as commands exit at the end of _start
+	wasi.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, _ api.Module, stack []uint64) {
+		vm := vmOf(ctx)
+		vm.exited = true
+		vm.exitCode = api.DecodeU32(stack[0])
+		panic(fmt.Errorf("machine exited with code %d", vm.exitCode))
+	}), []api.ValueType{api.ValueTypeI32}, []api.ValueType{}).Export("proc_exit")
+	if _, err := wasi.Instantiate(ctx); err != nil {
+		return err
+	}
+	env := mr.runtime.NewHostModuleBuilder("env")
+	for _, f := range compiled.ImportedFunctions() {
+		module, name, _ := f.Import()
+		if module != "env" {
+			continue
+		}
+		hf, ok := hostFuncs[name]
+		if !ok {
+			return fmt.Errorf("machine imports unknown host function env.%s", name)
+		}
+		if err := hf.check(f); err != nil {
+			return fmt.Errorf("env.%s: %w", name, err)
+		}
+		env.NewFunctionBuilder().WithGoModuleFunction(e.hostModuleFunc(hf, f.ResultTypes()), f.ParamTypes(), f.ResultTypes()).Export(name)
+	}
+	_, err = env.Instantiate(ctx)
+	return err
+}
+
+// instantiate starts the module of the machine for a run, in the runtime the
+// machine shares between its runs.
+func (e *embedded) instantiate(vm *machineVm, modPath string) error {
+	mr, err := e.acquireRuntime(modPath)
+	if err != nil {
+		return err
+	}
+	vm.machine = mr
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions().WithStdout(os.Stdout).WithStderr(os.Stderr)
+	if !vm.onChain {
+		config = config.WithSysWalltime().WithSysNanotime().WithRandSource(rand.Reader)
+	}
+	vm.mod, err = mr.runtime.InstantiateModule(vm.ctx, mr.compiled, config)
+	if err != nil {
+		return err
+	}
+	if err := vm.gas.start(vm.mod); err != nil {
+		return err
+	}
+	for _, start := range []string{"_initialize", "_start"} {
+		if fn := vm.mod.ExportedFunction(start); fn != nil {
+			if _, err := fn.Call(vm.ctx); err != nil && !(vm.exited && vm.exitCode == 0) {
+				return vm.check(err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// pass copies data into memory the machine allocates for it, and packs its
+// place the way the app engine hands data to machines.
+func (vm *machineVm) pass(ctx context.Context, data string) (uint64, error) {
+	malloc := vm.mod.ExportedFunction("malloc")
+	if malloc == nil {
+		return 0, errors.New("machine does not export malloc")
+	}
+	res, err := malloc.Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	offset := api.DecodeU32(res[0])
+	if !vm.mod.Memory().Write(offset, []byte(data)) {
+		return 0, errors.New("machine allocated memory out of range")
+	}
+	return uint64(offset)<<32 | uint64(len(data)), nil
+}
+
+func (vm *machineVm) call(name string, input string) error {
+	fn := vm.mod.ExportedFunction(name)
+	if fn == nil {
+		return fmt.Errorf("machine does not export %s", name)
+	}
+	arg, err := vm.pass(vm.ctx, input)
+	if err == nil {
+		_, err = fn.Call(vm.ctx, arg)
+	}
+	return vm.check(err)
+}
+
+func (vm *machineVm) check(err error) error {
+	if err != nil && vm.gas.exhausted() {
+		return ErrOutOfGas
+	}
+	return err
+}
+
+func (vm *machineVm) close(e *embedded) {
+	if vm.mod != nil {
+		vm.mod.Close(context.Background())
+	}
+	if vm.machine != nil {
+		e.releaseRuntime(vm.machine)
+	}
+	vm.trx.txn.Discard()
+	vm.cancel()
+}
+
+type hostCall struct {
+	mod   api.Module
+	vm    *machineVm
+	stack []uint64
+	read  int
+}
+
+// str reads the string whose offset and length are the i'th and i+1'th
+// params of the call.
+func (c *hostCall) str(i int) string {
+	b, ok := c.mod.Memory().Read(api.DecodeU32(c.stack[i]), api.DecodeU32(c.stack[i+1]))
+	if !ok {
+		return ""
+	}
+	c.read += len(b)
+	return string(b)
+}
+
+func (c *hostCall) i32(i int) int32 {
+	return api.DecodeI32(c.stack[i])
+}
+
+func (c *hostCall) key(i int) string {
+	return c.vm.machineId + "::" + c.str(i)
+}
+
+type hostFunc struct {
+	params int
+	// fn returns what is handed back to the machine, if anything
+	fn func(e *embedded, c *hostCall) (string, bool)
+}
+
+func (hf hostFunc) check(f api.FunctionDefinition) error {
+	params := f.ParamTypes()
+	if len(params) != hf.params {
+		return fmt.Errorf("takes %d params, not %d", hf.params, len(params))
+	}
+	for _, p := range params {
+		if p != api.ValueTypeI32 {
+			return errors.New("params must be i32")
+		}
+	}
+	if results := f.ResultTypes(); len(results) > 1 || (len(results) == 1 && results[0] != api.ValueTypeI32 && results[0] != api.ValueTypeI64) {
+		return errors.New("must return nothing, an i32 or an i64")
+	}
+	return nil
+}
+
+func (e *embedded) hostModuleFunc(hf hostFunc, results []api.ValueType) api.GoModuleFunc {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		vm := vmOf(ctx)
+		vm.gas.charge(GasPerHostCall)
+		c := &hostCall{mod: mod, vm: vm, stack: stack}
+		res, ok := hf.fn(e, c)
+		vm.gas.charge(GasPerByte * uint64(c.read+len(res)))
+		if len(results) == 0 {
+			return
+		}
+		stack[0] = 0
+		if ok && results[0] == api.ValueTypeI64 {
+			ptr, err := vm.pass(ctx, res)
+			if err != nil {
+				panic(err)
+			}
+			stack[0] = ptr
+		}
+	}
+}
+
+func wrapData(data any) string {
+	str, _ := json.Marshal(map[string]any{"data": data})
+	return string(str)
+}
+
+var hostFuncs = map[string]hostFunc{
+	"newSyncTask": {2, func(e *embedded, c *hostCall) (string, bool) {
+		task := syncTask{}
+		json.Unmarshal([]byte(c.str(0)), &task)
+		c.vm.tasks = append(c.vm.tasks, task)
+		return "", false
+	}},
+	"output": {2, func(e *embedded, c *hostCall) (string, bool) {
+		c.vm.output = c.str(0)
+		return "", false
+	}},
+	"consoleLog": {2, func(e *embedded, c *hostCall) (string, bool) {
+		e.callback("log", map[string]any{"text": c.str(0)})
+		return "", false
+	}},
+	"put": {4, func(e *embedded, c *hostCall) (string, bool) {
+		c.vm.trx.put(c.key(0), c.str(2))
+		return "", false
+	}},
+	"del": {2, func(e *embedded, c *hostCall) (string, bool) {
+		c.vm.trx.del(c.key(0))
+		return "", false
+	}},
+	"get": {2, func(e *embedded, c *hostCall) (string, bool) {
+		return c.vm.trx.get(c.key(0)), true
+	}},
+	"getByPrefix": {2, func(e *embedded, c *hostCall) (string, bool) {
+		return wrapData(c.vm.trx.getByPrefix(c.key(0))), true
+	}},
+	"httpPost": {6, func(e *embedded, c *hostCall) (string, bool) {
+		return e.callback("httpPost", map[string]any{
+			"machineId":  c.vm.machineId,
+			"url":        c.str(0),
+			"headers":    c.str(2),
+			"body":       c.str(4),
+			"callbackId": c.vm.callbackId,
+		}), true
+	}},
+	"signalPoint": {8, func(e *embedded, c *hostCall) (string, bool) {
+		return e.callback("signalPoint", map[string]any{
+			"machineId": c.vm.machineId,
+			"type":      c.str(0),
+			"pointId":   c.str(2),
+			"userId":    c.str(4),
+			"data":      c.str(6),
+		}), true
+	}},
+	"plantTrigger": {7, func(e *embedded, c *hostCall) (string, bool) {
+		e.callback("plantTrigger", map[string]any{
+			"machineId":  c.vm.machineId,
+			"tag":        c.str(0),
+			"input":      c.str(2),
+			"pointId":    c.str(4),
+			"count":      c.i32(6),
+			"callbackId": c.vm.callbackId,
+		})
+		return "", false
+	}},
+	"cancelTimer": {2, func(e *embedded, c *hostCall) (string, bool) {
+		return e.callback("cancelTimer", map[string]any{"machineId": c.vm.machineId, "name": c.str(0)}), true
+	}},
+	"listTimers": {0, func(e *embedded, c *hostCall) (string, bool) {
+		return e.callback("listTimers", map[string]any{"machineId": c.vm.machineId}), true
+	}},
+	"submitOnchainTrx": {8, func(e *embedded, c *hostCall) (string, bool) {
+		meta := c.str(6)
+		isBase := len(meta) > 0 && meta[0] == '1'
+		isFile := len(meta) > 1 && meta[1] == '1'
+		tag := ""
+		if len(meta) > 2 {
+			tag = meta[2:]
+		}
+		targetMachineId := ""
+		if !isBase {
+			targetMachineId = c.str(0)
+		}
+		return e.callback("submitOnchainTrx", map[string]any{
+			"pointId":            c.vm.pointId,
+			"machineId":          c.vm.machineId,
+			"targetMachineId":    targetMachineId,
+			"key":                c.str(2),
+			"tag":                tag,
+			"packet":             c.str(4),
+			"isFile":             isFile,
+			"isBase":             isBase,
+			"isRequesterOnchain": c.vm.onChain,
+		}), true
+	}},
+	"runDocker": {6, func(e *embedded, c *hostCall) (string, bool) {
+		return e.callback("runDocker", map[string]any{
+			"machineId":     c.vm.machineId,
+			"pointId":       c.vm.pointId,
+			"imageName":     c.str(0),
+			"inputFiles":    c.str(2),
+			"containerName": c.str(4),
+		}), true
+	}},
+	"execDocker": {6, func(e *embedded, c *hostCall) (string, bool) {
+		return wrapData(e.callback("execDocker", map[string]any{
+			"machineId":     c.vm.machineId,
+			"imageName":     c.str(0),
+			"containerName": c.str(2),
+			"command":       c.str(4),
+		})), true
+	}},
+	"copyToDocker": {8, func(e *embedded, c *hostCall) (string, bool) {
+		return wrapData(e.callback("copyToDocker", map[string]any{
+			"machineId":     c.vm.machineId,
+			"imageName":     c.str(0),
+			"containerName": c.str(2),
+			"fileName":      c.str(4),
+			"content":       c.str(6),
+		})), true
+	}},
+}
+
+// runOffChain queues a signal to the machine. The signals of a machine run
+// one after the other, so that they never overwrite what one another wrote.
+func (e *embedded) runOffChain(machineId string, modPath string, input string) {
+	e.signalsLock.Lock()
+	queue, ok := e.signals[machineId]
+	if !ok {
+		queue = make(chan string, 1000)
+		e.signals[machineId] = queue
+		future.Async(func() {
+			for input := range queue {
+				e.runSignal(machineId, modPath, input)
+			}
+		}, false)
+	}
+	e.signalsLock.Unlock()
+	queue <- input
+}
+
+// runSignal runs a signal to the machine and commits its writes, unless the
+// run fails. A run whose reads were changed by chain effects before it
+// committed is run again.
+func (e *embedded) runSignal(machineId string, modPath string, input string) {
+	signal := struct {
+		Point struct {
+			Id string `json:"id"`
+		} `json:"point"`
+	}{}
+	json.Unmarshal([]byte(input), &signal)
+	var err error
+	for range OffChainTries {
+		vm := e.newVm(machineId, signal.Point.Id, false)
+		err = e.instantiate(vm, modPath)
+		if err == nil {
+			err = vm.call("run", input)
+		}
+		if err == nil {
+			err = vm.trx.txn.Commit()
+		}
+		vm.close(e)
+		if !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+	}
+	if err != nil {
+		log.Println("machine", machineId, "failed:", err)
+	}
+}
+
+// runOnChain runs a group of chain trxs side by side, then their sync tasks
+// in the order they asked for, and submits a response for each.
+func (e *embedded) runOnChain(modRoot string, trxs []*worker.Trx) {
+	vms := make([]*machineVm, len(trxs))
+	wg := sync.WaitGroup{}
+	for i, t := range trxs {
+		wg.Add(1)
+		future.Async(func() {
+			defer wg.Done()
+			vms[i] = e.runChainTrx(modRoot, t)
+		}, false)
+	}
+	wg.Wait()
+	e.runSyncTasks(vms)
+	for i, vm := range vms {
+		ops := []ChainDbOp{}
+		if vm.err == nil {
+			ops = vm.trx.ops
+		} else {
+			log.Println("machine", vm.machineId, "failed on trx", trxs[i].CallbackId, ":", vm.err)
+		}
+		changes, _ := json.Marshal(ops)
+		e.callback("submitOnchainResponse", map[string]any{
+			"callbackId":   trxs[i].CallbackId,
+			"packet":       vm.output,
+			"resCode":      1,
+			"error":        "",
+			"changes":      string(changes),
+			"cost":         vm.gas.cost(),
+			"tokenId":      vm.tokenId,
+			"tokenOwnerId": vm.tokenOwnerId,
+		})
+		vm.close(e)
+	}
+}
+
+func (e *embedded) runChainTrx(modRoot string, t *worker.Trx) *machineVm {
+	vm := e.newVm(t.MachineId, "", true)
+	payload := struct {
+		TokenId string `json:"tokenId"`
+		Params  string `json:"params"`
+	}{}
+	json.Unmarshal([]byte(t.Payload), &payload)
+	vm.tokenOwnerId = t.UserId
+	vm.tokenId = payload.TokenId
+	vm.callbackId = t.CallbackId
+	validity := struct {
+		GasLimit uint64 `json:"gasLimit"`
+	}{}
+	json.Unmarshal([]byte(e.callback("checkTokenValidity", map[string]any{"tokenOwnerId": t.UserId, "tokenId": payload.TokenId})), &validity)
+	if validity.GasLimit == 0 {
+		vm.err = errors.New("token has no gas left")
+		return vm
+	}
+	vm.gas.limit = validity.GasLimit
+	if vm.err = e.instantiate(vm, modRoot+"/"+t.MachineId+"/module"); vm.err == nil {
+		vm.err = vm.call("run", payload.Params)
+	}
+	return vm
+}
+
+// runSyncTasks runs every task after the ones it depends on, the tasks asked
+// for earlier on the same data and the tasks of its own machine named by a
+// "lock_" dep.
+func (e *embedded) runSyncTasks(vms []*machineVm) {
+	lastOnData := map[string]chan struct{}{}
+	named := map[string]chan struct{}{}
+	wg := sync.WaitGroup{}
+	for i, vm := range vms {
+		if vm.err != nil {
+			continue
+		}
+		for _, task := range vm.tasks {
+			waits := []chan struct{}{}
+			for _, dep := range task.Deps {
+				if strings.HasPrefix(dep, "lock_") {
+					if done, ok := named[fmt.Sprint(i, ":", dep)]; ok {
+						waits = append(waits, done)
+					}
+					continue
+				}
+				if done, ok := lastOnData[dep]; ok {
+					waits = append(waits, done)
+				}
+			}
+			done := make(chan struct{})
+			for _, dep := range task.Deps {
+				if !strings.HasPrefix(dep, "lock_") {
+					lastOnData[dep] = done
+				}
+			}
+			named[fmt.Sprint(i, ":", task.Name)] = done
+			wg.Add(1)
+			future.Async(func() {
+				defer wg.Done()
+				defer close(done)
+				for _, w := range waits {
+					<-w
+				}
+				vm.lock.Lock()
+				defer vm.lock.Unlock()
+				if vm.err == nil {
+					vm.err = vm.call("runTask", task.Name)
+				}
+			}, false)
+		}
+	}
+	wg.Wait()
+}
+
+func (e *embedded) exportMachineState(machineId string) (map[string]string, error) {
+	state := map[string]string{}
+	prefix := []byte(machineId + "::")
+	err := e.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := string(it.Item().Key())
+			err := it.Item().Value(func(v []byte) error {
+				state[key] = string(v)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return state, err
+}
@@ -0,0 +1,224 @@
+package wasm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/tetratelabs/wazero"
+)
+
+func wasmVec(items ...[]byte) []byte {
+	out := appendU32(nil, uint32(len(items)))
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
+
+func wasmName(name string) []byte {
+	return append(appendU32(nil, uint32(len(name))), name...)
+}
+
+func wasmBody(locals []byte, code ...byte) []byte {
+	body := append(locals, code...)
+	return append(appendU32(nil, uint32(len(body))), body...)
+}
+
+// sampleModule is a machine that stores its input under "k", reads it back
+// through the host and outputs it from run, and loops forever from spin.
+func sampleModule() []byte {
+	module := []byte("\x00asm\x01\x00\x00\x00")
+	i32, i64 := byte(0x7f), byte(0x7e)
+	module = appendSection(module, 1, wasmVec(
+		[]byte{0x60, 4, i32, i32, i32, i32, 0},
+		[]byte{0x60, 2, i32, i32, 1, i64},
+		[]byte{0x60, 2, i32, i32, 0},
+		[]byte{0x60, 1, i32, 1, i32},
+		[]byte{0x60, 1, i64, 0},
+	))
+	module = appendSection(module, 2, wasmVec(
+		append(append(wasmName("env"), wasmName("put")...), 0x00, 0),
+		append(append(wasmName("env"), wasmName("get")...), 0x00, 1),
+		append(append(wasmName("env"), wasmName("output")...), 0x00, 2),
+	))
+	module = appendSection(module, 3, wasmVec([]byte{3}, []byte{4}, []byte{4}))
+	module = appendSection(module, 5, wasmVec([]byte{0x00, 1}))
+	module = appendSection(module, 6, wasmVec([]byte{i32, 0x01, 0x41, 0x80, 0x08, 0x0b}))
+	module = appendSection(module, 7, wasmVec(
+		append(wasmName("memory"), 0x02, 0),
+		append(wasmName("malloc"), 0x00, 3),
+		append(wasmName("run"), 0x00, 4),
+		append(wasmName("spin"), 0x00, 5),
+	))
+	module = appendSection(module, 10, wasmVec(
+		// malloc hands out the heap pointer and moves it past the size
+		wasmBody([]byte{0}, 0x23, 0, 0x23, 0, 0x20, 0, 0x6a, 0x24, 0, 0x0b),
+		// run puts its input under "k", gets it back and outputs it
+		wasmBody([]byte{1, 1, i64},
+			0x41, 0, 0x41, 1,
+			0x20, 0, 0x42, 32, 0x88, 0xa7,
+			0x20, 0, 0xa7,
+			0x10, 0,
+			0x41, 0, 0x41, 1, 0x10, 1, 0x21, 1,
+			0x20, 1, 0x42, 32, 0x88, 0xa7,
+			0x20, 1, 0xa7,
+			0x10, 2,
+			0x0b),
+		// spin loops without ever calling out
+		wasmBody([]byte{0}, 0x03, 0x40, 0x0c, 0, 0x0b, 0x0b),
+	))
+	module = appendSection(module, 11, wasmVec([]byte{0x00, 0x41, 0, 0x0b, 1, 'k'}))
+	return module
+}
+
+func newTestEmbedded(t *testing.T) (*embedded, string) {
+	dir := t.TempDir()
+	db, err := badger.Open(badger.DefaultOptions(filepath.Join(dir, "db")).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &embedded{
+		db:       db,
+		cache:    wazero.NewCompilationCache(),
+		runtimes: map[string]*machineRuntime{},
+		signals:  map[string]chan string{},
+	}
+	t.Cleanup(e.close)
+	modPath := filepath.Join(dir, "module")
+	if err := os.WriteFile(modPath, sampleModule(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return e, modPath
+}
+
+func runSample(t *testing.T, e *embedded, modPath string, onChain bool, limit uint64, fn string, input string) *machineVm {
+	vm := e.newVm("m1", "", onChain)
+	vm.gas.limit = limit
+	if vm.err = e.instantiate(vm, modPath); vm.err == nil {
+		vm.err = vm.call(fn, input)
+	}
+	return vm
+}
+
+func TestEmbeddedRunsHostImports(t *testing.T) {
+	e, modPath := newTestEmbedded(t)
+	vm := runSample(t, e, modPath, false, 0, "run", "hello")
+	if vm.err != nil {
+		t.Fatal(vm.err)
+	}
+	if vm.output != "hello" {
+		t.Fatalf("output %q, want hello", vm.output)
+	}
+	if len(vm.trx.ops) != 1 || vm.trx.ops[0].Key != "m1::k" {
+		t.Fatalf("unexpected ops %+v", vm.trx.ops)
+	}
+	if err := vm.trx.txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	vm.close(e)
+	state, err := e.exportMachineState("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state["m1::k"] != "hello" {
+		t.Fatalf("committed state %v", state)
+	}
+}
+
+func TestEmbeddedGasIsDeterministic(t *testing.T) {
+	e, modPath := newTestEmbedded(t)
+	costs := []uint64{}
+	for range 2 {
+		vm := runSample(t, e, modPath, true, 1_000_000, "run", "hello")
+		if vm.err != nil {
+			t.Fatal(vm.err)
+		}
+		costs = append(costs, vm.gas.cost())
+		vm.close(e)
+	}
+	if costs[0] == 0 || costs[0] != costs[1] {
+		t.Fatalf("costs %v, want the same non zero cost", costs)
+	}
+	vm := runSample(t, e, modPath, true, 1_000_000, "run", "hello, world")
+	defer vm.close(e)
+	// the longer input crosses into the host three times, put, get and output
+	if vm.gas.cost() != costs[0]+uint64(len(", world"))*3*GasPerByte {
+		t.Fatalf("cost %d of a longer input, want %d more than %d", vm.gas.cost(), len(", world")*3, costs[0])
+	}
+}
+
+func TestEmbeddedMetersLoopsWithoutCalls(t *testing.T) {
+	e, modPath := newTestEmbedded(t)
+	vm := runSample(t, e, modPath, true, 100_000, "spin", "")
+	defer vm.close(e)
+	if !errors.Is(vm.err, ErrOutOfGas) {
+		t.Fatalf("spinning ended with %v, want %v", vm.err, ErrOutOfGas)
+	}
+	if vm.gas.cost() != 100_000 {
+		t.Fatalf("cost %d, want the whole limit", vm.gas.cost())
+	}
+}
+
+func TestAppletTrxFailsOnChangedReads(t *testing.T) {
+	e, _ := newTestEmbedded(t)
+	vm := e.newVm("m1", "", false)
+	defer vm.close(e)
+	vm.trx.get("m1::k")
+	if err := applyDbOps(e.db, []ChainDbOp{{OpType: "put", Key: "m1::k", Val: "chain"}}); err != nil {
+		t.Fatal(err)
+	}
+	vm.trx.put("m1::k", "signal")
+	if err := vm.trx.txn.Commit(); !errors.Is(err, badger.ErrConflict) {
+		t.Fatalf("commit over a changed read gave %v, want a conflict", err)
+	}
+}
+
+func TestMeterModuleAddsGasGlobal(t *testing.T) {
+	metered, err := meterModule(sampleModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := meterModule(metered[:len(metered)-1]); err == nil {
+		t.Fatal("a truncated module was metered")
+	}
+	runtime := wazero.NewRuntime(t.Context())
+	defer runtime.Close(t.Context())
+	if _, err := runtime.CompileModule(t.Context(), metered); err != nil {
+		t.Fatalf("metered module does not compile: %v", err)
+	}
+}
+
+func TestMigrateCopiesAppEngineStateOnce(t *testing.T) {
+	e, _ := newTestEmbedded(t)
+	root := t.TempDir()
+	e.wm = &Wasm{storageRoot: root}
+	if err := os.MkdirAll(filepath.Join(root, "machines", "m1"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "machines", "m1", "module"), sampleModule(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	exports := 0
+	export := func(machineId string) (map[string]string, error) {
+		exports++
+		return map[string]string{machineId + "::k": "kept"}, nil
+	}
+	for range 2 {
+		if err := e.migrate(export); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exports != 1 {
+		t.Fatalf("state exported %d times, want once", exports)
+	}
+	state, err := e.exportMachineState("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state["m1::k"] != "kept" {
+		t.Fatalf("migrated state %v", state)
+	}
+}
@@ -0,0 +1,427 @@
+package wasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Machines are metered by the instructions they run. Before a module is
+// compiled, every straight run of instructions, which ends at the first
+// instruction that may branch, call or end a block, is prefixed with code that
+// takes the length of the run off the "kasper_gas" global the module is given,
+// and traps once it falls below zero. A loop pays for its body on every round,
+// so the gas a run uses only depends on the module and its input.
+const gasGlobal = "kasper_gas"
+
+// gasStart is the value the gas global starts with. Code run while the module
+// is instantiated is taken off it, before the limit of the run is set.
+const gasStart = math.MaxInt64
+
+var ErrBadModule = errors.New("malformed wasm module")
+
+type wasmReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *wasmReader) eof() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *wasmReader) byte() (byte, error) {
+	if r.eof() {
+		return 0, ErrBadModule
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *wasmReader) skip(n int) error {
+	if n < 0 || r.pos+n > len(r.data) {
+		return ErrBadModule
+	}
+	r.pos += n
+	return nil
+}
+
+// leb reads a leb128 number. Signed ones are only skipped, their value is not
+// needed.
+func (r *wasmReader) leb() (uint64, error) {
+	v := uint64(0)
+	for shift := 0; shift < 70; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, ErrBadModule
+}
+
+func (r *wasmReader) lebs(count int) error {
+	for range count {
+		if _, err := r.leb(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *wasmReader) vec() ([]byte, error) {
+	n, err := r.leb()
+	if err != nil {
+		return nil, err
+	}
+	start := r.pos
+	if err := r.skip(int(n)); err != nil {
+		return nil, err
+	}
+	return r.data[start:r.pos], nil
+}
+
+func appendU32(b []byte, v uint32) []byte {
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+func appendI64(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// gasCharge is the code taking cost off the gas global.
+func gasCharge(global uint32, cost int) []byte {
+	b := []byte{0x23}
+	b = appendU32(b, global)
+	b = append(b, 0x42)
+	b = appendI64(b, int64(cost))
+	b = append(b, 0x7d, 0x24)
+	b = appendU32(b, global)
+	b = append(b, 0x23)
+	b = appendU32(b, global)
+	// i64.const 0, i64.lt_s, if, unreachable, end
+	return append(b, 0x42, 0x00, 0x53, 0x04, 0x40, 0x00, 0x0b)
+}
+
+// endsRun tells the instructions after which the next one may not run.
+func endsRun(op byte) bool {
+	return op == 0x00 || (op >= 0x02 && op <= 0x05) || (op >= 0x0b && op <= 0x13)
+}
+
+// skipInstr moves past the immediates of an instruction whose opcode was read.
+func (r *wasmReader) skipInstr(op byte) error {
+	switch {
+	case op == 0x02 || op == 0x03 || op == 0x04:
+		b, err := r.byte()
+		if err != nil {
+			return err
+		}
+		// an empty or value block type is a single byte, a type index an s33
+		if b == 0x40 || (b >= 0x6f && b <= 0x7f) {
+			return nil
+		}
+		r.pos--
+		_, err = r.leb()
+		return err
+	case op == 0x0c || op == 0x0d || op == 0x10 || op == 0x12 || op == 0xd2:
+		return r.lebs(1)
+	case op == 0x0e:
+		n, err := r.leb()
+		if err != nil {
+			return err
+		}
+		return r.lebs(int(n) + 1)
+	case op == 0x11 || op == 0x13:
+		return r.lebs(2)
+	case op == 0x1c:
+		_, err := r.vec()
+		return err
+	case op >= 0x20 && op <= 0x26:
+		return r.lebs(1)
+	case op >= 0x28 && op <= 0x3e:
+		return r.lebs(2)
+	case op == 0x3f || op == 0x40 || op == 0xd0:
+		return r.skip(1)
+	case op == 0x41 || op == 0x42:
+		return r.lebs(1)
+	case op == 0x43:
+		return r.skip(4)
+	case op == 0x44:
+		return r.skip(8)
+	case op == 0xfc:
+		sub, err := r.leb()
+		if err != nil {
+			return err
+		}
+		switch {
+		case sub <= 7:
+			return nil
+		case sub == 8:
+			if err := r.lebs(1); err != nil {
+				return err
+			}
+			return r.skip(1)
+		case sub == 9 || (sub >= 13 && sub <= 17):
+			return r.lebs(1)
+		case sub == 10:
+			return r.skip(2)
+		case sub == 11:
+			return r.skip(1)
+		case sub == 12 || sub == 14:
+			return r.lebs(2)
+		}
+		return fmt.Errorf("%w: unknown instruction 0xfc %d", ErrBadModule, sub)
+	case op == 0xfd:
+		sub, err := r.leb()
+		if err != nil {
+			return err
+		}
+		switch {
+		case sub <= 0x0b || sub == 0x5c || sub == 0x5d:
+			return r.lebs(2)
+		case sub == 0x0c || sub == 0x0d:
+			return r.skip(16)
+		case sub >= 0x15 && sub <= 0x22:
+			return r.skip(1)
+		case sub >= 0x54 && sub <= 0x5b:
+			if err := r.lebs(2); err != nil {
+				return err
+			}
+			return r.skip(1)
+		}
+		return nil
+	case op <= 0x01 || op == 0x05 || op == 0x0b || op == 0x0f || op == 0x1a || op == 0x1b || (op >= 0x45 && op <= 0xc4) || op == 0xd1:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown instruction 0x%x", ErrBadModule, op)
+}
+
+// meterBody puts a gas charge in front of every run of instructions of a
+// function body.
+func meterBody(body []byte, global uint32) ([]byte, error) {
+	r := &wasmReader{data: body}
+	locals, err := r.leb()
+	if err != nil {
+		return nil, err
+	}
+	for range locals {
+		if err := r.lebs(1); err != nil {
+			return nil, err
+		}
+		if err := r.skip(1); err != nil {
+			return nil, err
+		}
+	}
+	out := append([]byte{}, body[:r.pos]...)
+	runStart, count := r.pos, 0
+	for !r.eof() {
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if err := r.skipInstr(op); err != nil {
+			return nil, err
+		}
+		count++
+		if endsRun(op) || r.eof() {
+			out = append(out, gasCharge(global, count)...)
+			out = append(out, body[runStart:r.pos]...)
+			runStart, count = r.pos, 0
+		}
+	}
+	return out, nil
+}
+
+func appendSection(b []byte, id byte, content []byte) []byte {
+	b = append(b, id)
+	b = appendU32(b, uint32(len(content)))
+	return append(b, content...)
+}
+
+// countImportedGlobals tells how many of the globals of a module are imported,
+// the index of the first global it defines.
+func countImportedGlobals(section []byte) (uint32, error) {
+	r := &wasmReader{data: section}
+	n, err := r.leb()
+	if err != nil {
+		return 0, err
+	}
+	globals := uint32(0)
+	for range n {
+		if _, err := r.vec(); err != nil {
+			return 0, err
+		}
+		if _, err := r.vec(); err != nil {
+			return 0, err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		switch kind {
+		case 0x00:
+			err = r.lebs(1)
+		case 0x01, 0x02:
+			if kind == 0x01 {
+				err = r.skip(1)
+			}
+			if err == nil {
+				var flags byte
+				if flags, err = r.byte(); err == nil {
+					err = r.lebs(1 + int(flags&0x01))
+				}
+			}
+		case 0x03:
+			globals++
+			err = r.skip(2)
+		case 0x04:
+			if err = r.skip(1); err == nil {
+				err = r.lebs(1)
+			}
+		default:
+			err = fmt.Errorf("%w: unknown import kind %d", ErrBadModule, kind)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return globals, nil
+}
+
+// appendToVec adds an entry to a section holding a single vector.
+func appendToVec(section []byte, entry []byte) ([]byte, error) {
+	r := &wasmReader{data: section}
+	n, err := r.leb()
+	if err != nil {
+		return nil, err
+	}
+	out := appendU32(nil, uint32(n)+1)
+	out = append(out, section[r.pos:]...)
+	return append(out, entry...), nil
+}
+
+// sectionOrder is the place a known section takes in a module.
+var sectionOrder = map[byte]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 13: 6, 6: 7, 7: 8, 8: 9, 9: 10, 12: 11, 10: 12, 11: 13}
+
+// meterModule returns a module with the gas of every instruction it runs
+// taken off its exported gas global.
+func meterModule(code []byte) ([]byte, error) {
+	if len(code) < 8 || !bytes.Equal(code[:4], []byte("\x00asm")) {
+		return nil, ErrBadModule
+	}
+	type section struct {
+		id      byte
+		content []byte
+	}
+	sections := []section{}
+	r := &wasmReader{data: code, pos: 8}
+	for !r.eof() {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		content, err := r.vec()
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, section{id, content})
+	}
+	global := uint32(0)
+	for _, s := range sections {
+		if s.id == 2 {
+			imported, err := countImportedGlobals(s.content)
+			if err != nil {
+				return nil, err
+			}
+			global += imported
+		}
+		if s.id == 6 {
+			defined, err := (&wasmReader{data: s.content}).leb()
+			if err != nil {
+				return nil, err
+			}
+			global += uint32(defined)
+		}
+	}
+	// a mutable i64 starting at gasStart
+	globalEntry := appendI64([]byte{0x7e, 0x01, 0x42}, gasStart)
+	globalEntry = append(globalEntry, 0x0b)
+	exportEntry := appendU32(nil, uint32(len(gasGlobal)))
+	exportEntry = append(exportEntry, gasGlobal...)
+	exportEntry = append(exportEntry, 0x03)
+	exportEntry = appendU32(exportEntry, global)
+
+	out := append([]byte{}, code[:8]...)
+	added := map[byte]bool{}
+	// addMissing writes the global and export sections a module lacks, in
+	// front of the first section that has to follow them, or at the end
+	addMissing := func(before byte) {
+		order, known := sectionOrder[before]
+		if !known {
+			return
+		}
+		if !added[6] && order > sectionOrder[6] {
+			out = appendSection(out, 6, append(appendU32(nil, 1), globalEntry...))
+			added[6] = true
+		}
+		if !added[7] && order > sectionOrder[7] {
+			out = appendSection(out, 7, append(appendU32(nil, 1), exportEntry...))
+			added[7] = true
+		}
+	}
+	for _, s := range sections {
+		addMissing(s.id)
+		content := s.content
+		var err error
+		switch s.id {
+		case 6:
+			content, err = appendToVec(content, globalEntry)
+			added[6] = true
+		case 7:
+			content, err = appendToVec(content, exportEntry)
+			added[7] = true
+		case 10:
+			content, err = meterCode(content, global)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = appendSection(out, s.id, content)
+	}
+	addMissing(11)
+	return out, nil
+}
+
+func meterCode(section []byte, global uint32) ([]byte, error) {
+	r := &wasmReader{data: section}
+	n, err := r.leb()
+	if err != nil {
+		return nil, err
+	}
+	out := appendU32(nil, uint32(n))
+	for range n {
+		body, err := r.vec()
+		if err != nil {
+			return nil, err
+		}
+		metered, err := meterBody(body, global)
+		if err != nil {
+			return nil, err
+		}
+		out = appendU32(out, uint32(len(metered)))
+		out = append(out, metered...)
+	}
+	return out, nil
+}
@@ -1,17 +1,17 @@
 package wasm
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"kasper/src/abstract/adapters/docker"
 	"kasper/src/abstract/adapters/file"
+	"kasper/src/abstract/adapters/scheduler"
 	"kasper/src/abstract/adapters/signaler"
 	"kasper/src/abstract/adapters/storage"
 	iaction "kasper/src/abstract/models/action"
+	"kasper/src/abstract/models/chain"
 	"kasper/src/abstract/models/core"
 	"kasper/src/abstract/models/packet"
 	"kasper/src/abstract/models/trx"
@@ -24,11 +24,13 @@ import (
 	inputs_users "kasper/src/shell/api/inputs/users"
 	"kasper/src/shell/api/model"
 	updates_points "kasper/src/shell/api/updates/points"
+	"kasper/src/shell/utils/egress"
 	"kasper/src/shell/utils/future"
 	"log"
-	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	zmq "github.com/pebbe/zmq4"
@@ -41,28 +43,47 @@ type Wasm struct {
 	docker      docker.IDocker
 	file        file.IFile
 	aeSocket    chan string
+	aeConnect   sync.Once
+	exportsLock sync.Mutex
+	exports     map[string]chan map[string]string
+	embedded    *embedded
+	runtime     string
+}
+
+var MachineExportTimeout = 30 * time.Second
+
+func (wm *Wasm) runOffChain(machineId string, input string) {
+	astPath := wm.app.Tools().Storage().StorageRoot() + "/machines/" + machineId + "/module"
+	if wm.embedded != nil {
+		future.Async(func() { wm.embedded.runOffChain(machineId, astPath, input) }, false)
+		return
+	}
+	str, _ := json.Marshal(map[string]any{
+		"type":      "runOffChain",
+		"machineId": machineId,
+		"input":     input,
+		"astPath":   astPath,
+	})
+	wm.aeSocket <- string(str)
 }
 
 func (wm *Wasm) Assign(machineId string) {
 	wm.app.Tools().Signaler().ListenToSingle(&signaler.Listener{
 		Id: machineId,
 		Signal: func(key string, a any) {
-			astPath := wm.app.Tools().Storage().StorageRoot() + "/machines/" + machineId + "/module"
 			data := string(a.([]byte))
 			if key == "points/signal" {
-				str, _ := json.Marshal(map[string]any{
-					"type":      "runOffChain",
-					"machineId": machineId,
-					"input":     data,
-					"astPath":   astPath,
-				})
-				wm.aeSocket <- string(str)
+				wm.runOffChain(machineId, data)
 			}
 		},
 	})
 }
 
 func (wm *Wasm) ExecuteChainTrxsGroup(trxs []*worker.Trx) {
+	if wm.embedded != nil {
+		wm.embedded.chainGroups <- trxs
+		return
+	}
 	b, e := json.Marshal(trxs)
 	if e != nil {
 		println(e)
@@ -79,6 +100,17 @@ func (wm *Wasm) ExecuteChainTrxsGroup(trxs []*worker.Trx) {
 }
 
 func (wm *Wasm) ExecuteChainEffects(effects string) {
+	if wm.embedded != nil {
+		ops := []ChainDbOp{}
+		if err := json.Unmarshal([]byte(effects), &ops); err != nil {
+			log.Println(err)
+			return
+		}
+		if err := applyDbOps(wm.embedded.db, ops); err != nil {
+			log.Println(err)
+		}
+		return
+	}
 	str, _ := json.Marshal(map[string]any{
 		"type":    "applyTrxEffects",
 		"effects": effects,
@@ -86,6 +118,48 @@ func (wm *Wasm) ExecuteChainEffects(effects string) {
 	wm.aeSocket <- string(str)
 }
 
+// Runtime is the runtime the wasm machines of the node run on, "appengine" for
+// the app engine reached over zmq or "wazero" for the embedded runtime.
+func (wm *Wasm) Runtime() string {
+	return wm.runtime
+}
+
+// ExportMachineState collects every applet key of a machine from the runtime
+// of the node.
+func (wm *Wasm) ExportMachineState(machineId string) (map[string]string, error) {
+	if wm.embedded != nil {
+		return wm.embedded.exportMachineState(machineId)
+	}
+	return wm.exportFromAppEngine(machineId)
+}
+
+func (wm *Wasm) exportFromAppEngine(machineId string) (map[string]string, error) {
+	result := make(chan map[string]string, 1)
+	wm.exportsLock.Lock()
+	if _, busy := wm.exports[machineId]; busy {
+		wm.exportsLock.Unlock()
+		return nil, errors.New("machine state export already running")
+	}
+	wm.exports[machineId] = result
+	wm.exportsLock.Unlock()
+	defer func() {
+		wm.exportsLock.Lock()
+		delete(wm.exports, machineId)
+		wm.exportsLock.Unlock()
+	}()
+	str, _ := json.Marshal(map[string]any{
+		"type":      "exportMachineState",
+		"machineId": machineId,
+	})
+	wm.aeSocket <- string(str)
+	select {
+	case state := <-result:
+		return state, nil
+	case <-time.After(MachineExportTimeout):
+		return nil, errors.New("machine state export timed out")
+	}
+}
+
 type ChainDbOp struct {
 	OpType string `json:"opType"`
 	Key    string `json:"key"`
@@ -103,16 +177,8 @@ func (wm *Wasm) RunVm(machineId string, pointId string, data string) {
 	if !isMemberOfPoint {
 		return
 	}
-	astPath := wm.app.Tools().Storage().StorageRoot() + "/machines/" + machineId + "/module"
 	b, _ := json.Marshal(updates_points.Send{User: model.User{}, Point: point, Action: "single", Data: data})
-	input := string(b)
-	str, _ := json.Marshal(map[string]any{
-		"type":      "runOffChain",
-		"machineId": machineId,
-		"input":     input,
-		"astPath":   astPath,
-	})
-	wm.aeSocket <- string(str)
+	wm.runOffChain(machineId, string(b))
 }
 
 func (wm *Wasm) WasmCallback(dataRaw string) (string, int64) {
@@ -199,47 +265,59 @@ func (wm *Wasm) WasmCallback(dataRaw string) (string, int64) {
 		creatorUserId := cnParts[2]
 		creatorSignature := cnParts[3]
 		lockId := cnParts[4]
-		inp, _ := json.Marshal(inputs_users.ConsumeLockInput{
-			Type:      "pay",
-			UserId:    creatorUserId,
-			Signature: creatorSignature,
-			LockId:    lockId,
-			Amount:    100,
+		lockAmount := int64(0)
+		wm.app.ModifyState(true, func(trx trx.ITrx) error {
+			if m, e := trx.GetJson("Json::User::"+creatorUserId, "lockedTokens."+lockId); e == nil && m["type"] == "pay" {
+				lockAmount = int64(m["amount"].(float64))
+			}
+			return nil
 		})
-		sign := wm.app.SignPacketAsOwner(inp)
-		resChan := make(chan bool)
-		wm.app.ExecBaseRequestOnChain("/users/consumeLock", inp, sign, wm.app.OwnerId(), "", func(b []byte, i int, err error) {
+		if lockAmount <= 0 {
+			err := errors.New("payment lock not found")
+			println(err)
+			return err.Error(), reqId
+		}
+		// the run is paid from the lock at the price of what the vm declared,
+		// never more than was locked
+		pay := func() {
+			inp, _ := json.Marshal(inputs_users.ConsumeLockInput{
+				Type:      "pay",
+				UserId:    creatorUserId,
+				Signature: creatorSignature,
+				LockId:    lockId,
+				Amount:    min(max(wm.docker.RunCost(machineId), 1), lockAmount),
+			})
+			sign := wm.app.SignPacketAsOwner(inp)
+			wm.app.ExecBaseRequestOnChain("/users/consumeLock", inp, sign, wm.app.OwnerId(), "", func(b []byte, i int, err error) {
+				if err != nil {
+					println(err)
+				}
+			})
+		}
+		if isAsync {
+			future.Async(func() {
+				if imageName != "main" || containerName != "main" {
+					wm.docker.Assign(machineId + "_" + imageName + "_" + containerName)
+				}
+				wm.docker.SaRContainer(machineId, imageName, containerName)
+				wm.docker.RunContainer(machineId, pointId, imageName, containerName, finalInputFiles, false)
+				pay()
+			}, false)
+		} else {
+			wm.docker.SaRContainer(machineId, imageName, containerName)
+			outputFile, _, err := wm.docker.RunContainer(machineId, pointId, imageName, containerName, finalInputFiles, false)
+			pay()
 			if err != nil {
 				println(err)
-				resChan <- false
-			} else {
-				resChan <- true
+				return err.Error(), reqId
 			}
-		})
-		if res := <-resChan; res {
-			if isAsync {
-				future.Async(func() {
-					if imageName != "main" || containerName != "main" {
-						wm.docker.Assign(machineId + "_" + imageName + "_" + containerName)
-					}
-					wm.docker.SaRContainer(machineId, imageName, containerName)
-					wm.docker.RunContainer(machineId, pointId, imageName, containerName, finalInputFiles, false)
-				}, false)
-			} else {
-				wm.docker.SaRContainer(machineId, imageName, containerName)
-				outputFile, err := wm.docker.RunContainer(machineId, pointId, imageName, containerName, finalInputFiles, false)
+			if outputFile != nil {
+				str, err := json.Marshal(outputFile)
 				if err != nil {
 					println(err)
 					return err.Error(), reqId
 				}
-				if outputFile != nil {
-					str, err := json.Marshal(outputFile)
-					if err != nil {
-						println(err)
-						return err.Error(), reqId
-					}
-					return string(str), reqId
-				}
+				return string(str), reqId
 			}
 		}
 	} else if key == "execDocker" {
@@ -301,6 +379,30 @@ func (wm *Wasm) WasmCallback(dataRaw string) (string, int64) {
 			return err.Error(), reqId
 		}
 		return "", reqId
+	} else if key == "machineState" {
+		machineId, err := checkField(input, "machineId", "")
+		if err != nil {
+			println(err)
+			return err.Error(), reqId
+		}
+		stateRaw, err := checkField[map[string]any](input, "state", nil)
+		if err != nil {
+			println(err)
+			return err.Error(), reqId
+		}
+		state := map[string]string{}
+		for k, v := range stateRaw {
+			if str, ok := v.(string); ok {
+				state[k] = str
+			}
+		}
+		wm.exportsLock.Lock()
+		result, ok := wm.exports[machineId]
+		wm.exportsLock.Unlock()
+		if ok {
+			result <- state
+		}
+		return "", reqId
 	} else if key == "log" {
 		_, err := checkField(input, "text", "")
 		if err != nil {
@@ -309,6 +411,11 @@ func (wm *Wasm) WasmCallback(dataRaw string) (string, int64) {
 		}
 		// println("elpis vm:", text)
 	} else if key == "httpPost" {
+		machineId, err := checkField(input, "machineId", "")
+		if err != nil {
+			println(err)
+			return err.Error(), reqId
+		}
 		url, err := checkField(input, "url", "")
 		if err != nil {
 			println(err)
@@ -326,34 +433,22 @@ func (wm *Wasm) WasmCallback(dataRaw string) (string, int64) {
 			println(err)
 			return err.Error(), reqId
 		}
-		req, err := http.NewRequest(method, url, bytes.NewBuffer([]byte(body)))
-		if err != nil {
-			println("Error creating request:" + err.Error())
-			return err.Error(), reqId
-		}
+		// the call is metered against the token of the committed request
+		// the machine runs it for, never one the machine names itself
+		callbackId, _ := checkField(input, "callbackId", "")
 		heads := map[string]string{}
 		err = json.Unmarshal([]byte(headers), &heads)
 		if err != nil {
 			println(err)
 			return err.Error(), reqId
 		}
-		for k, v := range heads {
-			req.Header.Set(k, v)
-		}
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		res, err := egress.Send(wm.app, callbackId, egress.Request{MachineId: machineId, Method: method, Url: url, Headers: heads, Body: []byte(body)})
 		if err != nil {
 			println("Request failed:" + err.Error())
 			return err.Error(), reqId
 		}
-		defer resp.Body.Close()
-		println("Response status:" + resp.Status)
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			println("Error reading response body:" + err.Error())
-			return err.Error(), reqId
-		}
-		return base64.StdEncoding.EncodeToString(bodyBytes), reqId
+		println("Response status:" + strconv.Itoa(res.Status))
+		return base64.StdEncoding.EncodeToString(res.Body), reqId
 	} else if key == "checkTokenValidity" {
 		tokenOwnerId, err := checkField(input, "tokenOwnerId", "")
 		if err != nil {
@@ -366,16 +461,14 @@ func (wm *Wasm) WasmCallback(dataRaw string) (string, int64) {
 			return err.Error(), reqId
 		}
 		gasLimit := int64(0)
+		metered := int64(0)
 		wm.app.ModifyState(true, func(trx trx.ITrx) error {
-			if trx.GetString("Temp::User::"+tokenOwnerId+"::consumedTokens::"+tokenId) == "true" {
-				return nil
-			}
-			if m, e := trx.GetJson("Json::User::"+tokenOwnerId, "lockedTokens."+tokenId); e == nil {
-				gasLimit = int64(m["amount"].(float64))
-			}
+			meter := model.TokenMeter{TokenOwnerId: tokenOwnerId, TokenId: tokenId}
+			gasLimit, _ = meter.Remaining(trx)
+			metered = meter.Cost(trx)
 			return nil
 		})
-		jsn, _ := json.Marshal(map[string]any{"gasLimit": gasLimit})
+		jsn, _ := json.Marshal(map[string]any{"gasLimit": gasLimit, "metered": metered})
 		return string(jsn), reqId
 	} else if key == "submitOnchainResponse" {
 		callbackId, err := checkField(input, "callbackId", "")
@@ -418,12 +511,16 @@ func (wm *Wasm) WasmCallback(dataRaw string) (string, int64) {
 			println(err)
 			return err.Error(), reqId
 		}
-		trxInp := packet.ConsumeTokenInput{TokenId: tokenId, Amount: int64(cost), TokenOwnerId: tokenOwnerId}
-		i, _ := json.Marshal(trxInp)
+		amount := int64(cost)
 		wm.app.ModifyState(false, func(trx trx.ITrx) error {
+			meter := model.TokenMeter{TokenOwnerId: tokenOwnerId, TokenId: tokenId}
+			amount = max(amount, meter.Cost(trx))
 			trx.PutString("Temp::User::"+tokenOwnerId+"::consumedTokens::"+tokenId, "true")
+			meter.Clear(trx)
 			return nil
 		})
+		trxInp := packet.ConsumeTokenInput{TokenId: tokenId, Amount: amount, TokenOwnerId: tokenOwnerId}
+		i, _ := json.Marshal(trxInp)
 		wm.app.ExecAppletResponseOnChain(callbackId, []byte(pack), "#appletsign", int(resCode), e, []update.Update{{Val: []byte("consumeToken: " + string(i))}, {Val: []byte("applet: " + changes)}})
 	} else if key == "submitOnchainTrx" {
 		machineId, err := checkField(input, "machineId", "")
@@ -511,7 +608,7 @@ func (wm *Wasm) WasmCallback(dataRaw string) (string, int64) {
 				wm.app.ExecBaseRequestOnChain(k, data, userSignature, userId, tag, func(b []byte, i int, err error) {
 					if err != nil {
 						println(err)
-						return
+						b = chain.FailedResult(i)
 					}
 					result = b
 					if !isRequesterOnchain {
@@ -542,7 +639,7 @@ func (wm *Wasm) WasmCallback(dataRaw string) (string, int64) {
 				wm.app.ExecAppletRequestOnChain(dstPointId, targetMachineId, k, data, userSignature, userId, tag, tokenId, func(b []byte, i int, err error) {
 					if err != nil {
 						println(err)
-						return
+						b = chain.FailedResult(i)
 					}
 					result = b
 					if !isRequesterOnchain {
@@ -586,27 +683,59 @@ func (wm *Wasm) WasmCallback(dataRaw string) (string, int64) {
 			return err.Error(), reqId
 		}
 		if tag == "alarm" {
-			future.Async(func() {
-				wm.app.ModifyState(false, func(trx trx.ITrx) error {
-					trx.PutLink("vmAlarmPointId::"+machineId, pointId)
-					trx.PutLink("vmAlarmData::"+machineId, data)
-					trx.PutLink("vmAlarmTime::"+machineId, fmt.Sprintf("%d", time.Now().UnixMilli()+(int64(count)*1000)))
-					return nil
-				})
-				time.Sleep(time.Duration(count) * time.Second)
-				wm.app.ModifyState(false, func(trx trx.ITrx) error {
-					trx.DelKey("link::vmAlarmPointId::" + machineId)
-					trx.DelKey("link::vmAlarmData::" + machineId)
-					trx.DelKey("link::vmAlarmTime::" + machineId)
-					return nil
-				})
-				if wm.app.Tools().Security().HasAccessToPoint(machineId, pointId) {
-					wm.RunVm(machineId, pointId, data)
-				}
-			}, false)
+			name, _ := checkField(input, "name", "alarm")
+			cron, _ := checkField(input, "cron", "")
+			at, _ := checkField(input, "at", float64(0))
+			// a timer planted while running a committed request runs on chain
+			// time from the block of that request, unless asked otherwise
+			callbackId, _ := checkField(input, "callbackId", "")
+			request, running := wm.app.RunningRequest(machineId, callbackId)
+			onChain, _ := checkField(input, "onChain", running)
+			if onChain && !running {
+				err := errors.New("on chain timers can only be planted by a committed request")
+				println(err)
+				return err.Error(), reqId
+			}
+			timer, err := wm.app.Tools().Scheduler().Schedule(scheduler.Timer{
+				MachineId: machineId,
+				Name:      name,
+				PointId:   pointId,
+				Input:     data,
+				Cron:      cron,
+				OnChain:   onChain,
+				FireAt:    int64(at),
+				CreatedAt: request.BlockTime,
+			}, time.Duration(count)*time.Second)
+			if err != nil {
+				println(err)
+				return err.Error(), reqId
+			}
+			jsn, _ := json.Marshal(timer)
+			return string(jsn), reqId
 		} else {
 			wm.app.PlantChainTrigger(int(count), machineId, tag, machineId, pointId, data)
 		}
+	} else if key == "cancelTimer" {
+		machineId, err := checkField(input, "machineId", "")
+		if err != nil {
+			println(err)
+			return err.Error(), reqId
+		}
+		name, err := checkField(input, "name", "")
+		if err != nil {
+			println(err)
+			return err.Error(), reqId
+		}
+		jsn, _ := json.Marshal(map[string]any{"cancelled": wm.app.Tools().Scheduler().Cancel(machineId, name)})
+		return string(jsn), reqId
+	} else if key == "listTimers" {
+		machineId, err := checkField(input, "machineId", "")
+		if err != nil {
+			println(err)
+			return err.Error(), reqId
+		}
+		jsn, _ := json.Marshal(map[string]any{"timers": wm.app.Tools().Scheduler().List(machineId)})
+		return string(jsn), reqId
 	} else if key == "signalPoint" {
 		machineId, err := checkField(input, "machineId", "")
 		if err != nil {
@@ -675,6 +804,10 @@ func checkField[T any](input map[string]any, fieldName string, defVal T) (T, err
 
 func NewWasm(core core.ICore, storageRoot string, storage storage.IStorage, kvDbPath string, docker docker.IDocker, file file.IFile) *Wasm {
 	os.MkdirAll(kvDbPath, os.ModePerm)
+	runtime := "appengine"
+	if v := os.Getenv("WASM_RUNTIME"); v != "" {
+		runtime = v
+	}
 	wm := &Wasm{
 		app:         core,
 		storageRoot: storageRoot,
@@ -682,7 +815,38 @@ func NewWasm(core core.ICore, storageRoot string, storage storage.IStorage, kvDb
 		docker:      docker,
 		file:        file,
 		aeSocket:    make(chan string, 1000),
+		exports:     map[string]chan map[string]string{},
+		runtime:     runtime,
 	}
+	switch runtime {
+	case "wazero":
+		log.Println("running wasm machines on the embedded runtime...")
+		embedded := newEmbedded(wm, kvDbPath)
+		// the state the app engine holds is copied through it, and the
+		// embedded runtime takes over once it is
+		if err := embedded.migrate(func(machineId string) (map[string]string, error) {
+			wm.connectAppEngine()
+			return wm.exportFromAppEngine(machineId)
+		}); err != nil {
+			log.Fatalf("failed to migrate the applet state of the app engine, start it once more: %v", err)
+		}
+		wm.embedded = embedded
+		return wm
+	case "appengine":
+	default:
+		log.Fatalf("unknown wasm runtime %s", runtime)
+	}
+	wm.connectAppEngine()
+	return wm
+}
+
+// connectAppEngine starts the zmq sockets the node and the app engine talk
+// over, once.
+func (wm *Wasm) connectAppEngine() {
+	wm.aeConnect.Do(wm.runAppEngineBridge)
+}
+
+func (wm *Wasm) runAppEngineBridge() {
 	future.Async(func() {
 		zctx, _ := zmq.NewContext()
 		s, _ := zctx.NewSocket(zmq.REP)
@@ -716,9 +880,10 @@ func NewWasm(core core.ICore, storageRoot string, storage storage.IStorage, kvDb
 			s.Send("", 0)
 		}
 	}, true)
-	return wm
 }
 
 func (wm *Wasm) CloseKVDB() {
-	// C.close()
+	if wm.embedded != nil {
+		wm.embedded.close()
+	}
 }
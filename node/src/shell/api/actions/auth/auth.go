@@ -1,9 +1,13 @@
 package actions_auth
 
 import (
+	"errors"
 	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/trx"
 	"kasper/src/abstract/state"
+	"kasper/src/core/module/actor/model/secured"
 	inputsauth "kasper/src/shell/api/inputs/auth"
+	"kasper/src/shell/api/model"
 	outputsauth "kasper/src/shell/api/outputs/auth"
 )
 
@@ -17,10 +21,34 @@ func Install(a *Actions, extra ...any) error {
 
 // GetServerPublicKey /auths/getServerPublicKey check [ false false false ] access [ true false false false GET ]
 func (a *Actions) GetServerPublicKey(_ state.IState, _ inputsauth.GetServerKeyInput) (any, error) {
-	return &outputsauth.GetServerKeyOutput{PublicKey: string(a.App.Tools().Security().FetchKeyPair("server_key")[1])}, nil
+	sec := a.App.Tools().Security()
+	rotations := sec.KeyRotations("server_key")
+	version := int64(0)
+	if len(rotations) > 0 {
+		version = rotations[len(rotations)-1].Version
+	}
+	return &outputsauth.GetServerKeyOutput{PublicKey: string(sec.FetchKeyPair("server_key")[1]), Version: version, Rotations: rotations}, nil
 }
 
 // GetServersMap /auths/getServersMap check [ false false false ] access [ true false false false GET ]
 func (a *Actions) GetServersMap(_ state.IState, _ inputsauth.GetServersMapInput) (any, error) {
-	return outputsauth.GetServersMapOutput{Servers: a.App.Tools().Network().Chain().Peers()}, nil
+	servers := a.App.Tools().Network().Chain().Peers()
+	nodes := []model.Node{}
+	a.App.ModifyState(true, func(trx trx.ITrx) error {
+		for _, server := range servers {
+			if node, found := (model.Node{Origin: server}).Resolve(trx); found {
+				nodes = append(nodes, node)
+			}
+		}
+		return nil
+	})
+	return outputsauth.GetServersMapOutput{Servers: servers, Nodes: nodes}, nil
+}
+
+// GetRateLimitStats /auths/getRateLimitStats check [ true false false ] access [ true false false false GET ]
+func (a *Actions) GetRateLimitStats(state state.IState, _ inputsauth.GetRateLimitStatsInput) (any, error) {
+	if !state.Info().IsGod() {
+		return nil, errors.New("access denied")
+	}
+	return outputsauth.GetRateLimitStatsOutput{Rejections: secured.Limiter.Rejections()}, nil
 }
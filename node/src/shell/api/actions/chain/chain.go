@@ -2,9 +2,13 @@ package actions_chain
 
 import (
 	"encoding/json"
+	"errors"
+	"kasper/src/abstract/adapters/security"
 	"kasper/src/abstract/models/core"
 	"kasper/src/abstract/state"
 	inputs_chain "kasper/src/shell/api/inputs/chain"
+	"kasper/src/shell/api/model"
+	"kasper/src/shell/utils/crypto"
 	"net"
 )
 
@@ -48,14 +52,34 @@ func (a *Actions) SubmitBaseTrx(state state.IState, input inputs_chain.SubBaseTr
 
 // RegisterNode /chains/registerNode check [ true false false ] access [ true false false false POST ]
 func (a *Actions) RegisterNode(state state.IState, input inputs_chain.RegisterNodeInput) (any, error) {
-	ipAddr := ""
+	if input.Orig != state.Source() {
+		return nil, errors.New("a node can only be registered through itself")
+	}
+	node := model.Node{Origin: input.Orig, OwnerId: state.Info().UserId(), PublicKey: input.PublicKey, CertFingerprint: input.CertFingerprint, WasmRuntime: input.WasmRuntime}
+	existing := (model.Node{Origin: input.Orig}).Pull(state.Trx())
+	if existing.OwnerId != "" && existing.OwnerId != node.OwnerId {
+		return nil, errors.New("origin is owned by another user")
+	}
+	// a registered node proves the registration with the key it is known by,
+	// or with a key that key was rotated to, so an old registration can not be
+	// replayed and nobody else can put another key on its origin
+	knownKey := input.PublicKey
+	if existing.PublicKey != "" {
+		knownKey = security.FollowRotations(existing.PublicKey, input.Rotations)
+		if knownKey != input.PublicKey {
+			return nil, errors.New("node key does not follow from its registered key")
+		}
+	}
+	if err := crypto.VerifySignature([]byte(knownKey), node.ProofMessage(), input.Proof); err != nil {
+		return nil, errors.New("node proof is not valid")
+	}
 	ips, _ := net.LookupIP(input.Orig)
 	for _, ip := range ips {
 		if ipv4 := ip.To4(); ipv4 != nil {
-			ipAddr = ipv4.String()
+			node.Ip = ipv4.String()
 			break
 		}
 	}
-	state.Trx().PutLink("NodeIpToHost::"+ipAddr, input.Orig)
+	node.Push(state.Trx())
 	return map[string]any{}, nil
 }
@@ -1,6 +1,7 @@
 package actions_dummy
 
 import (
+	"kasper/src/abstract/models/chain"
 	"kasper/src/abstract/models/core"
 	"kasper/src/abstract/state"
 	"kasper/src/shell/api/inputs"
@@ -18,7 +19,7 @@ func Install(a *Actions, extra ...any) error {
 
 // Hello /api/hello check [ false false false ] access [ true false false false GET ]
 func (a *Actions) Hello(_ state.IState, input inputs.HelloInput) (any, error) {
-	a.App.Tools().Network().Chain().SubmitTrx("main", "", "message", []byte("hello " + input.Name + " !"))
+	a.App.Tools().Network().Chain().SubmitTrx("main", "", chain.TrxMessage, []byte("hello " + input.Name + " !"))
 	return map[string]any{"message": "hello " + input.Name + " !"}, nil
 }
 
@@ -1,8 +1,13 @@
 package actions_machine
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"kasper/src/abstract/adapters/scheduler"
 	"kasper/src/abstract/models/core"
 	"kasper/src/abstract/models/trx"
 	"kasper/src/abstract/state"
@@ -12,8 +17,8 @@ import (
 	updates_points "kasper/src/shell/api/updates/points"
 	"kasper/src/shell/utils/future"
 	"log"
+	"sort"
 	"strconv"
-	"time"
 
 	"github.com/google/uuid"
 )
@@ -25,6 +30,7 @@ type Actions struct {
 }
 
 func Install(a *Actions, extra ...any) error {
+	legacyAlarms := []scheduler.Timer{}
 	a.App.ModifyState(true, func(trx trx.ITrx) error {
 		vms, err := model.Vm{}.All(trx, -1, -1)
 		if err != nil {
@@ -34,20 +40,8 @@ func Install(a *Actions, extra ...any) error {
 			if vm.Runtime == "wasm" {
 				a.App.Tools().Wasm().Assign(vm.MachineId)
 				if pointId := trx.GetLink("vmAlarmPointId::" + vm.MachineId); pointId != "" {
-					future.Async(func() {
-						t, _ := strconv.ParseInt(trx.GetLink("vmAlarmTime::"+vm.MachineId), 10, 64)
-						ct := time.Now().UnixMilli()
-						if t > ct {
-							time.Sleep(time.Duration(t-ct) * time.Millisecond)
-						}
-						data := trx.GetLink("vmAlarmData::" + vm.MachineId)
-						trx.DelKey("link::vmAlarmPointId::" + vm.MachineId)
-						trx.DelKey("link::vmAlarmData::" + vm.MachineId)
-						trx.DelKey("link::vmAlarmTime::" + vm.MachineId)
-						if a.App.Tools().Security().HasAccessToPoint(vm.MachineId, pointId) {
-							a.App.Tools().Wasm().RunVm(vm.MachineId, pointId, data)
-						}
-					}, false)
+					t, _ := strconv.ParseInt(trx.GetLink("vmAlarmTime::"+vm.MachineId), 10, 64)
+					legacyAlarms = append(legacyAlarms, scheduler.Timer{MachineId: vm.MachineId, Name: "alarm", PointId: pointId, Input: trx.GetLink("vmAlarmData::" + vm.MachineId), FireAt: max(t, 1)})
 				}
 			} else if vm.Runtime == "elpis" {
 				a.App.Tools().Elpis().Assign(vm.MachineId)
@@ -75,6 +69,21 @@ func Install(a *Actions, extra ...any) error {
 		}
 		return nil
 	})
+	if len(legacyAlarms) > 0 {
+		a.App.ModifyState(false, func(trx trx.ITrx) error {
+			for _, alarm := range legacyAlarms {
+				if _, err := a.App.Tools().Scheduler().Schedule(alarm, 0); err != nil {
+					log.Println(err)
+					continue
+				}
+				trx.DelKey("link::vmAlarmPointId::" + alarm.MachineId)
+				trx.DelKey("link::vmAlarmData::" + alarm.MachineId)
+				trx.DelKey("link::vmAlarmTime::" + alarm.MachineId)
+			}
+			return nil
+		})
+	}
+	a.App.Tools().Scheduler().Start()
 	return nil
 }
 
@@ -103,7 +112,7 @@ func (a *Actions) CreateApp(state state.IState, input inputs_machiner.CreateAppI
 	}
 	trx.PutLink("createdApp::"+state.Info().UserId()+"::"+app.Id, "true")
 	trx.PutIndex("App", "title", "id", app.Id+"->"+profile["title"].(string), []byte(app.Id))
-	a.App.Tools().Network().Chain().NotifyNewMachineCreated(input.ChainId, app.Id)
+	a.App.Tools().Network().Chain().NotifyNewMachineCreated(trx, input.ChainId, app.Id)
 	return map[string]any{"app": app}, nil
 }
 
@@ -235,6 +244,9 @@ func (a *Actions) DeleteMachine(state state.IState, input inputs_machiner.Delete
 	app.Push(trx)
 	trx.DelIndex("Machine", "id", "appId", input.MachineId)
 	trx.DelKey("link::appMachines::" + app.Id + "::" + input.MachineId)
+	for _, timer := range a.App.Tools().Scheduler().List(input.MachineId) {
+		a.App.Tools().Scheduler().Cancel(input.MachineId, timer.Name)
+	}
 	return map[string]any{}, nil
 }
 
@@ -305,7 +317,10 @@ func (a *Actions) ReadBuildLogs(state state.IState, input inputs_machiner.ReadBu
 	if state.Trx().GetLink("vmBuilds::"+input.MachineId+"::"+input.BuildId) != "true" {
 		return nil, errors.New("build not found")
 	}
-	return map[string]any{"logs": a.App.Tools().Storage().ReadBuildLogs(input.BuildId, input.MachineId)}, nil
+	return map[string]any{
+		"logs":      a.App.Tools().Storage().ReadBuildLogs(input.BuildId, input.MachineId),
+		"versionId": state.Trx().GetLink("vmBuildVersion::" + input.MachineId + "::" + input.BuildId),
+	}, nil
 }
 
 // ReadMachineBuilds /machines/readMachineBuilds check [ true false false ] access [ true false false false POST ]
@@ -337,6 +352,17 @@ func (a *Actions) Deploy(state state.IState, input inputs_machiner.DeployInput)
 	if err != nil {
 		return nil, err
 	}
+	egressPolicy := model.VmEgress{}
+	if egRaw, ok := input.Metadata["egress"]; ok {
+		b, _ := json.Marshal(egRaw)
+		if err := json.Unmarshal(b, &egressPolicy); err != nil {
+			return nil, errors.New("egress policy is not valid")
+		}
+		if egressPolicy.MaxResponseBytes < 0 || egressPolicy.TimeoutSeconds < 0 {
+			return nil, errors.New("egress limits can not be negative")
+		}
+	}
+	trx.PutJson("MachineMeta::"+vm.MachineId, "metadata.egress", egressPolicy, false)
 	var standalone bool
 	if input.Runtime == "docker" {
 		if input.Metadata == nil {
@@ -363,6 +389,17 @@ func (a *Actions) Deploy(state state.IState, input inputs_machiner.DeployInput)
 		} else {
 			imageName = "main"
 		}
+		resources := model.VmResources{}
+		if resRaw, ok := input.Metadata["resources"]; ok {
+			b, _ := json.Marshal(resRaw)
+			if err := json.Unmarshal(b, &resources); err != nil {
+				return nil, errors.New("resources are not valid")
+			}
+			if resources.Cpus < 0 || resources.MemoryMb < 0 || resources.PidsLimit < 0 || resources.DiskMb < 0 || resources.TimeoutSeconds < 0 || resources.DbMb < 0 {
+				return nil, errors.New("resources can not be negative")
+			}
+		}
+		trx.PutJson("MachineMeta::"+vm.MachineId, "metadata.resources", resources, false)
 		filesRaw, ok := input.Metadata["files"]
 		if !ok {
 			return nil, errors.New("files not provided")
@@ -371,11 +408,7 @@ func (a *Actions) Deploy(state state.IState, input inputs_machiner.DeployInput)
 		if !ok2 {
 			return nil, errors.New("files is not map")
 		}
-		dockerfileFolderPath := a.App.Tools().Storage().StorageRoot() + pluginsTemplateName + vm.MachineId + "/" + imageName
-		err2 := a.App.Tools().File().SaveDataToGlobalStorage(dockerfileFolderPath, data, "Dockerfile", true)
-		if err2 != nil {
-			return nil, err2
-		}
+		contents := map[string][]byte{"Dockerfile": data}
 		for k, v := range files {
 			dataStr, ok := v.(string)
 			if !ok {
@@ -387,14 +420,168 @@ func (a *Actions) Deploy(state state.IState, input inputs_machiner.DeployInput)
 			if err != nil {
 				return nil, err
 			}
-			err2 := a.App.Tools().File().SaveDataToGlobalStorage(dockerfileFolderPath, data, k, true)
-			if err2 != nil {
-				return nil, err2
+			contents[k] = data
+		}
+		version, err := a.createVersion(state, vm, input.Runtime, imageName, standalone, contents)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.activateVersion(state, vm, version); err != nil {
+			return nil, err
+		}
+		return outputs_machiner.PlugInput{VersionId: version.Id}, nil
+	}
+	version, err := a.createVersion(state, vm, input.Runtime, "", false, map[string][]byte{"module": data})
+	if err != nil {
+		return nil, err
+	}
+	if err := a.activateVersion(state, vm, version); err != nil {
+		return nil, err
+	}
+	return outputs_machiner.PlugInput{VersionId: version.Id}, nil
+}
+
+// ListTimers /machines/listTimers check [ true false false ] access [ true false false false POST ]
+func (a *Actions) ListTimers(state state.IState, input inputs_machiner.ListTimersInput) (any, error) {
+	if _, err := a.ownedVm(state, input.MachineId); err != nil {
+		return nil, err
+	}
+	return map[string]any{"timers": a.App.Tools().Scheduler().List(input.MachineId)}, nil
+}
+
+// CancelTimer /machines/cancelTimer check [ true false false ] access [ true false false false POST ]
+func (a *Actions) CancelTimer(state state.IState, input inputs_machiner.CancelTimerInput) (any, error) {
+	if _, err := a.ownedVm(state, input.MachineId); err != nil {
+		return nil, err
+	}
+	if !a.App.Tools().Scheduler().Cancel(input.MachineId, input.Name) {
+		return nil, errors.New("timer not found")
+	}
+	return map[string]any{}, nil
+}
+
+// ListVersions /machines/listVersions check [ true false false ] access [ true false false false POST ]
+func (a *Actions) ListVersions(state state.IState, input inputs_machiner.ListVersionsInput) (any, error) {
+	trx := state.Trx()
+	if _, err := a.ownedVm(state, input.MachineId); err != nil {
+		return nil, err
+	}
+	versions, err := model.VmVersion{}.List(trx, input.MachineId)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"versions": versions, "activeVersionId": trx.GetLink("vmActiveVersion::" + input.MachineId)}, nil
+}
+
+// ActivateVersion /machines/activateVersion check [ true false false ] access [ true false false false POST ]
+func (a *Actions) ActivateVersion(state state.IState, input inputs_machiner.ActivateVersionInput) (any, error) {
+	trx := state.Trx()
+	vm, err := a.ownedVm(state, input.MachineId)
+	if err != nil {
+		return nil, err
+	}
+	if trx.GetLink("vmVersions::"+vm.MachineId+"::"+input.VersionId) != "true" {
+		return nil, errors.New("version not found")
+	}
+	version := model.VmVersion{Id: input.VersionId}.Pull(trx)
+	if err := a.activateVersion(state, vm, version); err != nil {
+		return nil, err
+	}
+	return map[string]any{"version": version}, nil
+}
+
+// Rollback /machines/rollback check [ true false false ] access [ true false false false POST ]
+func (a *Actions) Rollback(state state.IState, input inputs_machiner.RollbackInput) (any, error) {
+	trx := state.Trx()
+	vm, err := a.ownedVm(state, input.MachineId)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := model.VmVersion{}.List(trx, vm.MachineId)
+	if err != nil {
+		return nil, err
+	}
+	activeId := trx.GetLink("vmActiveVersion::" + vm.MachineId)
+	for i, v := range versions {
+		if v.Id == activeId {
+			if i+1 >= len(versions) {
+				break
+			}
+			if err := a.activateVersion(state, vm, versions[i+1]); err != nil {
+				return nil, err
 			}
+			return map[string]any{"version": versions[i+1]}, nil
 		}
+	}
+	return nil, errors.New("no previous version to roll back to")
+}
+
+func (a *Actions) ownedVm(state state.IState, machineId string) (model.Vm, error) {
+	trx := state.Trx()
+	if !trx.HasObj("Vm", machineId) {
+		return model.Vm{}, errors.New("vm not found")
+	}
+	vm := model.Vm{MachineId: machineId}.Pull(trx)
+	app := model.App{Id: vm.AppId}.Pull(trx)
+	if app.OwnerId != state.Info().UserId() {
+		return model.Vm{}, errors.New("access to vm denied")
+	}
+	return vm, nil
+}
+
+func (a *Actions) versionFolder(machineId string, versionId string) string {
+	return a.App.Tools().Storage().StorageRoot() + pluginsTemplateName + machineId + "/versions/" + versionId
+}
+
+func (a *Actions) createVersion(state state.IState, vm model.Vm, runtime string, imageName string, standalone bool, files map[string][]byte) (model.VmVersion, error) {
+	trx := state.Trx()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		size := make([]byte, 8)
+		binary.BigEndian.PutUint64(size, uint64(len(name)))
+		h.Write(size)
+		h.Write([]byte(name))
+		binary.BigEndian.PutUint64(size, uint64(len(files[name])))
+		h.Write(size)
+		h.Write(files[name])
+	}
+	version := model.VmVersion{
+		Id:         a.App.Tools().Storage().GenId(trx, "global"),
+		MachineId:  vm.MachineId,
+		Runtime:    runtime,
+		Hash:       hex.EncodeToString(h.Sum(nil)),
+		DeployerId: state.Info().UserId(),
+		Time:       a.App.ChainTime(),
+		ImageName:  imageName,
+		Standalone: standalone,
+		Files:      names,
+	}
+	folder := a.versionFolder(vm.MachineId, version.Id)
+	for _, name := range names {
+		if err := a.App.Tools().File().SaveDataToGlobalStorage(folder, files[name], name, true); err != nil {
+			return model.VmVersion{}, err
+		}
+	}
+	version.Push(trx)
+	trx.PutLink("vmVersions::"+vm.MachineId+"::"+version.Id, "true")
+	return version, nil
+}
+
+func (a *Actions) activateVersion(state state.IState, vm model.Vm, version model.VmVersion) error {
+	trx := state.Trx()
+	folder := a.versionFolder(vm.MachineId, version.Id)
+	if version.Runtime == "docker" {
 		outputChan := make(chan string)
 		buildId := uuid.NewString()
+		userId := state.Info().UserId()
 		trx.PutLink("vmBuilds::"+vm.MachineId+"::"+buildId, "true")
+		trx.PutLink("vmBuildVersion::"+vm.MachineId+"::"+buildId, version.Id)
+		trx.PutLink("vmVersionBuilds::"+vm.MachineId+"::"+version.Id+"::"+buildId, "true")
 		future.Async(func() {
 			for {
 				data := <-outputChan
@@ -402,26 +589,30 @@ func (a *Actions) Deploy(state state.IState, input inputs_machiner.DeployInput)
 					break
 				}
 				l := a.App.Tools().Storage().LogBuild(buildId, vm.MachineId, data)
-				a.App.Tools().Signaler().SignalUser("docker/build", state.Info().UserId(), l, true)
+				a.App.Tools().Signaler().SignalUser("docker/build", userId, l, true)
 			}
 		}, false)
 		future.Async(func() {
-			err3 := a.App.Tools().Docker().BuildImage(dockerfileFolderPath, vm.MachineId, imageName, outputChan)
-			if err3 != nil {
-				log.Println(err3)
+			err := a.App.Tools().Docker().BuildImage(folder, vm.MachineId, version.ImageName, outputChan)
+			if err != nil {
+				log.Println(err)
 			}
 		}, false)
-		if standalone {
-			vm.Runtime = input.Runtime
+		if version.Standalone {
+			vm.Runtime = version.Runtime
 			vm.Push(trx)
 			a.App.Tools().Docker().Assign(vm.MachineId)
 		}
 	} else {
+		data, err := a.App.Tools().File().ReadFileByPath(folder + "/module")
+		if err != nil {
+			return err
+		}
 		err2 := a.App.Tools().File().SaveDataToGlobalStorage(a.App.Tools().Storage().StorageRoot()+pluginsTemplateName+vm.MachineId+"/", data, "module", true)
 		if err2 != nil {
-			return nil, err2
+			return err2
 		}
-		vm.Runtime = input.Runtime
+		vm.Runtime = version.Runtime
 		vm.Push(trx)
 		if vm.Runtime == "wasm" {
 			a.App.Tools().Wasm().Assign(vm.MachineId)
@@ -429,7 +620,8 @@ func (a *Actions) Deploy(state state.IState, input inputs_machiner.DeployInput)
 			a.App.Tools().Elpis().Assign(vm.MachineId)
 		}
 	}
-	return outputs_machiner.PlugInput{}, nil
+	trx.PutLink("vmActiveVersion::"+vm.MachineId, version.Id)
+	return nil
 }
 
 // ListApps /apps/list check [ true false false ] access [ true false false false GET ]
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"kasper/src/abstract/models/action"
 	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/packet"
 	"kasper/src/abstract/models/trx"
 	"kasper/src/abstract/state"
 	inputs_points "kasper/src/shell/api/inputs/points"
@@ -1117,6 +1118,65 @@ func (a *Actions) Signal(state state.IState, input inputs_points.SignalInput) (a
 	return outputs_points.SignalOutput{Passed: false}, nil
 }
 
+func (a *Actions) pickOwnSignal(state state.IState, signalId string) (packet.LogPacket, error) {
+	logs := a.App.Tools().Storage().PickPointLogs(state.Info().PointId(), []string{signalId})
+	if len(logs) == 0 || logs[0].Deleted {
+		return packet.LogPacket{}, errors.New("signal not found")
+	}
+	if logs[0].UserId != state.Info().UserId() && state.Trx().GetLink("admin::"+state.Info().PointId()+"::"+state.Info().UserId()) != "true" {
+		return packet.LogPacket{}, errors.New("access not permitted")
+	}
+	return logs[0], nil
+}
+
+// EditSignal /points/editSignal check [ true true true ] access [ true false false false POST ]
+func (a *Actions) EditSignal(state state.IState, input inputs_points.EditSignalInput) (any, error) {
+	trx := state.Trx()
+	a.Locks.SetIfAbsent(state.Info().PointId(), &LockHolder{})
+	locker, _ := a.Locks.Get(state.Info().PointId())
+	locker.Lock.Lock()
+	defer locker.Lock.Unlock()
+	old, err := a.pickOwnSignal(state, input.SignalId)
+	if err != nil {
+		return nil, err
+	}
+	point := model.Point{Id: state.Info().PointId()}.Pull(trx)
+	user := model.User{Id: state.Info().UserId()}.Pull(trx)
+	result := a.App.Tools().Storage().UpdateLog(point.Id, old.UserId, old.Id, input.Data, old.Time)
+	if lp, err := trx.GetJson("PointMeta::"+point.Id, "metadata.public.lastPacket"); err == nil && lp["id"] == result.Id {
+		trx.PutJson("PointMeta::"+point.Id, "metadata.public.lastPacket", result, false)
+	}
+	var p = updates_points.SignalEdited{Id: result.Id, Point: point, User: user, Data: result.Data, Time: result.Time}
+	future.Async(func() {
+		a.App.Tools().Signaler().SignalGroup("points/signalEdited", point.Id, p, true, []string{state.Info().UserId()})
+	}, false)
+	return outputs_points.SignalOutput{Passed: true, Packet: result}, nil
+}
+
+// DeleteSignal /points/deleteSignal check [ true true true ] access [ true false false false POST ]
+func (a *Actions) DeleteSignal(state state.IState, input inputs_points.DeleteSignalInput) (any, error) {
+	trx := state.Trx()
+	a.Locks.SetIfAbsent(state.Info().PointId(), &LockHolder{})
+	locker, _ := a.Locks.Get(state.Info().PointId())
+	locker.Lock.Lock()
+	defer locker.Lock.Unlock()
+	old, err := a.pickOwnSignal(state, input.SignalId)
+	if err != nil {
+		return nil, err
+	}
+	point := model.Point{Id: state.Info().PointId()}.Pull(trx)
+	user := model.User{Id: state.Info().UserId()}.Pull(trx)
+	result := a.App.Tools().Storage().DeleteLog(point.Id, old.UserId, old.Id, old.Time)
+	if lp, err := trx.GetJson("PointMeta::"+point.Id, "metadata.public.lastPacket"); err == nil && lp["id"] == result.Id {
+		trx.PutJson("PointMeta::"+point.Id, "metadata.public.lastPacket", result, false)
+	}
+	var p = updates_points.SignalDeleted{Id: result.Id, Point: point, User: user}
+	future.Async(func() {
+		a.App.Tools().Signaler().SignalGroup("points/signalDeleted", point.Id, p, true, []string{state.Info().UserId()})
+	}, false)
+	return outputs_points.SignalOutput{Passed: true, Packet: result}, nil
+}
+
 // History /points/history check [ true true true ] access [ true false false false POST ]
 func (a *Actions) History(state state.IState, input inputs_points.HistoryInput) (any, error) {
 	if state.Trx().GetLink("admin::"+state.Info().PointId()+"::"+state.Info().UserId()) != "true" {
@@ -1131,6 +1191,20 @@ func (a *Actions) History(state state.IState, input inputs_points.HistoryInput)
 	}
 }
 
+// MAXSEARCHRESULTS is the maximum number of messages returned by
+// /points/search
+const MAXSEARCHRESULTS = 100
+
+// Search /points/search check [ true true true ] access [ true false false false POST ]
+func (a *Actions) Search(state state.IState, input inputs_points.SearchInput) (any, error) {
+	if state.Trx().GetLink("admin::"+state.Info().PointId()+"::"+state.Info().UserId()) != "true" {
+		if meta, err := state.Trx().GetJson("PointAccess::"+state.Info().PointId()+"::"+state.Info().UserId(), "metadata"); err != nil || !meta["readHistory"].(bool) {
+			return nil, errors.New("access not permitted")
+		}
+	}
+	return outputs_points.SearchOutput{Packets: a.App.Tools().Storage().SearchPointLogs(state.Info().PointId(), input.Query, input.Offset, min(input.Count, MAXSEARCHRESULTS))}, nil
+}
+
 // List /points/list check [ true false false ] access [ true false false false GET ]
 func (a *Actions) List(state state.IState, input inputs_points.ListInput) (any, error) {
 	trx := state.Trx()
@@ -133,7 +133,7 @@ func Install(a *Actions, extra ...any) error {
 		}
 		inputBody := body[0:inputLength]
 		signature := body[inputLength:]
-		if success, _, _ := a.App.Tools().Security().AuthWithSignature(userId, inputBody, string(signature)); !success {
+		if success, _, _ := a.App.Tools().Security().AuthWithEnvelope(userId, r.URL.Path, "", inputBody, string(signature)); !success {
 			http.Error(w, "signature verification failed", http.StatusForbidden)
 			return
 		}
@@ -187,7 +187,7 @@ func Install(a *Actions, extra ...any) error {
 		userId := r.Header.Get("User-Id")
 		inputStr := r.Header.Get("Input")
 		signature := r.Header.Get("Signature")
-		if success, _, _ := a.App.Tools().Security().AuthWithSignature(userId, []byte(inputStr), signature); !success {
+		if success, _, _ := a.App.Tools().Security().AuthWithEnvelope(userId, r.URL.Path, "", []byte(inputStr), signature); !success {
 			http.Error(w, "signature verification failed", http.StatusForbidden)
 			return
 		}
@@ -271,7 +271,7 @@ func Install(a *Actions, extra ...any) error {
 		userId := r.Header.Get("User-Id")
 		inputStr := r.Header.Get("Input")
 		signature := r.Header.Get("Signature")
-		if success, _, _ := a.App.Tools().Security().AuthWithSignature(userId, []byte(inputStr), signature); !success {
+		if success, _, _ := a.App.Tools().Security().AuthWithEnvelope(userId, r.URL.Path, "", []byte(inputStr), signature); !success {
 			http.Error(w, "signature verification failed", http.StatusForbidden)
 			return
 		}
@@ -355,7 +355,7 @@ func Install(a *Actions, extra ...any) error {
 		userId := r.Header.Get("User-Id")
 		inputStr := r.Header.Get("Input")
 		signature := r.Header.Get("Signature")
-		if success, _, _ := a.App.Tools().Security().AuthWithSignature(userId, []byte(inputStr), signature); !success {
+		if success, _, _ := a.App.Tools().Security().AuthWithEnvelope(userId, r.URL.Path, "", []byte(inputStr), signature); !success {
 			http.Error(w, "signature verification failed", http.StatusForbidden)
 			return
 		}
@@ -430,7 +430,7 @@ func Install(a *Actions, extra ...any) error {
 		}
 		inputBody := body[0:inputLength]
 		signature := body[inputLength:]
-		if success, _, _ := a.App.Tools().Security().AuthWithSignature(userId, inputBody, string(signature)); !success {
+		if success, _, _ := a.App.Tools().Security().AuthWithEnvelope(userId, r.URL.Path, "", inputBody, string(signature)); !success {
 			http.Error(w, "signature verification failed", http.StatusForbidden)
 			return
 		}
@@ -467,7 +467,7 @@ func Install(a *Actions, extra ...any) error {
 		}
 		inputBody := body[0:inputLength]
 		signature := body[inputLength:]
-		if success, _, _ := a.App.Tools().Security().AuthWithSignature(userId, inputBody, string(signature)); !success {
+		if success, _, _ := a.App.Tools().Security().AuthWithEnvelope(userId, r.URL.Path, "", inputBody, string(signature)); !success {
 			http.Error(w, "signature verification failed", http.StatusForbidden)
 			return
 		}
@@ -520,7 +520,7 @@ func Install(a *Actions, extra ...any) error {
 		userId := r.URL.Query().Get("userId")
 		inputBody := []byte(r.URL.Query().Get("input"))
 		signature := r.URL.Query().Get("signature")
-		if success, _, _ := a.App.Tools().Security().AuthWithSignature(userId, inputBody, string(signature)); !success {
+		if success, _, _ := a.App.Tools().Security().AuthWithEnvelope(userId, r.URL.Path, "", inputBody, string(signature)); !success {
 			log.Println("Error accessing point:", err.Error())
 			http.Error(w, "signature verification failed", http.StatusForbidden)
 			return
@@ -597,7 +597,7 @@ func Install(a *Actions, extra ...any) error {
 		userId := r.URL.Query().Get("userId")
 		inputBody := []byte(r.URL.Query().Get("input"))
 		signature := r.URL.Query().Get("signature")
-		if success, _, _ := a.App.Tools().Security().AuthWithSignature(userId, inputBody, string(signature)); !success {
+		if success, _, _ := a.App.Tools().Security().AuthWithEnvelope(userId, r.URL.Path, "", inputBody, string(signature)); !success {
 			log.Println("Error accessing point:", err.Error())
 			http.Error(w, "signature verification failed", http.StatusForbidden)
 			return
@@ -153,9 +153,9 @@ func (a *Actions) ConsumeLock(state state.IState, input inputsusers.ConsumeLockI
 			sender := models.User{Id: input.UserId}.Pull(state.Trx())
 			if payment, err := state.Trx().GetJson("Json::User::"+sender.Id, "lockedTokens."+input.LockId); err == nil {
 				if typ, ok := payment["type"].(string); ok && (typ == "pay") {
-					if amount, ok := payment["amount"].(float64); ok && (int64(amount) == input.Amount) {
+					if amount, ok := payment["amount"].(float64); ok && (input.Amount > 0) && (input.Amount <= int64(amount)) {
 						if target, ok := payment["userId"].(string); ok && (target == receiver.Id) {
-							sender.Balance -= input.Amount
+							sender.Balance += int64(amount) - input.Amount
 							sender.Push(state.Trx())
 							receiver.Balance += input.Amount
 							receiver.Push(state.Trx())
@@ -165,7 +165,7 @@ func (a *Actions) ConsumeLock(state state.IState, input inputsusers.ConsumeLockI
 							return nil, errors.New("you are not target")
 						}
 					} else {
-						return nil, errors.New("amount of payment not matched")
+						return nil, errors.New("amount exceeds the payment")
 					}
 				} else {
 					return nil, errors.New("type is not payment")
@@ -226,7 +226,7 @@ func (a *Actions) Login(state state.IState, input inputsusers.LoginInput) (any,
 		}
 		bin, _ := json.Marshal(req)
 		sign := a.App.SignPacket(bin)
-		_, res, err2 := a.App.Actor().FetchAction("/users/create").(action.ISecureAction).SecurelyAct("", "", bin, sign, req, a.App.Id())
+		_, res, err2 := a.App.Actor().FetchAction("/users/create").(action.ISecureAction).SecurelyAct("", "", bin, sign, req, "")
 		if err2 != nil {
 			return nil, err2
 		}
@@ -0,0 +1,15 @@
+package inputs_auth
+
+type GetRateLimitStatsInput struct{}
+
+func (d GetRateLimitStatsInput) GetData() any {
+	return "dummy"
+}
+
+func (d GetRateLimitStatsInput) GetPointId() string {
+	return ""
+}
+
+func (d GetRateLimitStatsInput) Origin() string {
+	return ""
+}
@@ -1,7 +1,14 @@
 package inputs_machiner
 
+import "kasper/src/abstract/adapters/security"
+
 type RegisterNodeInput struct {
-	Orig string `json:"orig" validate:"required"`
+	Orig            string                 `json:"orig" validate:"required"`
+	PublicKey       string                 `json:"publicKey" validate:"required"`
+	CertFingerprint string                 `json:"certFingerprint" validate:"required"`
+	Proof           string                 `json:"proof" validate:"required"`
+	WasmRuntime     string                 `json:"wasmRuntime"`
+	Rotations       []security.KeyRotation `json:"rotations"`
 }
 
 func (d RegisterNodeInput) GetData() any {
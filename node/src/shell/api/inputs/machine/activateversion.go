@@ -0,0 +1,18 @@
+package inputs_machiner
+
+type ActivateVersionInput struct {
+	MachineId string `json:"machineId" validate:"required"`
+	VersionId string `json:"versionId" validate:"required"`
+}
+
+func (d ActivateVersionInput) GetData() any {
+	return "dummy"
+}
+
+func (d ActivateVersionInput) GetPointId() string {
+	return ""
+}
+
+func (d ActivateVersionInput) Origin() string {
+	return "global"
+}
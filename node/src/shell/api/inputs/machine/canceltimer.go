@@ -0,0 +1,18 @@
+package inputs_machiner
+
+type CancelTimerInput struct {
+	MachineId string `json:"machineId" validate:"required"`
+	Name      string `json:"name" validate:"required"`
+}
+
+func (d CancelTimerInput) GetData() any {
+	return "dummy"
+}
+
+func (d CancelTimerInput) GetPointId() string {
+	return ""
+}
+
+func (d CancelTimerInput) Origin() string {
+	return ""
+}
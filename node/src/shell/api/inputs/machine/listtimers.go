@@ -0,0 +1,17 @@
+package inputs_machiner
+
+type ListTimersInput struct {
+	MachineId string `json:"machineId" validate:"required"`
+}
+
+func (d ListTimersInput) GetData() any {
+	return "dummy"
+}
+
+func (d ListTimersInput) GetPointId() string {
+	return ""
+}
+
+func (d ListTimersInput) Origin() string {
+	return ""
+}
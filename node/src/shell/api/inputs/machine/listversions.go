@@ -0,0 +1,17 @@
+package inputs_machiner
+
+type ListVersionsInput struct {
+	MachineId string `json:"machineId" validate:"required"`
+}
+
+func (d ListVersionsInput) GetData() any {
+	return "dummy"
+}
+
+func (d ListVersionsInput) GetPointId() string {
+	return ""
+}
+
+func (d ListVersionsInput) Origin() string {
+	return "global"
+}
@@ -0,0 +1,17 @@
+package inputs_machiner
+
+type RollbackInput struct {
+	MachineId string `json:"machineId" validate:"required"`
+}
+
+func (d RollbackInput) GetData() any {
+	return "dummy"
+}
+
+func (d RollbackInput) GetPointId() string {
+	return ""
+}
+
+func (d RollbackInput) Origin() string {
+	return "global"
+}
@@ -0,0 +1,18 @@
+package inputs_points
+
+type DeleteSignalInput struct {
+	PointId  string `json:"pointId" validate:"required"`
+	SignalId string `json:"signalId" validate:"required"`
+}
+
+func (d DeleteSignalInput) GetData() any {
+	return "dummy"
+}
+
+func (d DeleteSignalInput) GetPointId() string {
+	return d.PointId
+}
+
+func (d DeleteSignalInput) Origin() string {
+	return ""
+}
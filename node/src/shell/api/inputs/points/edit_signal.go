@@ -0,0 +1,19 @@
+package inputs_points
+
+type EditSignalInput struct {
+	PointId  string `json:"pointId" validate:"required"`
+	SignalId string `json:"signalId" validate:"required"`
+	Data     string `json:"data" validate:"required"`
+}
+
+func (d EditSignalInput) GetData() any {
+	return "dummy"
+}
+
+func (d EditSignalInput) GetPointId() string {
+	return d.PointId
+}
+
+func (d EditSignalInput) Origin() string {
+	return ""
+}
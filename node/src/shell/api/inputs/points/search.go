@@ -0,0 +1,20 @@
+package inputs_points
+
+type SearchInput struct {
+	PointId string `json:"pointId" validate:"required"`
+	Query   string `json:"query" validate:"required"`
+	Offset  int    `json:"offset"`
+	Count   int    `json:"count" validate:"required"`
+}
+
+func (d SearchInput) GetData() any {
+	return "dummy"
+}
+
+func (d SearchInput) GetPointId() string {
+	return d.PointId
+}
+
+func (d SearchInput) Origin() string {
+	return ""
+}
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"kasper/src/abstract/models/trx"
+	"strconv"
+)
+
+// TokenMeter is what a machine has spent so far from a locked token on work
+// the node did for it, like container runs or outbound http traffic, priced
+// alike on every executor. A machine can not charge less than that when it
+// consumes the token.
+type TokenMeter struct {
+	TokenOwnerId string
+	TokenId      string
+}
+
+func (d TokenMeter) key() string {
+	return "Temp::User::" + d.TokenOwnerId + "::meteredCost::" + d.TokenId
+}
+
+func (d TokenMeter) Cost(trx trx.ITrx) int64 {
+	cost, _ := strconv.ParseInt(trx.GetString(d.key()), 10, 64)
+	return cost
+}
+
+func (d TokenMeter) Add(trx trx.ITrx, cost int64) {
+	trx.PutString(d.key(), strconv.FormatInt(d.Cost(trx)+cost, 10))
+}
+
+func (d TokenMeter) Clear(trx trx.ITrx) {
+	trx.DelKey(d.key())
+}
+
+// Remaining is what is left of a locked token after the metered cost, and
+// false if the token is not locked or was already consumed.
+func (d TokenMeter) Remaining(trx trx.ITrx) (int64, bool) {
+	if trx.GetString("Temp::User::"+d.TokenOwnerId+"::consumedTokens::"+d.TokenId) == "true" {
+		return 0, false
+	}
+	m, err := trx.GetJson("Json::User::"+d.TokenOwnerId, "lockedTokens."+d.TokenId)
+	if err != nil {
+		return 0, false
+	}
+	amount, ok := m["amount"].(float64)
+	if !ok {
+		return 0, false
+	}
+	return max(int64(amount)-d.Cost(trx), 0), true
+}
+
+// RunUsage is the price of what the container runs a machine made for a
+// committed request used on this node. It is sent with the node's response to
+// the request and the chain charges the figure the response quorum reported.
+type RunUsage struct {
+	RequestId string
+}
+
+func (d RunUsage) key() string {
+	return "Temp::RunUsage::" + d.RequestId
+}
+
+func (d RunUsage) Cost(trx trx.ITrx) int64 {
+	cost, _ := strconv.ParseInt(trx.GetString(d.key()), 10, 64)
+	return cost
+}
+
+func (d RunUsage) Add(trx trx.ITrx, cost int64) {
+	trx.PutString(d.key(), strconv.FormatInt(d.Cost(trx)+cost, 10))
+}
+
+func (d RunUsage) Clear(trx trx.ITrx) {
+	trx.DelKey(d.key())
+}
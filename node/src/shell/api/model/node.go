@@ -0,0 +1,100 @@
+package model
+
+import (
+	"fmt"
+	"kasper/src/abstract/models/trx"
+	"log"
+)
+
+type Node struct {
+	Origin          string `json:"origin"`
+	Ip              string `json:"ip"`
+	OwnerId         string `json:"ownerId"`
+	PublicKey       string `json:"publicKey"`
+	CertFingerprint string `json:"certFingerprint"`
+	WasmRuntime     string `json:"wasmRuntime"`
+}
+
+func (d Node) Type() string {
+	return "Node"
+}
+
+// ProofMessage is what a node signs with its server key to register its
+// origin, key, certificate and wasm runtime for an owner.
+func (d Node) ProofMessage() []byte {
+	return []byte(fmt.Sprintf("registerNode::%s::%s::%s::%s::%s", d.Origin, d.OwnerId, d.PublicKey, d.CertFingerprint, d.WasmRuntime))
+}
+
+func (d Node) Push(trx trx.ITrx) {
+	trx.PutObj(d.Type(), d.Origin, map[string][]byte{
+		"origin":          []byte(d.Origin),
+		"ip":              []byte(d.Ip),
+		"ownerId":         []byte(d.OwnerId),
+		"publicKey":       []byte(d.PublicKey),
+		"certFingerprint": []byte(d.CertFingerprint),
+		"wasmRuntime":     []byte(d.WasmRuntime),
+	})
+	trx.PutLink("nodes::"+d.Origin, "true")
+	if d.Ip != "" {
+		trx.PutLink("NodeIpToHost::"+d.Ip, d.Origin)
+	}
+}
+
+func (d Node) fill(m map[string][]byte) Node {
+	d.Origin = string(m["origin"])
+	d.Ip = string(m["ip"])
+	d.OwnerId = string(m["ownerId"])
+	d.PublicKey = string(m["publicKey"])
+	d.CertFingerprint = string(m["certFingerprint"])
+	d.WasmRuntime = string(m["wasmRuntime"])
+	return d
+}
+
+func (d Node) Pull(trx trx.ITrx) Node {
+	m := trx.GetObj(d.Type(), d.Origin)
+	if len(m) > 0 {
+		d = d.fill(m)
+	}
+	return d
+}
+
+// Resolve finds the node record of an origin, given as a host name or as the
+// ip address the host name was registered with.
+func (d Node) Resolve(trx trx.ITrx) (Node, bool) {
+	if d.Origin == "" {
+		return d, false
+	}
+	if n := d.Pull(trx); n.OwnerId != "" {
+		return n, true
+	}
+	if host := trx.GetLink("NodeIpToHost::" + d.Origin); host != "" {
+		if n := (Node{Origin: host}).Pull(trx); n.OwnerId != "" {
+			return n, true
+		}
+	}
+	return d, false
+}
+
+func (d Node) List(trx trx.ITrx) ([]Node, error) {
+	prefix := "nodes::"
+	list, err := trx.GetLinksList(prefix, -1, -1)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	for i := 0; i < len(list); i++ {
+		list[i] = list[i][len(prefix):]
+	}
+	objs, err := trx.GetObjList(d.Type(), list, map[string]string{})
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	nodes := []Node{}
+	for _, origin := range list {
+		if m, ok := objs[origin]; ok {
+			nodes = append(nodes, Node{}.fill(m))
+		}
+	}
+	return nodes, nil
+}
@@ -1,7 +1,9 @@
 package model
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"kasper/src/abstract/models/trx"
 	"log"
 	"sort"
@@ -233,3 +235,138 @@ func (d Vm) List(trx trx.ITrx, prefix string) ([]Vm, error) {
 	})
 	return entities, nil
 }
+
+// VmResources are the container limits a docker vm declares at deploy time,
+// kept in its machine metadata under "resources". Zero means the node default.
+type VmResources struct {
+	Cpus           float64 `json:"cpus"`
+	MemoryMb       int64   `json:"memoryMb"`
+	PidsLimit      int64   `json:"pidsLimit"`
+	DiskMb         int64   `json:"diskMb"`
+	TimeoutSeconds int64   `json:"timeoutSeconds"`
+	DbMb           int64   `json:"dbMb"`
+}
+
+func (d VmResources) Pull(trx trx.ITrx, machineId string) VmResources {
+	if m, err := trx.GetJson("MachineMeta::"+machineId, "metadata.resources"); err == nil {
+		b, _ := json.Marshal(m)
+		json.Unmarshal(b, &d)
+	}
+	return d
+}
+
+// VmEgress is the outbound http policy a vm declares at deploy time, kept in
+// its machine metadata under "egress". A vm only reaches the listed hosts,
+// given as "host", "host:port", "*.domain" or "*" for any host, with the
+// listed methods. Zero limits mean the node default.
+type VmEgress struct {
+	Hosts            []string `json:"hosts"`
+	Methods          []string `json:"methods"`
+	MaxResponseBytes int64    `json:"maxResponseBytes"`
+	TimeoutSeconds   int64    `json:"timeoutSeconds"`
+}
+
+// LegacyEgress is the policy of vms deployed before egress policies existed.
+// They could reach any host and keep doing so, still on public addresses only
+// and with the default methods and limits, until deployed again.
+var LegacyEgress = VmEgress{Hosts: []string{"*"}}
+
+func (d VmEgress) Pull(trx trx.ITrx, machineId string) VmEgress {
+	m, err := trx.GetJson("MachineMeta::"+machineId, "metadata.egress")
+	if err != nil {
+		return LegacyEgress
+	}
+	b, _ := json.Marshal(m)
+	json.Unmarshal(b, &d)
+	return d
+}
+
+type VmVersion struct {
+	Id         string   `json:"id"`
+	MachineId  string   `json:"machineId"`
+	Runtime    string   `json:"runtime"`
+	Hash       string   `json:"hash"`
+	DeployerId string   `json:"deployerId"`
+	Time       int64    `json:"time"`
+	ImageName  string   `json:"imageName"`
+	Standalone bool     `json:"standalone"`
+	Files      []string `json:"files"`
+}
+
+func (m VmVersion) Type() string {
+	return "VmVersion"
+}
+
+func (d VmVersion) Push(trx trx.ITrx) {
+	t := make([]byte, 8)
+	binary.LittleEndian.PutUint64(t, uint64(d.Time))
+	standalone := []byte{0x00}
+	if d.Standalone {
+		standalone = []byte{0x01}
+	}
+	files, _ := json.Marshal(d.Files)
+	trx.PutObj(d.Type(), d.Id, map[string][]byte{
+		"id":         []byte(d.Id),
+		"machineId":  []byte(d.MachineId),
+		"runtime":    []byte(d.Runtime),
+		"hash":       []byte(d.Hash),
+		"deployerId": []byte(d.DeployerId),
+		"time":       t,
+		"imageName":  []byte(d.ImageName),
+		"standalone": standalone,
+		"files":      files,
+	})
+}
+
+func (d VmVersion) fill(m map[string][]byte) VmVersion {
+	d.MachineId = string(m["machineId"])
+	d.Runtime = string(m["runtime"])
+	d.Hash = string(m["hash"])
+	d.DeployerId = string(m["deployerId"])
+	if len(m["time"]) == 8 {
+		d.Time = int64(binary.LittleEndian.Uint64(m["time"]))
+	}
+	d.ImageName = string(m["imageName"])
+	d.Standalone = bytes.Equal(m["standalone"], []byte{0x01})
+	json.Unmarshal(m["files"], &d.Files)
+	return d
+}
+
+func (d VmVersion) Pull(trx trx.ITrx) VmVersion {
+	m := trx.GetObj(d.Type(), d.Id)
+	if len(m) > 0 {
+		d = d.fill(m)
+	}
+	return d
+}
+
+// List returns the versions of a machine, newest first.
+func (d VmVersion) List(trx trx.ITrx, machineId string) ([]VmVersion, error) {
+	prefix := "vmVersions::" + machineId + "::"
+	list, err := trx.GetLinksList(prefix, -1, -1)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	for i := 0; i < len(list); i++ {
+		list[i] = list[i][len(prefix):]
+	}
+	objs, err := trx.GetObjList(d.Type(), list, map[string]string{})
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	entities := []VmVersion{}
+	for id, m := range objs {
+		if len(m) > 0 {
+			entities = append(entities, VmVersion{Id: id}.fill(m))
+		}
+	}
+	sort.Slice(entities, func(i, j int) bool {
+		if entities[i].Time == entities[j].Time {
+			return entities[i].Id > entities[j].Id
+		}
+		return entities[i].Time > entities[j].Time
+	})
+	return entities, nil
+}
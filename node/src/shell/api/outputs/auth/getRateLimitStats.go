@@ -0,0 +1,5 @@
+package outputs_auth
+
+type GetRateLimitStatsOutput struct {
+	Rejections map[string]int64 `json:"rejections"`
+}
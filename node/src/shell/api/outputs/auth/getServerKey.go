@@ -1,5 +1,9 @@
 package outputs_auth
 
+import "kasper/src/abstract/adapters/security"
+
 type GetServerKeyOutput struct {
-	PublicKey string `json:"publicKey"`
+	PublicKey string                 `json:"publicKey"`
+	Version   int64                  `json:"version"`
+	Rotations []security.KeyRotation `json:"rotations"`
 }
@@ -1,5 +1,8 @@
 package outputs_auth
 
+import "kasper/src/shell/api/model"
+
 type GetServersMapOutput struct {
-	Servers []string `json:"servers"`
+	Servers []string     `json:"servers"`
+	Nodes   []model.Node `json:"nodes"`
 }
@@ -1,3 +1,5 @@
 package outputs_machiner
 
-type PlugInput struct{}
+type PlugInput struct {
+	VersionId string `json:"versionId"`
+}
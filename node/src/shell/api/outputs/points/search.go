@@ -0,0 +1,7 @@
+package outputs_points
+
+import "kasper/src/abstract/models/packet"
+
+type SearchOutput struct {
+	Packets []packet.LogPacket `json:"packets"`
+}
@@ -22,6 +22,10 @@
 			return utils.ExtractSecureAction(c.Core, c.Actions.GetServersMap)
 		}
 		
+		func (c *Plugger) GetRateLimitStats() iaction.IAction {
+			return utils.ExtractSecureAction(c.Core, c.Actions.GetRateLimitStats)
+		}
+		
 	func (c *Plugger) Install(a *actions.Actions, extra ...any) *Plugger {
 		err := actions.Install(a, extra...)
 		if err != nil {
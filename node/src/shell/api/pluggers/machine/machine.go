@@ -66,6 +66,26 @@
 			return utils.ExtractSecureAction(c.Core, c.Actions.Deploy)
 		}
 		
+		func (c *Plugger) ListTimers() iaction.IAction {
+			return utils.ExtractSecureAction(c.Core, c.Actions.ListTimers)
+		}
+		
+		func (c *Plugger) CancelTimer() iaction.IAction {
+			return utils.ExtractSecureAction(c.Core, c.Actions.CancelTimer)
+		}
+		
+		func (c *Plugger) ListVersions() iaction.IAction {
+			return utils.ExtractSecureAction(c.Core, c.Actions.ListVersions)
+		}
+		
+		func (c *Plugger) ActivateVersion() iaction.IAction {
+			return utils.ExtractSecureAction(c.Core, c.Actions.ActivateVersion)
+		}
+		
+		func (c *Plugger) Rollback() iaction.IAction {
+			return utils.ExtractSecureAction(c.Core, c.Actions.Rollback)
+		}
+		
 		func (c *Plugger) ListApps() iaction.IAction {
 			return utils.ExtractSecureAction(c.Core, c.Actions.ListApps)
 		}
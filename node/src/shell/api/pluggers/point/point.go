@@ -102,10 +102,22 @@
 			return utils.ExtractSecureAction(c.Core, c.Actions.Signal)
 		}
 		
+		func (c *Plugger) EditSignal() iaction.IAction {
+			return utils.ExtractSecureAction(c.Core, c.Actions.EditSignal)
+		}
+		
+		func (c *Plugger) DeleteSignal() iaction.IAction {
+			return utils.ExtractSecureAction(c.Core, c.Actions.DeleteSignal)
+		}
+		
 		func (c *Plugger) History() iaction.IAction {
 			return utils.ExtractSecureAction(c.Core, c.Actions.History)
 		}
 		
+		func (c *Plugger) Search() iaction.IAction {
+			return utils.ExtractSecureAction(c.Core, c.Actions.Search)
+		}
+		
 		func (c *Plugger) List() iaction.IAction {
 			return utils.ExtractSecureAction(c.Core, c.Actions.List)
 		}
@@ -0,0 +1,9 @@
+package updates_points
+
+import models "kasper/src/shell/api/model"
+
+type SignalDeleted struct {
+	Id    string       `json:"id"`
+	User  models.User  `json:"user"`
+	Point models.Point `json:"point"`
+}
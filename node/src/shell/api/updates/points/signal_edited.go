@@ -0,0 +1,11 @@
+package updates_points
+
+import models "kasper/src/shell/api/model"
+
+type SignalEdited struct {
+	Id    string       `json:"id"`
+	User  models.User  `json:"user"`
+	Point models.Point `json:"point"`
+	Data  string       `json:"data"`
+	Time  int64        `json:"time"`
+}
@@ -1,10 +1,14 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
 
@@ -79,3 +83,60 @@ func ParsePublicKey(data []byte) *rsa.PublicKey {
 	parsedPubKey := parsedPubKeyIface.(*rsa.PublicKey)
 	return parsedPubKey
 }
+
+// DecodePublicKey parses a PEM encoded rsa public key that may come from
+// untrusted input.
+func DecodePublicKey(publicKey []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return nil, errors.New("public key is not valid")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an rsa key")
+	}
+	return rsaKey, nil
+}
+
+// VerifySignature checks a base64 RSA-PSS signature over data, as made by
+// SignPacket, against a PEM encoded public key that may come from untrusted
+// input.
+func VerifySignature(publicKey []byte, data []byte, signature string) error {
+	rsaKey, err := DecodePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	sign, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	return rsa.VerifyPSS(rsaKey, crypto.SHA256, hash[:], sign, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+}
+
+// Sign makes the base64 RSA-PSS signature of data that VerifySignature checks,
+// with a PEM encoded private key.
+func Sign(privateKey []byte, data []byte) (string, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return "", errors.New("private key is not valid")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("private key is not an rsa key")
+	}
+	hash := sha256.Sum256(data)
+	sign, err := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, hash[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sign), nil
+}
@@ -0,0 +1,331 @@
+package egress
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kasper/src/abstract/models/core"
+	"kasper/src/abstract/models/trx"
+	"kasper/src/shell/api/model"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultMethods are the methods a policy allows when it names none.
+var (
+	DefaultMethods = []string{http.MethodGet, http.MethodPost}
+
+	ErrHostNotAllowed   = errors.New("host is not allowed by the egress policy")
+	ErrMethodNotAllowed = errors.New("method is not allowed by the egress policy")
+	ErrAddressBlocked   = errors.New("address is blocked for machine egress")
+	ErrResponseTooLarge = errors.New("response exceeds the egress size limit")
+	ErrTokenExhausted   = errors.New("token is not locked or has nothing left for egress")
+
+	auditLock sync.Mutex
+)
+
+// Calls are priced alike on every executor, per started kilobyte of what the
+// machine sends and of the largest response its policy lets in. The traffic a
+// call really made is only known to the node that made it, so it is audited
+// but never charged, and the prices are part of the protocol.
+const (
+	KbPrice             = 1.0
+	pricedResponseBytes = 1024 * 1024
+)
+
+type Request struct {
+	MachineId string
+	Method    string
+	Url       string
+	Headers   map[string]string
+	Body      []byte
+}
+
+type Response struct {
+	Status        int
+	Body          []byte
+	SentBytes     int64
+	ReceivedBytes int64
+}
+
+type auditEntry struct {
+	Time          int64  `json:"time"`
+	MachineId     string `json:"machineId"`
+	Method        string `json:"method"`
+	Url           string `json:"url"`
+	Status        int    `json:"status"`
+	SentBytes     int64  `json:"sentBytes"`
+	ReceivedBytes int64  `json:"receivedBytes"`
+	Cost          int64  `json:"cost"`
+	Error         string `json:"error,omitempty"`
+}
+
+var blockedNets = func() []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func blockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddress runs on every connection after the host name was resolved, so
+// a public name pointing at an internal address is refused as well.
+func checkAddress(_ string, address string, _ syscall.RawConn) error {
+	if os.Getenv("EGRESS_ALLOW_PRIVATE") == "true" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || blockedIP(ip) {
+		return fmt.Errorf("%w: %s", ErrAddressBlocked, host)
+	}
+	return nil
+}
+
+func hostAllowed(hosts []string, u *url.URL) bool {
+	hostname := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	for _, entry := range hosts {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if entryHost == "*" {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(entryHost, "*."); ok {
+			if strings.HasSuffix(hostname, "."+suffix) {
+				return true
+			}
+		} else if entryHost == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+func limits(policy model.VmEgress) (int64, time.Duration) {
+	maxResponseBytes := int64(1024 * 1024)
+	if v, err := strconv.ParseInt(os.Getenv("EGRESS_MAX_RESPONSE_BYTES"), 10, 64); err == nil && v > 0 {
+		maxResponseBytes = v
+	}
+	maxTimeout := 30 * time.Second
+	if v, err := strconv.ParseInt(os.Getenv("EGRESS_TIMEOUT"), 10, 64); err == nil && v > 0 {
+		maxTimeout = time.Duration(v) * time.Second
+	}
+	maxBytes := policy.MaxResponseBytes
+	if maxBytes <= 0 || maxBytes > maxResponseBytes {
+		maxBytes = maxResponseBytes
+	}
+	timeout := time.Duration(policy.TimeoutSeconds) * time.Second
+	if timeout <= 0 || timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+	return maxBytes, timeout
+}
+
+// Check tells if a policy lets a request out, without sending it.
+func Check(policy model.VmEgress, method string, rawUrl string) (*url.URL, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("scheme %s is not allowed", u.Scheme)
+	}
+	methods := policy.Methods
+	if len(methods) == 0 {
+		methods = DefaultMethods
+	}
+	if !slices.ContainsFunc(methods, func(m string) bool { return strings.EqualFold(m, method) }) {
+		return nil, ErrMethodNotAllowed
+	}
+	if !hostAllowed(policy.Hosts, u) {
+		return nil, fmt.Errorf("%w: %s", ErrHostNotAllowed, u.Host)
+	}
+	return u, nil
+}
+
+func sentBytes(req Request) int64 {
+	sent := int64(len(req.Method) + len(req.Url) + len(req.Body))
+	for k, v := range req.Headers {
+		sent += int64(len(k) + len(v))
+	}
+	return sent
+}
+
+// Cost prices a call of a machine from the request and the policy it was
+// deployed with.
+func Cost(policy model.VmEgress, req Request) int64 {
+	received := policy.MaxResponseBytes
+	if received <= 0 {
+		received = pricedResponseBytes
+	}
+	return int64(math.Ceil(float64(sentBytes(req)+received) / 1024 * KbPrice))
+}
+
+func newClient(policy model.VmEgress, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: checkAddress}
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		DisableKeepAlives:     true,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !hostAllowed(policy.Hosts, req.URL) {
+				return fmt.Errorf("%w: %s", ErrHostNotAllowed, req.URL.Host)
+			}
+			return nil
+		},
+	}
+}
+
+// Do sends a request of a machine under its egress policy.
+func Do(policy model.VmEgress, req Request) (res Response, err error) {
+	u, err := Check(policy, req.Method, req.Url)
+	if err != nil {
+		return res, err
+	}
+	res.SentBytes = sentBytes(req)
+	maxBytes, timeout := limits(policy)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, strings.ToUpper(req.Method), u.String(), bytes.NewReader(req.Body))
+	if err != nil {
+		return res, err
+	}
+	for k, v := range req.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := newClient(policy, timeout).Do(httpReq)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	res.Status = resp.StatusCode
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	res.ReceivedBytes = int64(len(body))
+	if err != nil {
+		return res, err
+	}
+	if int64(len(body)) > maxBytes {
+		return res, ErrResponseTooLarge
+	}
+	res.Body = body
+	return res, nil
+}
+
+// Send runs a request a machine makes while running a committed request, under
+// the policy it was deployed with, and meters it against the token that request
+// was sent with, refusing to send once the token is used up. Requests made
+// outside of a committed request are not metered.
+func Send(app core.ICore, callbackId string, req Request) (res Response, err error) {
+	cost := int64(0)
+	defer func() {
+		audit(req, res, cost, err)
+	}()
+	request, _ := app.RunningRequest(req.MachineId, callbackId)
+	metered := request.TokenOwnerId != "" && request.TokenId != ""
+	meter := model.TokenMeter{TokenOwnerId: request.TokenOwnerId, TokenId: request.TokenId}
+	policy := model.VmEgress{}
+	remaining, locked := int64(0), false
+	app.ModifyState(true, func(trx trx.ITrx) error {
+		policy = model.VmEgress{}.Pull(trx, req.MachineId)
+		if metered {
+			remaining, locked = meter.Remaining(trx)
+		}
+		return nil
+	})
+	if _, err := Check(policy, req.Method, req.Url); err != nil {
+		return res, err
+	}
+	if metered {
+		cost = Cost(policy, req)
+		if !locked || remaining < cost {
+			return res, ErrTokenExhausted
+		}
+		app.ModifyState(false, func(trx trx.ITrx) error {
+			meter.Add(trx, cost)
+			return nil
+		})
+	}
+	return Do(policy, req)
+}
+
+func audit(req Request, res Response, cost int64, err error) {
+	entry := auditEntry{
+		Time:          time.Now().UnixMilli(),
+		MachineId:     req.MachineId,
+		Method:        req.Method,
+		Url:           req.Url,
+		Status:        res.Status,
+		SentBytes:     res.SentBytes,
+		ReceivedBytes: res.ReceivedBytes,
+		Cost:          cost,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	line, _ := json.Marshal(entry)
+	path := os.Getenv("EGRESS_AUDIT_LOG")
+	if path == "" && os.Getenv("STORAGE_ROOT_PATH") != "" {
+		path = os.Getenv("STORAGE_ROOT_PATH") + "/egress-audit.log"
+	}
+	if path == "" {
+		log.Println("egress:", string(line))
+		return
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	f, e := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if e != nil {
+		log.Println("egress audit log:", e, string(line))
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
@@ -0,0 +1,175 @@
+package egress
+
+import (
+	"errors"
+	"kasper/src/shell/api/model"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestBlockedIP(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1":          true,
+		"127.8.9.10":         true,
+		"::1":                true,
+		"10.1.2.3":           true,
+		"172.16.0.1":         true,
+		"172.31.255.255":     true,
+		"192.168.1.1":        true,
+		"169.254.169.254":    true,
+		"0.0.0.0":            true,
+		"100.64.0.1":         true,
+		"224.0.0.1":          true,
+		"fc00::1":            true,
+		"fe80::1":            true,
+		"::ffff:127.0.0.1":   true,
+		"::ffff:10.0.0.1":    true,
+		"::ffff:169.254.1.1": true,
+		"64:ff9b::7f00:1":    true,
+		"8.8.8.8":            false,
+		"172.32.0.1":         false,
+		"::ffff:8.8.8.8":     false,
+		"2606:4700::1111":    false,
+	}
+	for addr, want := range cases {
+		if got := blockedIP(net.ParseIP(addr)); got != want {
+			t.Errorf("blockedIP(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	t.Setenv("EGRESS_ALLOW_PRIVATE", "false")
+	cases := map[string]bool{
+		"127.0.0.1:80":            false,
+		"[::1]:443":               false,
+		"[::ffff:192.168.0.1]:80": false,
+		"10.0.0.5:8080":           false,
+		"8.8.8.8:443":             true,
+		"[2606:4700::1111]:443":   true,
+		"localhost:80":            false,
+	}
+	for address, allowed := range cases {
+		err := checkAddress("tcp", address, nil)
+		if allowed && err != nil {
+			t.Errorf("%s refused: %v", address, err)
+		}
+		if !allowed && !errors.Is(err, ErrAddressBlocked) {
+			t.Errorf("%s gave %v, want it blocked", address, err)
+		}
+	}
+	if err := checkAddress("tcp", "8.8.8.8", nil); err == nil {
+		t.Errorf("address without a port accepted")
+	}
+	t.Setenv("EGRESS_ALLOW_PRIVATE", "true")
+	if err := checkAddress("tcp", "127.0.0.1:80", nil); err != nil {
+		t.Errorf("loopback refused with private addresses allowed: %v", err)
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	cases := []struct {
+		hosts []string
+		url   string
+		want  bool
+	}{
+		{[]string{"api.example.com"}, "https://api.example.com/v1", true},
+		{[]string{"API.Example.com "}, "https://api.EXAMPLE.com", true},
+		{[]string{"api.example.com"}, "https://example.com", false},
+		{[]string{"api.example.com"}, "https://api.example.com.evil.io", false},
+		{[]string{"*.example.com"}, "https://a.b.example.com", true},
+		{[]string{"*.example.com"}, "https://example.com", false},
+		{[]string{"*.example.com"}, "https://badexample.com", false},
+		{[]string{"*"}, "http://anything.io:8080", true},
+		{[]string{"api.example.com:443"}, "https://api.example.com", true},
+		{[]string{"api.example.com:443"}, "http://api.example.com", false},
+		{[]string{"api.example.com:8443"}, "https://api.example.com:8443/x", true},
+		{[]string{"api.example.com:8443"}, "https://api.example.com:9443/x", false},
+		{[]string{"*:443"}, "https://any.io", true},
+		{[]string{"*:443"}, "http://any.io", false},
+		{nil, "https://api.example.com", false},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.url)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if got := hostAllowed(c.hosts, u); got != c.want {
+			t.Errorf("hostAllowed(%v, %s) = %v, want %v", c.hosts, c.url, got, c.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	policy := model.VmEgress{Hosts: []string{"api.example.com"}}
+	if _, err := Check(policy, "get", "https://api.example.com/x"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := Check(policy, http.MethodDelete, "https://api.example.com/x"); !errors.Is(err, ErrMethodNotAllowed) {
+		t.Fatalf("method outside the defaults gave %v", err)
+	}
+	if _, err := Check(policy, http.MethodGet, "https://other.com"); !errors.Is(err, ErrHostNotAllowed) {
+		t.Fatalf("host outside the policy gave %v", err)
+	}
+	if _, err := Check(policy, http.MethodGet, "file:///etc/passwd"); err == nil {
+		t.Fatalf("file scheme accepted")
+	}
+}
+
+func TestDoRefusesInternalAddresses(t *testing.T) {
+	t.Setenv("EGRESS_ALLOW_PRIVATE", "false")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer srv.Close()
+	_, err := Do(model.VmEgress{Hosts: []string{"*"}}, Request{Method: http.MethodGet, Url: srv.URL})
+	if !errors.Is(err, ErrAddressBlocked) {
+		t.Fatalf("request to loopback gave %v", err)
+	}
+}
+
+func TestDoChecksRedirects(t *testing.T) {
+	t.Setenv("EGRESS_ALLOW_PRIVATE", "true")
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("blocked"))
+	}))
+	defer blocked.Close()
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/out" {
+			http.Redirect(w, r, blocked.URL, http.StatusFound)
+			return
+		}
+		if r.URL.Path == "/in" {
+			http.Redirect(w, r, "/ok", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer allowed.Close()
+	u, _ := url.Parse(allowed.URL)
+	policy := model.VmEgress{Hosts: []string{u.Host}}
+
+	res, err := Do(policy, Request{Method: http.MethodGet, Url: allowed.URL + "/in"})
+	if err != nil || string(res.Body) != "ok" {
+		t.Fatalf("redirect within the policy gave %q %v", res.Body, err)
+	}
+	if _, err := Do(policy, Request{Method: http.MethodGet, Url: allowed.URL + "/out"}); !errors.Is(err, ErrHostNotAllowed) {
+		t.Fatalf("redirect to a host outside the policy gave %v", err)
+	}
+}
+
+func TestDoLimitsResponseSize(t *testing.T) {
+	t.Setenv("EGRESS_ALLOW_PRIVATE", "true")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2048))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	_, err := Do(model.VmEgress{Hosts: []string{u.Host}, MaxResponseBytes: 1024}, Request{Method: http.MethodGet, Url: srv.URL})
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("oversized response gave %v", err)
+	}
+}